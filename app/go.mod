@@ -5,6 +5,7 @@ go 1.24
 require (
 	github.com/a-h/templ v0.3.898
 	github.com/geoffjay/plantd/core v0.0.0-20250608024831-6d6af927872f
+	github.com/geoffjay/plantd/state v0.0.0-00010101000000-000000000000
 	github.com/goccy/go-json v0.10.4
 	github.com/gofiber/adaptor/v2 v2.2.1
 	github.com/gofiber/contrib/websocket v1.3.0
@@ -74,3 +75,8 @@ require (
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace (
+	github.com/geoffjay/plantd/identity => ../identity
+	github.com/geoffjay/plantd/state => ../state
+)
@@ -4,11 +4,13 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/geoffjay/plantd/app/internal/auth"
 	"github.com/geoffjay/plantd/app/internal/services"
 
 	"github.com/gofiber/fiber/v2"
@@ -18,6 +20,7 @@ import (
 // SSEHandler handles Server-Sent Events for real-time updates using Datastar.
 type SSEHandler struct {
 	brokerService  *services.BrokerService
+	stateService   *services.StateService
 	healthService  *services.HealthService
 	metricsService *services.MetricsService
 	mu             sync.RWMutex
@@ -32,11 +35,13 @@ type SSEHandler struct {
 // NewSSEHandler creates a new SSE handler.
 func NewSSEHandler(
 	brokerService *services.BrokerService,
+	stateService *services.StateService,
 	healthService *services.HealthService,
 	metricsService *services.MetricsService,
 ) *SSEHandler {
 	return &SSEHandler{
 		brokerService:  brokerService,
+		stateService:   stateService,
 		healthService:  healthService,
 		metricsService: metricsService,
 		activeStreams:  make(map[string]context.CancelFunc),
@@ -173,6 +178,95 @@ func (h *SSEHandler) SystemStatusSSE(c *fiber.Ctx) error {
 	}
 }
 
+// StateSSE streams the changes of the state service, the scopes to receive
+// are given with the `scope` query parameter and every scope is received when
+// there are none.
+func (h *SSEHandler) StateSSE(c *fiber.Ctx) error {
+	logger := log.WithField("handler", "sse.state")
+	logger.Debug("Starting SSE stream for state changes")
+
+	if h.stateService == nil {
+		return fiber.NewError(fiber.StatusServiceUnavailable, "State service unavailable")
+	}
+
+	// Set SSE headers
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+
+	var scopes []string
+	for _, scope := range c.Context().QueryArgs().PeekMulti("scope") {
+		scopes = append(scopes, string(scope))
+	}
+
+	userToken := ""
+	if sessionData, ok := auth.GetSessionData(c); ok {
+		userToken = sessionData.AccessToken
+	}
+
+	// Generate unique stream ID
+	streamID := fmt.Sprintf("state-%d", time.Now().UnixNano())
+
+	// Create cancellable context for this stream
+	ctx, cancel := context.WithCancel(c.UserContext())
+
+	// Register this stream
+	h.mu.Lock()
+	h.activeStreams[streamID] = cancel
+	h.mu.Unlock()
+
+	// Cleanup function
+	defer func() {
+		logger.Debug("Cleaning up SSE state stream")
+		h.mu.Lock()
+		delete(h.activeStreams, streamID)
+		h.mu.Unlock()
+		cancel()
+	}()
+
+	changes, err := h.stateService.SubscribeToChanges(ctx, userToken, scopes)
+	var denied *services.StateRequestError
+	if errors.As(err, &denied) {
+		logger.WithError(err).Warn("Not allowed to subscribe to state changes")
+		return fiber.NewError(fiber.StatusForbidden, "Not allowed to read the requested scopes")
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to subscribe to state changes")
+		return fiber.NewError(fiber.StatusServiceUnavailable, "Failed to subscribe to state changes")
+	}
+
+	keepAliveTicker := time.NewTicker(30 * time.Second)
+	defer keepAliveTicker.Stop()
+
+	// Main event loop
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debug("SSE state client disconnected")
+			return nil
+		case change, ok := <-changes:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				logger.WithError(err).Warn("Failed to encode state change")
+				continue
+			}
+			if _, err := c.WriteString(fmt.Sprintf("event: state-change\nid: %d\ndata: %s\n\n", change.Revision, data)); err != nil {
+				logger.WithError(err).Debug("Failed to send state change, client disconnected")
+				return nil
+			}
+		case <-keepAliveTicker.C:
+			// Send keep-alive comment
+			if _, err := c.WriteString(": keep-alive\n\n"); err != nil {
+				logger.WithError(err).Debug("Failed to send keep-alive, client disconnected")
+				return nil
+			}
+		}
+	}
+}
+
 // isCircuitOpen checks if the circuit breaker is open
 func (h *SSEHandler) isCircuitOpen() bool {
 	h.mu.RLock()
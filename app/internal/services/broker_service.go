@@ -18,7 +18,8 @@ import (
 
 // BrokerService handles communication with the plantd broker for service discovery and management.
 type BrokerService struct {
-	client         *mdp.Client
+	client         *mdp.SharedClient
+	timeout        time.Duration
 	config         *config.Config
 	logger         *log.Entry
 	circuitBreaker *CircuitBreaker
@@ -107,6 +108,10 @@ type ServiceStatus struct {
 	Heartbeat   int       `json:"heartbeat_ms"`
 	RequestRate float64   `json:"request_rate"`
 	ErrorRate   float64   `json:"error_rate"`
+	Busy        int       `json:"busy"`
+	Queued      int       `json:"queued"`
+	Served      int64     `json:"served"`
+	Failed      int64     `json:"failed"`
 }
 
 // BrokerHealth represents broker-specific health and performance metrics.
@@ -170,7 +175,7 @@ func NewBrokerService(cfg *config.Config) (*BrokerService, error) {
 
 	// Try to create MDP client with circuit breaker protection
 	err := circuitBreaker.Call(func() error {
-		client, err := mdp.NewClient(brokerEndpoint)
+		client, err := mdp.NewSharedClient(brokerEndpoint)
 		if err != nil {
 			return fmt.Errorf("failed to create MDP client: %w", err)
 		}
@@ -181,7 +186,7 @@ func NewBrokerService(cfg *config.Config) (*BrokerService, error) {
 			timeout = 30 * time.Second
 			logger.WithError(err).Warn("Failed to parse services timeout, using default 30s")
 		}
-		client.SetTimeout(timeout)
+		bs.timeout = timeout
 
 		bs.mutex.Lock()
 		bs.client = client
@@ -238,7 +243,7 @@ func (bs *BrokerService) GetServiceStatuses(ctx context.Context) ([]ServiceStatu
 	}
 
 	// Query broker for service list using MMI (Management Interface)
-	response, err := bs.queryMMI(ctx, "mmi.services")
+	services, err := bs.queryServiceList(ctx)
 	if err != nil {
 		if bs.logger != nil {
 			bs.logger.WithError(err).Warn("Failed to query services from broker")
@@ -246,38 +251,16 @@ func (bs *BrokerService) GetServiceStatuses(ctx context.Context) ([]ServiceStatu
 		return []ServiceStatus{}, nil // Return empty list instead of error to prevent app crash
 	}
 
-	if len(response) == 0 {
+	if len(services) == 0 {
 		if bs.logger != nil {
 			bs.logger.Warn("No services found in broker")
 		}
 		return []ServiceStatus{}, nil
 	}
 
-	// Parse service names from response
-	serviceNames := response
-
-	// Get detailed status for each service
-	var statuses []ServiceStatus
-	for _, serviceName := range serviceNames {
-		status, err := bs.getServiceDetails(ctx, serviceName)
-		if err != nil {
-			if bs.logger != nil {
-				bs.logger.WithError(err).WithField("service", serviceName).
-					Warn("Failed to get service details, using basic status")
-			}
-
-			// Create basic status if detailed query fails
-			status = &ServiceStatus{
-				Name:      serviceName,
-				Status:    "unknown",
-				Workers:   0,
-				LastSeen:  time.Time{},
-				Version:   "",
-				Endpoint:  "",
-				Heartbeat: 0,
-			}
-		}
-		statuses = append(statuses, *status)
+	statuses := make([]ServiceStatus, 0, len(services))
+	for _, service := range services {
+		statuses = append(statuses, newServiceStatus(service))
 	}
 
 	if bs.logger != nil {
@@ -295,38 +278,76 @@ func (bs *BrokerService) GetServiceDetails(ctx context.Context, serviceName stri
 func (bs *BrokerService) getServiceDetails(ctx context.Context, serviceName string) (*ServiceStatus, error) {
 	bs.logger.WithField("service", serviceName).Debug("Getting service details")
 
-	// Query service workers
-	workersResponse, err := bs.queryMMI(ctx, "mmi.service."+serviceName)
+	services, err := bs.queryServiceList(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query service workers: %w", err)
 	}
 
-	// Parse worker count
-	workerCount := len(workersResponse)
+	for _, service := range services {
+		if service.Name == serviceName {
+			status := newServiceStatus(service)
+			return &status, nil
+		}
+	}
+
+	return nil, fmt.Errorf("service %s not found", serviceName)
+}
+
+// queryServiceList requests the state of all services known to the broker.
+func (bs *BrokerService) queryServiceList(ctx context.Context) ([]mdp.ServiceInfo, error) {
+	response, err := bs.queryMMI(ctx, mdp.MMIServiceList)
+	if err != nil {
+		return nil, err
+	}
+	return parseServiceList(response)
+}
+
+// parseServiceList decodes the reply to an mmi.services query, which is a
+// status code followed by a JSON encoded list of services.
+func parseServiceList(response []string) ([]mdp.ServiceInfo, error) {
+	if len(response) < 2 {
+		return nil, fmt.Errorf("malformed service list response: %v", response)
+	}
+	if response[0] != mdp.MMICodeOK {
+		return nil, fmt.Errorf("service list request failed with code %s", response[0])
+	}
 
-	// Determine service status based on worker availability
-	var status string
-	if workerCount > 0 {
+	var services []mdp.ServiceInfo
+	if err := json.Unmarshal([]byte(response[1]), &services); err != nil {
+		return nil, fmt.Errorf("failed to decode service list: %w", err)
+	}
+
+	return services, nil
+}
+
+// newServiceStatus creates the status of a service from the information
+// reported by the broker.
+func newServiceStatus(service mdp.ServiceInfo) ServiceStatus {
+	workers := service.Waiting + service.Busy
+
+	// A service is healthy as long as it has workers to handle requests
+	status := StatusUnhealthy
+	if workers > 0 {
 		status = StatusHealthy
-	} else {
-		status = StatusUnhealthy
 	}
 
-	// For now, create basic service status
-	// In a full implementation, this would query additional metrics
-	serviceStatus := &ServiceStatus{
-		Name:        serviceName,
-		Status:      status,
-		Workers:     workerCount,
-		LastSeen:    time.Now(), // This would come from broker metrics
-		Version:     "",         // This would require service-specific query
-		Endpoint:    "",         // This would come from service registration
-		Heartbeat:   2500,       // Default MDP heartbeat interval
-		RequestRate: 0.0,        // This would come from broker metrics
-		ErrorRate:   0.0,        // This would come from broker metrics
+	var errorRate float64
+	if total := service.Served + service.Failed; total > 0 {
+		errorRate = float64(service.Failed) / float64(total)
 	}
 
-	return serviceStatus, nil
+	return ServiceStatus{
+		Name:      service.Name,
+		Status:    status,
+		Workers:   workers,
+		LastSeen:  time.Now(),
+		Heartbeat: int(mdp.HeartbeatInterval / time.Millisecond),
+		ErrorRate: errorRate,
+		Busy:      service.Busy,
+		Queued:    service.Queued,
+		Served:    service.Served,
+		Failed:    service.Failed,
+	}
 }
 
 // GetBrokerHealth retrieves comprehensive broker health and performance metrics.
@@ -459,62 +480,15 @@ func (bs *BrokerService) queryMMIWithTimeout(ctx context.Context, query string)
 
 	var response []string
 	err := bs.circuitBreaker.Call(func() error {
-		// Create a result channel for safe goroutine communication
-		type mdpResult struct {
-			response []string
-			err      error
-		}
+		ctx, cancel := bs.requestContext(ctx)
+		defer cancel()
 
-		resultChan := make(chan mdpResult, 1)
-
-		// Run MDP operation in isolated goroutine with panic recovery
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					bs.logger.WithField("panic", r).Error("Panic in MMI query")
-					resultChan <- mdpResult{
-						response: nil,
-						err:      fmt.Errorf("MMI query panicked: %v", r),
-					}
-				}
-			}()
-
-			// Send MMI query to broker
-			if err := client.Send(query); err != nil {
-				resultChan <- mdpResult{
-					response: nil,
-					err:      fmt.Errorf("failed to send MMI query: %w", err),
-				}
-				return
-			}
-
-			// Receive response
-			resp, err := client.Recv()
-			if err != nil {
-				resultChan <- mdpResult{
-					response: nil,
-					err:      fmt.Errorf("failed to receive MMI response: %w", err),
-				}
-				return
-			}
-
-			resultChan <- mdpResult{
-				response: resp,
-				err:      nil,
-			}
-		}()
-
-		// Wait for either completion or timeout
-		select {
-		case result := <-resultChan:
-			if result.err != nil {
-				return result.err
-			}
-			response = result.response
-			return nil
-		case <-ctx.Done():
-			return fmt.Errorf("MMI query timed out: %w", ctx.Err())
+		resp, err := client.Request(ctx, query)
+		if err != nil {
+			return fmt.Errorf("MMI query failed: %w", err)
 		}
+		response = resp
+		return nil
 	})
 
 	if err != nil {
@@ -546,69 +520,38 @@ func (bs *BrokerService) queryServiceWithTimeout(ctx context.Context, serviceNam
 		"args":    args,
 	}).Trace("Sending service query with timeout")
 
-	// Prepare message
-	message := append([]string{command}, args...)
+	bs.mutex.RLock()
+	client := bs.client
+	bs.mutex.RUnlock()
 
-	// Create a result channel for safe goroutine communication
-	type mdpResult struct {
-		response []string
-		err      error
+	if client == nil {
+		return nil, fmt.Errorf("broker client is not initialized")
 	}
 
-	resultChan := make(chan mdpResult, 1)
-
-	// Run MDP operation in isolated goroutine with panic recovery
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				bs.logger.WithField("panic", r).Error("Panic in service query")
-				resultChan <- mdpResult{
-					response: nil,
-					err:      fmt.Errorf("service query panicked: %v", r),
-				}
-			}
-		}()
+	ctx, cancel := bs.requestContext(ctx)
+	defer cancel()
 
-		// Send service query
-		if err := bs.client.Send(serviceName, message...); err != nil {
-			resultChan <- mdpResult{
-				response: nil,
-				err:      fmt.Errorf("failed to send service query: %w", err),
-			}
-			return
-		}
+	response, err := client.Request(ctx, serviceName, append([]string{command}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("service query failed: %w", err)
+	}
 
-		// Receive response
-		resp, err := bs.client.Recv()
-		if err != nil {
-			resultChan <- mdpResult{
-				response: nil,
-				err:      fmt.Errorf("failed to receive service response: %w", err),
-			}
-			return
-		}
+	bs.logger.WithFields(log.Fields{
+		"service":  serviceName,
+		"command":  command,
+		"response": response,
+	}).Trace("Received service response")
 
-		resultChan <- mdpResult{
-			response: resp,
-			err:      nil,
-		}
-	}()
+	return response, nil
+}
 
-	// Wait for either completion or timeout
-	select {
-	case result := <-resultChan:
-		if result.err != nil {
-			return nil, result.err
-		}
-		bs.logger.WithFields(log.Fields{
-			"service":  serviceName,
-			"command":  command,
-			"response": result.response,
-		}).Trace("Received service response")
-		return result.response, nil
-	case <-ctx.Done():
-		return nil, fmt.Errorf("service query timed out: %w", ctx.Err())
+// requestContext applies the configured timeout to requests that don't
+// already have a deadline.
+func (bs *BrokerService) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || bs.timeout == 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, bs.timeout)
 }
 
 // Legacy methods for compatibility
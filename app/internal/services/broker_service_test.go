@@ -9,6 +9,7 @@ import (
 	"github.com/geoffjay/plantd/app/config"
 	"github.com/geoffjay/plantd/core/mdp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCircuitBreaker(t *testing.T) {
@@ -142,7 +143,7 @@ func TestNewBrokerService(t *testing.T) {
 
 func TestBrokerService_IsAvailable(t *testing.T) {
 	t.Run("available when not disabled and no client error", func(t *testing.T) {
-		client := &mdp.Client{} // Mock client
+		client := &mdp.SharedClient{} // Mock client
 		bs := &BrokerService{
 			client:    client,
 			disabled:  false,
@@ -176,7 +177,7 @@ func TestBrokerService_GetStatus(t *testing.T) {
 		cfg := &config.Config{}
 		cfg.Services.BrokerEndpoint = TestBrokerEndpoint
 
-		client := &mdp.Client{} // Mock client
+		client := &mdp.SharedClient{} // Mock client
 		bs := &BrokerService{
 			client:    client,
 			config:    cfg,
@@ -250,6 +251,47 @@ func TestBrokerService_GetServiceStatuses(t *testing.T) {
 	})
 }
 
+func TestParseServiceList(t *testing.T) {
+	t.Run("parse valid service list", func(t *testing.T) {
+		response := []string{
+			mdp.MMICodeOK,
+			`[{"name":"echo","waiting":1,"busy":2,"queued":3,"served":30,"failed":10}]`,
+		}
+
+		services, err := parseServiceList(response)
+
+		require.NoError(t, err)
+		require.Len(t, services, 1)
+		assert.Equal(t, "echo", services[0].Name)
+		assert.Equal(t, 3, services[0].Queued)
+
+		status := newServiceStatus(services[0])
+		assert.Equal(t, StatusHealthy, status.Status)
+		assert.Equal(t, 3, status.Workers)
+		assert.Equal(t, 2, status.Busy)
+		assert.Equal(t, int64(30), status.Served)
+		assert.InDelta(t, 0.25, status.ErrorRate, 0.001)
+	})
+
+	t.Run("service without workers is unhealthy", func(t *testing.T) {
+		status := newServiceStatus(mdp.ServiceInfo{Name: "echo", Queued: 5})
+		assert.Equal(t, StatusUnhealthy, status.Status)
+		assert.Equal(t, 0, status.Workers)
+		assert.Equal(t, 0.0, status.ErrorRate)
+	})
+
+	t.Run("parse invalid responses", func(t *testing.T) {
+		_, err := parseServiceList([]string{mdp.MMICodeOK})
+		assert.Error(t, err)
+
+		_, err = parseServiceList([]string{mdp.MMICodeError, "[]"})
+		assert.Error(t, err)
+
+		_, err = parseServiceList([]string{mdp.MMICodeOK, "not json"})
+		assert.Error(t, err)
+	})
+}
+
 func TestBrokerService_Close(t *testing.T) {
 	t.Run("close with nil client", func(t *testing.T) {
 		bs := &BrokerService{
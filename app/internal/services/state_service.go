@@ -4,20 +4,25 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/geoffjay/plantd/app/config"
+	"github.com/geoffjay/plantd/core/bus"
 	"github.com/geoffjay/plantd/core/mdp"
+	"github.com/geoffjay/plantd/state/api"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // StateService handles communication with the plantd state service for configuration and state management.
 type StateService struct {
-	client *mdp.Client
-	config *config.Config
-	logger *log.Entry
+	client  *mdp.SharedClient
+	timeout time.Duration
+	config  *config.Config
+	logger  *log.Entry
 }
 
 // StateData represents a state key-value pair with metadata.
@@ -63,6 +68,47 @@ type StateChangeNotification struct {
 	ChangedAt   time.Time   `json:"changed_at"`
 	ChangeType  string      `json:"change_type"` // "create", "update", "delete"
 	Description string      `json:"description"`
+	Revision    uint64      `json:"revision"`
+}
+
+// StateOperation is a set or delete of a key, it's only made when the key is
+// at Revision and has the value Expected for those that are set.
+type StateOperation struct {
+	Operation string      `json:"operation"` // "set" or "delete"
+	Scope     string      `json:"scope,omitempty"`
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value,omitempty"`
+	Revision  *uint64     `json:"revision,omitempty"`
+	Expected  interface{} `json:"expected,omitempty"`
+}
+
+// StateBatchResult represents the changes made by a batch of operations.
+type StateBatchResult struct {
+	Count    int               `json:"count"`
+	Revision uint64            `json:"revision"`
+	Changes  []api.StateChange `json:"changes"`
+}
+
+// StateSwapResult represents the outcome of a compare-and-swap, with what the
+// key is when it wasn't swapped.
+type StateSwapResult struct {
+	Scope    string `json:"scope"`
+	Key      string `json:"key"`
+	Swapped  bool   `json:"swapped"`
+	Revision uint64 `json:"revision"`
+	Exists   bool   `json:"exists"`
+	Value    string `json:"value"`
+}
+
+// StateRequestError is returned when the state service fails a request, with
+// the data of its reply.
+type StateRequestError struct {
+	Message string
+	Data    json.RawMessage
+}
+
+func (e *StateRequestError) Error() string {
+	return "state service error: " + e.Message
 }
 
 // NewStateService creates a new state service client.
@@ -82,7 +128,7 @@ func NewStateService(cfg *config.Config) (*StateService, error) {
 	}
 
 	// Create MDP client for state service communication
-	client, err := mdp.NewClient(stateEndpoint)
+	client, err := mdp.NewSharedClient(stateEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create MDP client for state service: %w", err)
 	}
@@ -93,7 +139,6 @@ func NewStateService(cfg *config.Config) (*StateService, error) {
 		timeout = 30 * time.Second
 		logger.WithError(err).Warn("Failed to parse services timeout, using default 30s")
 	}
-	client.SetTimeout(timeout)
 
 	logger.WithFields(log.Fields{
 		"state_endpoint": stateEndpoint,
@@ -101,9 +146,10 @@ func NewStateService(cfg *config.Config) (*StateService, error) {
 	}).Info("State service client initialized")
 
 	return &StateService{
-		client: client,
-		config: cfg,
-		logger: logger,
+		client:  client,
+		timeout: timeout,
+		config:  cfg,
+		logger:  logger,
 	}, nil
 }
 
@@ -262,27 +308,17 @@ func (ss *StateService) CreateBackup(ctx context.Context, userToken, name, descr
 		"description": description,
 	}).Debug("Creating state backup")
 
-	// Serialize scopes list
-	scopesBytes, err := json.Marshal(scopes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to serialize scopes: %w", err)
-	}
-
-	// Send authenticated request to state service
-	response, err := ss.sendAuthenticatedRequest(ctx, userToken, "create_backup", name, description, string(scopesBytes))
+	var backup StateBackup
+	err := ss.sendStateRequest(ctx, "create_backup", map[string]interface{}{
+		"token":       userToken,
+		"name":        name,
+		"description": description,
+		"scopes":      scopes,
+	}, &backup)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create backup: %w", err)
 	}
 
-	if len(response) == 0 || response[0] == "" {
-		return nil, fmt.Errorf("empty backup response")
-	}
-
-	var backup StateBackup
-	if err := json.Unmarshal([]byte(response[0]), &backup); err != nil {
-		return nil, fmt.Errorf("failed to parse backup response: %w", err)
-	}
-
 	ss.logger.WithFields(log.Fields{
 		"backup_id": backup.ID,
 		"name":      name,
@@ -295,21 +331,14 @@ func (ss *StateService) CreateBackup(ctx context.Context, userToken, name, descr
 func (ss *StateService) RestoreBackup(ctx context.Context, userToken, backupID string) error {
 	ss.logger.WithField("backup_id", backupID).Debug("Restoring state backup")
 
-	// Send authenticated request to state service
-	response, err := ss.sendAuthenticatedRequest(ctx, userToken, "restore_backup", backupID)
+	err := ss.sendStateRequest(ctx, "restore_backup", map[string]interface{}{
+		"token": userToken,
+		"id":    backupID,
+	}, nil)
 	if err != nil {
 		return fmt.Errorf("failed to restore backup: %w", err)
 	}
 
-	// Check response for success
-	if len(response) > 0 && response[0] == StatusError {
-		errorMsg := ErrorUnknown
-		if len(response) > 1 {
-			errorMsg = response[1]
-		}
-		return fmt.Errorf("state service error: %s", errorMsg)
-	}
-
 	ss.logger.WithField("backup_id", backupID).Info("State backup restored successfully")
 	return nil
 }
@@ -318,21 +347,18 @@ func (ss *StateService) RestoreBackup(ctx context.Context, userToken, backupID s
 func (ss *StateService) ListBackups(ctx context.Context, userToken string) ([]StateBackup, error) {
 	ss.logger.Debug("Listing state backups")
 
-	// Send authenticated request to state service
-	response, err := ss.sendAuthenticatedRequest(ctx, userToken, "list_backups")
+	var result struct {
+		Backups []StateBackup `json:"backups"`
+	}
+	err := ss.sendStateRequest(ctx, "list_backups", map[string]interface{}{
+		"token": userToken,
+	}, &result)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list backups: %w", err)
 	}
 
-	var backups []StateBackup
-	if len(response) > 0 && response[0] != "" {
-		if err := json.Unmarshal([]byte(response[0]), &backups); err != nil {
-			return nil, fmt.Errorf("failed to parse backups response: %w", err)
-		}
-	}
-
-	ss.logger.WithField("backup_count", len(backups)).Debug("Retrieved backup list")
-	return backups, nil
+	ss.logger.WithField("backup_count", len(result.Backups)).Debug("Retrieved backup list")
+	return result.Backups, nil
 }
 
 // ValidateStateData validates state data against schema (if available).
@@ -342,63 +368,254 @@ func (ss *StateService) ValidateStateData(ctx context.Context, userToken, scope,
 		"key":   key,
 	}).Debug("Validating state data")
 
-	// Serialize the value
-	valueBytes, err := json.Marshal(value)
-	if err != nil {
-		return false, nil, fmt.Errorf("failed to serialize value: %w", err)
-	}
-
-	// Send authenticated request to state service
-	response, err := ss.sendAuthenticatedRequest(ctx, userToken, "validate_data", scope, key, string(valueBytes))
+	var result struct {
+		Valid  bool `json:"valid"`
+		Errors []struct {
+			Path    string `json:"path"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err := ss.sendStateRequest(ctx, "validate_data", map[string]interface{}{
+		"token":   userToken,
+		"service": scope,
+		"key":     key,
+		"value":   value,
+	}, &result)
 	if err != nil {
 		return false, nil, fmt.Errorf("failed to validate state data: %w", err)
 	}
 
-	if len(response) < 2 {
-		return false, nil, fmt.Errorf("invalid validation response")
-	}
-
-	// Parse validation result
-	isValid := response[0] == "true"
-	var errors []string
-	if len(response) > 1 && response[1] != "" {
-		if err := json.Unmarshal([]byte(response[1]), &errors); err != nil {
-			errors = []string{response[1]} // Fallback to single error string
-		}
+	isValid := result.Valid
+	messages := make([]string, 0, len(result.Errors))
+	for _, problem := range result.Errors {
+		messages = append(messages, problem.Path+": "+problem.Message)
 	}
 
 	ss.logger.WithFields(log.Fields{
 		"scope":  scope,
 		"key":    key,
 		"valid":  isValid,
-		"errors": errors,
+		"errors": messages,
 	}).Debug("State data validation complete")
 
-	return isValid, errors, nil
+	return isValid, messages, nil
+}
+
+// ApplyStateBatch makes several set and delete operations in a single
+// transaction, either all of them are made or none are. Operations are made
+// in the scope given unless they name another one.
+func (ss *StateService) ApplyStateBatch(ctx context.Context, userToken, scope string, operations []StateOperation) (*StateBatchResult, error) {
+	ss.logger.WithFields(log.Fields{
+		"scope":      scope,
+		"operations": len(operations),
+	}).Debug("Applying state batch")
+
+	var result StateBatchResult
+	err := ss.sendStateRequest(ctx, "state-batch", map[string]interface{}{
+		"token":      userToken,
+		"service":    scope,
+		"operations": operations,
+	}, &result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply state batch: %w", err)
+	}
+
+	ss.logger.WithFields(log.Fields{
+		"scope":      scope,
+		"operations": result.Count,
+		"revision":   result.Revision,
+	}).Info("State batch applied successfully")
+	return &result, nil
 }
 
-// SubscribeToChanges subscribes to state change notifications.
-func (ss *StateService) SubscribeToChanges(ctx context.Context, userToken string, scopes []string) (<-chan StateChangeNotification, error) { //nolint:revive
+// CompareAndSwapState makes an operation on a key only when it's at the
+// revision or has the value the operation expects. When it isn't, the result
+// has what it is rather than an error being returned.
+func (ss *StateService) CompareAndSwapState(ctx context.Context, userToken, scope string, operation StateOperation) (*StateSwapResult, error) {
+	ss.logger.WithFields(log.Fields{
+		"scope": scope,
+		"key":   operation.Key,
+	}).Debug("Comparing and swapping state data")
+
+	request := map[string]interface{}{
+		"token":     userToken,
+		"service":   scope,
+		"operation": operation.Operation,
+		"key":       operation.Key,
+	}
+	if operation.Value != nil {
+		request["value"] = operation.Value
+	}
+	if operation.Revision != nil {
+		request["revision"] = *operation.Revision
+	}
+	if operation.Expected != nil {
+		request["expected"] = operation.Expected
+	}
+
+	var result StateSwapResult
+	err := ss.sendStateRequest(ctx, "state-cas", request, &result)
+	var failed *StateRequestError
+	if errors.As(err, &failed) && len(failed.Data) > 0 {
+		if json.Unmarshal(failed.Data, &result) == nil && result.Key != "" {
+			ss.logger.WithFields(log.Fields{
+				"scope":    scope,
+				"key":      operation.Key,
+				"revision": result.Revision,
+			}).Debug("State data wasn't what was expected")
+			return &result, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare and swap state data: %w", err)
+	}
+
+	ss.logger.WithFields(log.Fields{
+		"scope":    scope,
+		"key":      operation.Key,
+		"revision": result.Revision,
+	}).Info("State data swapped successfully")
+	return &result, nil
+}
+
+// SubscribeToChanges subscribes to the changes the state service publishes on
+// the state bus, every scope is received when none are given. The channel is
+// closed when the context is done.
+func (ss *StateService) SubscribeToChanges(ctx context.Context, userToken string, scopes []string) (<-chan StateChangeNotification, error) {
 	ss.logger.WithField("scopes", scopes).Debug("Subscribing to state changes")
 
-	// Create notification channel
+	endpoint := ss.config.Services.StateBusEndpoint
+	if endpoint == "" {
+		return nil, fmt.Errorf("state bus endpoint is not configured")
+	}
+
+	// the bus doesn't check who's listening, so the state service is asked
+	// whether the token can read the scopes, or every scope without any
+	if err := ss.checkRead(ctx, userToken, scopes); err != nil {
+		return nil, err
+	}
+
+	// a single scope can be filtered by the bus, several are filtered here
+	filter := api.StateChangeTopicFor("")
+	if len(scopes) == 1 {
+		filter = api.StateChangeTopicFor(scopes[0])
+	}
+
 	notifications := make(chan StateChangeNotification, 100)
+	callback := &stateChangeCallback{
+		ctx:           ctx,
+		scopes:        make(map[string]bool),
+		notifications: notifications,
+	}
+	for _, scope := range scopes {
+		callback.scopes[scope] = true
+	}
+
+	sink := bus.NewSink(endpoint, filter)
+	sink.SetHandler(&bus.SinkHandler{Callback: callback})
 
-	// For now, this is a placeholder implementation
-	// In a real implementation, this would establish a persistent connection
-	// or use pub/sub for real-time notifications
 	go func() {
 		defer close(notifications)
-		// Placeholder: would implement real subscription logic here
-		select { //nolint:staticcheck
-		case <-ctx.Done():
-			return
-		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		sink.Run(ctx, &wg)
+		ss.logger.WithField("scopes", scopes).Debug("State change subscription closed")
 	}()
 
 	return notifications, nil
 }
 
+// checkRead checks that a token can read every one of the scopes, or every
+// scope when none are given.
+func (ss *StateService) checkRead(ctx context.Context, userToken string, scopes []string) error {
+	if len(scopes) == 0 {
+		if err := ss.sendStateRequest(ctx, "state-check-read", map[string]interface{}{
+			"token": userToken,
+		}, nil); err != nil {
+			return fmt.Errorf("not allowed to read every scope: %w", err)
+		}
+		return nil
+	}
+
+	for _, scope := range scopes {
+		if err := ss.sendStateRequest(ctx, "state-check-read", map[string]interface{}{
+			"token":   userToken,
+			"service": scope,
+		}, nil); err != nil {
+			return fmt.Errorf("not allowed to read scope %s: %w", scope, err)
+		}
+	}
+	return nil
+}
+
+// stateChangeCallback passes the changes a sink receives to a subscriber.
+type stateChangeCallback struct {
+	ctx           context.Context
+	scopes        map[string]bool
+	notifications chan<- StateChangeNotification
+}
+
+// Handle decodes a state change, it implements bus.SinkCallback.
+func (cb *stateChangeCallback) Handle(message *bus.Message) error {
+	var change api.StateChange
+	if err := json.Unmarshal(message.Body, &change); err != nil {
+		return fmt.Errorf("failed to decode state change: %w", err)
+	}
+
+	// the topic filter is a prefix so it also matches longer scope names
+	if len(cb.scopes) > 0 && !cb.scopes[change.Scope] {
+		return nil
+	}
+
+	select {
+	case cb.notifications <- newStateChangeNotification(&change):
+	case <-cb.ctx.Done():
+	}
+	return nil
+}
+
+// newStateChangeNotification converts a change published by the state service.
+func newStateChangeNotification(change *api.StateChange) StateChangeNotification {
+	notification := StateChangeNotification{
+		Scope:     change.Scope,
+		Key:       change.Key,
+		ChangedBy: change.Actor,
+		ChangedAt: change.Time,
+		Revision:  change.Revision,
+	}
+	if change.OldValue != "" {
+		notification.OldValue = change.OldValue
+	}
+	if change.NewValue != "" {
+		notification.NewValue = change.NewValue
+	}
+
+	switch change.Operation {
+	case api.StateSet:
+		notification.ChangeType = "update"
+		if change.OldValue == "" {
+			notification.ChangeType = "create"
+		}
+		notification.Description = fmt.Sprintf("%s set in %s", change.Key, change.Scope)
+	case api.StateDelete:
+		notification.ChangeType = "delete"
+		notification.Description = fmt.Sprintf("%s deleted from %s", change.Key, change.Scope)
+	case api.StateCreateScope:
+		notification.ChangeType = "create"
+		notification.Description = fmt.Sprintf("scope %s created", change.Scope)
+	case api.StateDeleteScope:
+		notification.ChangeType = "delete"
+		notification.Description = fmt.Sprintf("scope %s deleted", change.Scope)
+	case api.StateRestoreScope:
+		notification.ChangeType = "update"
+		notification.Description = fmt.Sprintf("scope %s restored from a backup", change.Scope)
+	default:
+		notification.ChangeType = change.Operation
+	}
+
+	return notification
+}
+
 // CheckConnectivity verifies connectivity to the state service.
 func (ss *StateService) CheckConnectivity(ctx context.Context) error { //nolint:revive
 	ss.logger.Debug("Checking state service connectivity")
@@ -425,6 +642,52 @@ func (ss *StateService) sendAuthenticatedRequest(ctx context.Context, userToken,
 	return ss.sendRequest(ctx, "org.plantd.State", message...)
 }
 
+// stateResponse is the reply of the state service to a request with a JSON
+// body.
+type stateResponse struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// sendStateRequest sends a request with a JSON body to the state service and
+// decodes the data of the reply into out, unless it's nil. A
+// StateRequestError is returned when the state service fails the request.
+func (ss *StateService) sendStateRequest(ctx context.Context, command string, request map[string]interface{}, out interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to serialize request: %w", err)
+	}
+
+	reply, err := ss.sendRequest(ctx, "org.plantd.State", command, string(body))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 || reply[0] == "" {
+		return fmt.Errorf("empty %s response", command)
+	}
+
+	var response stateResponse
+	if err := json.Unmarshal([]byte(reply[0]), &response); err != nil {
+		return fmt.Errorf("failed to parse %s response: %w", command, err)
+	}
+	if !response.Success {
+		message := response.Error
+		if message == "" {
+			message = ErrorUnknown
+		}
+		return &StateRequestError{Message: message, Data: response.Data}
+	}
+
+	if out == nil || len(response.Data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(response.Data, out); err != nil {
+		return fmt.Errorf("failed to parse %s response: %w", command, err)
+	}
+	return nil
+}
+
 // sendRequest sends a request to the state service.
 func (ss *StateService) sendRequest(ctx context.Context, service string, args ...string) ([]string, error) { //nolint:revive
 	command := "<no_command>"
@@ -439,83 +702,29 @@ func (ss *StateService) sendRequest(ctx context.Context, service string, args ..
 	}).Trace("Sending state service request")
 
 	// Create a timeout for the entire operation
-	opCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	opCtx, cancel := context.WithTimeout(ctx, ss.timeout)
 	defer cancel()
 
-	// Use a channel to handle the MDP operation safely
-	type result struct {
-		response []string
-		err      error
+	if ss.client == nil {
+		return nil, fmt.Errorf("state service client not initialized")
 	}
 
-	resultChan := make(chan result, 1)
-
-	// Run the MDP operation in a separate goroutine with panic recovery
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				ss.logger.WithField("panic", r).Error("Panic in state service request")
-				resultChan <- result{
-					response: nil,
-					err:      fmt.Errorf("state service request panicked: %v", r),
-				}
-			}
-		}()
-
-		// Check if client is available
-		if ss.client == nil {
-			resultChan <- result{
-				response: nil,
-				err:      fmt.Errorf("state service client not initialized"),
-			}
-			return
-		}
-
-		// Send request with error handling
-		err := ss.client.Send(service, args...)
-		if err != nil {
-			resultChan <- result{
-				response: nil,
-				err:      fmt.Errorf("failed to send state service request: %w", err),
-			}
-			return
-		}
-
-		// Receive response with error handling
-		response, err := ss.client.Recv()
-		if err != nil {
-			resultChan <- result{
-				response: nil,
-				err:      fmt.Errorf("failed to receive state service response: %w", err),
-			}
-			return
-		}
-
-		resultChan <- result{
-			response: response,
-			err:      nil,
-		}
-	}()
-
-	// Wait for either completion or timeout
-	select {
-	case res := <-resultChan:
-		if res.err != nil {
-			return nil, res.err
+	response, err := ss.client.Request(opCtx, service, args...)
+	if err != nil {
+		if opCtx.Err() != nil {
+			ss.logger.WithError(err).WithField("command", command).Warn("State service request timed out")
+			return nil, fmt.Errorf("state service request timed out: %w", err)
 		}
+		return nil, fmt.Errorf("state service request failed: %w", err)
+	}
 
-		ss.logger.WithFields(log.Fields{
-			"service":  service,
-			"command":  command,
-			"response": res.response,
-		}).Trace("Received state service response")
-
-		return res.response, nil
+	ss.logger.WithFields(log.Fields{
+		"service":  service,
+		"command":  command,
+		"response": response,
+	}).Trace("Received state service response")
 
-	case <-opCtx.Done():
-		ss.logger.WithError(opCtx.Err()).WithField("command", command).Warn("State service request timed out")
-		return nil, fmt.Errorf("state service request timed out: %w", opCtx.Err())
-	}
+	return response, nil
 }
 
 // HealthCheck performs a comprehensive health check of the state service.
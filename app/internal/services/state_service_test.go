@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/geoffjay/plantd/core/bus"
+	"github.com/geoffjay/plantd/state/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStateChangeNotification(t *testing.T) {
+	now := time.Now()
+
+	t.Run("set of a new key is a create", func(t *testing.T) {
+		notification := newStateChangeNotification(&api.StateChange{
+			Revision:  4,
+			Time:      now,
+			Operation: api.StateSet,
+			Scope:     "org.plantd.Test",
+			Key:       "foo",
+			NewValue:  "bar",
+			Actor:     "user@example.com",
+		})
+		assert.Equal(t, "create", notification.ChangeType)
+		assert.Equal(t, "org.plantd.Test", notification.Scope)
+		assert.Equal(t, "foo", notification.Key)
+		assert.Nil(t, notification.OldValue)
+		assert.Equal(t, "bar", notification.NewValue)
+		assert.Equal(t, "user@example.com", notification.ChangedBy)
+		assert.Equal(t, now, notification.ChangedAt)
+		assert.Equal(t, uint64(4), notification.Revision)
+	})
+
+	t.Run("set of an existing key is an update", func(t *testing.T) {
+		notification := newStateChangeNotification(&api.StateChange{
+			Operation: api.StateSet,
+			Scope:     "org.plantd.Test",
+			Key:       "foo",
+			OldValue:  "bar",
+			NewValue:  "baz",
+		})
+		assert.Equal(t, "update", notification.ChangeType)
+		assert.Equal(t, "bar", notification.OldValue)
+	})
+
+	t.Run("deletes", func(t *testing.T) {
+		notification := newStateChangeNotification(&api.StateChange{
+			Operation: api.StateDelete,
+			Scope:     "org.plantd.Test",
+			Key:       "foo",
+			OldValue:  "bar",
+		})
+		assert.Equal(t, "delete", notification.ChangeType)
+
+		notification = newStateChangeNotification(&api.StateChange{
+			Operation: api.StateDeleteScope,
+			Scope:     "org.plantd.Test",
+		})
+		assert.Equal(t, "delete", notification.ChangeType)
+		assert.Empty(t, notification.Key)
+	})
+}
+
+func TestStateChangeCallback(t *testing.T) {
+	notifications := make(chan StateChangeNotification, 2)
+	callback := &stateChangeCallback{
+		ctx:           context.Background(),
+		scopes:        map[string]bool{"org.plantd.Test": true},
+		notifications: notifications,
+	}
+
+	for _, scope := range []string{"org.plantd.Test", "org.plantd.TestMore"} {
+		body, err := json.Marshal(&api.StateChange{
+			Operation: api.StateSet,
+			Scope:     scope,
+			Key:       "foo",
+			NewValue:  "bar",
+		})
+		require.NoError(t, err)
+		require.NoError(t, callback.Handle(&bus.Message{
+			Topic: api.StateChangeTopicFor(scope),
+			Body:  body,
+		}))
+	}
+
+	require.Len(t, notifications, 1)
+	notification := <-notifications
+	assert.Equal(t, "org.plantd.Test", notification.Scope)
+
+	assert.Error(t, callback.Handle(&bus.Message{Body: []byte("not json")}))
+}
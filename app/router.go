@@ -107,6 +107,7 @@ func initializeRouter(app *fiber.App, authHandlers *handlers.AuthHandlers, authM
 	// Create SSE handler for real-time updates and store globally for cleanup
 	sseHandler := internalHandlers.NewSSEHandler(
 		service.brokerService,
+		service.stateService,
 		service.healthService,
 		service.metricsService,
 	)
@@ -133,6 +134,7 @@ func initializeRouter(app *fiber.App, authHandlers *handlers.AuthHandlers, authM
 	// Real-time update routes (SSE) with timeout middleware
 	app.Get("/dashboard/sse", authMiddleware.RequireAuth(), sseTimeoutMiddleware, sseHandler.DashboardSSE)
 	app.Get("/system/status/sse", authMiddleware.RequireAuth(), sseTimeoutMiddleware, sseHandler.SystemStatusSSE)
+	app.Get("/state/sse", authMiddleware.RequireAuth(), sseTimeoutMiddleware, sseHandler.StateSSE)
 
 	app.Get("/sse", handlers.ReloadSSE)
 
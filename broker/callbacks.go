@@ -6,17 +6,65 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/geoffjay/plantd/core/bus"
+	"github.com/geoffjay/plantd/core/mdp"
 	"github.com/geoffjay/plantd/core/service"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// brokerInfo provides the state of the services known to the broker.
+type brokerInfo interface {
+	GetServiceInfo() []mdp.ServiceInfo
+	GetWorkerInfo() []mdp.WorkerInfo
+}
+
 type serviceCallback struct {
-	name string
+	name   string
+	broker brokerInfo
 }
 
 type servicesCallback struct {
-	name string
+	name   string
+	broker brokerInfo
+}
+
+// busInfo provides the traffic of a message bus.
+type busInfo interface {
+	Name() string
+	Stats() bus.Stats
+}
+
+type busesCallback struct {
+	name  string
+	buses []busInfo
+}
+
+// serviceStatus is the response data for a single service.
+type serviceStatus struct {
+	mdp.ServiceInfo
+	Workers []mdp.WorkerInfo `json:"workers"`
+}
+
+// serviceStatuses combines the service and worker information reported by
+// the broker, the workers are listed with the service they're attached to.
+func serviceStatuses(broker brokerInfo) []serviceStatus {
+	workers := make(map[string][]mdp.WorkerInfo)
+	for _, worker := range broker.GetWorkerInfo() {
+		workers[worker.ServiceName] = append(workers[worker.ServiceName], worker)
+	}
+
+	services := broker.GetServiceInfo()
+	statuses := make([]serviceStatus, 0, len(services))
+	for _, info := range services {
+		status := serviceStatus{ServiceInfo: info, Workers: workers[info.Name]}
+		if status.Workers == nil {
+			status.Workers = make([]mdp.WorkerInfo, 0)
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
 }
 
 // nolint: unused
@@ -43,12 +91,15 @@ func (cb *serviceCallback) Execute(msgBody string) ([]byte, error) {
 			errors.New("`service` missing")
 	}
 
-	// TODO:
-	// 1. Check if service exists
-	// 2. Check if service is running
-	// 3. Create response with service data, eg. client and worker count
+	for _, status := range serviceStatuses(cb.broker) {
+		if status.Name != scope {
+			continue
+		}
+		return json.Marshal(map[string]serviceStatus{scope: status})
+	}
 
-	return []byte(`{"` + scope + `": {} }`), nil
+	return []byte(`{"error": "service not found"}`),
+		fmt.Errorf("service %s not found", scope)
 }
 
 // Execute callback function to handle `services` requests.
@@ -65,18 +116,54 @@ func (cb *servicesCallback) Execute(msgBody string) ([]byte, error) {
 		return []byte(msg), err
 	}
 
-	// TODO:
-	// 1. Check if service exists
-	// 2. Check if service is running
-	// 3. Create response with services data, eg. client and worker count
+	return json.Marshal(map[string][]serviceStatus{
+		"services": serviceStatuses(cb.broker),
+	})
+}
+
+// busStats returns the traffic of every bus, or only of the named one.
+func busStats(buses []busInfo, name string) []bus.Stats {
+	stats := make([]bus.Stats, 0, len(buses))
+	for _, b := range buses {
+		if name != "" && b.Name() != name {
+			continue
+		}
+		stats = append(stats, b.Stats())
+	}
+	return stats
+}
+
+// Execute callback function to handle `buses` requests.
+func (cb *busesCallback) Execute(msgBody string) ([]byte, error) {
+	var (
+		name    string
+		request service.RawRequest
+	)
+
+	log.Tracef("name: %s", cb.name)
+	log.Tracef("body: %s", msgBody)
+
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		msg := fmt.Sprintf("{\"error\":\"%s\"}", err.Error())
+		return []byte(msg), err
+	}
+
+	name, _ = request["bus"].(string)
+	stats := busStats(cb.buses, name)
+	if name != "" && len(stats) == 0 {
+		return []byte(`{"error": "bus not found"}`),
+			fmt.Errorf("bus %s not found", name)
+	}
 
-	return []byte(`{"services": [] }`), nil
+	return json.Marshal(map[string][]bus.Stats{"buses": stats})
 }
 
 // Callback handles subscriber events on the state bus.
 // nolint: unused
-func (cb *sinkCallback) Handle(data []byte) error {
-	log.WithFields(log.Fields{"data": string(data)}).Debug(
-		"data received on state bus")
+func (cb *sinkCallback) Handle(message *bus.Message) error {
+	log.WithFields(log.Fields{
+		"topic": message.Topic,
+		"data":  string(message.Body),
+	}).Debug("data received on state bus")
 	return nil
 }
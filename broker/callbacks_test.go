@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/geoffjay/plantd/core/bus"
+	"github.com/geoffjay/plantd/core/mdp"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testBroker struct{}
+
+func (b *testBroker) GetServiceInfo() []mdp.ServiceInfo {
+	return []mdp.ServiceInfo{
+		{Name: "org.plantd.Echo", Waiting: 1, Busy: 1, Queued: 2, Served: 10, Failed: 1},
+		{Name: "org.plantd.State", Queued: 1},
+	}
+}
+
+func (b *testBroker) GetWorkerInfo() []mdp.WorkerInfo {
+	return []mdp.WorkerInfo{
+		{ID: "worker-001", ServiceName: "org.plantd.Echo", Status: mdp.WorkerStatusWaiting, TotalRequests: 4},
+		{ID: "worker-002", ServiceName: "org.plantd.Echo", Status: mdp.WorkerStatusBusy, TotalRequests: 6},
+	}
+}
+
+// TestServiceCallback tests the service callback.
+func TestServiceCallback(t *testing.T) {
+	cb := &serviceCallback{name: "service", broker: &testBroker{}}
+
+	data, err := cb.Execute(`{"service": "org.plantd.Echo"}`)
+	require.NoError(t, err)
+
+	var response map[string]serviceStatus
+	require.NoError(t, json.Unmarshal(data, &response))
+	require.Contains(t, response, "org.plantd.Echo")
+
+	status := response["org.plantd.Echo"]
+	assert.Equal(t, 2, status.Queued)
+	assert.Equal(t, int64(10), status.Served)
+	require.Len(t, status.Workers, 2)
+	assert.Equal(t, "worker-001", status.Workers[0].ID)
+
+	_, err = cb.Execute(`{"service": "org.plantd.Missing"}`)
+	assert.ErrorContains(t, err, "service org.plantd.Missing not found")
+
+	_, err = cb.Execute(`{}`)
+	assert.Error(t, err)
+}
+
+// TestServicesCallback tests the services callback.
+func TestServicesCallback(t *testing.T) {
+	cb := &servicesCallback{name: "services", broker: &testBroker{}}
+
+	data, err := cb.Execute(`{}`)
+	require.NoError(t, err)
+
+	var response map[string][]serviceStatus
+	require.NoError(t, json.Unmarshal(data, &response))
+	require.Len(t, response["services"], 2)
+	assert.Len(t, response["services"][0].Workers, 2)
+	assert.Empty(t, response["services"][1].Workers)
+	assert.NotNil(t, response["services"][1].Workers)
+}
+
+type testBus struct {
+	name string
+}
+
+func (b *testBus) Name() string {
+	return b.name
+}
+
+func (b *testBus) Stats() bus.Stats {
+	return bus.Stats{
+		Name:     b.name,
+		Running:  true,
+		Messages: 3,
+		Bytes:    120,
+		Topics: map[string]bus.TopicStats{
+			"org.plantd.metric": {Messages: 3, Bytes: 120},
+		},
+		Filters: []string{"org.plantd"},
+	}
+}
+
+// TestBusesCallback tests the buses callback.
+func TestBusesCallback(t *testing.T) {
+	cb := &busesCallback{name: "buses", buses: []busInfo{
+		&testBus{name: "state"},
+		&testBus{name: "metric"},
+	}}
+
+	data, err := cb.Execute(`{}`)
+	require.NoError(t, err)
+
+	var response map[string][]bus.Stats
+	require.NoError(t, json.Unmarshal(data, &response))
+	require.Len(t, response["buses"], 2)
+	assert.Equal(t, "state", response["buses"][0].Name)
+
+	data, err = cb.Execute(`{"bus": "metric"}`)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &response))
+	require.Len(t, response["buses"], 1)
+	assert.Equal(t, uint64(3), response["buses"][0].Topics["org.plantd.metric"].Messages)
+	assert.Equal(t, []string{"org.plantd"}, response["buses"][0].Filters)
+
+	_, err = cb.Execute(`{"bus": "missing"}`)
+	assert.ErrorContains(t, err, "bus missing not found")
+}
@@ -2,31 +2,87 @@ package main
 
 import (
 	"sync"
+	"time"
 
 	cfg "github.com/geoffjay/plantd/core/config"
+	"github.com/geoffjay/plantd/core/curve"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type busConfig struct {
-	Name     string `mapstructure:"name"`
-	Frontend string `mapstructure:"frontend"`
-	Backend  string `mapstructure:"backend"`
-	Capture  string `mapstructure:"capture"`
+	Name       string       `mapstructure:"name"`
+	Frontend   string       `mapstructure:"frontend"`
+	Backend    string       `mapstructure:"backend"`
+	Capture    string       `mapstructure:"capture"`
+	Snapshot   string       `mapstructure:"snapshot"`
+	Record     recordConfig `mapstructure:"record"`
+	Exclude    []string     `mapstructure:"exclude"`
+	StatsDepth int          `mapstructure:"stats-depth"`
+}
+
+type recordConfig struct {
+	Path     string        `mapstructure:"path"`
+	MaxSize  int64         `mapstructure:"max-size"`
+	MaxAge   time.Duration `mapstructure:"max-age"`
+	MaxFiles int           `mapstructure:"max-files"`
+}
+
+type clusterConfig struct {
+	Enabled   bool            `mapstructure:"enabled"`
+	NodeID    string          `mapstructure:"node-id"`
+	Advertise string          `mapstructure:"advertise"`
+	Discovery string          `mapstructure:"discovery"`
+	Peers     []string        `mapstructure:"peers"`
+	PeerKeys  []peerKeyConfig `mapstructure:"peer-keys"`
+}
+
+// peerKeyConfig is the CURVE public key of a peer broker, peers without one
+// are expected to share this broker's key pair.
+type peerKeyConfig struct {
+	NodeID string `mapstructure:"node-id"`
+	Key    string `mapstructure:"key"`
+}
+
+type allowedWorkersConfig struct {
+	Service string   `mapstructure:"service"`
+	Keys    []string `mapstructure:"keys"`
+}
+
+type dispatchStrategyConfig struct {
+	Service  string `mapstructure:"service"`
+	Strategy string `mapstructure:"strategy"`
 }
 
 // Config represents the configuration for the broker service.
+//
+// With PersistRequests enabled every request is written to disk when it's
+// received, again when it's dispatched, and deleted when it's answered, and
+// each of those waits for the disk to sync. PersistNoSync leaves syncing to
+// the operating system, which lifts that limit on the broker's throughput at
+// the cost of durability: requests still survive the broker crashing, but the
+// ones written shortly before the host itself fails can be lost.
 type Config struct {
 	cfg.Config
 
-	Env               string            `mapstructure:"env"`
-	Endpoint          string            `mapstructure:"endpoint"`
-	ClientEndpoint    string            `mapstructure:"client-endpoint"`
-	HeartbeatLiveness int               `mapstructure:"heartbeat-liveness"`
-	HeartbeatInterval int               `mapstructure:"heartbeat-interval"`
-	Buses             []busConfig       `mapstructure:"buses"`
-	Log               cfg.LogConfig     `mapstructure:"log"`
-	Service           cfg.ServiceConfig `mapstructure:"service"`
+	Env                string                   `mapstructure:"env"`
+	Endpoint           string                   `mapstructure:"endpoint"`
+	ClientEndpoint     string                   `mapstructure:"client-endpoint"`
+	HeartbeatLiveness  int                      `mapstructure:"heartbeat-liveness"`
+	HeartbeatInterval  int                      `mapstructure:"heartbeat-interval"`
+	PersistRequests    bool                     `mapstructure:"persist-requests"`
+	PersistPath        string                   `mapstructure:"persist-path"`
+	PersistNoSync      bool                     `mapstructure:"persist-no-sync"`
+	MaxQueueDepth      int                      `mapstructure:"max-queue-depth"`
+	MaxRequestAge      time.Duration            `mapstructure:"max-request-age"`
+	Buses              []busConfig              `mapstructure:"buses"`
+	Cluster            clusterConfig            `mapstructure:"cluster"`
+	Curve              curve.Config             `mapstructure:"curve"`
+	AllowedWorkers     []allowedWorkersConfig   `mapstructure:"allowed-workers"`
+	DispatchStrategy   string                   `mapstructure:"dispatch-strategy"`
+	DispatchStrategies []dispatchStrategyConfig `mapstructure:"dispatch-strategies"`
+	Log                cfg.LogConfig            `mapstructure:"log"`
+	Service            cfg.ServiceConfig        `mapstructure:"service"`
 }
 
 var lock = &sync.Mutex{}
@@ -38,29 +94,42 @@ var defaults = map[string]interface{}{
 	"client-endpoint":    "tcp://localhost:9797",
 	"heartbeat-liveness": 3,
 	"heartbeat-interval": 2500000,
-	"buses": []map[string]string{
+	"persist-requests":   false,
+	"persist-path":       "/var/lib/plantd/broker",
+	"persist-no-sync":    false,
+	"max-queue-depth":    0,
+	"max-request-age":    "0s",
+	"buses": []map[string]interface{}{
 		{
 			"name":     "state",
 			"frontend": "@tcp://127.0.0.1:11000",
 			"backend":  "@tcp://127.0.0.1:11001",
 			"capture":  "inproc://broker.state.pipe",
+			"snapshot": "@tcp://127.0.0.1:11002",
+			// state commands are only for the state service
+			"exclude": []string{"org.plantd.state.command"},
 		},
 		{
 			"name":     "event",
 			"frontend": "@tcp://127.0.0.1:12000",
 			"backend":  "@tcp://127.0.0.1:12001",
 			"capture":  "inproc://broker.event.pipe",
+			"snapshot": "@tcp://127.0.0.1:12002",
 		},
 		{
 			"name":     "metric",
 			"frontend": "@tcp://127.0.0.1:13000",
 			"backend":  "@tcp://127.0.0.1:13001",
 			"capture":  "inproc://broker.metric.pipe",
+			"snapshot": "@tcp://127.0.0.1:13002",
 		},
 	},
-	"log.formatter":    "text",
-	"log.level":        "info",
-	"log.loki.address": "http://localhost:3100",
+	"cluster.enabled":   false,
+	"cluster.advertise": "tcp://localhost:9797",
+	"cluster.discovery": "tcp://*:9798",
+	"log.formatter":     "text",
+	"log.level":         "info",
+	"log.loki.address":  "http://localhost:3100",
 	"log.loki.labels": map[string]string{
 		"app": "broker", "environment": "development"},
 	"service.id": "org.plantd.Broker",
@@ -2,14 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
 
 	"github.com/geoffjay/plantd/core/bus"
 	cfg "github.com/geoffjay/plantd/core/config"
+	"github.com/geoffjay/plantd/core/curve"
 	"github.com/geoffjay/plantd/core/mdp"
 	"github.com/geoffjay/plantd/core/util"
 
@@ -42,8 +45,6 @@ func NewService() *Service {
 	}
 
 	service.dumpConfig()
-	service.RegisterCallback("service", &serviceCallback{name: "service"})
-	service.RegisterCallback("services", &servicesCallback{name: "services"})
 
 	if err := service.initBroker(); err != nil {
 		log.WithFields(log.Fields{"err": err}).Error(
@@ -51,6 +52,13 @@ func NewService() *Service {
 		return nil
 	}
 
+	service.RegisterCallback("service", &serviceCallback{
+		name: "service", broker: service.broker})
+	service.RegisterCallback("services", &servicesCallback{
+		name: "services", broker: service.broker})
+	service.RegisterCallback("buses", &busesCallback{
+		name: "buses", buses: service.busInfo()})
+
 	if err := service.initWorker(); err != nil {
 		log.WithFields(log.Fields{"err": err}).Error(
 			"failed to initialize worker")
@@ -81,21 +89,101 @@ func initBuses() (buses []*bus.Bus) {
 			"backend":  b.Backend,
 			"frontend": b.Frontend,
 			"capture":  b.Capture,
+			"snapshot": b.Snapshot,
+			"record":   b.Record.Path,
 		}).Info("initializing message bus")
-		buses = append(buses, bus.NewBus(bus.Config{
-			Name:     b.Name,
-			Unit:     b.Name,
-			Backend:  b.Backend,
-			Frontend: b.Frontend,
-			Capture:  b.Capture,
-		}))
+		busConfig := bus.Config{
+			Name:       b.Name,
+			Unit:       b.Name,
+			Backend:    b.Backend,
+			Frontend:   b.Frontend,
+			Capture:    b.Capture,
+			Snapshot:   b.Snapshot,
+			Exclude:    b.Exclude,
+			StatsDepth: b.StatsDepth,
+			Curve:      &config.Curve,
+		}
+		if b.Record.Path != "" {
+			busConfig.Record = &bus.RecorderConfig{
+				Path:     b.Record.Path,
+				MaxSize:  b.Record.MaxSize,
+				MaxAge:   b.Record.MaxAge,
+				MaxFiles: b.Record.MaxFiles,
+			}
+		}
+		buses = append(buses, bus.NewBus(busConfig))
 	}
 
 	return
 }
 
+// busInfo lists the buses for the callbacks that report on them.
+func (s *Service) busInfo() []busInfo {
+	buses := make([]busInfo, 0, len(s.buses))
+	for _, b := range s.buses {
+		buses = append(buses, b)
+	}
+	return buses
+}
+
 func (s *Service) initBroker() error {
-	s.broker, _ = mdp.NewBroker(s.endpoint)
+	var err error
+	config := GetConfig()
+
+	brokerConfig := mdp.DefaultConfig()
+	brokerConfig.PersistRequests = config.PersistRequests
+	brokerConfig.PersistPath = config.PersistPath
+	brokerConfig.PersistNoSync = config.PersistNoSync
+	brokerConfig.MaxServiceQueueDepth = config.MaxQueueDepth
+	brokerConfig.MaxServiceRequestAge = config.MaxRequestAge
+	brokerConfig.ClusterMode = config.Cluster.Enabled
+	brokerConfig.ClusterNodeID = config.Cluster.NodeID
+	brokerConfig.ClusterAdvertise = config.Cluster.Advertise
+	brokerConfig.ClusterDiscovery = config.Cluster.Discovery
+	brokerConfig.ClusterPeers = config.Cluster.Peers
+	if len(config.Cluster.PeerKeys) > 0 {
+		brokerConfig.ClusterPeerKeys = make(map[string]string)
+		for _, peer := range config.Cluster.PeerKeys {
+			brokerConfig.ClusterPeerKeys[peer.NodeID] = peer.Key
+		}
+	}
+	if config.Curve != (curve.Config{}) {
+		brokerConfig.Curve = &config.Curve
+	}
+	if len(config.AllowedWorkers) > 0 {
+		brokerConfig.AllowedWorkers = make(map[string][]string)
+		for _, allowed := range config.AllowedWorkers {
+			brokerConfig.AllowedWorkers[allowed.Service] = allowed.Keys
+		}
+	}
+	if config.DispatchStrategy != "" {
+		brokerConfig.DispatchStrategy = mdp.DispatchStrategy(config.DispatchStrategy)
+	}
+	if len(config.DispatchStrategies) > 0 {
+		brokerConfig.ServiceDispatchStrategies = make(map[string]mdp.DispatchStrategy)
+		for _, dispatch := range config.DispatchStrategies {
+			brokerConfig.ServiceDispatchStrategies[dispatch.Service] = mdp.DispatchStrategy(dispatch.Strategy)
+		}
+	}
+	if brokerConfig.ClusterMode && brokerConfig.ClusterNodeID == "" {
+		// each broker in a cluster needs a unique ID, the host name is a sane default
+		if brokerConfig.ClusterNodeID, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+	if err = brokerConfig.Validate(); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("invalid broker configuration")
+		return err
+	}
+
+	if s.broker, err = mdp.NewBrokerWithConfig(s.endpoint, brokerConfig); err != nil {
+		log.WithFields(log.Fields{
+			"err":          err,
+			"persist-path": config.PersistPath,
+		}).Error("failed to create broker")
+		return err
+	}
+
 	if err := s.broker.Bind(); err != nil {
 		log.WithFields(log.Fields{
 			"err":      err,
@@ -111,8 +199,12 @@ func (s *Service) initWorker() error {
 	var err error
 	config := GetConfig()
 
-	if s.worker, err = mdp.NewWorker(config.ClientEndpoint,
-		"org.plantd.Broker"); err != nil {
+	// the worker for the broker service uses the keys of the broker itself
+	keys := config.Curve
+	keys.ServerKey = keys.PublicKey
+
+	if s.worker, err = mdp.NewWorkerWithCurve(config.ClientEndpoint,
+		"org.plantd.Broker", &keys); err != nil {
 		log.WithFields(log.Fields{
 			"err":             err,
 			"client-endpoint": config.ClientEndpoint,
@@ -177,6 +269,7 @@ func (s *Service) runHealth(ctx context.Context, wg *sync.WaitGroup) {
 			},
 		)
 		http.HandleFunc("/healthz", h.Handler)
+		http.HandleFunc("/buses", s.busesHandler)
 		if err := http.ListenAndServe(fmt.Sprintf(":%d", port),
 			nil); err != nil {
 			log.WithFields(log.Fields{"error": err}).Fatal(
@@ -189,6 +282,22 @@ func (s *Service) runHealth(ctx context.Context, wg *sync.WaitGroup) {
 	log.WithFields(log.Fields{"context": "service.run-health"}).Debug("exiting")
 }
 
+// busesHandler reports the traffic of the buses on the health server, a `bus`
+// query parameter limits it to one of them.
+func (s *Service) busesHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("bus")
+	stats := busStats(s.busInfo(), name)
+	if name != "" && len(stats) == 0 {
+		http.Error(w, fmt.Sprintf("bus %s not found", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]bus.Stats{"buses": stats}); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("failed to write bus stats")
+	}
+}
+
 func (s *Service) runBroker(ctx context.Context) {
 	done := make(chan bool, 1)
 	go s.broker.Run(done)
@@ -256,7 +365,7 @@ func (s *Service) runWorker(ctx context.Context, wg *sync.WaitGroup) {
 				}).Debug("processing message")
 				var data []byte
 				switch msgType {
-				case "services", "service":
+				case "services", "service", "buses":
 					log.Tracef("part: %s", part)
 					if data, err = s.handler.callbacks[msgType].Execute(
 						part); err != nil {
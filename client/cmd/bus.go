@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/geoffjay/plantd/core/bus"
+	"github.com/geoffjay/plantd/core/curve"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replayPath      string
+	replayEndpoint  string
+	replayFrom      string
+	replayTo        string
+	replaySpeed     float64
+	replayServerKey string
+
+	busCmd = &cobra.Command{
+		Use:   "bus",
+		Short: "Perform message bus related tasks",
+	}
+	busReplayCmd = &cobra.Command{
+		Use:   "replay <bus>",
+		Short: "Replay recorded bus messages",
+		Long: `Republish the messages a broker recorded for a bus onto a bus frontend.
+Messages are published with the spacing they were captured with, divided by
+the speed, a speed of 0 publishes them as fast as possible.`,
+		Example: `  plant bus replay metric --path /var/lib/plantd/record \
+    --endpoint ">tcp://localhost:13000" \
+    --from 2026-10-16T08:00:00Z --to 2026-10-16T08:30:00Z --speed 10`,
+		Args: cobra.ExactArgs(1),
+		Run:  replay,
+	}
+)
+
+func init() {
+	busCmd.AddCommand(busReplayCmd)
+
+	busReplayCmd.Flags().StringVar(&replayPath, "path", ".", "Directory that holds the recordings")
+	busReplayCmd.Flags().StringVar(&replayEndpoint, "endpoint", "", "Frontend of the bus to publish to")
+	busReplayCmd.Flags().StringVar(&replayFrom, "from", "", "Start of the time range (RFC 3339)")
+	busReplayCmd.Flags().StringVar(&replayTo, "to", "", "End of the time range (RFC 3339)")
+	busReplayCmd.Flags().Float64Var(&replaySpeed, "speed", 1, "Playback speed, 0 publishes as fast as possible")
+	busReplayCmd.Flags().StringVar(&replayServerKey, "server-key", "", "Public key of a bus that uses CURVE")
+
+	if err := busReplayCmd.MarkFlagRequired("endpoint"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func replay(_ *cobra.Command, args []string) {
+	from, err := parseReplayTime(replayFrom)
+	if err != nil {
+		log.Fatalf("invalid --from time: %s", err)
+	}
+	to, err := parseReplayTime(replayTo)
+	if err != nil {
+		log.Fatalf("invalid --to time: %s", err)
+	}
+
+	config := bus.ReplayConfig{
+		Path:     replayPath,
+		Name:     args[0],
+		Endpoint: replayEndpoint,
+		From:     from,
+		To:       to,
+		Speed:    replaySpeed,
+	}
+	if replayServerKey != "" {
+		// the replay connects with a throwaway key pair
+		public, secret, err := curve.GenerateKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Curve = &curve.Config{ServerKey: replayServerKey, PublicKey: public, SecretKey: secret}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	count, err := bus.Replay(ctx, config)
+	if err != nil {
+		log.Fatalf("replay stopped after %d messages: %s", count, err)
+	}
+
+	log.Printf("replayed %d messages\n", count)
+}
+
+func parseReplayTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
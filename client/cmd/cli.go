@@ -81,12 +81,14 @@ func init() {
 
 func addCommands() {
 	cliCmd.AddCommand(authCmd)
+	cliCmd.AddCommand(busCmd)
 	cliCmd.AddCommand(configCmd)
 	cliCmd.AddCommand(echoCmd)
 	// cliCmd.AddCommand(jobCmd)
 	cliCmd.AddCommand(stateCmd)
 
 	// Miscellaneous commands
+	cliCmd.AddCommand(keygenCmd)
 	cliCmd.AddCommand(versionCmd)
 }
 
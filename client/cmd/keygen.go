@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/geoffjay/plantd/core/curve"
+
+	"github.com/spf13/cobra"
+)
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a CURVE key pair",
+	Long:  `Generate a CurveZMQ key pair for a broker, worker or client configuration.`,
+	Run: func(_ *cobra.Command, _ []string) {
+		public, secret, err := curve.GenerateKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("public-key: %q\nsecret-key: %q\n", public, secret)
+	},
+}
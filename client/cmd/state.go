@@ -1,17 +1,38 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
 
 	"github.com/geoffjay/plantd/client/auth"
 	plantd "github.com/geoffjay/plantd/core/service"
+	"github.com/geoffjay/plantd/state/api"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var (
-	serviceFlag string
+	serviceFlag   string
+	watchRevision uint64
+	watchTimeout  time.Duration
+	historyLimit  uint64
+	backupName    string
+	backupDesc    string
+	schemaRemove  bool
+	casRevision   int64
+	casExpected   string
+	casDelete     bool
+	setTTL        time.Duration
+	setLease      uint64
+	leaseKeep     bool
 
 	stateCmd = &cobra.Command{
 		Use:   "state",
@@ -66,6 +87,98 @@ var (
 		Args:  cobra.NoArgs,
 		Run:   listScopes,
 	}
+	stateWatchCmd = &cobra.Command{
+		Use:   "watch [key]",
+		Short: "Watch state values for changes",
+		Long: `Print the changes of the keys in a service scope that start with the key as
+they happen, every key of the scope is watched when it's left out. Changes are
+watched until the command is interrupted.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  watch,
+	}
+	stateHistoryCmd = &cobra.Command{
+		Use:   "history",
+		Short: "Show the history of a state value",
+		Long: `Show the revisions kept of a value by key in the state management service,
+newest first, with when and by whom each was set`,
+		Args: cobra.ExactArgs(1),
+		Run:  history,
+	}
+	stateBackupCmd = &cobra.Command{
+		Use:   "backup [scope...]",
+		Short: "Back up service scopes",
+		Long: `Take a backup of service scopes in the state management service, every scope
+is backed up when none are given`,
+		Args: cobra.ArbitraryArgs,
+		Run:  backup,
+	}
+	stateRestoreCmd = &cobra.Command{
+		Use:   "restore <id> [scope...]",
+		Short: "Restore service scopes from a backup",
+		Long: `Replace service scopes with the ones in a backup, every scope of the backup
+is restored when none are given`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  restore,
+	}
+	stateBackupsCmd = &cobra.Command{
+		Use:   "backups",
+		Short: "List the backups that are kept",
+		Long:  "List the backups kept by the state management service, newest first",
+		Args:  cobra.NoArgs,
+		Run:   listBackups,
+	}
+	stateSchemaCmd = &cobra.Command{
+		Use:   "schema [pattern] [file]",
+		Short: "Show or set the schemas of a service scope",
+		Long: `Show the JSON Schemas that values of a service scope are validated against,
+every one is shown when no key pattern is given. The schema of a pattern is set
+from a file when one is given, or removed with --remove.`,
+		Args: cobra.MaximumNArgs(2),
+		Run:  schema,
+	}
+	stateBatchCmd = &cobra.Command{
+		Use:   "batch [file]",
+		Short: "Set and delete several state values at once",
+		Long: `Make the set and delete operations in a JSON file together, either all of
+them are made or none are. The file has a list of operations, each with an
+operation (set by default), key, value, and a scope when it isn't the service
+scope. Operations are read from stdin when no file is given.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  batch,
+	}
+	stateCasCmd = &cobra.Command{
+		Use:   "cas <key> [value]",
+		Short: "Compare and swap a state value",
+		Long: `Set a value by key, or delete it with --delete, only when the key is at the
+--revision or has the --expected value. A revision of 0 is a key that doesn't
+exist yet.`,
+		Args: cobra.RangeArgs(1, 2),
+		Run:  compareAndSwap,
+	}
+	stateLeaseGrantCmd = &cobra.Command{
+		Use:   "lease-grant <ttl>",
+		Short: "Grant a lease on a service scope",
+		Long: `Grant a lease that lasts for the TTL unless it's renewed, keys set with
+--lease are removed when it expires. The lease is owned by the profile that
+granted it.`,
+		Args: cobra.ExactArgs(1),
+		Run:  grantLease,
+	}
+	stateLeaseRenewCmd = &cobra.Command{
+		Use:   "lease-renew <id>",
+		Short: "Renew a lease",
+		Long: `Keep a lease for another TTL, or keep renewing it until the command is
+interrupted with --keep`,
+		Args: cobra.ExactArgs(1),
+		Run:  renewLease,
+	}
+	stateLeaseRevokeCmd = &cobra.Command{
+		Use:   "lease-revoke <id>",
+		Short: "Revoke a lease",
+		Long:  "End a lease and remove the keys that were set with it",
+		Args:  cobra.ExactArgs(1),
+		Run:   revokeLease,
+	}
 )
 
 func init() {
@@ -76,6 +189,32 @@ func init() {
 	stateCmd.AddCommand(stateCreateScopeCmd)
 	stateCmd.AddCommand(stateDeleteScopeCmd)
 	stateCmd.AddCommand(stateListScopesCmd)
+	stateCmd.AddCommand(stateWatchCmd)
+	stateCmd.AddCommand(stateHistoryCmd)
+	stateCmd.AddCommand(stateBackupCmd)
+	stateCmd.AddCommand(stateRestoreCmd)
+	stateCmd.AddCommand(stateBackupsCmd)
+	stateCmd.AddCommand(stateSchemaCmd)
+	stateCmd.AddCommand(stateBatchCmd)
+	stateCmd.AddCommand(stateCasCmd)
+	stateCmd.AddCommand(stateLeaseGrantCmd)
+	stateCmd.AddCommand(stateLeaseRenewCmd)
+	stateCmd.AddCommand(stateLeaseRevokeCmd)
+
+	stateWatchCmd.Flags().Uint64Var(&watchRevision, "revision", 0, "Revision to resume watching from, 0 for the latest")
+	stateWatchCmd.Flags().DurationVar(&watchTimeout, "timeout", 30*time.Second, "How long each watch request stays open")
+	stateHistoryCmd.Flags().Uint64Var(&historyLimit, "limit", 0, "Number of revisions to show, 0 for every one kept")
+	stateBackupCmd.Flags().StringVar(&backupName, "name", "", "Name of the backup")
+	stateBackupCmd.Flags().StringVar(&backupDesc, "description", "", "Description of the backup")
+	stateSchemaCmd.Flags().BoolVar(&schemaRemove, "remove", false, "Remove the schema of the pattern")
+	stateCasCmd.Flags().Int64Var(&casRevision, "revision", -1, "Revision the key has to be at")
+	stateCasCmd.Flags().StringVar(&casExpected, "expected", "", "Value the key has to have")
+	stateCasCmd.Flags().BoolVar(&casDelete, "delete", false, "Delete the key instead of setting it")
+	stateSetCmd.Flags().DurationVar(&setTTL, "ttl", 0, "How long until the key expires, 0 for never")
+	stateSetCmd.Flags().Uint64Var(&setLease, "lease", 0, "Lease the key expires along with")
+	stateCasCmd.Flags().DurationVar(&setTTL, "ttl", 0, "How long until the key expires, 0 for never")
+	stateCasCmd.Flags().Uint64Var(&setLease, "lease", 0, "Lease the key expires along with")
+	stateLeaseRenewCmd.Flags().BoolVar(&leaseKeep, "keep", false, "Keep renewing the lease until interrupted")
 
 	// Add flags for service scope and authentication profile
 	stateCmd.PersistentFlags().StringVar(&serviceFlag, "service", "org.plantd.Client", "Service scope for state operations")
@@ -126,16 +265,38 @@ func set(_ *cobra.Command, args []string) {
 			"key":     key,
 			"value":   value,
 		}
+		if setTTL > 0 {
+			(*request)["ttl"] = setTTL.String()
+		}
+		if setLease > 0 {
+			(*request)["lease"] = setLease
+		}
 		response, err := client.SendRawRequest("org.plantd.State", "state-set", request)
 		if err != nil {
 			return err
 		}
+		if success, _ := response["success"].(bool); !success {
+			return responseError(response)
+		}
 
 		log.Printf("%+v\n", response)
 		return nil
 	})
 }
 
+// responseError returns the error of a response that failed, each way a value
+// didn't match its schemas is printed first when that's why.
+func responseError(response map[string]interface{}) error {
+	data, _ := response["data"].(map[string]interface{})
+	problems, _ := data["errors"].([]interface{})
+	for _, value := range problems {
+		problem, _ := value.(map[string]interface{})
+		log.Printf("%s: %s (%s)\n", problem["path"], problem["message"], problem["pattern"])
+	}
+	message, _ := response["error"].(string)
+	return errors.New(message)
+}
+
 // executeWithAuth handles authentication for state operations with automatic token refresh
 func executeWithAuth(operation func(token string) error) {
 	tokenMgr := auth.NewTokenManager()
@@ -398,3 +559,470 @@ func listScopes(_ *cobra.Command, _ []string) {
 		return nil
 	})
 }
+
+func watch(_ *cobra.Command, args []string) {
+	log.Println(endpoint)
+
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		// each request stays open for a while, the next resumes from the
+		// revision the last one ended at
+		revision := watchRevision
+		for ctx.Err() == nil {
+			request := plantd.RawRequest{
+				"token":   token,       // Include authentication token
+				"service": serviceFlag, // Use configurable service flag
+				"prefix":  prefix,
+				"timeout": watchTimeout.String(),
+			}
+			if revision > 0 {
+				request["revision"] = revision
+			}
+
+			response, err := client.SendRawRequestStream("org.plantd.State", "state-watch", &request,
+				func(partial plantd.RawResponse) error {
+					revision = responseRevision(partial, revision)
+					if partial["type"] == "change" {
+						printChange(partial["change"])
+					}
+					return ctx.Err()
+				})
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if message, ok := response["error"].(string); ok && message != "" {
+				return errors.New(message)
+			}
+			if data, ok := response["data"].(map[string]interface{}); ok {
+				revision = responseRevision(data, revision)
+			}
+		}
+
+		return nil
+	})
+}
+
+// responseRevision reads the revision of a watch response, the current one is
+// kept when there isn't one.
+func responseRevision(response map[string]interface{}, current uint64) uint64 {
+	if revision, ok := response["revision"].(float64); ok && revision > 0 {
+		return uint64(revision)
+	}
+	return current
+}
+
+func printChange(value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("%+v\n", value)
+		return
+	}
+	var change api.StateChange
+	if err = json.Unmarshal(data, &change); err != nil {
+		log.Printf("%s\n", data)
+		return
+	}
+
+	switch change.Operation {
+	case api.StateSet:
+		log.Printf("[%d] set %s: %q -> %q (%s)\n", change.Revision, change.Key,
+			change.OldValue, change.NewValue, change.Actor)
+	case api.StateDelete:
+		log.Printf("[%d] delete %s: %q (%s)\n", change.Revision, change.Key,
+			change.OldValue, change.Actor)
+	default:
+		log.Printf("[%d] %s %s (%s)\n", change.Revision, change.Operation,
+			change.Scope, change.Actor)
+	}
+}
+
+func history(_ *cobra.Command, args []string) {
+	log.Println(endpoint)
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		request := &plantd.RawRequest{
+			"token":   token,       // Include authentication token
+			"service": serviceFlag, // Use configurable service flag
+			"key":     args[0],
+		}
+		if historyLimit > 0 {
+			(*request)["limit"] = historyLimit
+		}
+		response, err := client.SendRawRequest("org.plantd.State", "state-history", request)
+		if err != nil {
+			return err
+		}
+		if message, ok := response["error"].(string); ok && message != "" {
+			return errors.New(message)
+		}
+
+		data, _ := response["data"].(map[string]interface{})
+		revisions, _ := data["revisions"].([]interface{})
+		for _, value := range revisions {
+			printRevision(value)
+		}
+		return nil
+	})
+}
+
+func printRevision(value interface{}) {
+	revision, ok := value.(map[string]interface{})
+	if !ok {
+		log.Printf("%+v\n", value)
+		return
+	}
+
+	number, _ := revision["revision"].(float64)
+	modified, _ := revision["time"].(string)
+	actor, _ := revision["actor"].(string)
+	if deleted, _ := revision["deleted"].(bool); deleted {
+		log.Printf("[%d] %s deleted (%s)\n", uint64(number), modified, actor)
+		return
+	}
+	log.Printf("[%d] %s %q (%s)\n", uint64(number), modified, revision["value"], actor)
+}
+
+func backup(_ *cobra.Command, args []string) {
+	log.Println(endpoint)
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		request := &plantd.RawRequest{
+			"token":       token, // Include authentication token
+			"name":        backupName,
+			"description": backupDesc,
+			"scopes":      args,
+		}
+		response, err := client.SendRawRequest("org.plantd.State", "create_backup", request)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%+v\n", response)
+		return nil
+	})
+}
+
+func restore(_ *cobra.Command, args []string) {
+	log.Println(endpoint)
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		request := &plantd.RawRequest{
+			"token":  token, // Include authentication token
+			"id":     args[0],
+			"scopes": args[1:],
+		}
+		response, err := client.SendRawRequest("org.plantd.State", "restore_backup", request)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%+v\n", response)
+		return nil
+	})
+}
+
+func listBackups(_ *cobra.Command, _ []string) {
+	log.Println(endpoint)
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		request := &plantd.RawRequest{
+			"token": token, // Include authentication token
+		}
+		response, err := client.SendRawRequest("org.plantd.State", "list_backups", request)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%+v\n", response)
+		return nil
+	})
+}
+
+func schema(_ *cobra.Command, args []string) {
+	log.Println(endpoint)
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		request := &plantd.RawRequest{
+			"token":   token,       // Include authentication token
+			"service": serviceFlag, // Use configurable service flag
+		}
+		if len(args) > 0 {
+			(*request)["pattern"] = args[0]
+		}
+
+		// a schema request without one removes it
+		operation := "state-get-schema"
+		switch {
+		case schemaRemove && len(args) == 0:
+			return errors.New("pattern required to remove a schema")
+		case schemaRemove:
+			operation = "state-set-schema"
+		case len(args) == 2:
+			operation = "state-set-schema"
+			data, err := os.ReadFile(args[1])
+			if err != nil {
+				return err
+			}
+			var document interface{}
+			if err := json.Unmarshal(data, &document); err != nil {
+				return err
+			}
+			(*request)["schema"] = document
+		}
+
+		response, err := client.SendRawRequest("org.plantd.State", operation, request)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%+v\n", response)
+		return nil
+	})
+}
+
+func batch(_ *cobra.Command, args []string) {
+	log.Println(endpoint)
+
+	data, err := readInput(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(data, &operations); err != nil {
+		log.Fatalf("Invalid operations: %s", err)
+	}
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		request := &plantd.RawRequest{
+			"token":      token,       // Include authentication token
+			"service":    serviceFlag, // Use configurable service flag
+			"operations": operations,
+		}
+		response, err := client.SendRawRequest("org.plantd.State", "state-batch", request)
+		if err != nil {
+			return err
+		}
+		if success, _ := response["success"].(bool); !success {
+			return responseError(response)
+		}
+
+		log.Printf("%+v\n", response)
+		return nil
+	})
+}
+
+// readInput reads the file that's given, or stdin when there isn't one.
+func readInput(args []string) ([]byte, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(args[0])
+}
+
+func compareAndSwap(cmd *cobra.Command, args []string) {
+	log.Println(endpoint)
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		request := &plantd.RawRequest{
+			"token":   token,       // Include authentication token
+			"service": serviceFlag, // Use configurable service flag
+			"key":     args[0],
+		}
+		switch {
+		case casDelete:
+			(*request)["operation"] = "delete"
+		case len(args) == 2:
+			(*request)["value"] = args[1]
+		default:
+			return errors.New("value required unless the key is deleted")
+		}
+		if setTTL > 0 {
+			(*request)["ttl"] = setTTL.String()
+		}
+		if setLease > 0 {
+			(*request)["lease"] = setLease
+		}
+		if casRevision >= 0 {
+			(*request)["revision"] = casRevision
+		}
+		if cmd.Flags().Changed("expected") {
+			(*request)["expected"] = casExpected
+		}
+
+		response, err := client.SendRawRequest("org.plantd.State", "state-cas", request)
+		if err != nil {
+			return err
+		}
+		if success, _ := response["success"].(bool); !success {
+			return responseError(response)
+		}
+
+		log.Printf("%+v\n", response)
+		return nil
+	})
+}
+
+func grantLease(_ *cobra.Command, args []string) {
+	log.Println(endpoint)
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		request := &plantd.RawRequest{
+			"token":   token,       // Include authentication token
+			"service": serviceFlag, // Use configurable service flag
+			"ttl":     args[0],
+		}
+		response, err := client.SendRawRequest("org.plantd.State", "state-lease-grant", request)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%+v\n", response)
+		return nil
+	})
+}
+
+func renewLease(_ *cobra.Command, args []string) {
+	log.Println(endpoint)
+
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid lease %s", args[0])
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		request := &plantd.RawRequest{
+			"token":   token,       // Include authentication token
+			"service": serviceFlag, // Use configurable service flag
+			"lease":   id,
+		}
+		for {
+			response, err := client.SendRawRequest("org.plantd.State", "state-lease-renew", request)
+			if err != nil {
+				return err
+			}
+			if message, ok := response["error"].(string); ok && message != "" {
+				return errors.New(message)
+			}
+			log.Printf("%+v\n", response)
+			if !leaseKeep {
+				return nil
+			}
+
+			// renewed well before it expires
+			data, _ := response["data"].(map[string]interface{})
+			ttl, _ := data["ttl"].(string)
+			interval, err := time.ParseDuration(ttl)
+			if err != nil || interval <= 0 {
+				return fmt.Errorf("invalid lease TTL %s", ttl)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(interval / 3):
+			}
+		}
+	})
+}
+
+func revokeLease(_ *cobra.Command, args []string) {
+	log.Println(endpoint)
+
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid lease %s", args[0])
+	}
+
+	// Execute with authentication
+	executeWithAuth(func(token string) error {
+		client, err := plantd.NewClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		request := &plantd.RawRequest{
+			"token":   token,       // Include authentication token
+			"service": serviceFlag, // Use configurable service flag
+			"lease":   id,
+		}
+		response, err := client.SendRawRequest("org.plantd.State", "state-lease-revoke", request)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%+v\n", response)
+		return nil
+	})
+}
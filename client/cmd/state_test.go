@@ -64,6 +64,83 @@ func TestStateCommands(t *testing.T) {
 			minArgs: 0,
 			maxArgs: 0,
 		},
+		{
+			name:    "watch command",
+			cmd:     stateWatchCmd,
+			use:     "watch [key]",
+			minArgs: 0,
+			maxArgs: 1,
+		},
+		{
+			name:    "history command",
+			cmd:     stateHistoryCmd,
+			use:     "history",
+			minArgs: 1,
+			maxArgs: 1,
+		},
+		{
+			name:    "backup command",
+			cmd:     stateBackupCmd,
+			use:     "backup [scope...]",
+			minArgs: 0,
+			maxArgs: -1,
+		},
+		{
+			name:    "restore command",
+			cmd:     stateRestoreCmd,
+			use:     "restore <id> [scope...]",
+			minArgs: 1,
+			maxArgs: -1,
+		},
+		{
+			name:    "backups command",
+			cmd:     stateBackupsCmd,
+			use:     "backups",
+			minArgs: 0,
+			maxArgs: 0,
+		},
+		{
+			name:    "schema command",
+			cmd:     stateSchemaCmd,
+			use:     "schema [pattern] [file]",
+			minArgs: 0,
+			maxArgs: 2,
+		},
+		{
+			name:    "batch command",
+			cmd:     stateBatchCmd,
+			use:     "batch [file]",
+			minArgs: 0,
+			maxArgs: 1,
+		},
+		{
+			name:    "cas command",
+			cmd:     stateCasCmd,
+			use:     "cas <key> [value]",
+			minArgs: 1,
+			maxArgs: 2,
+		},
+		{
+			name:    "lease-grant command",
+			cmd:     stateLeaseGrantCmd,
+			use:     "lease-grant <ttl>",
+			minArgs: 1,
+			maxArgs: 1,
+		},
+		{
+			name:    "lease-renew command",
+			cmd:     stateLeaseRenewCmd,
+			use:     "lease-renew <id>",
+			minArgs: 1,
+			maxArgs: 1,
+		},
+		{
+			name:    "lease-revoke command",
+			cmd:     stateLeaseRevokeCmd,
+			use:     "lease-revoke <id>",
+			minArgs: 1,
+			maxArgs: 1,
+		},
 	}
 
 	for _, tt := range tests {
@@ -106,6 +183,17 @@ func TestStateCommandStructure(t *testing.T) {
 		"create-scope",
 		"delete-scope",
 		"list-scopes",
+		"watch [key]",
+		"history",
+		"backup [scope...]",
+		"restore <id> [scope...]",
+		"backups",
+		"schema [pattern] [file]",
+		"batch [file]",
+		"cas <key> [value]",
+		"lease-grant <ttl>",
+		"lease-renew <id>",
+		"lease-revoke <id>",
 	}
 
 	subcommands := stateCmd.Commands()
@@ -5,6 +5,7 @@ go 1.24
 require (
 	github.com/geoffjay/plantd/core v0.0.0-20250608040042-47ac2c0f29bb
 	github.com/geoffjay/plantd/identity v0.0.0-20250616210328-5317820bc755
+	github.com/geoffjay/plantd/state v0.0.0-00010101000000-000000000000
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/cobra v1.3.0
 	github.com/spf13/viper v1.10.1
@@ -49,4 +50,7 @@ require (
 	gorm.io/gorm v1.30.0 // indirect
 )
 
-replace github.com/geoffjay/plantd/identity => ../identity
+replace (
+	github.com/geoffjay/plantd/identity => ../identity
+	github.com/geoffjay/plantd/state => ../state
+)
@@ -4,9 +4,12 @@ package bus
 import (
 	"context"
 	"errors"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/geoffjay/plantd/core/curve"
+
 	log "github.com/sirupsen/logrus"
 	czmq "github.com/zeromq/goczmq/v4"
 )
@@ -18,6 +21,13 @@ type Bus struct {
 	backend  string
 	frontend string
 	capture  string
+	snapshot string
+	curve    *curve.Config
+	cache    *lastValueCache
+	record   *RecorderConfig
+	recorder *Recorder
+	exclude  []string
+	stats    *busStats
 }
 
 // Config holds configuration parameters for creating a new Bus.
@@ -27,6 +37,23 @@ type Config struct {
 	Backend  string
 	Frontend string
 	Capture  string
+	// Snapshot is the endpoint of a ROUTER socket that answers sinks asking
+	// for the last value of the topics they subscribe to, it's optional and
+	// needs a capture endpoint to have values to return.
+	Snapshot string
+	// Record writes every captured message to rotating files that can be
+	// replayed later, it's optional and needs a capture endpoint.
+	Record *RecorderConfig
+	// Exclude lists the prefixes of the topics that aren't kept in the last
+	// value cache or recorded, for messages that mustn't be handed to sinks
+	// that join later or be written to disk.
+	Exclude []string
+	// StatsDepth is the number of topic segments that traffic is counted by,
+	// DefaultStatsDepth is used when it's zero.
+	StatsDepth int
+	// Curve enables CURVE encryption on the frontend and backend, sources and
+	// sinks then need the public key of the bus as their server key.
+	Curve *curve.Config
 }
 
 // NewBus instantiates a new PUB/SUB bus type.
@@ -37,9 +64,37 @@ func NewBus(config Config) *Bus {
 		backend:  config.Backend,
 		frontend: config.Frontend,
 		capture:  config.Capture,
+		snapshot: config.Snapshot,
+		curve:    config.Curve,
+		cache:    newLastValueCache(),
+		record:   config.Record,
+		exclude:  config.Exclude,
+		stats:    newBusStats(config.StatsDepth),
 	}
 }
 
+// Name returns the name of the bus.
+func (b *Bus) Name() string {
+	return b.name
+}
+
+// Stats returns the traffic that has passed through the bus, messages are only
+// counted when the bus has a capture endpoint.
+func (b *Bus) Stats() Stats {
+	return b.stats.snapshot(b.name)
+}
+
+// Snapshot returns the last message published on every topic that starts with
+// the prefix, it's empty when the bus has no capture endpoint.
+func (b *Bus) Snapshot(prefix string) []*Message {
+	return b.cache.snapshot(prefix)
+}
+
+// LastValue returns the last message published on a topic.
+func (b *Bus) LastValue(topic string) (*Message, bool) {
+	return b.cache.get(topic)
+}
+
 // captureThread is used to monitor traffic on a bus for debugging.
 // FIXME: This is currently here to test keeping the socket alive.
 func (b *Bus) captureThread(done chan bool) {
@@ -116,6 +171,24 @@ func (b *Bus) Run(done chan bool) {
 func (b *Bus) Start(ctx context.Context, wg *sync.WaitGroup) error {
 	defer wg.Done()
 
+	b.stats.setRunning(true)
+	defer b.stats.setRunning(false)
+
+	if b.capture != "" {
+		capture, snapshot, err := b.openCapture()
+		if err != nil {
+			return err
+		}
+
+		captureCtx, cancelCapture := context.WithCancel(ctx)
+		captured := make(chan struct{})
+		go b.runCapture(captureCtx, capture, snapshot, captured)
+		defer func() {
+			cancelCapture()
+			<-captured
+		}()
+	}
+
 	done := make(chan bool)
 	errc := make(chan error)
 
@@ -149,6 +222,18 @@ func (b *Bus) Start(ctx context.Context, wg *sync.WaitGroup) error {
 		}
 		log.WithFields(fields).Info("backend connected")
 
+		if b.curve.Enabled() {
+			if err = proxy.SetFrontendCurve(b.curve.PublicKey, b.curve.SecretKey); err != nil {
+				log.WithFields(fields).Error("failed to enable curve on frontend")
+				errc <- err
+			}
+			if err = proxy.SetBackendCurve(b.curve.PublicKey, b.curve.SecretKey); err != nil {
+				log.WithFields(fields).Error("failed to enable curve on backend")
+				errc <- err
+			}
+			log.WithFields(fields).Info("curve enabled")
+		}
+
 		if err = proxy.SetCapture(b.capture); err != nil {
 			log.WithFields(fields).Error("failed to connect capture to proxy")
 			errc <- err
@@ -173,3 +258,184 @@ func (b *Bus) Start(ctx context.Context, wg *sync.WaitGroup) error {
 		}
 	}
 }
+
+// openCapture binds the sockets that receive the messages passing through the
+// proxy and that answer snapshot requests, the capture socket has to exist
+// before the proxy connects to it.
+func (b *Bus) openCapture() (capture, snapshot *czmq.Sock, err error) {
+	fields := log.Fields{
+		"bus":      b.name,
+		"capture":  b.capture,
+		"snapshot": b.snapshot,
+	}
+
+	if capture, err = czmq.NewPull(b.capture); err != nil {
+		log.WithFields(fields).Error("failed to bind capture socket")
+		return nil, nil, err
+	}
+
+	if b.snapshot != "" {
+		if snapshot, err = czmq.NewRouter(b.snapshot, b.curve.ServerOptions()...); err != nil {
+			log.WithFields(fields).Error("failed to bind snapshot socket")
+			capture.Destroy()
+			return nil, nil, err
+		}
+		log.WithFields(fields).Info("snapshot connected")
+	}
+
+	if b.record != nil && b.record.Path != "" {
+		if b.recorder, err = NewRecorder(b.name, *b.record); err != nil {
+			log.WithFields(fields).Error("failed to create recorder")
+			capture.Destroy()
+			if snapshot != nil {
+				snapshot.Destroy()
+			}
+			return nil, nil, err
+		}
+		log.WithFields(fields).WithField("path", b.record.Path).Info("recording captured messages")
+	}
+
+	return capture, snapshot, nil
+}
+
+// runCapture keeps the last value cache up to date with the messages captured
+// from the proxy and answers snapshot requests from it.
+func (b *Bus) runCapture(ctx context.Context, capture, snapshot *czmq.Sock, done chan<- struct{}) {
+	defer close(done)
+	defer capture.Destroy()
+	if snapshot != nil {
+		defer snapshot.Destroy()
+	}
+	if b.recorder != nil {
+		defer func() {
+			if err := b.recorder.Close(); err != nil {
+				log.WithFields(log.Fields{"bus": b.name, "error": err}).Warn("failed to close recorder")
+			}
+		}()
+	}
+
+	poller, err := czmq.NewPoller(capture)
+	if err != nil {
+		log.WithFields(log.Fields{"bus": b.name, "error": err}).Error("failed to create capture poller")
+		return
+	}
+	defer poller.Destroy()
+
+	if snapshot != nil {
+		if err = poller.Add(snapshot); err != nil {
+			log.WithFields(log.Fields{"bus": b.name, "error": err}).Error("failed to poll snapshot socket")
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"bus": b.name}).Debug("capture ended")
+			return
+		default:
+		}
+
+		socket, err := poller.Wait(250)
+		if err != nil {
+			log.WithFields(log.Fields{"bus": b.name, "error": err}).Error("capture poller failed")
+			return
+		}
+		if socket == nil {
+			continue
+		}
+
+		frames, err := socket.RecvMessage()
+		if err != nil {
+			log.WithFields(log.Fields{"bus": b.name, "error": err}).Warn("failed to receive capture")
+			continue
+		}
+
+		if socket == snapshot {
+			b.sendSnapshot(snapshot, frames)
+			continue
+		}
+
+		if b.stats.subscription(frames) {
+			continue
+		}
+		b.captured(frames)
+	}
+}
+
+// captured counts, records and caches a message that passed through the
+// proxy, messages on excluded topics are only counted.
+func (b *Bus) captured(frames [][]byte) {
+	size := 0
+	for _, frame := range frames {
+		size += len(frame)
+	}
+
+	message, err := ParseMessage(frames)
+	if err == nil && b.excluded(message.Topic) {
+		b.stats.message(message.Topic, size)
+		return
+	}
+
+	if b.recorder != nil {
+		if recordErr := b.recorder.Record(frames); recordErr != nil {
+			log.WithFields(log.Fields{"bus": b.name, "error": recordErr}).Warn("failed to record message")
+		}
+	}
+
+	if err != nil {
+		b.stats.message("", size)
+		log.WithFields(log.Fields{"bus": b.name, "error": err}).Trace("captured invalid message")
+		return
+	}
+	b.stats.message(message.Topic, size)
+	b.cache.update(message)
+}
+
+// excluded returns whether a topic is kept out of the cache and recordings.
+func (b *Bus) excluded(topic string) bool {
+	for _, prefix := range b.exclude {
+		if strings.HasPrefix(topic, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendSnapshot replies to a snapshot request with the cached value of every
+// topic that matches the requested prefix.
+func (b *Bus) sendSnapshot(socket *czmq.Sock, request [][]byte) {
+	if len(request) < 2 || string(request[1]) != SnapshotRequest {
+		log.WithFields(log.Fields{"bus": b.name}).Warn("received invalid snapshot request")
+		return
+	}
+
+	identity := request[0]
+	prefix := ""
+	if len(request) > 2 {
+		prefix = string(request[2])
+	}
+
+	messages := b.cache.snapshot(prefix)
+	for _, message := range messages {
+		frames, err := message.Frames()
+		if err != nil {
+			continue
+		}
+		if err = socket.SendMessage(append([][]byte{identity}, frames...)); err != nil {
+			log.WithFields(log.Fields{"bus": b.name, "error": err}).Error("failed to send snapshot")
+			return
+		}
+	}
+
+	if err := socket.SendMessage([][]byte{identity, []byte(SnapshotEnd), []byte(prefix)}); err != nil {
+		log.WithFields(log.Fields{"bus": b.name, "error": err}).Error("failed to send snapshot")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"bus":      b.name,
+		"prefix":   prefix,
+		"messages": len(messages),
+	}).Debug("sent snapshot")
+}
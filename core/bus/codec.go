@@ -0,0 +1,116 @@
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// ContentTypeMsgpack is the content type of messages with a MessagePack
+	// body.
+	ContentTypeMsgpack = "application/msgpack"
+	// ContentTypeProtobuf is the content type of messages with a protobuf body.
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Codec encodes and decodes the body of typed messages.
+type Codec interface {
+	ContentType() string
+	Marshal(value any) ([]byte, error)
+	Unmarshal(data []byte, value any) error
+}
+
+var (
+	// JSONCodec encodes bodies as JSON.
+	JSONCodec Codec = jsonCodec{}
+	// MsgpackCodec encodes bodies as MessagePack, struct fields are named by
+	// their `codec` or `json` tags.
+	MsgpackCodec Codec = msgpackCodec{}
+	// ProtobufCodec encodes bodies as protobuf, values have to be generated
+	// protobuf messages.
+	ProtobufCodec Codec = protobufCodec{}
+
+	codecs = map[string]Codec{
+		ContentTypeJSON:     JSONCodec,
+		ContentTypeMsgpack:  MsgpackCodec,
+		ContentTypeProtobuf: ProtobufCodec,
+	}
+
+	msgpackHandle = &codec.MsgpackHandle{}
+)
+
+// CodecFor returns the codec of a content type.
+func CodecFor(contentType string) (Codec, bool) {
+	c, ok := codecs[contentType]
+	return c, ok
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(value any) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value any) error {
+	return json.Unmarshal(data, value)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (msgpackCodec) Marshal(value any) ([]byte, error) {
+	var data []byte
+	err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(value)
+	return data, err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, value any) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(value)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protobufCodec) Marshal(value any) ([]byte, error) {
+	message, ok := value.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", value)
+	}
+	return proto.Marshal(message)
+}
+
+func (protobufCodec) Unmarshal(data []byte, value any) error {
+	if message, ok := value.(proto.Message); ok {
+		return proto.Unmarshal(data, message)
+	}
+
+	// a subscriber of a message type decodes into a pointer to a nil message,
+	// which needs to be allocated first
+	target := reflect.ValueOf(value)
+	if target.Kind() == reflect.Pointer && target.Elem().Kind() == reflect.Pointer {
+		allocated := reflect.New(target.Elem().Type().Elem())
+		if message, ok := allocated.Interface().(proto.Message); ok {
+			if err := proto.Unmarshal(data, message); err != nil {
+				return err
+			}
+			target.Elem().Set(allocated)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%T is not a protobuf message", value)
+}
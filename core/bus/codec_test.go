@@ -0,0 +1,59 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodecFor(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec, ProtobufCodec} {
+		found, ok := CodecFor(codec.ContentType())
+		require.True(t, ok)
+		assert.Equal(t, codec, found)
+	}
+
+	_, ok := CodecFor("text/plain")
+	assert.False(t, ok)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	metric := Metric{
+		Time:    time.Now().UTC().Truncate(time.Millisecond),
+		Device:  "pump-1",
+		Channel: "pressure",
+		Value:   101.3,
+		Units:   "kPa",
+	}
+
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			data, err := codec.Marshal(metric)
+			require.NoError(t, err)
+
+			var decoded Metric
+			require.NoError(t, codec.Unmarshal(data, &decoded))
+			assert.Equal(t, metric.Device, decoded.Device)
+			assert.Equal(t, metric.Channel, decoded.Channel)
+			assert.InDelta(t, metric.Value, decoded.Value, 0.0001)
+			assert.True(t, metric.Time.Equal(decoded.Time))
+		})
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	data, err := ProtobufCodec.Marshal(wrapperspb.Double(101.3))
+	require.NoError(t, err)
+
+	// a nil message pointer is allocated
+	var decoded *wrapperspb.DoubleValue
+	require.NoError(t, ProtobufCodec.Unmarshal(data, &decoded))
+	assert.InDelta(t, 101.3, decoded.GetValue(), 0.0001)
+
+	_, err = ProtobufCodec.Marshal(Metric{})
+	assert.Error(t, err)
+	assert.Error(t, ProtobufCodec.Unmarshal(data, &Metric{}))
+}
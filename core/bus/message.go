@@ -0,0 +1,99 @@
+package bus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ContentTypeJSON is the content type of messages with a JSON body.
+const ContentTypeJSON = "application/json"
+
+// Message is a single message on a bus. It's sent as three frames, the topic
+// that subscribers filter on, the header encoded as JSON, and the body.
+type Message struct {
+	Topic  string
+	Header Header
+	Body   []byte
+}
+
+// Header holds the metadata of a message.
+type Header struct {
+	ContentType string    `json:"content_type,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	SourceID    string    `json:"source_id,omitempty"`
+	Sequence    uint64    `json:"sequence"`
+}
+
+var errEmptyMessage = errors.New("message has no frames")
+
+// NewMessage creates a message for a topic, the header is completed by the
+// source that publishes it.
+func NewMessage(topic string, body []byte) *Message {
+	return &Message{
+		Topic: topic,
+		Body:  body,
+	}
+}
+
+// Frames encodes the message for sending.
+func (m *Message) Frames() ([][]byte, error) {
+	header, err := json.Marshal(m.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode message header: %w", err)
+	}
+	return [][]byte{[]byte(m.Topic), header, m.Body}, nil
+}
+
+// ParseMessage decodes the frames of a received message. Messages from
+// sources that prepend the topic to the body in a single frame are still
+// accepted, for those the topic is everything before the start of the JSON
+// body and the header is empty.
+func ParseMessage(frames [][]byte) (*Message, error) {
+	switch len(frames) {
+	case 0:
+		return nil, errEmptyMessage
+	case 1:
+		return parseLegacyMessage(frames[0]), nil
+	case 3:
+		message := &Message{
+			Topic: string(frames[0]),
+			Body:  frames[2],
+		}
+		if err := json.Unmarshal(frames[1], &message.Header); err != nil {
+			return nil, fmt.Errorf("failed to decode message header: %w", err)
+		}
+		return message, nil
+	default:
+		return nil, fmt.Errorf("message has %d frames, expected 3", len(frames))
+	}
+}
+
+// parseLegacyMessage splits a single frame message into topic and body.
+func parseLegacyMessage(frame []byte) *Message {
+	index := bytes.IndexAny(frame, "{[")
+	if index < 0 {
+		return &Message{Body: frame}
+	}
+	return &Message{
+		Topic: string(frame[:index]),
+		Body:  frame[index:],
+	}
+}
+
+// sourceCount numbers the sources of a process so that their default IDs
+// differ, each source keeps its own sequence numbers.
+var sourceCount atomic.Uint64
+
+// defaultSourceID identifies a source when it hasn't been given an ID.
+func defaultSourceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), sourceCount.Add(1))
+}
@@ -0,0 +1,59 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageFrames(t *testing.T) {
+	message := NewMessage("org.plantd.metric", []byte(`{"value":1}`))
+	message.Header = Header{
+		ContentType: ContentTypeJSON,
+		Timestamp:   time.Now().UTC(),
+		SourceID:    "source-001",
+		Sequence:    42,
+	}
+
+	frames, err := message.Frames()
+	require.NoError(t, err)
+	require.Len(t, frames, 3)
+	assert.Equal(t, []byte("org.plantd.metric"), frames[0])
+
+	parsed, err := ParseMessage(frames)
+	require.NoError(t, err)
+	assert.Equal(t, message.Topic, parsed.Topic)
+	assert.Equal(t, message.Body, parsed.Body)
+	assert.Equal(t, message.Header.ContentType, parsed.Header.ContentType)
+	assert.Equal(t, message.Header.SourceID, parsed.Header.SourceID)
+	assert.Equal(t, message.Header.Sequence, parsed.Header.Sequence)
+	assert.True(t, message.Header.Timestamp.Equal(parsed.Header.Timestamp))
+}
+
+func TestParseMessage(t *testing.T) {
+	t.Run("Legacy", func(t *testing.T) {
+		parsed, err := ParseMessage([][]byte{[]byte(`org.plantd.Metric{"value":1}`)})
+		require.NoError(t, err)
+		assert.Equal(t, "org.plantd.Metric", parsed.Topic)
+		assert.Equal(t, []byte(`{"value":1}`), parsed.Body)
+		assert.Equal(t, Header{}, parsed.Header)
+	})
+
+	t.Run("LegacyWithoutJSON", func(t *testing.T) {
+		parsed, err := ParseMessage([][]byte{[]byte("hello")})
+		require.NoError(t, err)
+		assert.Empty(t, parsed.Topic)
+		assert.Equal(t, []byte("hello"), parsed.Body)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := ParseMessage(nil)
+		assert.Error(t, err)
+		_, err = ParseMessage([][]byte{[]byte("topic"), []byte("body")})
+		assert.Error(t, err)
+		_, err = ParseMessage([][]byte{[]byte("topic"), []byte("header"), []byte("body")})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,326 @@
+package bus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geoffjay/plantd/core/curve"
+
+	log "github.com/sirupsen/logrus"
+	czmq "github.com/zeromq/goczmq/v4"
+)
+
+const (
+	// DefaultRecordMaxSize is the size a recording grows to before it's
+	// rotated.
+	DefaultRecordMaxSize = 64 * 1024 * 1024
+	// DefaultRecordMaxAge is how long a recording is written to before it's
+	// rotated.
+	DefaultRecordMaxAge = time.Hour
+
+	recordExtension  = ".jsonl"
+	recordTimeLayout = "20060102T150405.000000000Z"
+)
+
+// Record is a captured message as it's stored in a recording.
+type Record struct {
+	Time   time.Time `json:"time"`
+	Topic  string    `json:"topic"`
+	Frames [][]byte  `json:"frames"`
+}
+
+// RecorderConfig holds the configuration of a bus recorder.
+type RecorderConfig struct {
+	// Path is the directory the recordings are written to.
+	Path string
+	// MaxSize is the number of bytes written to a file before it's rotated.
+	MaxSize int64
+	// MaxAge is how long a file is written to before it's rotated.
+	MaxAge time.Duration
+	// MaxFiles is the number of files that are kept, the oldest are removed
+	// first. Zero keeps all of them.
+	MaxFiles int
+}
+
+// Recorder writes captured messages to rotating files. Every file is named
+// after the bus and the time of its first record, which is what's used to find
+// the files that cover a time range when they're read back.
+type Recorder struct {
+	name    string
+	config  RecorderConfig
+	mu      sync.Mutex
+	file    *os.File
+	opened  time.Time
+	written int64
+}
+
+// NewRecorder creates a recorder for the messages of a bus.
+func NewRecorder(name string, config RecorderConfig) (*Recorder, error) {
+	if config.Path == "" {
+		return nil, errors.New("recorder path is required")
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultRecordMaxSize
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = DefaultRecordMaxAge
+	}
+	if err := os.MkdirAll(config.Path, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create recorder path: %w", err)
+	}
+
+	return &Recorder{name: name, config: config}, nil
+}
+
+// Record writes the frames of a captured message with the time it was
+// captured.
+func (r *Recorder) Record(frames [][]byte) error {
+	record := &Record{Time: time.Now().UTC(), Frames: frames}
+	if message, err := ParseMessage(frames); err == nil {
+		record.Topic = message.Topic
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err = r.rotate(record.Time); err != nil {
+		return err
+	}
+
+	n, err := r.file.Write(line)
+	r.written += int64(n)
+
+	return err
+}
+
+// Close closes the file that's being written.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+
+	return err
+}
+
+// rotate starts a new file when there's none open or the current one is too
+// large or too old.
+func (r *Recorder) rotate(now time.Time) error {
+	if r.file != nil && r.written < r.config.MaxSize && now.Sub(r.opened) < r.config.MaxAge {
+		return nil
+	}
+
+	if r.file != nil {
+		if err := r.file.Close(); err != nil {
+			log.WithFields(log.Fields{"bus": r.name, "error": err}).Warn("failed to close recording")
+		}
+	}
+
+	filename := filepath.Join(r.config.Path, recordFilename(r.name, now))
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		r.file = nil
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+
+	r.file = file
+	r.opened = now
+	r.written = 0
+	log.WithFields(log.Fields{"bus": r.name, "file": filename}).Debug("started recording")
+
+	r.prune()
+
+	return nil
+}
+
+// prune removes the oldest files when there are more than the configured
+// number.
+func (r *Recorder) prune() {
+	if r.config.MaxFiles <= 0 {
+		return
+	}
+
+	files, err := recordFiles(r.config.Path, r.name)
+	if err != nil || len(files) <= r.config.MaxFiles {
+		return
+	}
+
+	for _, file := range files[:len(files)-r.config.MaxFiles] {
+		if err = os.Remove(file.path); err != nil {
+			log.WithFields(log.Fields{"bus": r.name, "error": err}).Warn("failed to remove recording")
+		}
+	}
+}
+
+type recordFile struct {
+	path  string
+	start time.Time
+}
+
+func recordFilename(name string, start time.Time) string {
+	return fmt.Sprintf("%s-%s%s", name, start.UTC().Format(recordTimeLayout), recordExtension)
+}
+
+// recordFiles lists the recordings of a bus ordered by their start time.
+func recordFiles(dir, name string) ([]recordFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := name + "-"
+	files := make([]recordFile, 0)
+	for _, entry := range entries {
+		filename := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(filename, prefix) || !strings.HasSuffix(filename, recordExtension) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filename, prefix), recordExtension)
+		start, err := time.Parse(recordTimeLayout, stamp)
+		if err != nil {
+			continue
+		}
+		files = append(files, recordFile{path: filepath.Join(dir, filename), start: start})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].start.Before(files[j].start)
+	})
+
+	return files, nil
+}
+
+// ReadRecords reads the recorded messages of a bus that were captured between
+// from and to, a zero time leaves that end of the range open.
+func ReadRecords(dir, name string, from, to time.Time, fn func(record *Record) error) error {
+	files, err := recordFiles(dir, name)
+	if err != nil {
+		return err
+	}
+
+	for i, file := range files {
+		// files that end before the range starts or begin after it ends are skipped
+		if i+1 < len(files) && !from.IsZero() && !files[i+1].start.After(from) {
+			continue
+		}
+		if !to.IsZero() && file.start.After(to) {
+			break
+		}
+		if err = readRecordFile(file.path, from, to, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readRecordFile(path string, from, to time.Time, fn func(record *Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := &Record{}
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			log.WithFields(log.Fields{"file": path, "error": err}).Warn("skipping invalid record")
+			continue
+		}
+		if !from.IsZero() && record.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && record.Time.After(to) {
+			return nil
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// ReplayConfig holds the parameters of a replay.
+type ReplayConfig struct {
+	// Path is the directory that holds the recordings.
+	Path string
+	// Name is the name of the bus that was recorded.
+	Name string
+	// Endpoint is the frontend of the bus to publish to.
+	Endpoint string
+	// From and To select the time range to replay, a zero time leaves that end
+	// of the range open.
+	From time.Time
+	To   time.Time
+	// Speed multiplies the rate messages are published at, 1 replays them in
+	// real time and zero or less publishes them as fast as possible.
+	Speed float64
+	// Curve holds the keys to connect to an encrypted bus.
+	Curve *curve.Config
+}
+
+// Replay publishes recorded messages onto a bus with the same spacing they
+// were captured with, scaled by the speed. It returns the number of messages
+// that were published.
+func Replay(ctx context.Context, config ReplayConfig) (int, error) {
+	publisher, err := czmq.NewPub(config.Endpoint, config.Curve.ClientOptions()...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to bus: %w", err)
+	}
+	defer publisher.Destroy()
+
+	// give the connection a moment so the first messages aren't lost
+	time.Sleep(250 * time.Millisecond)
+
+	var first time.Time
+	var started time.Time
+	count := 0
+
+	err = ReadRecords(config.Path, config.Name, config.From, config.To, func(record *Record) error {
+		if first.IsZero() {
+			first = record.Time
+			started = time.Now()
+		}
+
+		if config.Speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(first)) / config.Speed)
+			select {
+			case <-time.After(time.Until(started.Add(offset))):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err := publisher.SendMessage(record.Frames); err != nil {
+			return fmt.Errorf("failed to publish record: %w", err)
+		}
+		count++
+
+		return nil
+	})
+
+	return count, err
+}
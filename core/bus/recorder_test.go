@@ -0,0 +1,90 @@
+package bus
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func recordMessage(t *testing.T, recorder *Recorder, topic string) {
+	t.Helper()
+
+	frames, err := NewMessage(topic, []byte(`{"value":1}`)).Frames()
+	require.NoError(t, err)
+	require.NoError(t, recorder.Record(frames))
+}
+
+func TestNewRecorder(t *testing.T) {
+	_, err := NewRecorder("metric", RecorderConfig{})
+	assert.Error(t, err)
+
+	recorder, err := NewRecorder("metric", RecorderConfig{Path: t.TempDir()})
+	require.NoError(t, err)
+	assert.Equal(t, int64(DefaultRecordMaxSize), recorder.config.MaxSize)
+	assert.Equal(t, DefaultRecordMaxAge, recorder.config.MaxAge)
+	assert.NoError(t, recorder.Close())
+}
+
+func TestRecorderReadRecords(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder("metric", RecorderConfig{Path: dir})
+	require.NoError(t, err)
+
+	recordMessage(t, recorder, "org.plantd.metric.a")
+	middle := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	recordMessage(t, recorder, "org.plantd.metric.b")
+	recordMessage(t, recorder, "org.plantd.metric.c")
+	require.NoError(t, recorder.Close())
+
+	var topics []string
+	err = ReadRecords(dir, "metric", time.Time{}, time.Time{}, func(record *Record) error {
+		topics = append(topics, record.Topic)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"org.plantd.metric.a", "org.plantd.metric.b", "org.plantd.metric.c"}, topics)
+
+	topics = nil
+	err = ReadRecords(dir, "metric", middle, time.Time{}, func(record *Record) error {
+		topics = append(topics, record.Topic)
+		assert.Len(t, record.Frames, 3)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"org.plantd.metric.b", "org.plantd.metric.c"}, topics)
+
+	topics = nil
+	err = ReadRecords(dir, "metric", time.Time{}, middle, func(record *Record) error {
+		topics = append(topics, record.Topic)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"org.plantd.metric.a"}, topics)
+}
+
+func TestRecorderRotate(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder("state", RecorderConfig{Path: dir, MaxSize: 1, MaxFiles: 2})
+	require.NoError(t, err)
+
+	for range 4 {
+		recordMessage(t, recorder, "org.plantd.state")
+	}
+	require.NoError(t, recorder.Close())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	count := 0
+	err = ReadRecords(dir, "state", time.Time{}, time.Time{}, func(_ *Record) error {
+		count++
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
@@ -0,0 +1,42 @@
+package bus
+
+import "time"
+
+const (
+	// MetricTopic is the topic template of metrics.
+	MetricTopic = "org.plantd.metric.<device>.<channel>"
+	// EventTopic is the topic template of events.
+	EventTopic = "org.plantd.event.<source>.<name>"
+)
+
+// Metric is a single measurement of a device channel, it's published on the
+// metric bus with MetricTopic.
+type Metric struct {
+	Time    time.Time `json:"time"`
+	Device  string    `json:"device"`
+	Channel string    `json:"channel"`
+	Value   float64   `json:"value"`
+	Units   string    `json:"units,omitempty"`
+	Tags    []string  `json:"tags,omitempty"`
+}
+
+// Params returns the topic parameters of the metric.
+func (m Metric) Params() TopicParams {
+	return TopicParams{"device": m.Device, "channel": m.Channel}
+}
+
+// Event is something that happened in a service or device, it's published on
+// the event bus with EventTopic.
+type Event struct {
+	Time     time.Time         `json:"time"`
+	Source   string            `json:"source"`
+	Name     string            `json:"name"`
+	Severity string            `json:"severity,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+// Params returns the topic parameters of the event.
+func (e Event) Params() TopicParams {
+	return TopicParams{"source": e.Source, "name": e.Name}
+}
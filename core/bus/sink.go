@@ -3,6 +3,10 @@ package bus
 import (
 	"context"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/geoffjay/plantd/core/curve"
 
 	log "github.com/sirupsen/logrus"
 	czmq "github.com/zeromq/goczmq/v4"
@@ -10,10 +14,17 @@ import (
 
 // Sink type to function as a bus subscriber device.
 type Sink struct {
-	endpoint string
-	filter   string
-	running  bool
-	handler  *SinkHandler
+	endpoint        string
+	filter          string
+	running         bool
+	handler         *SinkHandler
+	curve           *curve.Config
+	snapshot        string
+	snapshotTimeout time.Duration
+	sequences       *sequenceTracker
+	gaps            atomic.Uint64
+	mu              sync.Mutex
+	cancel          context.CancelFunc
 }
 
 // SinkHandler defines the type of a callback.
@@ -21,17 +32,39 @@ type SinkHandler struct {
 	Callback SinkCallback
 }
 
-// SinkCallback defines an interface for a callback handler.
+// SinkCallback defines an interface for a callback handler, it receives each
+// message with the topic and header separated from the body.
 type SinkCallback interface {
-	Handle(data []byte) error
+	Handle(message *Message) error
+}
+
+// GapCallback can be implemented by a SinkCallback to be told when messages
+// have been missed.
+type GapCallback interface {
+	HandleGap(gap *Gap)
+}
+
+// Gap describes messages from a source on a topic that were never received.
+type Gap struct {
+	Topic    string
+	SourceID string
+	Expected uint64
+	Received uint64
+}
+
+// Missed is the number of messages that were lost.
+func (g *Gap) Missed() uint64 {
+	return g.Received - g.Expected
 }
 
 // NewSink constructs an instance of a message bus sink.
 func NewSink(endpoint, filter string) *Sink {
 	return &Sink{
-		endpoint: endpoint,
-		filter:   filter,
-		running:  false,
+		endpoint:        endpoint,
+		filter:          filter,
+		running:         false,
+		snapshotTimeout: DefaultSnapshotTimeout,
+		sequences:       newSequenceTracker(),
 	}
 }
 
@@ -46,6 +79,25 @@ func (s *Sink) defaultFields(err error) log.Fields {
 	return fields
 }
 
+// SetCurve sets the CURVE keys used to connect to the bus, this must be done
+// before the sink is run.
+func (s *Sink) SetCurve(keys *curve.Config) {
+	s.curve = keys
+}
+
+// SetSnapshot sets the snapshot endpoint of the bus, when it's set the sink
+// asks for the last value of every topic that matches its filter before it
+// handles any other message. This must be done before the sink is run.
+func (s *Sink) SetSnapshot(endpoint string, timeout time.Duration) {
+	s.snapshot = endpoint
+	s.snapshotTimeout = timeout
+}
+
+// Gaps returns the number of messages the sink has missed.
+func (s *Sink) Gaps() uint64 {
+	return s.gaps.Load()
+}
+
 // SetHandler sets the message handler for the sink to use.
 func (s *Sink) SetHandler(handler *SinkHandler) {
 	s.handler = handler
@@ -59,7 +111,14 @@ func (s *Sink) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	defer wg.Done()
 
-	if subscriber, err = czmq.NewSub(s.endpoint, s.filter); err != nil {
+	// Stop ends the run through this context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	if subscriber, err = czmq.NewSub(s.endpoint, s.filter, s.curve.ClientOptions()...); err != nil {
 		log.WithFields(s.defaultFields(err)).Panic("subscriber create")
 	}
 	log.WithFields(s.defaultFields(nil)).Debug("created message queue sink socket")
@@ -76,9 +135,17 @@ func (s *Sink) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 	log.Debug("successfully added subscriber to poller")
 
+	// the subscription is already queueing messages, anything that's also in
+	// the snapshot is dropped as a duplicate when it's received
+	if s.snapshot != "" {
+		s.loadSnapshot()
+	}
+
 	s.running = true
 
+	handled := make(chan struct{})
 	go func() {
+		defer close(handled)
 		for s.running {
 			log.WithFields(log.Fields{"socket": s.endpoint}).Trace("waiting for data...")
 			socket, err := poller.Wait(1000)
@@ -92,30 +159,143 @@ func (s *Sink) Run(ctx context.Context, wg *sync.WaitGroup) {
 			}
 
 			log.Trace("poller received data")
-			data, _, rerr := socket.RecvFrame()
-			// TODO while more flag (_) is set
+			frames, rerr := socket.RecvMessage()
 			if rerr != nil {
 				log.Error(rerr)
 				continue
 			}
-			log.Trace("handling received data")
-			if err = s.handler.Callback.Handle(data); err != nil {
-				log.WithFields(log.Fields{"error": err}).Error("failed to handle message")
+			message, perr := ParseMessage(frames)
+			if perr != nil {
+				log.WithFields(s.defaultFields(perr)).Error("received invalid message")
+				continue
 			}
+			s.handle(message)
 		}
 	}()
 
 	<-ctx.Done()
 	log.Debug("sink received shutdown")
 	s.Stop()
+
+	// the sockets can only be destroyed once they're no longer polled
+	<-handled
+}
+
+// loadSnapshot requests the last values of the topics that match the filter and
+// handles them as if they had just been received.
+func (s *Sink) loadSnapshot() {
+	fields := s.defaultFields(nil)
+	fields["snapshot"] = s.snapshot
+
+	messages, err := RequestSnapshot(s.snapshot, s.filter, s.snapshotTimeout, s.curve)
+	if err != nil {
+		fields["err"] = err
+		log.WithFields(fields).Warn("failed to load snapshot")
+	}
+
+	for _, message := range messages {
+		s.handle(message)
+	}
+	log.WithFields(fields).Debugf("loaded %d messages from snapshot", len(messages))
 }
 
-// Stop sets the flag to shutdown the loop handling messages.
+// handle checks the sequence of a message and passes it to the handler, gaps
+// are reported and duplicates are dropped.
+func (s *Sink) handle(message *Message) {
+	gap, deliver := s.sequences.check(message)
+	if gap != nil {
+		s.gaps.Add(gap.Missed())
+		log.WithFields(log.Fields{
+			"topic":    gap.Topic,
+			"source":   gap.SourceID,
+			"expected": gap.Expected,
+			"received": gap.Received,
+		}).Warn("missed messages")
+		if callback, ok := s.handler.Callback.(GapCallback); ok {
+			callback.HandleGap(gap)
+		}
+	}
+	if !deliver {
+		log.WithFields(log.Fields{
+			"topic":    message.Topic,
+			"sequence": message.Header.Sequence,
+		}).Trace("dropped duplicate message")
+		return
+	}
+
+	log.Trace("handling received data")
+	if err := s.handler.Callback.Handle(message); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("failed to handle message")
+	}
+}
+
+// Stop sets the flag to shutdown the loop handling messages, a running sink
+// closes its socket once the loop has ended.
 func (s *Sink) Stop() {
 	s.running = false
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
 }
 
 // Running is used to check if the message handler should be running.
 func (s *Sink) Running() bool {
 	return s.running
 }
+
+// sequenceTracker follows the sequence numbers of every source and topic a
+// sink receives.
+type sequenceTracker struct {
+	mu   sync.Mutex
+	last map[sequenceKey]trackedSequence
+}
+
+type sequenceKey struct {
+	sourceID string
+	topic    string
+}
+
+type trackedSequence struct {
+	sequence  uint64
+	timestamp time.Time
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{last: make(map[sequenceKey]trackedSequence)}
+}
+
+// check records the sequence number of a message. It returns the gap between
+// it and the last message from the same source and topic, and whether the
+// message should be delivered, it shouldn't when it has been seen before.
+// A lower sequence number with a later timestamp means the source restarted.
+func (t *sequenceTracker) check(message *Message) (*Gap, bool) {
+	header := message.Header
+	if header.Sequence == 0 {
+		// legacy messages aren't numbered
+		return nil, true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := sequenceKey{sourceID: header.SourceID, topic: message.Topic}
+	last, seen := t.last[key]
+	if seen && header.Sequence <= last.sequence && !header.Timestamp.After(last.timestamp) {
+		return nil, false
+	}
+	t.last[key] = trackedSequence{sequence: header.Sequence, timestamp: header.Timestamp}
+
+	if seen && header.Sequence > last.sequence+1 {
+		return &Gap{
+			Topic:    message.Topic,
+			SourceID: header.SourceID,
+			Expected: last.sequence + 1,
+			Received: header.Sequence,
+		}, true
+	}
+
+	return nil, true
+}
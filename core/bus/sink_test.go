@@ -15,8 +15,8 @@ type mockSinkCallback struct {
 	mock.Mock
 }
 
-func (m *mockSinkCallback) Handle(data []byte) error {
-	args := m.Called(data)
+func (m *mockSinkCallback) Handle(message *Message) error {
+	args := m.Called(message)
 	return args.Error(0)
 }
 
@@ -166,7 +166,7 @@ func TestSinkCallbackInterface(t *testing.T) {
 
 	// Test callback functionality
 	mockCallback := &mockSinkCallback{}
-	testData := []byte("test data")
+	testData := NewMessage("org.plantd.test", []byte("test data"))
 	mockCallback.On("Handle", testData).Return(nil)
 
 	err := mockCallback.Handle(testData)
@@ -176,7 +176,7 @@ func TestSinkCallbackInterface(t *testing.T) {
 
 func TestSinkCallbackError(t *testing.T) {
 	mockCallback := &mockSinkCallback{}
-	testData := []byte("test data")
+	testData := NewMessage("org.plantd.test", []byte("test data"))
 	expectedErr := assert.AnError
 
 	mockCallback.On("Handle", testData).Return(expectedErr)
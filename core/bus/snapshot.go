@@ -0,0 +1,123 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geoffjay/plantd/core/curve"
+
+	czmq "github.com/zeromq/goczmq/v4"
+)
+
+const (
+	// SnapshotRequest is the command a sink sends to the snapshot endpoint of
+	// a bus, it's followed by the topic prefix to return values for.
+	SnapshotRequest = "ICANHAZ?"
+	// SnapshotEnd is the command a bus sends after the last message of a
+	// snapshot, it's followed by the prefix that was requested.
+	SnapshotEnd = "KTHXBAI"
+
+	// DefaultSnapshotTimeout is how long a sink waits for a snapshot.
+	DefaultSnapshotTimeout = 2 * time.Second
+)
+
+var errSnapshotTimeout = errors.New("timed out waiting for snapshot")
+
+// lastValueCache holds the last message that was published on each topic.
+type lastValueCache struct {
+	mu       sync.RWMutex
+	messages map[string]*Message
+}
+
+func newLastValueCache() *lastValueCache {
+	return &lastValueCache{messages: make(map[string]*Message)}
+}
+
+// update replaces the cached value of the topic of the message.
+func (c *lastValueCache) update(message *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages[message.Topic] = message
+}
+
+// get returns the cached value of a topic.
+func (c *lastValueCache) get(topic string) (*Message, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	message, ok := c.messages[topic]
+	return message, ok
+}
+
+// snapshot returns the cached values of every topic that starts with the
+// prefix, ordered by topic.
+func (c *lastValueCache) snapshot(prefix string) []*Message {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	messages := make([]*Message, 0)
+	for topic, message := range c.messages {
+		if strings.HasPrefix(topic, prefix) {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Topic < messages[j].Topic
+	})
+
+	return messages
+}
+
+// RequestSnapshot asks the snapshot endpoint of a bus for the last value of
+// every topic that starts with the prefix.
+func RequestSnapshot(endpoint, prefix string, timeout time.Duration, keys *curve.Config) ([]*Message, error) {
+	socket, err := czmq.NewDealer(endpoint, keys.ClientOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to snapshot endpoint: %w", err)
+	}
+	defer socket.Destroy()
+
+	poller, err := czmq.NewPoller(socket)
+	if err != nil {
+		return nil, err
+	}
+	defer poller.Destroy()
+
+	if err = socket.SendMessage([][]byte{[]byte(SnapshotRequest), []byte(prefix)}); err != nil {
+		return nil, fmt.Errorf("failed to send snapshot request: %w", err)
+	}
+
+	messages := make([]*Message, 0)
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return messages, errSnapshotTimeout
+		}
+
+		ready, err := poller.Wait(int(remaining.Milliseconds()))
+		if err != nil {
+			return messages, err
+		}
+		if ready == nil {
+			return messages, errSnapshotTimeout
+		}
+
+		frames, err := socket.RecvMessage()
+		if err != nil {
+			return messages, err
+		}
+		if len(frames) > 0 && string(frames[0]) == SnapshotEnd {
+			return messages, nil
+		}
+
+		message, err := ParseMessage(frames)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, message)
+	}
+}
@@ -0,0 +1,156 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastValueCache(t *testing.T) {
+	cache := newLastValueCache()
+
+	cache.update(NewMessage("org.plantd.metric.b", []byte(`{"value":1}`)))
+	cache.update(NewMessage("org.plantd.metric.a", []byte(`{"value":2}`)))
+	cache.update(NewMessage("org.plantd.metric.b", []byte(`{"value":3}`)))
+	cache.update(NewMessage("org.plantd.event.a", []byte(`{"value":4}`)))
+
+	message, ok := cache.get("org.plantd.metric.b")
+	require.True(t, ok)
+	assert.Equal(t, []byte(`{"value":3}`), message.Body)
+
+	_, ok = cache.get("org.plantd.metric.c")
+	assert.False(t, ok)
+
+	snapshot := cache.snapshot("org.plantd.metric")
+	require.Len(t, snapshot, 2)
+	assert.Equal(t, "org.plantd.metric.a", snapshot[0].Topic)
+	assert.Equal(t, "org.plantd.metric.b", snapshot[1].Topic)
+
+	assert.Len(t, cache.snapshot(""), 3)
+	assert.Empty(t, cache.snapshot("org.plantd.state"))
+}
+
+func TestBusSnapshot(t *testing.T) {
+	bus := NewBus(Config{Name: "test-bus"})
+	bus.cache.update(NewMessage("org.plantd.metric.a", []byte("{}")))
+
+	assert.Len(t, bus.Snapshot("org.plantd"), 1)
+	_, ok := bus.LastValue("org.plantd.metric.a")
+	assert.True(t, ok)
+}
+
+func sequencedMessage(topic string, sequence uint64, timestamp time.Time) *Message {
+	message := NewMessage(topic, []byte("{}"))
+	message.Header = Header{SourceID: "source-001", Sequence: sequence, Timestamp: timestamp}
+	return message
+}
+
+func TestSequenceTracker(t *testing.T) {
+	now := time.Now()
+	tracker := newSequenceTracker()
+
+	t.Run("first message", func(t *testing.T) {
+		gap, deliver := tracker.check(sequencedMessage("org.plantd.a", 10, now))
+		assert.Nil(t, gap)
+		assert.True(t, deliver)
+	})
+
+	t.Run("next message", func(t *testing.T) {
+		gap, deliver := tracker.check(sequencedMessage("org.plantd.a", 11, now))
+		assert.Nil(t, gap)
+		assert.True(t, deliver)
+	})
+
+	t.Run("missed messages", func(t *testing.T) {
+		gap, deliver := tracker.check(sequencedMessage("org.plantd.a", 15, now))
+		require.NotNil(t, gap)
+		assert.True(t, deliver)
+		assert.Equal(t, uint64(12), gap.Expected)
+		assert.Equal(t, uint64(15), gap.Received)
+		assert.Equal(t, uint64(3), gap.Missed())
+	})
+
+	t.Run("duplicate message", func(t *testing.T) {
+		gap, deliver := tracker.check(sequencedMessage("org.plantd.a", 14, now))
+		assert.Nil(t, gap)
+		assert.False(t, deliver)
+	})
+
+	t.Run("source restarted", func(t *testing.T) {
+		gap, deliver := tracker.check(sequencedMessage("org.plantd.a", 1, now.Add(time.Second)))
+		assert.Nil(t, gap)
+		assert.True(t, deliver)
+	})
+
+	t.Run("topics are independent", func(t *testing.T) {
+		gap, deliver := tracker.check(sequencedMessage("org.plantd.b", 1, now))
+		assert.Nil(t, gap)
+		assert.True(t, deliver)
+	})
+
+	t.Run("unnumbered message", func(t *testing.T) {
+		gap, deliver := tracker.check(NewMessage("org.plantd.a", []byte("{}")))
+		assert.Nil(t, gap)
+		assert.True(t, deliver)
+	})
+}
+
+type mockGapCallback struct {
+	mockSinkCallback
+	gaps []*Gap
+}
+
+func (m *mockGapCallback) HandleGap(gap *Gap) {
+	m.gaps = append(m.gaps, gap)
+}
+
+func TestSinkHandleGap(t *testing.T) {
+	now := time.Now()
+	callback := &mockGapCallback{}
+	callback.On("Handle", mock.Anything).Return(nil)
+
+	sink := NewSink("inproc://test", "org.plantd")
+	sink.SetHandler(&SinkHandler{Callback: callback})
+
+	sink.handle(sequencedMessage("org.plantd.a", 1, now))
+	sink.handle(sequencedMessage("org.plantd.a", 4, now))
+	sink.handle(sequencedMessage("org.plantd.a", 4, now))
+
+	require.Len(t, callback.gaps, 1)
+	assert.Equal(t, uint64(2), sink.Gaps())
+	callback.AssertNumberOfCalls(t, "Handle", 2)
+}
+
+func TestBusCaptureExclude(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder("state", RecorderConfig{Path: dir})
+	require.NoError(t, err)
+	bus := NewBus(Config{Name: "state", Exclude: []string{"org.plantd.state.command"}})
+	bus.recorder = recorder
+
+	for _, topic := range []string{"org.plantd.state.command.org.plantd.Test", "org.plantd.state.change.org.plantd.Test"} {
+		frames, err := NewMessage(topic, []byte(`{"key":"foo"}`)).Frames()
+		require.NoError(t, err)
+		bus.captured(frames)
+	}
+	require.NoError(t, recorder.Close())
+
+	_, ok := bus.LastValue("org.plantd.state.command.org.plantd.Test")
+	assert.False(t, ok)
+	_, ok = bus.LastValue("org.plantd.state.change.org.plantd.Test")
+	assert.True(t, ok)
+
+	var topics []string
+	err = ReadRecords(dir, "state", time.Time{}, time.Time{}, func(record *Record) error {
+		topics = append(topics, record.Topic)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"org.plantd.state.change.org.plantd.Test"}, topics)
+
+	// excluded messages are still counted
+	assert.Equal(t, uint64(2), bus.Stats().Messages)
+}
@@ -3,18 +3,71 @@ package bus
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/geoffjay/plantd/core/curve"
 
 	log "github.com/sirupsen/logrus"
 	czmq "github.com/zeromq/goczmq/v4"
 )
 
+// QueuePolicy decides what happens to a message that's queued when the queue
+// of a source is full.
+type QueuePolicy string
+
+const (
+	// QueueBlock waits until there's room in the queue.
+	QueueBlock QueuePolicy = "block"
+	// QueueDropOldest discards the oldest message in the queue.
+	QueueDropOldest QueuePolicy = "drop-oldest"
+	// QueueDropNewest discards the message being queued.
+	QueueDropNewest QueuePolicy = "drop-newest"
+	// QueueError discards the message being queued and returns ErrQueueFull.
+	QueueError QueuePolicy = "error"
+
+	// DefaultQueueSize is the number of messages a source holds before its
+	// queue policy applies.
+	DefaultQueueSize = 100
+)
+
+var (
+	// ErrQueueFull is returned when a message can't be queued with the
+	// QueueError policy.
+	ErrQueueFull = errors.New("source queue is full")
+	// ErrSourceStopped is returned when a message is queued after the source
+	// was stopped.
+	ErrSourceStopped = errors.New("source is stopped")
+)
+
 // Source type to function as a bus publisher device.
 type Source struct {
-	endpoint string
-	envelope string
-	running  bool
-	queue    chan []byte
+	endpoint    string
+	envelope    string
+	id          string
+	contentType string
+	sequences   map[string]uint64
+	running     bool
+	queue       chan *Message
+	policy      QueuePolicy
+	done        chan struct{}
+	stopOnce    sync.Once
+	curve       *curve.Config
+
+	published atomic.Uint64
+	dropped   atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// SourceStats holds the message counters of a source.
+type SourceStats struct {
+	Queued    int    `json:"queued"`
+	Published uint64 `json:"published"`
+	Dropped   uint64 `json:"dropped"`
+	Failed    uint64 `json:"failed"`
 }
 
 var shutdownCommand = []byte{0x0D, 0x0E, 0x0A, 0x0D}
@@ -22,11 +75,58 @@ var shutdownCommand = []byte{0x0D, 0x0E, 0x0A, 0x0D}
 // NewSource constructs an instance of a message bus sink.
 func NewSource(endpoint, envelope string) *Source {
 	return &Source{
-		endpoint: endpoint,
-		envelope: envelope,
-		running:  false,
-		queue:    make(chan []byte),
+		endpoint:  endpoint,
+		envelope:  envelope,
+		id:        defaultSourceID(),
+		sequences: make(map[string]uint64),
+		running:   false,
+		queue:     make(chan *Message, DefaultQueueSize),
+		policy:    QueueBlock,
+		done:      make(chan struct{}),
+	}
+}
+
+// SetQueue sets the size of the message queue and what to do when it's full,
+// this must be done before the source is run.
+func (s *Source) SetQueue(size int, policy QueuePolicy) error {
+	switch policy {
+	case QueueBlock, QueueDropOldest, QueueDropNewest, QueueError:
+	default:
+		return fmt.Errorf("invalid queue policy: %s", policy)
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid queue size: %d", size)
 	}
+	s.queue = make(chan *Message, size)
+	s.policy = policy
+	return nil
+}
+
+// Stats returns the message counters of the source.
+func (s *Source) Stats() SourceStats {
+	return SourceStats{
+		Queued:    len(s.queue),
+		Published: s.published.Load(),
+		Dropped:   s.dropped.Load(),
+		Failed:    s.failed.Load(),
+	}
+}
+
+// SetID sets the ID that the source stamps on the messages it publishes.
+func (s *Source) SetID(id string) {
+	s.id = id
+}
+
+// SetContentType sets the content type of the messages queued with
+// QueueMessage.
+func (s *Source) SetContentType(contentType string) {
+	s.contentType = contentType
+}
+
+// SetCurve sets the CURVE keys used to connect to the bus, this must be done
+// before the source is run.
+func (s *Source) SetCurve(keys *curve.Config) {
+	s.curve = keys
 }
 
 func (s *Source) defaultFields(err error) log.Fields {
@@ -47,7 +147,7 @@ func (s *Source) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	defer wg.Done()
 
-	if publisher, err = czmq.NewPub(s.endpoint); err != nil {
+	if publisher, err = czmq.NewPub(s.endpoint, s.curve.ClientOptions()...); err != nil {
 		log.WithFields(s.defaultFields(err)).Panic("publisher create")
 	}
 	log.WithFields(s.defaultFields(nil)).Debug("created message queue source socket")
@@ -55,38 +155,66 @@ func (s *Source) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	s.running = true
 
+	handled := make(chan struct{})
 	go func() {
-		for message := range s.queue {
-			if bytes.Equal(message, shutdownCommand) {
-				log.Debug("received shutdown command")
-				break
-			}
-
-			frame := append([]byte(s.envelope), message...)
-			if err := publisher.SendFrame(frame, 0); err != nil {
-				log.WithFields(s.defaultFields(err)).Panic("send error")
+		defer close(handled)
+		for {
+			select {
+			case message := <-s.queue:
+				if message.Topic == "" && bytes.Equal(message.Body, shutdownCommand) {
+					log.Debug("received shutdown command")
+					log.Debug("source message queue handler stopped")
+					return
+				}
+				s.publish(publisher, message)
+			case <-s.done:
+				log.Debug("source message queue handler stopped")
+				return
 			}
 		}
-		log.Debug("source message queue handler stopped")
 	}()
 
 	<-ctx.Done()
 	log.Debug("source context done")
 	s.Stop()
+	<-handled
+}
+
+// publish sends a message from the queue, failures are counted rather than
+// stopping the source.
+func (s *Source) publish(publisher *czmq.Sock, message *Message) {
+	frames, err := s.stamp(message).Frames()
+	if err != nil {
+		s.failed.Add(1)
+		log.WithFields(s.defaultFields(err)).Error("failed to encode message")
+		return
+	}
+	if err = publisher.SendMessage(frames); err != nil {
+		s.failed.Add(1)
+		log.WithFields(s.defaultFields(err)).Error("send error")
+		return
+	}
+	s.published.Add(1)
 }
 
 // Shutdown gracefully shuts down the source.
 func (s *Source) Shutdown() {
 	if s.running {
-		s.queue <- shutdownCommand
+		select {
+		case s.queue <- &Message{Body: shutdownCommand}:
+		case <-s.done:
+		}
 	}
 }
 
-// Stop sets the flag to shutdown the loop handling the message queue.
+// Stop sets the flag to shutdown the loop handling the message queue, messages
+// that are still queued are discarded.
 func (s *Source) Stop() {
 	s.running = false
-	log.Debug("source closing connection")
-	close(s.queue)
+	s.stopOnce.Do(func() {
+		log.Debug("source closing connection")
+		close(s.done)
+	})
 }
 
 // Running is used to check if the message queue handler should be running.
@@ -94,7 +222,104 @@ func (s *Source) Running() bool {
 	return s.running
 }
 
-// QueueMessage adds a message to the source's message queue.
-func (s *Source) QueueMessage(message []byte) {
-	s.queue <- message
+// QueueMessage adds a message to the source's message queue, it's published
+// with the envelope of the source as its topic.
+func (s *Source) QueueMessage(message []byte) error {
+	return s.QueueMessageContext(context.Background(), message)
+}
+
+// QueueMessageContext is QueueMessage that gives up when the context is done
+// while it's waiting for room in the queue.
+func (s *Source) QueueMessageContext(ctx context.Context, message []byte) error {
+	return s.QueueContext(ctx, &Message{
+		Topic:  s.envelope,
+		Header: Header{ContentType: s.contentType},
+		Body:   message,
+	})
+}
+
+// Queue adds a message with its own topic to the source's message queue. The
+// timestamp, source ID and sequence number of the topic are set when it's
+// published.
+func (s *Source) Queue(message *Message) error {
+	return s.QueueContext(context.Background(), message)
+}
+
+// QueueContext is Queue that gives up when the context is done while it's
+// waiting for room in the queue. What happens when the queue is full depends
+// on the queue policy of the source.
+func (s *Source) QueueContext(ctx context.Context, message *Message) error {
+	select {
+	case <-s.done:
+		return ErrSourceStopped
+	default:
+	}
+
+	switch s.policy {
+	case QueueDropNewest, QueueError:
+		return s.queueOrDrop(message)
+	case QueueDropOldest:
+		s.queueDropOldest(message)
+		return nil
+	case QueueBlock:
+	}
+
+	select {
+	case s.queue <- message:
+		return nil
+	case <-s.done:
+		return ErrSourceStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// queueOrDrop queues a message if there's room and drops it otherwise.
+func (s *Source) queueOrDrop(message *Message) error {
+	select {
+	case s.queue <- message:
+		return nil
+	default:
+	}
+
+	s.dropped.Add(1)
+	if s.policy == QueueError {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// queueDropOldest makes room for a message by dropping the oldest ones, with
+// an unbuffered queue there's nothing to drop so the message itself is.
+func (s *Source) queueDropOldest(message *Message) {
+	for {
+		select {
+		case s.queue <- message:
+			return
+		default:
+		}
+		if cap(s.queue) == 0 {
+			s.dropped.Add(1)
+			return
+		}
+		select {
+		case <-s.queue:
+			s.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// stamp completes the header of a message that is about to be published.
+// Sequence numbers are counted per topic so that sinks can tell when they've
+// missed a message on any topic they subscribe to.
+func (s *Source) stamp(message *Message) *Message {
+	if s.sequences == nil {
+		s.sequences = make(map[string]uint64)
+	}
+	s.sequences[message.Topic]++
+	message.Header.Timestamp = time.Now()
+	message.Header.SourceID = s.id
+	message.Header.Sequence = s.sequences[message.Topic]
+	return message
 }
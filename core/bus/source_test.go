@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewSource(t *testing.T) {
@@ -60,9 +61,10 @@ func TestSourceStop(t *testing.T) {
 	source.Stop()
 	assert.False(t, source.Running())
 
-	assert.Panics(t, func() {
-		source.QueueMessage([]byte("test"))
-	})
+	assert.ErrorIs(t, source.QueueMessage([]byte("test")), ErrSourceStopped)
+
+	// Stopping again is harmless
+	assert.NotPanics(t, source.Stop)
 }
 
 func TestSourceQueueMessage(t *testing.T) {
@@ -72,13 +74,14 @@ func TestSourceQueueMessage(t *testing.T) {
 
 	// Should be able to queue message
 	go func() {
-		source.QueueMessage(message)
+		_ = source.QueueMessage(message)
 	}()
 
 	// Should receive the message
 	select {
 	case received := <-source.queue:
-		assert.Equal(t, message, received)
+		assert.Equal(t, "envelope", received.Topic)
+		assert.Equal(t, message, received.Body)
 	case <-time.After(1 * time.Second):
 		t.Fatal("timeout waiting for message")
 	}
@@ -93,7 +96,7 @@ func TestSourceShutdown(t *testing.T) {
 
 	select {
 	case received := <-source.queue:
-		assert.Equal(t, shutdownCommand, received)
+		assert.Equal(t, shutdownCommand, received.Body)
 	case <-time.After(1 * time.Second):
 		t.Fatal("timeout waiting for shutdown command")
 	}
@@ -170,3 +173,92 @@ func TestShutdownCommand(t *testing.T) {
 	expected := []byte{0x0D, 0x0E, 0x0A, 0x0D}
 	assert.Equal(t, expected, shutdownCommand)
 }
+
+func TestSourceStamp(t *testing.T) {
+	source := NewSource("inproc://test", "envelope")
+	source.SetID("source-001")
+
+	first := source.stamp(NewMessage("org.plantd.a", []byte("{}")))
+	second := source.stamp(NewMessage("org.plantd.a", []byte("{}")))
+	other := source.stamp(NewMessage("org.plantd.b", []byte("{}")))
+
+	assert.Equal(t, "source-001", first.Header.SourceID)
+	assert.False(t, first.Header.Timestamp.IsZero())
+	assert.Equal(t, uint64(1), first.Header.Sequence)
+	assert.Equal(t, uint64(2), second.Header.Sequence)
+	assert.Equal(t, uint64(1), other.Header.Sequence)
+}
+
+func TestSourceDefaultID(t *testing.T) {
+	first := NewSource("inproc://test", "envelope")
+	second := NewSource("inproc://test", "envelope")
+	assert.NotEqual(t, first.id, second.id)
+
+	// sources publishing on the same topic are tracked apart
+	tracker := newSequenceTracker()
+	for i := 0; i < 3; i++ {
+		for _, source := range []*Source{first, second} {
+			gap, deliver := tracker.check(source.stamp(NewMessage("org.plantd.a", []byte("{}"))))
+			assert.Nil(t, gap)
+			assert.True(t, deliver)
+		}
+	}
+}
+
+func TestSourceSetQueue(t *testing.T) {
+	source := NewSource("inproc://test", "envelope")
+
+	assert.Error(t, source.SetQueue(10, QueuePolicy("invalid")))
+	assert.Error(t, source.SetQueue(-1, QueueBlock))
+	assert.NoError(t, source.SetQueue(10, QueueDropOldest))
+	assert.Equal(t, 10, cap(source.queue))
+	assert.Equal(t, QueueDropOldest, source.policy)
+}
+
+func TestSourceQueuePolicies(t *testing.T) {
+	t.Run("block", func(t *testing.T) {
+		source := NewSource("inproc://test", "envelope")
+		require.NoError(t, source.SetQueue(1, QueueBlock))
+		require.NoError(t, source.QueueMessage([]byte("1")))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, source.QueueMessageContext(ctx, []byte("2")), context.DeadlineExceeded)
+		assert.Equal(t, uint64(0), source.Stats().Dropped)
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		source := NewSource("inproc://test", "envelope")
+		require.NoError(t, source.SetQueue(2, QueueDropOldest))
+		for _, body := range []string{"1", "2", "3"} {
+			require.NoError(t, source.QueueMessage([]byte(body)))
+		}
+
+		assert.Equal(t, []byte("2"), (<-source.queue).Body)
+		assert.Equal(t, []byte("3"), (<-source.queue).Body)
+		assert.Equal(t, uint64(1), source.Stats().Dropped)
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		source := NewSource("inproc://test", "envelope")
+		require.NoError(t, source.SetQueue(2, QueueDropNewest))
+		for _, body := range []string{"1", "2", "3"} {
+			require.NoError(t, source.QueueMessage([]byte(body)))
+		}
+
+		assert.Equal(t, []byte("1"), (<-source.queue).Body)
+		assert.Equal(t, []byte("2"), (<-source.queue).Body)
+		assert.Equal(t, uint64(1), source.Stats().Dropped)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		source := NewSource("inproc://test", "envelope")
+		require.NoError(t, source.SetQueue(1, QueueError))
+		require.NoError(t, source.QueueMessage([]byte("1")))
+
+		assert.ErrorIs(t, source.QueueMessage([]byte("2")), ErrQueueFull)
+		stats := source.Stats()
+		assert.Equal(t, 1, stats.Queued)
+		assert.Equal(t, uint64(1), stats.Dropped)
+	})
+}
@@ -0,0 +1,143 @@
+package bus
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStatsDepth is the number of topic segments that messages are counted
+// by, with three the topic org.plantd.metric.temperature is counted under
+// org.plantd.metric.
+const DefaultStatsDepth = 3
+
+// Stats holds the traffic that has passed through a bus.
+type Stats struct {
+	Name        string    `json:"name"`
+	Running     bool      `json:"running"`
+	Messages    uint64    `json:"messages"`
+	Bytes       uint64    `json:"bytes"`
+	LastMessage time.Time `json:"last_message"`
+	// Topics holds the traffic of each topic prefix.
+	Topics map[string]TopicStats `json:"topics"`
+	// Filters holds the subscription filters that are active on the backend.
+	// The XPUB socket of the proxy only reports the first subscription to a
+	// filter and the last unsubscription from it, so how many sinks share a
+	// filter isn't known.
+	Filters []string `json:"filters"`
+}
+
+// TopicStats holds the traffic of a topic prefix.
+type TopicStats struct {
+	Messages    uint64    `json:"messages"`
+	Bytes       uint64    `json:"bytes"`
+	LastMessage time.Time `json:"last_message"`
+}
+
+// busStats counts the traffic seen on the capture socket of a bus.
+type busStats struct {
+	mu       sync.RWMutex
+	depth    int
+	running  bool
+	messages uint64
+	bytes    uint64
+	last     time.Time
+	topics   map[string]*TopicStats
+	filters  map[string]struct{}
+}
+
+func newBusStats(depth int) *busStats {
+	if depth <= 0 {
+		depth = DefaultStatsDepth
+	}
+	return &busStats{
+		depth:   depth,
+		topics:  make(map[string]*TopicStats),
+		filters: make(map[string]struct{}),
+	}
+}
+
+func (s *busStats) setRunning(running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = running
+}
+
+// message counts a message that was published on a topic.
+func (s *busStats) message(topic string, size int) {
+	now := time.Now()
+	prefix := topicPrefix(topic, s.depth)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages++
+	s.bytes += uint64(size)
+	s.last = now
+
+	stats, ok := s.topics[prefix]
+	if !ok {
+		stats = &TopicStats{}
+		s.topics[prefix] = stats
+	}
+	stats.Messages++
+	stats.Bytes += uint64(size)
+	stats.LastMessage = now
+}
+
+// subscription tracks the subscription event of an XPUB socket, which is a
+// single frame starting with 1 to subscribe or 0 to unsubscribe followed by
+// the filter. It returns false when the frames aren't a subscription event.
+func (s *busStats) subscription(frames [][]byte) bool {
+	if len(frames) != 1 || len(frames[0]) == 0 || frames[0][0] > 1 {
+		return false
+	}
+
+	filter := string(frames[0][1:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if frames[0][0] == 1 {
+		s.filters[filter] = struct{}{}
+	} else {
+		delete(s.filters, filter)
+	}
+
+	return true
+}
+
+// snapshot copies the counters of a bus.
+func (s *busStats) snapshot(name string) Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := Stats{
+		Name:        name,
+		Running:     s.running,
+		Messages:    s.messages,
+		Bytes:       s.bytes,
+		LastMessage: s.last,
+		Topics:      make(map[string]TopicStats, len(s.topics)),
+		Filters:     make([]string, 0, len(s.filters)),
+	}
+	for prefix, topic := range s.topics {
+		stats.Topics[prefix] = *topic
+	}
+	for filter := range s.filters {
+		stats.Filters = append(stats.Filters, filter)
+	}
+	sort.Strings(stats.Filters)
+
+	return stats
+}
+
+// topicPrefix shortens a topic to its first segments.
+func topicPrefix(topic string, depth int) string {
+	segments := strings.SplitN(topic, ".", depth+1)
+	if len(segments) <= depth {
+		return topic
+	}
+	return strings.Join(segments[:depth], ".")
+}
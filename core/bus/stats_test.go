@@ -0,0 +1,63 @@
+package bus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicPrefix(t *testing.T) {
+	assert.Equal(t, "org.plantd.metric", topicPrefix("org.plantd.metric.temperature.1", 3))
+	assert.Equal(t, "org.plantd.metric", topicPrefix("org.plantd.metric", 3))
+	assert.Equal(t, "org.plantd", topicPrefix("org.plantd", 3))
+	assert.Equal(t, "org", topicPrefix("org.plantd.metric", 1))
+	assert.Equal(t, "", topicPrefix("", 3))
+}
+
+func TestBusStatsMessages(t *testing.T) {
+	stats := newBusStats(0)
+	assert.Equal(t, DefaultStatsDepth, stats.depth)
+
+	stats.message("org.plantd.metric.temperature", 10)
+	stats.message("org.plantd.metric.humidity", 20)
+	stats.message("org.plantd.state.set", 5)
+
+	snapshot := stats.snapshot("metric")
+	assert.Equal(t, "metric", snapshot.Name)
+	assert.Equal(t, uint64(3), snapshot.Messages)
+	assert.Equal(t, uint64(35), snapshot.Bytes)
+	assert.False(t, snapshot.LastMessage.IsZero())
+
+	require.Contains(t, snapshot.Topics, "org.plantd.metric")
+	assert.Equal(t, uint64(2), snapshot.Topics["org.plantd.metric"].Messages)
+	assert.Equal(t, uint64(30), snapshot.Topics["org.plantd.metric"].Bytes)
+	assert.Equal(t, uint64(1), snapshot.Topics["org.plantd.state"].Messages)
+}
+
+func TestBusStatsFilters(t *testing.T) {
+	stats := newBusStats(0)
+
+	assert.True(t, stats.subscription([][]byte{append([]byte{1}, "org.plantd"...)}))
+	assert.True(t, stats.subscription([][]byte{append([]byte{1}, "org.plantd"...)}))
+	assert.True(t, stats.subscription([][]byte{append([]byte{1}, "org.plantd.state"...)}))
+	assert.True(t, stats.subscription([][]byte{append([]byte{1}, "org.plantd.metric"...)}))
+	assert.True(t, stats.subscription([][]byte{append([]byte{0}, "org.plantd.metric"...)}))
+
+	// messages aren't subscription events
+	assert.False(t, stats.subscription([][]byte{[]byte(`org.plantd{"value":1}`)}))
+	assert.False(t, stats.subscription([][]byte{[]byte("org.plantd"), []byte("{}"), []byte("{}")}))
+
+	snapshot := stats.snapshot("state")
+	assert.Equal(t, []string{"org.plantd", "org.plantd.state"}, snapshot.Filters)
+}
+
+func TestBusStatsRunning(t *testing.T) {
+	bus := NewBus(Config{Name: "test-bus"})
+	assert.False(t, bus.Stats().Running)
+
+	bus.stats.setRunning(true)
+	stats := bus.Stats()
+	assert.True(t, stats.Running)
+	assert.Equal(t, "test-bus", stats.Name)
+}
@@ -0,0 +1,113 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TopicParams holds the values of the placeholders of a topic template.
+type TopicParams map[string]string
+
+// TopicTemplate is a topic with placeholders for some of its segments, for
+// example org.plantd.metric.<device>.<channel>.
+type TopicTemplate struct {
+	pattern  string
+	segments []topicSegment
+}
+
+type topicSegment struct {
+	value       string
+	placeholder bool
+}
+
+// ParseTopicTemplate parses a dot separated topic where the segments written
+// as <name> are placeholders.
+func ParseTopicTemplate(pattern string) (*TopicTemplate, error) {
+	if pattern == "" {
+		return nil, errors.New("topic template is empty")
+	}
+
+	template := &TopicTemplate{pattern: pattern}
+	names := make(map[string]bool)
+	for _, segment := range strings.Split(pattern, ".") {
+		if segment == "" {
+			return nil, fmt.Errorf("topic template %s has an empty segment", pattern)
+		}
+		if strings.HasPrefix(segment, "<") && strings.HasSuffix(segment, ">") {
+			name := segment[1 : len(segment)-1]
+			if name == "" || names[name] {
+				return nil, fmt.Errorf("topic template %s has an invalid placeholder %s", pattern, segment)
+			}
+			names[name] = true
+			template.segments = append(template.segments, topicSegment{value: name, placeholder: true})
+			continue
+		}
+		if strings.ContainsAny(segment, "<>") {
+			return nil, fmt.Errorf("topic template %s has an invalid segment %s", pattern, segment)
+		}
+		template.segments = append(template.segments, topicSegment{value: segment})
+	}
+
+	return template, nil
+}
+
+// String returns the pattern of the template.
+func (t *TopicTemplate) String() string {
+	return t.pattern
+}
+
+// Prefix returns the fixed part of the template before the first placeholder,
+// it's the filter a sink needs to receive every topic that matches.
+func (t *TopicTemplate) Prefix() string {
+	literals := make([]string, 0, len(t.segments))
+	for _, segment := range t.segments {
+		if segment.placeholder && len(literals) == 0 {
+			return ""
+		}
+		if segment.placeholder {
+			return strings.Join(literals, ".") + "."
+		}
+		literals = append(literals, segment.value)
+	}
+	return t.pattern
+}
+
+// Expand fills in the placeholders of the template.
+func (t *TopicTemplate) Expand(params TopicParams) (string, error) {
+	segments := make([]string, 0, len(t.segments))
+	for _, segment := range t.segments {
+		if !segment.placeholder {
+			segments = append(segments, segment.value)
+			continue
+		}
+		value, ok := params[segment.value]
+		if !ok || value == "" {
+			return "", fmt.Errorf("topic parameter %s is missing", segment.value)
+		}
+		if strings.Contains(value, ".") {
+			return "", fmt.Errorf("topic parameter %s can't contain a '.'", segment.value)
+		}
+		segments = append(segments, value)
+	}
+	return strings.Join(segments, "."), nil
+}
+
+// Match checks whether a topic fits the template and returns the values of
+// its placeholders.
+func (t *TopicTemplate) Match(topic string) (TopicParams, bool) {
+	segments := strings.Split(topic, ".")
+	if len(segments) != len(t.segments) {
+		return nil, false
+	}
+
+	params := make(TopicParams)
+	for i, segment := range t.segments {
+		if segment.placeholder {
+			params[segment.value] = segments[i]
+		} else if segment.value != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
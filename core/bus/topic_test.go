@@ -0,0 +1,57 @@
+package bus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTopicTemplate(t *testing.T) {
+	template, err := ParseTopicTemplate(MetricTopic)
+	require.NoError(t, err)
+	assert.Equal(t, MetricTopic, template.String())
+	assert.Equal(t, "org.plantd.metric.", template.Prefix())
+
+	template, err = ParseTopicTemplate("org.plantd.state")
+	require.NoError(t, err)
+	assert.Equal(t, "org.plantd.state", template.Prefix())
+
+	template, err = ParseTopicTemplate("<scope>.state")
+	require.NoError(t, err)
+	assert.Equal(t, "", template.Prefix())
+
+	for _, pattern := range []string{"", "org..plantd", "org.<>", "org.<a>.<a>", "org.pl<a>ntd"} {
+		_, err = ParseTopicTemplate(pattern)
+		assert.Error(t, err, pattern)
+	}
+}
+
+func TestTopicTemplateExpand(t *testing.T) {
+	template, err := ParseTopicTemplate(MetricTopic)
+	require.NoError(t, err)
+
+	topic, err := template.Expand(TopicParams{"device": "pump-1", "channel": "pressure"})
+	require.NoError(t, err)
+	assert.Equal(t, "org.plantd.metric.pump-1.pressure", topic)
+
+	_, err = template.Expand(TopicParams{"device": "pump-1"})
+	assert.ErrorContains(t, err, "channel is missing")
+
+	_, err = template.Expand(TopicParams{"device": "pump.1", "channel": "pressure"})
+	assert.Error(t, err)
+}
+
+func TestTopicTemplateMatch(t *testing.T) {
+	template, err := ParseTopicTemplate(MetricTopic)
+	require.NoError(t, err)
+
+	params, ok := template.Match("org.plantd.metric.pump-1.pressure")
+	require.True(t, ok)
+	assert.Equal(t, TopicParams{"device": "pump-1", "channel": "pressure"}, params)
+
+	_, ok = template.Match("org.plantd.metric.pump-1")
+	assert.False(t, ok)
+	_, ok = template.Match("org.plantd.event.pump-1.pressure")
+	assert.False(t, ok)
+}
@@ -0,0 +1,132 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Publisher publishes values of one type on a source, the topic of each is
+// filled in from a template.
+type Publisher[T any] struct {
+	source   *Source
+	template *TopicTemplate
+	codec    Codec
+}
+
+// NewPublisher creates a publisher for a source, JSON is used when the codec
+// is nil.
+func NewPublisher[T any](source *Source, template string, codec Codec) (*Publisher[T], error) {
+	if source == nil {
+		return nil, errors.New("publisher needs a source")
+	}
+	parsed, err := ParseTopicTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	return &Publisher[T]{source: source, template: parsed, codec: codec}, nil
+}
+
+// Publish queues a value on the topic the parameters expand the template to.
+func (p *Publisher[T]) Publish(ctx context.Context, params TopicParams, value T) error {
+	topic, err := p.template.Expand(params)
+	if err != nil {
+		return err
+	}
+
+	body, err := p.codec.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", topic, err)
+	}
+
+	return p.source.QueueContext(ctx, &Message{
+		Topic:  topic,
+		Header: Header{ContentType: p.codec.ContentType()},
+		Body:   body,
+	})
+}
+
+// Handler receives the decoded values of a subscriber.
+type Handler[T any] func(ctx context.Context, topic string, value T) error
+
+// Subscriber decodes the messages a sink receives on the topics that match a
+// template and passes them to a handler. Messages are decoded with the codec
+// of their content type, the codec of the subscriber is used when they don't
+// have one.
+type Subscriber[T any] struct {
+	ctx      context.Context
+	template *TopicTemplate
+	codec    Codec
+	handler  Handler[T]
+}
+
+// NewSubscriber creates a subscriber, JSON is used when the codec is nil.
+func NewSubscriber[T any](template string, codec Codec, handler Handler[T]) (*Subscriber[T], error) {
+	if handler == nil {
+		return nil, errors.New("subscriber needs a handler")
+	}
+	parsed, err := ParseTopicTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	return &Subscriber[T]{
+		ctx:      context.Background(),
+		template: parsed,
+		codec:    codec,
+		handler:  handler,
+	}, nil
+}
+
+// Template returns the topic template of the subscriber.
+func (s *Subscriber[T]) Template() *TopicTemplate {
+	return s.template
+}
+
+// Filter returns the sink filter that receives every topic of the template.
+func (s *Subscriber[T]) Filter() string {
+	return s.template.Prefix()
+}
+
+// Attach makes the subscriber the handler of a sink, the context is passed to
+// the handler with every value. This must be done before the sink is run.
+func (s *Subscriber[T]) Attach(ctx context.Context, sink *Sink) {
+	s.ctx = ctx
+	sink.SetHandler(&SinkHandler{Callback: s})
+}
+
+// Handle decodes a message for the handler, it implements SinkCallback.
+// Messages on topics that don't match the template are ignored.
+func (s *Subscriber[T]) Handle(message *Message) error {
+	if _, ok := s.template.Match(message.Topic); !ok {
+		log.WithFields(log.Fields{
+			"topic":    message.Topic,
+			"template": s.template.String(),
+		}).Trace("ignoring message")
+		return nil
+	}
+
+	codec := s.codec
+	if message.Header.ContentType != "" {
+		var ok bool
+		if codec, ok = CodecFor(message.Header.ContentType); !ok {
+			return fmt.Errorf("unsupported content type %s on %s", message.Header.ContentType, message.Topic)
+		}
+	}
+
+	var value T
+	if err := codec.Unmarshal(message.Body, &value); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", message.Topic, err)
+	}
+
+	return s.handler(s.ctx, message.Topic, value)
+}
@@ -0,0 +1,78 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublisher(t *testing.T) {
+	_, err := NewPublisher[Metric](nil, MetricTopic, nil)
+	assert.Error(t, err)
+
+	source := NewSource("inproc://test", "envelope")
+	publisher, err := NewPublisher[Metric](source, MetricTopic, MsgpackCodec)
+	require.NoError(t, err)
+
+	metric := Metric{Time: time.Now(), Device: "pump-1", Channel: "pressure", Value: 101.3}
+	require.NoError(t, publisher.Publish(context.Background(), metric.Params(), metric))
+
+	message := <-source.queue
+	assert.Equal(t, "org.plantd.metric.pump-1.pressure", message.Topic)
+	assert.Equal(t, ContentTypeMsgpack, message.Header.ContentType)
+
+	assert.Error(t, publisher.Publish(context.Background(), TopicParams{}, metric))
+}
+
+func TestSubscriber(t *testing.T) {
+	_, err := NewSubscriber[Metric](MetricTopic, nil, nil)
+	assert.Error(t, err)
+
+	var received []Metric
+	subscriber, err := NewSubscriber(MetricTopic, nil, func(_ context.Context, topic string, metric Metric) error {
+		assert.Equal(t, "org.plantd.metric.pump-1.pressure", topic)
+		received = append(received, metric)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "org.plantd.metric.", subscriber.Filter())
+
+	sink := NewSink("inproc://test", subscriber.Filter())
+	subscriber.Attach(context.Background(), sink)
+	assert.Equal(t, subscriber, sink.handler.Callback)
+
+	body, err := MsgpackCodec.Marshal(Metric{Device: "pump-1", Channel: "pressure", Value: 1})
+	require.NoError(t, err)
+	message := NewMessage("org.plantd.metric.pump-1.pressure", body)
+	message.Header.ContentType = ContentTypeMsgpack
+	require.NoError(t, subscriber.Handle(message))
+
+	// without a content type the codec of the subscriber is used
+	require.NoError(t, subscriber.Handle(NewMessage("org.plantd.metric.pump-1.pressure", []byte(`{"value":2}`))))
+
+	// other topics are ignored
+	require.NoError(t, subscriber.Handle(NewMessage("org.plantd.metric.pump-1", []byte(`{"value":3}`))))
+
+	require.Len(t, received, 2)
+	assert.InDelta(t, 1.0, received[0].Value, 0.0001)
+	assert.InDelta(t, 2.0, received[1].Value, 0.0001)
+
+	message = NewMessage("org.plantd.metric.pump-1.pressure", []byte("{}"))
+	message.Header.ContentType = "text/plain"
+	assert.Error(t, subscriber.Handle(message))
+}
+
+func TestSubscriberHandlerError(t *testing.T) {
+	expected := errors.New("failed")
+	subscriber, err := NewSubscriber(MetricTopic, JSONCodec, func(_ context.Context, _ string, _ Metric) error {
+		return expected
+	})
+	require.NoError(t, err)
+
+	err = subscriber.Handle(NewMessage("org.plantd.metric.pump-1.pressure", []byte(`{}`)))
+	assert.ErrorIs(t, err, expected)
+}
@@ -0,0 +1,161 @@
+// Package curve provides CurveZMQ encryption and authentication helpers.
+package curve
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	czmq "github.com/zeromq/goczmq/v4"
+)
+
+// KeyLength is the length of a Z85 encoded CURVE key.
+const KeyLength = 40
+
+// Config holds the CURVE keys of a socket, keys are Z85 encoded. The server key
+// is the public key of the server that a client connects to, it isn't used by
+// servers.
+//
+// Example:
+//
+//	public-key: "rq:rM>}U?@Lns47E1%kR.o@n%FcmmsL/@{H8]yf7"
+//	secret-key: "JTKVSB%%)wK0E.X)V>+}o?pNmC{O&4W4b!Ni{Lh6"
+//	server-key: "Yne@$w-vo<fVvi]a<NY6T1ed:M$fCG*[IaLV{hID"
+type Config struct {
+	PublicKey string `mapstructure:"public-key" yaml:"public_key"`
+	SecretKey string `mapstructure:"secret-key" yaml:"secret_key"`
+	ServerKey string `mapstructure:"server-key" yaml:"server_key"`
+}
+
+// GenerateKeys creates a new key pair.
+func GenerateKeys() (publicKey, secretKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	if publicKey, err = z85Encode(key.PublicKey().Bytes()); err != nil {
+		return "", "", err
+	}
+	if secretKey, err = z85Encode(key.Bytes()); err != nil {
+		return "", "", err
+	}
+	return publicKey, secretKey, nil
+}
+
+// Enabled is true when the configuration has a key pair, a nil configuration
+// is disabled.
+func (c *Config) Enabled() bool {
+	return c != nil && c.PublicKey != "" && c.SecretKey != ""
+}
+
+// Validate checks that the keys are well formed.
+func (c *Config) Validate() error {
+	if c == nil || (c.PublicKey == "" && c.SecretKey == "" && c.ServerKey == "") {
+		return nil
+	}
+	if !c.Enabled() {
+		return errors.New("curve public and secret keys must both be set")
+	}
+
+	keys := map[string]string{"public": c.PublicKey, "secret": c.SecretKey}
+	if c.ServerKey != "" {
+		keys["server"] = c.ServerKey
+	}
+	for name, key := range keys {
+		if _, err := decodeKey(key); err != nil {
+			return fmt.Errorf("invalid curve %s key: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ServerOptions returns the socket options for a CURVE server, nothing is
+// returned when the configuration is disabled.
+func (c *Config) ServerOptions() []czmq.SockOption {
+	if !c.Enabled() {
+		return nil
+	}
+	return []czmq.SockOption{
+		czmq.SockSetCurveServer(1),
+		czmq.SockSetCurvePublickey(c.PublicKey),
+		czmq.SockSetCurveSecretkey(c.SecretKey),
+	}
+}
+
+// ClientOptions returns the socket options for a CURVE client, nothing is
+// returned when the configuration is disabled.
+func (c *Config) ClientOptions() []czmq.SockOption {
+	if !c.Enabled() {
+		return nil
+	}
+	return []czmq.SockOption{
+		czmq.SockSetCurveServerkey(c.ServerKey),
+		czmq.SockSetCurvePublickey(c.PublicKey),
+		czmq.SockSetCurveSecretkey(c.SecretKey),
+	}
+}
+
+// Proof creates a proof that the client holds the secret key for its public
+// key. Only the server can verify it, so it must only be sent over a CURVE
+// connection where it can't be observed.
+func (c *Config) Proof(data string) (string, error) {
+	if !c.Enabled() {
+		return "", errors.New("curve is not enabled")
+	}
+	return proof(c.SecretKey, c.ServerKey, data)
+}
+
+// Verify checks a proof that a client created with Proof.
+func (c *Config) Verify(publicKey, data, digest string) bool {
+	if !c.Enabled() {
+		return false
+	}
+	expected, err := proof(c.SecretKey, publicKey, data)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(expected), []byte(digest))
+}
+
+// proof signs the data with the secret that the two key pairs share, which
+// either side can compute from its own secret key and the other's public key.
+func proof(secretKey, publicKey, data string) (string, error) {
+	secret, err := decodeKey(secretKey)
+	if err != nil {
+		return "", err
+	}
+	public, err := decodeKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	private, err := ecdh.X25519().NewPrivateKey(secret)
+	if err != nil {
+		return "", err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// decodeKey converts a Z85 key to binary.
+func decodeKey(key string) ([]byte, error) {
+	if len(key) != KeyLength {
+		return nil, fmt.Errorf("key must be %d characters", KeyLength)
+	}
+	return z85Decode(key)
+}
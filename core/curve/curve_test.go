@@ -0,0 +1,77 @@
+package curve
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZ85(t *testing.T) {
+	// test vector from the Z85 specification
+	data := []byte{0x86, 0x4F, 0xD2, 0x6F, 0xB5, 0x59, 0xF7, 0x5B}
+
+	text, err := z85Encode(data)
+	require.NoError(t, err)
+	assert.Equal(t, "HelloWorld", text)
+
+	decoded, err := z85Decode(text)
+	require.NoError(t, err)
+	assert.Equal(t, data, decoded)
+
+	_, err = z85Encode([]byte{1, 2, 3})
+	assert.Error(t, err)
+	_, err = z85Decode("Hello")
+	assert.NoError(t, err)
+	_, err = z85Decode("Hell~")
+	assert.Error(t, err)
+	_, err = z85Decode("Hell")
+	assert.Error(t, err)
+}
+
+func TestConfig(t *testing.T) {
+	var disabled *Config
+	assert.False(t, disabled.Enabled())
+	assert.NoError(t, disabled.Validate())
+	assert.Nil(t, disabled.ServerOptions())
+	assert.Nil(t, disabled.ClientOptions())
+
+	public, secret, err := GenerateKeys()
+	require.NoError(t, err)
+	assert.Len(t, public, KeyLength)
+	assert.Len(t, secret, KeyLength)
+
+	config := &Config{PublicKey: public, SecretKey: secret}
+	assert.True(t, config.Enabled())
+	assert.NoError(t, config.Validate())
+
+	assert.Error(t, (&Config{PublicKey: public}).Validate())
+	assert.Error(t, (&Config{PublicKey: public, SecretKey: "short"}).Validate())
+	assert.Error(t, (&Config{PublicKey: public, SecretKey: secret, ServerKey: "short"}).Validate())
+}
+
+func TestProof(t *testing.T) {
+	serverPublic, serverSecret, err := GenerateKeys()
+	require.NoError(t, err)
+	clientPublic, clientSecret, err := GenerateKeys()
+	require.NoError(t, err)
+	otherPublic, otherSecret, err := GenerateKeys()
+	require.NoError(t, err)
+
+	server := &Config{PublicKey: serverPublic, SecretKey: serverSecret}
+	client := &Config{PublicKey: clientPublic, SecretKey: clientSecret, ServerKey: serverPublic}
+	other := &Config{PublicKey: otherPublic, SecretKey: otherSecret, ServerKey: serverPublic}
+
+	digest, err := client.Proof("org.plantd.State")
+	require.NoError(t, err)
+	assert.True(t, server.Verify(clientPublic, "org.plantd.State", digest))
+	assert.False(t, server.Verify(clientPublic, "org.plantd.Echo", digest))
+
+	// a client can't claim a key that it doesn't hold
+	forged, err := other.Proof("org.plantd.State")
+	require.NoError(t, err)
+	assert.False(t, server.Verify(clientPublic, "org.plantd.State", forged))
+
+	_, err = (&Config{}).Proof("org.plantd.State")
+	assert.Error(t, err)
+}
@@ -0,0 +1,58 @@
+package curve
+
+import (
+	"errors"
+	"strings"
+)
+
+// Z85 is the encoding used by ZeroMQ for printable CURVE keys, see
+// https://rfc.zeromq.org/spec/32/.
+const z85Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+var errZ85Length = errors.New("z85 data must be a multiple of 4 bytes")
+
+// z85Encode encodes binary data, the length must be a multiple of 4.
+func z85Encode(data []byte) (string, error) {
+	if len(data)%4 != 0 {
+		return "", errZ85Length
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(data) * 5 / 4)
+	for i := 0; i < len(data); i += 4 {
+		value := uint32(data[i])<<24 | uint32(data[i+1])<<16 | uint32(data[i+2])<<8 | uint32(data[i+3])
+		var chunk [5]byte
+		for j := 4; j >= 0; j-- {
+			chunk[j] = z85Alphabet[value%85]
+			value /= 85
+		}
+		sb.Write(chunk[:])
+	}
+
+	return sb.String(), nil
+}
+
+// z85Decode decodes Z85 text, the length must be a multiple of 5.
+func z85Decode(text string) ([]byte, error) {
+	if len(text)%5 != 0 {
+		return nil, errors.New("z85 text must be a multiple of 5 characters")
+	}
+
+	data := make([]byte, 0, len(text)*4/5)
+	for i := 0; i < len(text); i += 5 {
+		var value uint64
+		for j := 0; j < 5; j++ {
+			index := strings.IndexByte(z85Alphabet, text[i+j])
+			if index < 0 {
+				return nil, errors.New("invalid z85 character")
+			}
+			value = value*85 + uint64(index)
+		}
+		if value > 0xffffffff {
+			return nil, errors.New("invalid z85 block")
+		}
+		data = append(data, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+
+	return data, nil
+}
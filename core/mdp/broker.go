@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"runtime"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/geoffjay/plantd/core/util"
@@ -24,42 +26,102 @@ type Broker struct {
 	isBound      bool                     // if the socket is bound to an endpoint
 	ErrorChannel chan error
 	EventChannel chan Event
+	config       *Config      // broker configuration
+	mmi          *MMIHandler  // handles management interface requests
+	startedAt    time.Time    // used to report uptime
+	mu           sync.RWMutex // guards services and workers while messages are processed
 	// Request durability support
 	requestManager *RequestManager // manages request persistence and retry
 	cleanupTicker  *time.Ticker    // periodic cleanup of expired requests
+	// Federation support
+	cluster    *ClusterManager       // peer brokers, nil unless cluster mode is enabled
+	forwarders map[string]*forwarder // sockets relaying requests to peer brokers
+	poller     *czmq.Poller          // poller used by Run, forwarders are added to it
+	// Worker authorization
+	challenges map[string]challenge // nonces issued to registering workers by sender
 }
 
 // Service defines a single service instance.
 type Service struct {
 	broker   *Broker         // Broker instance
 	name     string          // Service name
-	requests [][]string      // list of client requests
+	requests []*Request      // list of client requests
 	waiting  []*brokerWorker // list of waiting workers
+	served   int64           // requests completed by a worker
+	failed   int64           // requests that were rejected or abandoned
+	active   time.Time       // last time a request or reply was seen
 }
 
 // brokerWorker defines a single worker, idle or active.
 type brokerWorker struct {
-	broker        *Broker   // Broker instance
-	idString      string    // ID of worker as string
-	identity      string    // ID frame for routing
-	service       *Service  // owning service, if known
-	expiry        time.Time // expires at unless heartbeat
-	totalRequests int64
+	broker        *Broker    // Broker instance
+	idString      string     // ID of worker as string
+	identity      string     // ID frame for routing
+	service       *Service   // owning service, if known
+	expiry        time.Time  // expires at unless heartbeat
+	requests      []*Request // requests being processed, oldest first
+	capacity      int        // requests the worker accepts at once
+	totalRequests int64      // requests completed by the worker
 }
 
 // WorkerInfo is used to return certain information about a worker.
 type WorkerInfo struct {
-	ID            string `json:"id"`
-	Identity      string `json:"identity"`
-	ServiceName   string `json:"service-name"`
-	TotalRequests int64  `json:"total-requests"`
+	ID            string    `json:"id"`
+	Identity      string    `json:"identity"`
+	ServiceName   string    `json:"service-name"`
+	TotalRequests int64     `json:"total-requests"`
+	Status        string    `json:"status"`
+	Request       string    `json:"request,omitempty"`
+	Outstanding   int       `json:"outstanding"`
+	Capacity      int       `json:"capacity"`
+	Expiry        time.Time `json:"expiry"`
 }
 
-// NewBroker creates a new broker instance.
+// ServiceInfo is used to return the state of a service.
+type ServiceInfo struct {
+	Name    string `json:"name"`
+	Waiting int    `json:"waiting"`
+	Busy    int    `json:"busy"`
+	Queued  int    `json:"queued"`
+	Served  int64  `json:"served"`
+	Failed  int64  `json:"failed"`
+
+	LastActivity time.Time `json:"last-activity"`
+}
+
+// Worker status values reported in WorkerInfo.
+const (
+	WorkerStatusWaiting = "waiting"
+	WorkerStatusBusy    = "busy"
+)
+
+// NewBroker creates a new broker instance using the default configuration.
 func NewBroker(endpoint string) (broker *Broker, err error) {
+	return NewBrokerWithConfig(endpoint, DefaultConfig())
+}
+
+// NewBrokerWithConfig creates a new broker instance. When request persistence
+// is enabled in the configuration pending requests are kept on disk, and any
+// that were left over from a previous run are queued again.
+func NewBrokerWithConfig(endpoint string, config *Config) (broker *Broker, err error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+
 	// Initialize persistence store
-	persistenceStore := NewMemoryPersistenceStore()
+	var persistenceStore PersistenceStore
+	if config.PersistRequests {
+		options := BoltOptions{NoSync: config.PersistNoSync}
+		if persistenceStore, err = NewBoltPersistenceStoreWithOptions(config.PersistPath, options); err != nil {
+			return nil, err
+		}
+	} else {
+		persistenceStore = NewMemoryPersistenceStore()
+	}
 	requestManager := NewRequestManager(persistenceStore)
+	if config.MaxRetries > 0 {
+		requestManager.SetMaxRetries(config.MaxRetries)
+	}
 
 	broker = &Broker{
 		endpoint:       endpoint,
@@ -70,9 +132,36 @@ func NewBroker(endpoint string) (broker *Broker, err error) {
 		isBound:        false,
 		ErrorChannel:   make(chan error, 1),
 		EventChannel:   make(chan Event),
+		config:         config,
 		requestManager: requestManager,
 		cleanupTicker:  time.NewTicker(1 * time.Minute), // cleanup every minute
+		forwarders:     make(map[string]*forwarder),
+		challenges:     make(map[string]challenge),
+		startedAt:      time.Now(),
 	}
+	broker.mmi = NewMMIHandler(broker)
+
+	if config.ClusterMode {
+		broker.cluster, err = NewClusterManager(ClusterConfig{
+			LocalID:           config.ClusterNodeID,
+			LocalEndpoint:     config.ClusterAdvertise,
+			DiscoveryEndpoint: config.ClusterDiscovery,
+			HeartbeatInterval: config.HeartbeatInterval,
+			FailureThreshold:  config.HeartbeatLiveness,
+			Peers:             config.ClusterPeers,
+		})
+		if err != nil {
+			_ = requestManager.Close()
+			return nil, err
+		}
+		if config.Curve.Enabled() && len(config.ClusterPeerKeys) == 0 {
+			log.WithFields(log.Fields{
+				"node_id": config.ClusterNodeID,
+			}).Info("no cluster peer keys, peer brokers must share this broker's CURVE key pair")
+		}
+	}
+
+	broker.restorePendingRequests()
 
 	// Start cleanup goroutine for expired requests
 	go broker.cleanupExpiredRequests()
@@ -80,20 +169,110 @@ func NewBroker(endpoint string) (broker *Broker, err error) {
 	return
 }
 
+// restorePendingRequests queues any requests that were persisted but not
+// completed, oldest first, so they are dispatched once workers are available.
+func (b *Broker) restorePendingRequests() {
+	requests, err := b.requestManager.GetPendingRequests()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("failed to load pending requests")
+		return
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Timestamp.Before(requests[j].Timestamp)
+	})
+
+	for _, request := range requests {
+		service := b.ServiceRequire(request.Service)
+		service.requests = append(service.requests, request)
+	}
+
+	if len(requests) > 0 {
+		log.WithFields(log.Fields{
+			"requests": len(requests),
+		}).Info("restored pending requests")
+	}
+}
+
 // GetWorkerInfo is used to request all information about connected workers.
+// It is safe to call while the broker is running.
 func (b *Broker) GetWorkerInfo() []WorkerInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.workerInfo()
+}
+
+// GetServiceInfo is used to request the state of all known services. It is
+// safe to call while the broker is running.
+func (b *Broker) GetServiceInfo() []ServiceInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.serviceInfo()
+}
+
+func (b *Broker) workerInfo() []WorkerInfo {
 	var info []WorkerInfo
 	for _, worker := range b.workers {
-		info = append(info, WorkerInfo{
+		item := WorkerInfo{
 			ID:            worker.idString,
 			Identity:      worker.identity,
-			ServiceName:   worker.service.name,
 			TotalRequests: worker.totalRequests,
+			Status:        WorkerStatusWaiting,
+			Outstanding:   len(worker.requests),
+			Capacity:      worker.capacity,
+			Expiry:        worker.expiry,
+		}
+		if worker.service != nil {
+			item.ServiceName = worker.service.name
+		}
+		if request := worker.current(); request != nil {
+			item.Status = WorkerStatusBusy
+			item.Request = request.ID
+		}
+		info = append(info, item)
+	}
+
+	sort.Slice(info, func(i, j int) bool {
+		return info[i].ID < info[j].ID
+	})
+
+	return info
+}
+
+func (b *Broker) serviceInfo() []ServiceInfo {
+	busy := make(map[*Service]int)
+	for _, worker := range b.workers {
+		if worker.service != nil && len(worker.requests) > 0 {
+			busy[worker.service]++
+		}
+	}
+
+	info := make([]ServiceInfo, 0, len(b.services))
+	for _, service := range b.services {
+		info = append(info, ServiceInfo{
+			Name:    service.name,
+			Waiting: len(service.waiting),
+			Busy:    busy[service],
+			Queued:  len(service.requests),
+			Served:  service.served,
+			Failed:  service.failed,
+
+			LastActivity: service.active,
 		})
 	}
+
+	sort.Slice(info, func(i, j int) bool {
+		return info[i].Name < info[j].Name
+	})
+
 	return info
 }
 
+// Uptime returns how long ago the broker was created.
+func (b *Broker) Uptime() time.Duration {
+	return time.Since(b.startedAt)
+}
+
 // nolint
 func initMonitor(socket *czmq.Sock) {
 	monitor := czmq.NewMonitor(socket)
@@ -158,6 +337,14 @@ func (b *Broker) Close() (err error) {
 		_ = b.requestManager.Close()
 	}
 
+	// Leave the cluster and drop any connections to peer brokers
+	if b.cluster != nil {
+		_ = b.cluster.Stop()
+	}
+	for key, fwd := range b.forwarders {
+		b.closeForwarder(key, fwd)
+	}
+
 	if b.isBound && b.Socket != nil {
 		err = b.Socket.Unbind(b.endpoint)
 		b.Socket.Destroy()
@@ -170,10 +357,16 @@ func (b *Broker) Close() (err error) {
 	return
 }
 
+// expiringStore is implemented by persistence stores that can remove expired
+// requests on demand.
+type expiringStore interface {
+	CleanupExpiredRequests() int
+}
+
 // cleanupExpiredRequests periodically cleans up expired requests
 func (b *Broker) cleanupExpiredRequests() {
 	for range b.cleanupTicker.C {
-		if store, ok := b.requestManager.store.(*MemoryPersistenceStore); ok {
+		if store, ok := b.requestManager.store.(expiringStore); ok {
 			removed := store.CleanupExpiredRequests()
 			if removed > 0 {
 				log.WithFields(log.Fields{
@@ -188,7 +381,7 @@ func (b *Broker) cleanupExpiredRequests() {
 // Note that MDP uses a single socket for both clients and workers.
 func (b *Broker) Bind() (err error) {
 	// creating the socket binds by default
-	b.Socket, err = czmq.NewRouter(b.endpoint)
+	b.Socket, err = czmq.NewRouter(b.endpoint, b.config.Curve.ServerOptions()...)
 	if err != nil {
 		b.ErrorChannel <- err
 		log.WithFields(log.Fields{
@@ -207,6 +400,16 @@ func (b *Broker) Bind() (err error) {
 		b.EventChannel <- NewBrokerEvent(fmt.Sprintf("broker bound to endpoint %s", b.endpoint))
 	}()
 
+	if b.cluster != nil {
+		if err = b.cluster.Start(); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"endpoint": b.endpoint,
+			}).Error("MDP broker/0.2.0 failed to join cluster")
+			return err
+		}
+	}
+
 	err = nil
 	log.WithFields(log.Fields{
 		"endpoint": b.endpoint,
@@ -221,6 +424,10 @@ func (b *Broker) Bind() (err error) {
 // nolint: cyclop
 func (b *Broker) Run(done chan bool) {
 	poller, _ := czmq.NewPoller(b.Socket)
+	b.poller = poller
+	for _, fwd := range b.forwarders {
+		_ = poller.Add(fwd.socket)
+	}
 
 	log.Debug("starting broker...")
 	for {
@@ -232,6 +439,9 @@ func (b *Broker) Run(done chan bool) {
 			log.WithFields(log.Fields{
 				"timeout (ms)": int(HeartbeatInterval) / 1e6,
 			}).Trace("no messages received on broker endpoint for the timeout duration")
+		} else if socket != b.Socket {
+			// Replies from peer brokers to forwarded requests
+			b.ForwarderMsg(socket)
 		} else {
 			recv, _ := socket.RecvMessage()
 			msg := byte2DToStringArray(recv)
@@ -320,7 +530,13 @@ func (b *Broker) Run(done chan bool) {
 
 		// disconnect and delete any expired workers sending heartbeats to idle workers if needed
 		if time.Now().After(b.HeartbeatAt) {
+			b.mu.Lock()
 			b.Purge()
+			b.PurgeBusy()
+			b.purgeChallenges()
+			if b.cluster != nil {
+				b.updateCluster()
+			}
 			for _, worker := range b.Waiting {
 				log.WithFields(log.Fields{
 					"service": worker.service.name,
@@ -333,6 +549,7 @@ func (b *Broker) Run(done chan bool) {
 				}
 			}
 			b.HeartbeatAt = time.Now().Add(HeartbeatInterval)
+			b.mu.Unlock()
 		}
 	}
 
@@ -343,6 +560,9 @@ func (b *Broker) Run(done chan bool) {
 // to the broker by a worker.
 // nolint: cyclop
 func (b *Broker) WorkerMsg(sender string, msg []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	// at least, command
 	if len(msg) == 0 {
 		log.Error("zero length message")
@@ -352,7 +572,6 @@ func (b *Broker) WorkerMsg(sender string, msg []string) {
 	idString := fmt.Sprintf("%q", sender)
 	_, workerReady := b.workers[idString]
 	worker := b.workerRequire(sender)
-	worker.totalRequests++
 
 	switch command {
 	case MdpwReady:
@@ -363,8 +582,22 @@ func (b *Broker) WorkerMsg(sender string, msg []string) {
 		case len(sender) >= 4 /* reserved service name */ && sender[:4] == MMINamespace:
 			worker.Delete(true)
 		default:
+			headers, _ := splitHeaders(msg[1:])
+			if err := b.authorizeWorker(sender, msg[0], headers); err != nil {
+				if !errors.Is(err, errWorkerChallenged) {
+					log.WithFields(log.Fields{
+						"error":   err,
+						"service": msg[0],
+					}).Warn("rejected worker registration")
+				}
+				// a disconnect would have the worker retry right away, without
+				// one it only hears back on its next heartbeat
+				worker.Delete(false)
+				return
+			}
 			// attach worker to service and mark as idle
 			worker.service = b.ServiceRequire(msg[0])
+			worker.capacity = parseCapacity(headers)
 			worker.Waiting()
 		}
 	case MdpwPartial:
@@ -372,14 +605,17 @@ func (b *Broker) WorkerMsg(sender string, msg []string) {
 			// remove & save client return envelope and insert the
 			// protocol header and service name, then re-wrap envelope.
 			client, msg := util.Unwrap(msg)
-			snd := stringArrayToByte2D(append(
-				[]string{client, MdpcClient, MdpcPartial, worker.service.name}, msg...))
+			header := append([]string{client, MdpcClient, MdpcPartial, worker.service.name},
+				worker.current().replyHeaders()...)
+			snd := stringArrayToByte2D(append(header, msg...))
 			if err := b.Socket.SendMessage(snd); err != nil {
 				b.ErrorChannel <- err
 				log.WithFields(log.Fields{"error": err}).Error("failed to send partial message to client")
 				return
 			}
 			// Don't set worker to waiting for partial responses - wait for final
+			worker.refreshExpiry()
+			worker.service.active = time.Now()
 		} else {
 			worker.Delete(true)
 		}
@@ -388,20 +624,22 @@ func (b *Broker) WorkerMsg(sender string, msg []string) {
 			// remove & save client return envelope and insert the
 			// protocol header and service name, then re-wrap envelope.
 			client, msg := util.Unwrap(msg)
-			snd := stringArrayToByte2D(append(
-				[]string{client, MdpcClient, MdpcFinal, worker.service.name}, msg...))
+			header := append([]string{client, MdpcClient, MdpcFinal, worker.service.name},
+				worker.current().replyHeaders()...)
+			snd := stringArrayToByte2D(append(header, msg...))
 			if err := b.Socket.SendMessage(snd); err != nil {
 				b.ErrorChannel <- err
 				log.WithFields(log.Fields{"error": err}).Error("failed to send final message to client")
 				return
 			}
+			worker.completeRequest()
 			worker.Waiting()
 		} else {
 			worker.Delete(true)
 		}
 	case MdpwHeartbeat:
 		if workerReady {
-			worker.expiry = time.Now().Add(HeartbeatExpiry)
+			worker.refreshExpiry()
 		} else {
 			worker.Delete(true)
 		}
@@ -419,8 +657,11 @@ func (b *Broker) WorkerMsg(sender string, msg []string) {
 // directly here (at present, we implement only the mmi.service request).
 // nolint: nestif
 func (b *Broker) ClientMsg(sender string, msg []string) {
-	// the message should contain the service name and message body
-	if len(msg) < 2 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// the message should contain the service name, MMI requests may omit the body
+	if len(msg) == 0 || (len(msg) < 2 && !IsMMIService(msg[0])) {
 		err := errors.New("message contains less than 2 frames")
 		b.ErrorChannel <- err
 		// XXX: this is a panic() in the example
@@ -429,38 +670,51 @@ func (b *Broker) ClientMsg(sender string, msg []string) {
 	}
 
 	serviceFrame, msg := util.PopStr(msg)
-	service := b.ServiceRequire(serviceFrame)
-
-	// Set reply return identity to client sender
-	m := []string{sender, ""}
-	msg = append(m, msg...)
 
 	// If we got a MMI service request, process that internally
-	if len(serviceFrame) >= 4 && serviceFrame[:4] == MMINamespace {
-		var returnCode string
-		if serviceFrame == MMIService {
-			name := msg[len(msg)-1]
-			service, ok := b.services[name]
-			if ok && len(service.waiting) > 0 {
-				returnCode = "200"
-			} else {
-				returnCode = "404"
-			}
-		} else {
-			returnCode = "501"
+	if IsMMIService(serviceFrame) {
+		headers, body := splitHeaders(msg)
+		reply, err := b.mmi.HandleRequest(serviceFrame, body)
+		if err != nil {
+			reply = []string{MMICodeError, err.Error()}
 		}
 
-		msg[len(msg)-1] = returnCode
-
-		// remove & save client return envelope and insert the
-		// protocol header and service name, then re-wrap envelope.
-		client, msg := util.Unwrap(msg)
-		snd := stringArrayToByte2D(append([]string{client, MdpcClient, MdpcFinal, serviceFrame}, msg...))
+		header := append([]string{sender, MdpcClient, MdpcFinal, serviceFrame}, tagHeaders(headers)...)
+		snd := stringArrayToByte2D(append(header, reply...))
 		if err := b.Socket.SendMessage(snd); err != nil {
 			b.ErrorChannel <- err
 			log.WithFields(log.Fields{"error": err}).Error("failed to send message to client")
 		}
 	} else {
+		service := b.ServiceRequire(serviceFrame)
+		service.active = time.Now()
+
+		// Set reply return identity to client sender
+		m := []string{sender, ""}
+		msg = append(m, msg...)
+
+		// Without local workers the request can be handled by a peer broker
+		if b.forwardRequest(sender, service, msg[2:]) {
+			return
+		}
+
+		// Reject the request outright when the service can't keep up, so that
+		// the client can back off instead of growing the queue
+		service.dropExpired()
+		if reason, overloaded := service.overloaded(); overloaded {
+			log.WithFields(log.Fields{
+				"client":  sender,
+				"service": serviceFrame,
+				"queued":  len(service.requests),
+				"reason":  reason,
+			}).Warn("rejected request for overloaded service")
+			service.failed++
+			headers, _ := splitHeaders(msg[2:])
+			b.sendClientError(sender, serviceFrame, tagHeaders(headers),
+				NewServiceOverloadedError(serviceFrame, reason))
+			return
+		}
+
 		// Phase 3: Persist request for durability before dispatching
 		request, err := b.requestManager.CreateRequest(sender, serviceFrame, msg)
 		if err != nil {
@@ -479,35 +733,96 @@ func (b *Broker) ClientMsg(sender string, msg []string) {
 			"service":    serviceFrame,
 		}).Debug("persisted client request")
 
-		// Mark as processing and dispatch to service
-		if err := b.requestManager.MarkRequestProcessing(request.ID); err != nil {
-			log.WithFields(log.Fields{
-				"error":      err,
-				"request_id": request.ID,
-			}).Warn("failed to mark request as processing")
-		}
-
 		// else dispatch the message to the requested service
-		service.Dispatch(msg)
+		service.Dispatch(request)
 	}
 }
 
-// Purge deletes any idle workers that haven't pinged us in a
-// while. We hold workers from oldest to most recent, so we can stop
-// scanning whenever we find a live worker. This means we'll mainly stop
-// at the first worker, which is essential when we have large numbers of
-// workers (since we call this method in our critical path).
+// Purge deletes any waiting workers that haven't pinged us in a while.
+// Workers that accept more than one request stay in the waiting list while
+// they hold requests and can be given the busy timeout, so the list isn't
+// ordered by expiry and is scanned in full.
 func (b *Broker) Purge() {
 	now := time.Now()
-	for len(b.Waiting) > 0 {
-		if b.Waiting[0].expiry.After(now) {
-			// worker is alive, we're done here
-			break
+	var expired []*brokerWorker
+	for _, worker := range b.Waiting {
+		if worker.expiry.Before(now) {
+			expired = append(expired, worker)
 		}
+	}
+	for _, worker := range expired {
 		log.WithFields(log.Fields{
-			"worker": b.Waiting[0].idString,
+			"worker": worker.idString,
 		}).Debug("deleting expired worker")
-		b.Waiting[0].Delete(false)
+		worker.Delete(false)
+	}
+}
+
+// PurgeBusy deletes any workers that have held a request for longer than the
+// busy timeout without replying, nothing is deleted when it isn't set. Busy
+// workers at capacity aren't in the waiting list so they have to be found by
+// scanning all known workers, this is only done when heartbeats are due rather
+// than on every dispatch.
+func (b *Broker) PurgeBusy() {
+	if b.config.WorkerBusyTimeout == 0 {
+		return
+	}
+	now := time.Now()
+	for _, worker := range b.workers {
+		if request := worker.current(); request != nil && worker.expiry.Before(now) {
+			log.WithFields(log.Fields{
+				"worker":     worker.idString,
+				"request_id": request.ID,
+			}).Warn("deleting unresponsive busy worker")
+			worker.Delete(false)
+		}
+	}
+}
+
+// requeueRequest puts a request that was lost along with its worker back at the
+// front of the service queue. Once the retry limit for the request has been
+// reached the client is sent an error instead.
+func (b *Broker) requeueRequest(request *Request) {
+	retried, err := b.requestManager.RetryRequest(request.ID)
+	if err != nil {
+		// the request can't be retried, so the client hears about it now
+		// rather than waiting out its own timeout
+		log.WithFields(log.Fields{
+			"error":      err,
+			"request_id": request.ID,
+		}).Warn("failed to retry request")
+		b.ServiceRequire(request.Service).failed++
+		b.sendClientError(request.Client, request.Service, request.replyHeaders(),
+			NewRequestFailedError(request.ID, request.Retries+1))
+		return
+	}
+
+	if retried.Status == StatusFailed {
+		b.ServiceRequire(retried.Service).failed++
+		b.sendClientError(retried.Client, retried.Service, retried.replyHeaders(),
+			NewRequestFailedError(retried.ID, retried.Retries))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"request_id": retried.ID,
+		"service":    retried.Service,
+		"retries":    retried.Retries,
+	}).Info("requeued request from lost worker")
+
+	service := b.ServiceRequire(retried.Service)
+	service.requests = append([]*Request{retried}, service.requests...)
+	service.Dispatch(nil)
+}
+
+// sendClientError replies to a client with an error in place of a response
+// from a worker. The headers are placed ahead of the error code.
+func (b *Broker) sendClientError(client, service string, headers []string, mdpErr *Error) {
+	frames := append([]string{client, MdpcClient, MdpcError, service}, headers...)
+	snd := stringArrayToByte2D(append(frames, mdpErr.Code, mdpErr.Message))
+	if err := b.Socket.SendMessage(snd); err != nil {
+		b.ErrorChannel <- err
+		log.WithFields(log.Fields{"error": err}).Error("failed to send error message to client")
 	}
 }
 
@@ -520,7 +835,7 @@ func (b *Broker) ServiceRequire(serviceFrame string) (service *Service) {
 		service = &Service{
 			broker:   b,
 			name:     name,
-			requests: make([][]string, 0),
+			requests: make([]*Request, 0),
 			waiting:  make([]*brokerWorker, 0),
 		}
 		b.services[name] = service
@@ -530,25 +845,87 @@ func (b *Broker) ServiceRequire(serviceFrame string) (service *Service) {
 }
 
 // Dispatch sends requests to waiting workers.
-func (s *Service) Dispatch(msg []string) {
-	if len(msg) > 0 {
-		// queue message if any
-		s.requests = append(s.requests, msg)
+func (s *Service) Dispatch(request *Request) {
+	if request != nil {
+		// queue request if any
+		s.requests = append(s.requests, request)
 	}
 
+	s.dropExpired()
+
 	s.broker.Purge()
 	for len(s.waiting) > 0 && len(s.requests) > 0 {
-		var worker *brokerWorker
-		worker, s.waiting = popWorker(s.waiting)
+		worker := s.selectWorker(s.requests[0])
+		request, s.requests = popRequest(s.requests)
+
+		// the worker goes to the back of the waiting lists, or leaves them
+		// when it has reached its capacity
+		s.waiting = delWorker(s.waiting, worker)
 		s.broker.Waiting = delWorker(s.broker.Waiting, worker)
-		msg, s.requests = util.PopMsg(s.requests)
-		if err := worker.Send(MdpwRequest, "", msg); err != nil {
+		worker.requests = append(worker.requests, request)
+		if worker.available() {
+			s.waiting = append(s.waiting, worker)
+			s.broker.Waiting = append(s.broker.Waiting, worker)
+		}
+		worker.refreshExpiry()
+		if err := s.broker.requestManager.MarkRequestProcessing(request.ID); err != nil {
+			log.WithFields(log.Fields{
+				"error":      err,
+				"request_id": request.ID,
+			}).Warn("failed to mark request as processing")
+		}
+		if err := worker.Send(MdpwRequest, "", request.Data); err != nil {
 			s.broker.ErrorChannel <- err
 			log.WithFields(log.Fields{"error": err}).Error("failed to dispatch request to worker")
 		}
 	}
 }
 
+// dropExpired removes queued requests that have passed their deadline, the
+// clients have given up on them so they aren't worth dispatching.
+func (s *Service) dropExpired() {
+	now := time.Now()
+	requests := s.requests[:0]
+	for _, request := range s.requests {
+		if !request.pastDeadline(now) {
+			requests = append(requests, request)
+			continue
+		}
+
+		s.failed++
+		if err := s.broker.requestManager.ExpireRequest(request.ID); err != nil {
+			log.WithFields(log.Fields{
+				"error":      err,
+				"request_id": request.ID,
+			}).Warn("failed to remove expired request")
+		}
+
+		log.WithFields(log.Fields{
+			"request_id": request.ID,
+			"client":     request.Client,
+			"service":    s.name,
+		}).Debug("dropped request past its deadline")
+	}
+	s.requests = requests
+}
+
+// overloaded checks the request queue against the configured limits, the
+// reason is returned if a new request should be rejected.
+func (s *Service) overloaded() (string, bool) {
+	config := s.broker.config
+	if config.MaxServiceQueueDepth > 0 && len(s.requests) >= config.MaxServiceQueueDepth {
+		return fmt.Sprintf("queue depth limit of %d reached", config.MaxServiceQueueDepth), true
+	}
+
+	if config.MaxServiceRequestAge > 0 && len(s.requests) > 0 {
+		if age := time.Since(s.requests[0].Timestamp); age > config.MaxServiceRequestAge {
+			return fmt.Sprintf("oldest queued request waited %s", age.Round(time.Millisecond)), true
+		}
+	}
+
+	return "", false
+}
+
 // workerRequire is a lazy constructor that locates a worker by identity, or
 // creates a new worker if there is no worker already with that identity.
 func (b *Broker) workerRequire(identity string) (worker *brokerWorker) {
@@ -560,6 +937,7 @@ func (b *Broker) workerRequire(identity string) (worker *brokerWorker) {
 			broker:   b,
 			idString: idString,
 			identity: identity,
+			capacity: 1,
 		}
 		b.workers[idString] = worker
 		log.WithFields(log.Fields{"id": idString}).Debug("registering new worker")
@@ -582,6 +960,14 @@ func (w *brokerWorker) Delete(disconnect bool) {
 
 	w.broker.Waiting = delWorker(w.broker.Waiting, w)
 	delete(w.broker.workers, w.idString)
+
+	// the worker was lost while it held requests, give them to other workers
+	// in reverse so that they're back at the front of the queue in order
+	requests := w.requests
+	w.requests = nil
+	for i := len(requests) - 1; i >= 0; i-- {
+		w.broker.requeueRequest(requests[i])
+	}
 }
 
 // Send formats and sends a command to a worker using MDP v0.2 format (no empty frames).
@@ -614,11 +1000,62 @@ func (w *brokerWorker) Send(command, option string, msg []string) (err error) {
 	return
 }
 
+// current returns the oldest request the worker holds, replies from the
+// worker belong to it because workers handle requests in order.
+func (w *brokerWorker) current() *Request {
+	if len(w.requests) == 0 {
+		return nil
+	}
+	return w.requests[0]
+}
+
+// available is true while the worker holds fewer requests than its capacity.
+func (w *brokerWorker) available() bool {
+	return len(w.requests) < w.capacity
+}
+
+// completeRequest removes the request the worker was processing from the
+// persistence store after the final reply has been returned to the client.
+func (w *brokerWorker) completeRequest() {
+	request := w.current()
+	if request == nil {
+		return
+	}
+
+	w.totalRequests++
+	if w.service != nil {
+		w.service.served++
+		w.service.active = time.Now()
+	}
+
+	if err := w.broker.requestManager.MarkRequestCompleted(request.ID); err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"request_id": request.ID,
+		}).Warn("failed to mark request as completed")
+	}
+	w.requests = w.requests[1:]
+}
+
+// refreshExpiry extends the time the worker is considered alive for. Workers
+// that hold requests don't send heartbeats so they're given the busy timeout
+// when there is one.
+func (w *brokerWorker) refreshExpiry() {
+	if len(w.requests) > 0 && w.broker.config.WorkerBusyTimeout > 0 {
+		w.expiry = time.Now().Add(w.broker.config.WorkerBusyTimeout)
+	} else {
+		w.expiry = time.Now().Add(HeartbeatExpiry)
+	}
+}
+
 // Waiting checks if a worker is expecting work.
 func (w *brokerWorker) Waiting() {
-	// queue to broker and service waiting lists
-	w.broker.Waiting = append(w.broker.Waiting, w)
-	w.service.waiting = append(w.service.waiting, w)
-	w.expiry = time.Now().Add(HeartbeatExpiry)
-	w.service.Dispatch([]string{})
+	// queue to broker and service waiting lists, a worker with spare capacity
+	// is already in them
+	if !containsWorker(w.service.waiting, w) {
+		w.broker.Waiting = append(w.broker.Waiting, w)
+		w.service.waiting = append(w.service.waiting, w)
+	}
+	w.refreshExpiry()
+	w.service.Dispatch(nil)
 }
@@ -1,5 +1,151 @@
 package mdp
 
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerRequeuesRequestFromLostWorker(t *testing.T) {
+	broker, err := NewBroker("tcp://*:0")
+	require.NoError(t, err)
+	defer broker.Close() //nolint:errcheck
+
+	service := broker.ServiceRequire("echo")
+	held, err := broker.requestManager.CreateRequest("client-001", "echo", []string{"client-001", "", "held"})
+	require.NoError(t, err)
+	queued, err := broker.requestManager.CreateRequest("client-002", "echo", []string{"client-002", "", "queued"})
+	require.NoError(t, err)
+	service.requests = append(service.requests, queued)
+
+	worker := broker.workerRequire("worker-001")
+	worker.service = service
+	worker.requests = []*Request{held}
+
+	worker.Delete(false)
+
+	_, exists := broker.workers[worker.idString]
+	assert.False(t, exists)
+	require.Len(t, service.requests, 2)
+	assert.Equal(t, held.ID, service.requests[0].ID)
+	assert.Equal(t, 1, service.requests[0].Retries)
+	assert.Equal(t, queued.ID, service.requests[1].ID)
+}
+
+func TestBrokerFailsRequestThatCannotBeRetried(t *testing.T) {
+	broker, err := NewBroker("tcp://*:0")
+	require.NoError(t, err)
+	defer broker.Close() //nolint:errcheck
+
+	service := broker.ServiceRequire("echo")
+	// a request the manager no longer has can't be retried
+	missing := &Request{ID: "request-001", Client: "client-001", Service: "echo", Timestamp: time.Now()}
+
+	worker := broker.workerRequire("worker-001")
+	worker.service = service
+	worker.requests = []*Request{missing}
+
+	worker.Delete(false)
+
+	assert.Empty(t, service.requests)
+	assert.Equal(t, int64(1), service.failed)
+}
+
+func TestBrokerPurgeBusy(t *testing.T) {
+	config := DefaultConfig()
+	config.WorkerBusyTimeout = 30 * time.Second
+
+	broker, err := NewBrokerWithConfig("tcp://*:0", config)
+	require.NoError(t, err)
+	defer broker.Close() //nolint:errcheck
+
+	service := broker.ServiceRequire("echo")
+
+	lost, err := broker.requestManager.CreateRequest("client-001", "echo", []string{"client-001", "", "lost"})
+	require.NoError(t, err)
+	expired := broker.workerRequire("worker-expired")
+	expired.service = service
+	expired.requests = []*Request{lost}
+	expired.expiry = time.Now().Add(-time.Second)
+
+	active, err := broker.requestManager.CreateRequest("client-002", "echo", []string{"client-002", "", "active"})
+	require.NoError(t, err)
+	busy := broker.workerRequire("worker-busy")
+	busy.service = service
+	busy.requests = []*Request{active}
+	busy.refreshExpiry()
+
+	broker.PurgeBusy()
+
+	_, exists := broker.workers[expired.idString]
+	assert.False(t, exists)
+	_, exists = broker.workers[busy.idString]
+	assert.True(t, exists)
+	require.Len(t, service.requests, 1)
+	assert.Equal(t, lost.ID, service.requests[0].ID)
+}
+
+func TestBrokerPurgeBusyDisabled(t *testing.T) {
+	broker, err := NewBroker("tcp://*:0")
+	require.NoError(t, err)
+	defer broker.Close() //nolint:errcheck
+
+	request, err := broker.requestManager.CreateRequest("client-001", "echo", []string{"client-001", "", "slow"})
+	require.NoError(t, err)
+	worker := broker.workerRequire("worker-slow")
+	worker.service = broker.ServiceRequire("echo")
+	worker.requests = []*Request{request}
+	worker.expiry = time.Now().Add(-time.Minute)
+
+	// workers running a long request aren't deleted by default
+	broker.PurgeBusy()
+
+	_, exists := broker.workers[worker.idString]
+	assert.True(t, exists)
+}
+
+func TestServiceOverloaded(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxServiceQueueDepth = 2
+	config.MaxServiceRequestAge = time.Minute
+
+	broker, err := NewBrokerWithConfig("tcp://*:0", config)
+	require.NoError(t, err)
+	defer broker.Close() //nolint:errcheck
+
+	service := broker.ServiceRequire("echo")
+	_, overloaded := service.overloaded()
+	assert.False(t, overloaded)
+
+	t.Run("QueueDepth", func(t *testing.T) {
+		service.requests = []*Request{
+			{ID: "request-001", Timestamp: time.Now()},
+			{ID: "request-002", Timestamp: time.Now()},
+		}
+		reason, overloaded := service.overloaded()
+		assert.True(t, overloaded)
+		assert.Contains(t, reason, "queue depth")
+	})
+
+	t.Run("RequestAge", func(t *testing.T) {
+		service.requests = []*Request{
+			{ID: "request-001", Timestamp: time.Now().Add(-2 * time.Minute)},
+		}
+		reason, overloaded := service.overloaded()
+		assert.True(t, overloaded)
+		assert.Contains(t, reason, "waited")
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		config.MaxServiceQueueDepth = 0
+		config.MaxServiceRequestAge = 0
+		_, overloaded := service.overloaded()
+		assert.False(t, overloaded)
+	})
+}
+
 // import (
 // 	"os"
 // 	"testing"
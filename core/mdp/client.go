@@ -4,10 +4,14 @@ package mdp
 // Implements the MDP/Worker spec at http://rfc.zeromq.org/spec:7.
 
 import (
+	"context"
 	"fmt"
 	"runtime"
+	"strconv"
 	"time"
 
+	"github.com/geoffjay/plantd/core/curve"
+
 	log "github.com/sirupsen/logrus"
 	czmq "github.com/zeromq/goczmq/v4"
 )
@@ -18,6 +22,8 @@ type Client struct {
 	client  *czmq.Sock    // Socket to broker
 	timeout time.Duration // Request timeout
 	poller  *czmq.Poller
+	tag     uint64        // Tag of the last request sent with RequestContext
+	curve   *curve.Config // CURVE keys, if the broker requires them
 }
 
 // ResponseStream represents a streaming response handler for MDP v0.2
@@ -71,7 +77,13 @@ func (rs *ResponseStream) Next() (msg []string, final bool, err error) {
 
 		command := recvMsg[1]
 		service := recvMsg[2]
-		data := recvMsg[3:]
+		_, data := splitHeaders(recvMsg[3:])
+
+		// The broker answered in place of a worker, this ends the stream
+		if command == MdpcError {
+			rs.finished = true
+			return nil, true, errorFromReply(data).WithContext("service", service)
+		}
 
 		// Check if this is the final response
 		if command == MdpcFinal {
@@ -105,6 +117,21 @@ func NewClient(broker string) (c *Client, err error) {
 	return
 }
 
+// NewClientWithCurve creates a new instance of an MDP client that connects to
+// the broker using CURVE encryption.
+func NewClientWithCurve(broker string, keys *curve.Config) (c *Client, err error) {
+	c = &Client{
+		broker:  broker,
+		timeout: 2500 * time.Millisecond,
+		curve:   keys,
+	}
+
+	err = c.ConnectToBroker()
+	runtime.SetFinalizer(c, (*Client).Close)
+
+	return
+}
+
 // Close the client socket.
 func (c *Client) Close() (err error) {
 	if c.poller != nil {
@@ -130,7 +157,7 @@ func (c *Client) ConnectToBroker() (err error) {
 	_ = c.Close()
 
 	// Create new DEALER socket
-	if c.client, err = czmq.NewDealer(c.broker); err != nil {
+	if c.client, err = czmq.NewDealer(c.broker, c.curve.ClientOptions()...); err != nil {
 		log.WithFields(log.Fields{
 			"broker": c.broker,
 			"error":  err,
@@ -222,6 +249,13 @@ func (c *Client) Send(service string, request ...string) (err error) {
 	return
 }
 
+// SendWithDeadline sends a request that carries a deadline. The broker drops
+// the request if it hasn't been dispatched before the deadline, and the worker
+// can use it to abandon work that the client is no longer waiting for.
+func (c *Client) SendWithDeadline(deadline time.Time, service string, request ...string) error {
+	return c.Send(service, append([]string{EncodeDeadline(deadline)}, request...)...)
+}
+
 // Recv waits for a reply message and returns that to the caller. Returns the
 // reply message or NULL if there was no reply. This method handles both PARTIAL
 // and FINAL responses but only returns the FINAL response for backward compatibility.
@@ -271,7 +305,17 @@ func (c *Client) Recv() (msg []string, err error) {
 
 		command := recvMsg[1]
 		service := recvMsg[2]
-		data := recvMsg[3:]
+		_, data := splitHeaders(recvMsg[3:])
+
+		// The broker answered in place of a worker
+		if command == MdpcError {
+			mdpErr := errorFromReply(data).WithContext("service", service)
+			log.WithFields(log.Fields{
+				"service": service,
+				"error":   mdpErr,
+			}).Debug("received error response")
+			return nil, mdpErr
+		}
 
 		// For backward compatibility, wait for FINAL response
 		// If this is PARTIAL, keep reading until FINAL
@@ -301,6 +345,88 @@ func (c *Client) Recv() (msg []string, err error) {
 	return
 }
 
+// RequestContext sends a request and waits for its reply until the context is
+// done. The request is tagged so that replies to earlier requests that arrive
+// late are discarded, and the context deadline, if any, is sent along so that
+// the broker and worker can abandon the request once it passes.
+func (c *Client) RequestContext(ctx context.Context, service string, request ...string) ([]string, error) {
+	c.tag++
+	tag := strconv.FormatUint(c.tag, 10)
+
+	headers := []string{EncodeTag(tag)}
+	if deadline, ok := ctx.Deadline(); ok {
+		headers = append(headers, EncodeDeadline(deadline))
+	}
+
+	if err := c.Send(service, append(headers, request...)...); err != nil {
+		return nil, err
+	}
+
+	return c.recvContext(ctx, tag)
+}
+
+// RecvContext waits for a reply message until the context is done, in which
+// case the context error is returned. Unlike Recv the connection is left as is
+// when no reply arrives, and PARTIAL responses are skipped.
+func (c *Client) RecvContext(ctx context.Context) ([]string, error) {
+	return c.recvContext(ctx, "")
+}
+
+// recvContext waits for the FINAL reply with the given tag, an empty tag
+// accepts the first FINAL reply received.
+func (c *Client) recvContext(ctx context.Context, tag string) ([]string, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		socket, err := c.poller.Wait(int(pollTimeout(ctx, c.timeout) / time.Millisecond))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("client failure while socket poller was waiting")
+			return nil, err
+		}
+		if socket == nil {
+			continue
+		}
+
+		recv, err := socket.RecvMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		recvMsg := byte2DToStringArray(recv)
+		if err := ValidateClientMessage(recvMsg); err != nil {
+			log.WithError(err).Error("received invalid client message")
+			return nil, fmt.Errorf("invalid message format: %w", err)
+		}
+
+		command := recvMsg[1]
+		service := recvMsg[2]
+		headers, data := splitHeaders(recvMsg[3:])
+
+		if tag != "" {
+			if replyTag, _ := headerTag(headers); replyTag != tag {
+				log.WithFields(log.Fields{
+					"service": service,
+					"tag":     replyTag,
+				}).Debug("discarded reply to an earlier request")
+				continue
+			}
+		}
+
+		switch command {
+		case MdpcPartial:
+			continue
+		case MdpcError:
+			return nil, errorFromReply(data).WithContext("service", service)
+		}
+
+		return data, nil
+	}
+}
+
 // RecvStream returns a ResponseStream for handling streaming responses with PARTIAL/FINAL support
 func (c *Client) RecvStream(service string) *ResponseStream {
 	return &ResponseStream{
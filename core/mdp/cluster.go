@@ -3,10 +3,20 @@ package mdp
 import (
 	"context"
 	"encoding/json"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	czmq "github.com/zeromq/goczmq/v4"
+)
+
+const (
+	// ClusterHeartbeatTopic prefixes heartbeat messages exchanged between brokers
+	ClusterHeartbeatTopic = "mdp.cluster.heartbeat"
+
+	// defaultFailureTimeout is used when no heartbeat based threshold is configured
+	defaultFailureTimeout = 60 * time.Second
 )
 
 // BrokerNode represents a single broker in the cluster
@@ -26,6 +36,9 @@ type ClusterManager struct {
 	localNode         *BrokerNode
 	nodes             map[string]*BrokerNode
 	discoveryEndpoint string
+	peers             []string
+	heartbeatInterval time.Duration
+	failureTimeout    time.Duration
 	heartbeatTicker   *time.Ticker
 	ctx               context.Context
 	cancel            context.CancelFunc
@@ -39,6 +52,7 @@ type ClusterConfig struct {
 	DiscoveryEndpoint string        `json:"discovery_endpoint"`
 	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
 	FailureThreshold  int           `json:"failure_threshold"`
+	Peers             []string      `json:"peers"` // discovery endpoints of the other brokers
 }
 
 // NewClusterManager creates a new cluster manager
@@ -55,10 +69,19 @@ func NewClusterManager(config ClusterConfig) (*ClusterManager, error) {
 		FailureCount: 0,
 	}
 
+	// A node is considered failed after missing the configured number of heartbeats
+	failureTimeout := defaultFailureTimeout
+	if config.FailureThreshold > 0 {
+		failureTimeout = config.HeartbeatInterval * time.Duration(config.FailureThreshold)
+	}
+
 	cm := &ClusterManager{
 		localNode:         localNode,
 		nodes:             make(map[string]*BrokerNode),
 		discoveryEndpoint: config.DiscoveryEndpoint,
+		peers:             config.Peers,
+		heartbeatInterval: config.HeartbeatInterval,
+		failureTimeout:    failureTimeout,
 		heartbeatTicker:   time.NewTicker(config.HeartbeatInterval),
 		ctx:               ctx,
 		cancel:            cancel,
@@ -71,18 +94,39 @@ func NewClusterManager(config ClusterConfig) (*ClusterManager, error) {
 	return cm, nil
 }
 
-// Start begins cluster discovery and heartbeat processes
+// Start begins cluster discovery and heartbeat processes. Heartbeats are
+// published on the discovery endpoint and received from each of the peers.
 func (cm *ClusterManager) Start() error {
+	var publisher, subscriber *czmq.Sock
+	var err error
+
+	if cm.discoveryEndpoint != "" {
+		if publisher, err = czmq.NewPub(cm.discoveryEndpoint); err != nil {
+			return NewConnectionFailedError(cm.discoveryEndpoint, err)
+		}
+	}
+
+	if len(cm.peers) > 0 {
+		endpoints := strings.Join(cm.peers, ",")
+		if subscriber, err = czmq.NewSub(endpoints, ClusterHeartbeatTopic); err != nil {
+			if publisher != nil {
+				publisher.Destroy()
+			}
+			return NewConnectionFailedError(endpoints, err)
+		}
+	}
+
 	log.WithFields(log.Fields{
 		"endpoint": cm.discoveryEndpoint,
+		"peers":    cm.peers,
 		"node_id":  cm.localNode.ID,
 	}).Info("cluster manager started")
 
 	// Start heartbeat sender
-	go cm.sendHeartbeats()
+	go cm.sendHeartbeats(publisher)
 
 	// Start discovery listener
-	go cm.listenForDiscovery()
+	go cm.listenForDiscovery(subscriber)
 
 	// Start failure detection
 	go cm.detectFailures()
@@ -105,6 +149,11 @@ func (cm *ClusterManager) Stop() error {
 	return nil
 }
 
+// LocalID returns the identifier of the local node
+func (cm *ClusterManager) LocalID() string {
+	return cm.localNode.ID
+}
+
 // GetNodes returns all known cluster nodes
 func (cm *ClusterManager) GetNodes() map[string]*BrokerNode {
 	cm.mu.RLock()
@@ -226,23 +275,29 @@ func (cm *ClusterManager) OnNodeUpdate(callback func(*BrokerNode)) {
 	cm.updateCallbacks = append(cm.updateCallbacks, callback)
 }
 
-// sendHeartbeats sends periodic heartbeats to announce this node's presence
-func (cm *ClusterManager) sendHeartbeats() {
+// sendHeartbeats sends periodic heartbeats to announce this node's presence,
+// the publisher is owned by this goroutine and is destroyed when it exits.
+func (cm *ClusterManager) sendHeartbeats(publisher *czmq.Sock) {
+	if publisher != nil {
+		defer publisher.Destroy()
+	}
+
 	for {
 		select {
 		case <-cm.ctx.Done():
 			return
 		case <-cm.heartbeatTicker.C:
-			cm.sendHeartbeat()
+			cm.sendHeartbeat(publisher)
 		}
 	}
 }
 
-// sendHeartbeat sends a single heartbeat message (simplified implementation)
-func (cm *ClusterManager) sendHeartbeat() {
-	cm.mu.RLock()
-	_, err := json.Marshal(cm.localNode)
-	cm.mu.RUnlock()
+// sendHeartbeat publishes the state of the local node to the peers
+func (cm *ClusterManager) sendHeartbeat(publisher *czmq.Sock) {
+	cm.mu.Lock()
+	cm.localNode.LastSeen = time.Now()
+	data, err := json.Marshal(cm.localNode)
+	cm.mu.Unlock()
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -252,26 +307,128 @@ func (cm *ClusterManager) sendHeartbeat() {
 		return
 	}
 
+	if publisher == nil {
+		return
+	}
+
+	if err = publisher.SendMessage([][]byte{[]byte(ClusterHeartbeatTopic), data}); err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"node_id": cm.localNode.ID,
+		}).Error("failed to send cluster heartbeat")
+		return
+	}
+
 	log.WithFields(log.Fields{
 		"node_id": cm.localNode.ID,
-	}).Debug("sent cluster heartbeat")
+	}).Trace("sent cluster heartbeat")
 }
 
-// listenForDiscovery listens for cluster discovery messages (simplified)
-func (cm *ClusterManager) listenForDiscovery() {
+// listenForDiscovery receives heartbeats from the peers, the subscriber is
+// owned by this goroutine and is destroyed when it exits.
+func (cm *ClusterManager) listenForDiscovery(subscriber *czmq.Sock) {
 	log.WithFields(log.Fields{
 		"node_id": cm.localNode.ID,
 	}).Debug("cluster discovery listener started")
 
-	<-cm.ctx.Done()
-	log.WithFields(log.Fields{
+	defer log.WithFields(log.Fields{
 		"node_id": cm.localNode.ID,
 	}).Debug("cluster discovery listener stopped")
+
+	if subscriber == nil {
+		<-cm.ctx.Done()
+		return
+	}
+	defer subscriber.Destroy()
+
+	poller, err := czmq.NewPoller(subscriber)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("failed to create cluster discovery poller")
+		return
+	}
+	defer poller.Destroy()
+
+	for {
+		select {
+		case <-cm.ctx.Done():
+			return
+		default:
+		}
+
+		socket, err := poller.Wait(int(cm.heartbeatInterval / time.Millisecond))
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("cluster discovery poller failed")
+			return
+		}
+		if socket == nil {
+			continue
+		}
+
+		msg, err := socket.RecvMessage()
+		if err != nil || len(msg) < 2 {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"frames": len(msg),
+			}).Warn("received invalid cluster heartbeat")
+			continue
+		}
+
+		cm.handleHeartbeat(msg[1])
+	}
+}
+
+// handleHeartbeat updates the membership list from a heartbeat sent by a peer
+func (cm *ClusterManager) handleHeartbeat(data []byte) {
+	var heartbeat BrokerNode
+	if err := json.Unmarshal(data, &heartbeat); err != nil {
+		log.WithFields(log.Fields{"error": err}).Warn("failed to decode cluster heartbeat")
+		return
+	}
+
+	if heartbeat.ID == "" || heartbeat.ID == cm.localNode.ID {
+		return
+	}
+
+	cm.mu.Lock()
+	node, exists := cm.nodes[heartbeat.ID]
+	if !exists {
+		node = &BrokerNode{ID: heartbeat.ID}
+		cm.nodes[heartbeat.ID] = node
+
+		log.WithFields(log.Fields{
+			"node_id":  heartbeat.ID,
+			"endpoint": heartbeat.Endpoint,
+		}).Info("discovered cluster node")
+	}
+
+	recovered := node.Status != StatusActive && exists
+	node.Endpoint = heartbeat.Endpoint
+	node.Load = heartbeat.Load
+	node.Services = heartbeat.Services
+	node.LastSeen = time.Now()
+	node.Status = StatusActive
+
+	nodeCopy := *node
+	callbacks := make([]func(*BrokerNode), len(cm.updateCallbacks))
+	copy(callbacks, cm.updateCallbacks)
+	cm.mu.Unlock()
+
+	if recovered {
+		log.WithFields(log.Fields{
+			"node_id": heartbeat.ID,
+		}).Info("cluster node recovered")
+	}
+
+	if !exists || recovered {
+		for _, callback := range callbacks {
+			go callback(&nodeCopy)
+		}
+	}
 }
 
 // detectFailures monitors for failed nodes and marks them as inactive
 func (cm *ClusterManager) detectFailures() {
-	ticker := time.NewTicker(30 * time.Second) // Check every 30 seconds
+	ticker := time.NewTicker(cm.heartbeatInterval)
 	defer ticker.Stop()
 
 	for {
@@ -290,14 +447,13 @@ func (cm *ClusterManager) checkNodeHealth() {
 	defer cm.mu.Unlock()
 
 	now := time.Now()
-	failureThreshold := 60 * time.Second // Consider node failed after 60s of no heartbeat
 
 	for nodeID, node := range cm.nodes {
 		if nodeID == cm.localNode.ID {
 			continue // Skip local node
 		}
 
-		if now.Sub(node.LastSeen) > failureThreshold {
+		if now.Sub(node.LastSeen) > cm.failureTimeout {
 			if node.Status == StatusActive {
 				node.Status = StatusFailed
 				node.FailureCount++
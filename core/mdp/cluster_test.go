@@ -1,10 +1,13 @@
 package mdp
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/geoffjay/plantd/core/curve"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -480,3 +483,77 @@ func BenchmarkClusterOperations(b *testing.B) {
 		}
 	})
 }
+
+func TestClusterHeartbeat(t *testing.T) {
+	cm, err := NewClusterManager(ClusterConfig{
+		LocalID:           "broker-001",
+		LocalEndpoint:     "tcp://localhost:9797",
+		HeartbeatInterval: 100 * time.Millisecond,
+		FailureThreshold:  3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "broker-001", cm.LocalID())
+	assert.Equal(t, 300*time.Millisecond, cm.failureTimeout)
+
+	t.Run("IgnoresLocalNode", func(t *testing.T) {
+		data, err := json.Marshal(&BrokerNode{ID: "broker-001", Endpoint: "tcp://localhost:9797"})
+		require.NoError(t, err)
+		cm.handleHeartbeat(data)
+		assert.Len(t, cm.GetNodes(), 1)
+	})
+
+	t.Run("DiscoversPeer", func(t *testing.T) {
+		data, err := json.Marshal(&BrokerNode{
+			ID:       "broker-002",
+			Endpoint: "tcp://remote:9797",
+			Load:     2,
+			Services: []string{"echo"},
+			Status:   StatusActive,
+		})
+		require.NoError(t, err)
+		cm.handleHeartbeat(data)
+
+		nodes := cm.GetNodes()
+		require.Contains(t, nodes, "broker-002")
+		assert.Equal(t, "tcp://remote:9797", nodes["broker-002"].Endpoint)
+		assert.Equal(t, []string{"echo"}, nodes["broker-002"].Services)
+
+		node := cm.GetBrokerForService("echo")
+		require.NotNil(t, node)
+		assert.Equal(t, "broker-002", node.ID)
+	})
+
+	t.Run("InvalidHeartbeat", func(t *testing.T) {
+		cm.handleHeartbeat([]byte("not json"))
+		assert.Len(t, cm.GetNodes(), 2)
+	})
+}
+
+func TestForwardIdentity(t *testing.T) {
+	identity := forwardIdentity("broker-001", "\x00client")
+	assert.Equal(t, "cluster:broker-001:00636c69656e74", identity)
+	assert.True(t, isForwardedClient(identity))
+	assert.False(t, isForwardedClient("\x00client"))
+}
+
+func TestPeerKey(t *testing.T) {
+	public, secret, err := curve.GenerateKeys()
+	require.NoError(t, err)
+	peerPublic, _, err := curve.GenerateKeys()
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.ClusterPeerKeys = map[string]string{"broker-002": peerPublic}
+	assert.Error(t, config.Validate())
+
+	config.Curve = &curve.Config{PublicKey: public, SecretKey: secret}
+	require.NoError(t, config.Validate())
+
+	broker := &Broker{config: config}
+	assert.Equal(t, peerPublic, broker.peerKey("broker-002"))
+	// peers without a key share this broker's
+	assert.Equal(t, public, broker.peerKey("broker-003"))
+
+	config.ClusterPeerKeys["broker-003"] = "not a key"
+	assert.Error(t, config.Validate())
+}
@@ -7,6 +7,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/geoffjay/plantd/core/curve"
+
 	"gopkg.in/yaml.v2"
 )
 
@@ -49,15 +51,43 @@ type Config struct {
 	CertPath         string `yaml:"cert_path" default:""`
 	KeyPath          string `yaml:"key_path" default:""`
 
-	// Worker pool settings
+	// CurveZMQ keys of the broker, and the public keys of the workers that
+	// are allowed to register for each service. Services without an entry
+	// accept any worker.
+	Curve          *curve.Config       `yaml:"curve,omitempty"`
+	AllowedWorkers map[string][]string `yaml:"allowed_workers,omitempty"`
+
+	// Worker pool settings. Workers don't send heartbeats while they handle a
+	// request, so a busy timeout has to be longer than the slowest request or
+	// requests are sent to another worker while the first is still running.
+	// Zero disables it.
 	WorkerPoolSize    int           `yaml:"worker_pool_size" default:"10"`
 	WorkerIdleTimeout time.Duration `yaml:"worker_idle_timeout" default:"60000ms"`
+	WorkerBusyTimeout time.Duration `yaml:"worker_busy_timeout" default:"0"`
+
+	// Service queue limits, zero disables the limit
+	MaxServiceQueueDepth int           `yaml:"max_service_queue_depth" default:"0"`
+	MaxServiceRequestAge time.Duration `yaml:"max_service_request_age" default:"0"`
+
+	// Dispatch settings, the strategy used to pick a worker for a request can
+	// be set for all services and overridden per service
+	DispatchStrategy          DispatchStrategy            `yaml:"dispatch_strategy" default:"lru"`
+	ServiceDispatchStrategies map[string]DispatchStrategy `yaml:"service_dispatch_strategies,omitempty"`
 
 	// Broker settings
-	PersistRequests bool     `yaml:"persist_requests" default:"false"`
-	PersistPath     string   `yaml:"persist_path" default:"./mdp_persist"`
-	ClusterMode     bool     `yaml:"cluster_mode" default:"false"`
-	ClusterPeers    []string `yaml:"cluster_peers" default:""`
+	PersistRequests  bool     `yaml:"persist_requests" default:"false"`
+	PersistPath      string   `yaml:"persist_path" default:"./mdp_persist"`
+	PersistNoSync    bool     `yaml:"persist_no_sync" default:"false"`
+	ClusterMode      bool     `yaml:"cluster_mode" default:"false"`
+	ClusterPeers     []string `yaml:"cluster_peers" default:""`
+	ClusterNodeID    string   `yaml:"cluster_node_id" default:""`
+	ClusterAdvertise string   `yaml:"cluster_advertise" default:""`
+	ClusterDiscovery string   `yaml:"cluster_discovery" default:""`
+
+	// CurveZMQ public keys of the peer brokers by node ID, used to connect to
+	// them when forwarding requests. Peers without an entry are expected to
+	// share this broker's key pair.
+	ClusterPeerKeys map[string]string `yaml:"cluster_peer_keys,omitempty"`
 }
 
 // DefaultConfig returns a configuration with default values
@@ -81,13 +111,15 @@ func DefaultConfig() *Config {
 		EnableMetrics:     true,
 		MetricsInterval:   30 * time.Second,
 		EnableMMI:         true,
-		MMIServices:       []string{MMIService, MMIWorkers, MMIHeartbeat, MMIBroker},
+		MMIServices:       []string{MMIService, MMIWorkers, MMIHeartbeat, MMIBroker, MMIServiceList, MMIWorker},
 		EnableAuth:        false,
 		EnableEncryption:  false,
 		CertPath:          "",
 		KeyPath:           "",
 		WorkerPoolSize:    10,
 		WorkerIdleTimeout: 60000 * time.Millisecond,
+		WorkerBusyTimeout: 0,
+		DispatchStrategy:  LeastRecentlyUsed,
 		PersistRequests:   false,
 		PersistPath:       "./mdp_persist",
 		ClusterMode:       false,
@@ -205,6 +237,28 @@ func (c *Config) applyEnvironmentOverrides() { //nolint:cyclop
 			c.WorkerPoolSize = i
 		}
 	}
+	if val := os.Getenv("MDP_WORKER_BUSY_TIMEOUT"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.WorkerBusyTimeout = duration
+		}
+	}
+
+	// Service queue limits
+	if val := os.Getenv("MDP_MAX_SERVICE_QUEUE_DEPTH"); val != "" {
+		if i, err := strconv.Atoi(val); err == nil {
+			c.MaxServiceQueueDepth = i
+		}
+	}
+	if val := os.Getenv("MDP_MAX_SERVICE_REQUEST_AGE"); val != "" {
+		if duration, err := time.ParseDuration(val); err == nil {
+			c.MaxServiceRequestAge = duration
+		}
+	}
+
+	// Dispatch settings
+	if val := os.Getenv("MDP_DISPATCH_STRATEGY"); val != "" {
+		c.DispatchStrategy = DispatchStrategy(val)
+	}
 
 	// Broker settings
 	if val := os.Getenv("MDP_PERSIST_REQUESTS"); val != "" {
@@ -213,9 +267,29 @@ func (c *Config) applyEnvironmentOverrides() { //nolint:cyclop
 	if val := os.Getenv("MDP_PERSIST_PATH"); val != "" {
 		c.PersistPath = val
 	}
+	if val := os.Getenv("MDP_PERSIST_NO_SYNC"); val != "" {
+		c.PersistNoSync = strings.ToLower(val) == BoolTrue
+	}
 	if val := os.Getenv("MDP_CLUSTER_MODE"); val != "" {
 		c.ClusterMode = strings.ToLower(val) == BoolTrue
 	}
+	if val := os.Getenv("MDP_CLUSTER_PEERS"); val != "" {
+		c.ClusterPeers = strings.Split(val, ",")
+	}
+	if val := os.Getenv("MDP_CLUSTER_NODE_ID"); val != "" {
+		c.ClusterNodeID = val
+	}
+	if val := os.Getenv("MDP_CLUSTER_ADVERTISE"); val != "" {
+		c.ClusterAdvertise = val
+	}
+	if val := os.Getenv("MDP_CLUSTER_DISCOVERY"); val != "" {
+		c.ClusterDiscovery = val
+	}
+
+	// CurveZMQ keys
+	if public, secret := os.Getenv("MDP_CURVE_PUBLIC_KEY"), os.Getenv("MDP_CURVE_SECRET_KEY"); public != "" && secret != "" {
+		c.Curve = &curve.Config{PublicKey: public, SecretKey: secret}
+	}
 }
 
 // Validate validates the configuration parameters
@@ -281,17 +355,58 @@ func (c *Config) Validate() error { //nolint:cyclop
 	if c.WorkerIdleTimeout <= 0 {
 		return fmt.Errorf("worker_idle_timeout must be positive")
 	}
+	if c.WorkerBusyTimeout < 0 {
+		return fmt.Errorf("worker_busy_timeout cannot be negative")
+	}
+
+	// Validate service queue limits
+	if c.MaxServiceQueueDepth < 0 {
+		return fmt.Errorf("max_service_queue_depth cannot be negative")
+	}
+	if c.MaxServiceRequestAge < 0 {
+		return fmt.Errorf("max_service_request_age cannot be negative")
+	}
+
+	// Validate dispatch settings
+	if c.DispatchStrategy != "" && !c.DispatchStrategy.valid() {
+		return fmt.Errorf("invalid dispatch_strategy: %s", c.DispatchStrategy)
+	}
+	for service, strategy := range c.ServiceDispatchStrategies {
+		if !strategy.valid() {
+			return fmt.Errorf("invalid dispatch strategy for service %s: %s", service, strategy)
+		}
+	}
 
 	// Validate security settings
 	if c.EnableEncryption && (c.CertPath == "" || c.KeyPath == "") {
 		return fmt.Errorf("cert_path and key_path required when encryption is enabled")
 	}
+	if err := c.Curve.Validate(); err != nil {
+		return err
+	}
+	if len(c.AllowedWorkers) > 0 && !c.Curve.Enabled() {
+		return fmt.Errorf("curve keys required when allowed_workers is set")
+	}
 
 	// Validate persistence settings
 	if c.PersistRequests && c.PersistPath == "" {
 		return fmt.Errorf("persist_path required when request persistence is enabled")
 	}
 
+	// Validate cluster settings
+	if c.ClusterMode && (c.ClusterNodeID == "" || c.ClusterAdvertise == "") {
+		return fmt.Errorf("cluster_node_id and cluster_advertise required when cluster mode is enabled")
+	}
+	if len(c.ClusterPeerKeys) > 0 && !c.Curve.Enabled() {
+		return fmt.Errorf("curve keys required when cluster_peer_keys is set")
+	}
+	for node, key := range c.ClusterPeerKeys {
+		keys := curve.Config{PublicKey: c.Curve.PublicKey, SecretKey: c.Curve.SecretKey, ServerKey: key}
+		if err := keys.Validate(); err != nil {
+			return fmt.Errorf("invalid cluster peer key for %s: %w", node, err)
+		}
+	}
+
 	return nil
 }
 
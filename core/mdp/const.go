@@ -39,6 +39,7 @@ const (
 const (
 	MdpcPartial = "PARTIAL" // Partial response from broker to client
 	MdpcFinal   = "FINAL"   // Final response from broker to client
+	MdpcError   = "ERROR"   // Error response from broker to client
 )
 
 // MDP v0.2 Worker commands (human-readable string identifiers)
@@ -69,6 +70,10 @@ const (
 	MMIWorkers   = "mmi.workers"   // List workers for a service
 	MMIHeartbeat = "mmi.heartbeat" // Echo heartbeat
 	MMIBroker    = "mmi.broker"    // Get broker information
+
+	// Extended MMI services
+	MMIServiceList = "mmi.services" // List all services with queue and worker counts
+	MMIWorker      = "mmi.worker"   // Get details of connected workers
 )
 
 // MMI response codes following HTTP-style status codes
@@ -127,5 +132,8 @@ var (
 		MMIWorkers:   "List workers for a service",
 		MMIHeartbeat: "Echo heartbeat",
 		MMIBroker:    "Get broker information",
+
+		MMIServiceList: "List all services",
+		MMIWorker:      "Get worker details",
 	}
 )
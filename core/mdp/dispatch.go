@@ -0,0 +1,119 @@
+package mdp
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// DispatchStrategy defines how a service picks which of its available workers
+// receives the next request.
+type DispatchStrategy string
+
+const (
+	// LeastRecentlyUsed dispatches to the worker that has been available the
+	// longest, this is the default
+	LeastRecentlyUsed DispatchStrategy = "lru"
+	// LeastOutstanding dispatches to the worker with the fewest requests that
+	// haven't been answered yet
+	LeastOutstanding DispatchStrategy = "least_outstanding"
+	// WeightedCapacity dispatches to the worker with the lowest load relative
+	// to the capacity it advertised when it registered
+	WeightedCapacity DispatchStrategy = "weighted"
+	// Sticky dispatches requests with the same sticky key, or from the same
+	// client, to the same worker while it's available
+	Sticky DispatchStrategy = "sticky"
+)
+
+// DispatchStrategies lists the supported dispatch strategies.
+var DispatchStrategies = []DispatchStrategy{
+	LeastRecentlyUsed, LeastOutstanding, WeightedCapacity, Sticky,
+}
+
+// valid is true for the supported strategies.
+func (s DispatchStrategy) valid() bool {
+	for _, strategy := range DispatchStrategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchStrategy returns the strategy configured for the service.
+func (s *Service) dispatchStrategy() DispatchStrategy {
+	config := s.broker.config
+	if strategy, ok := config.ServiceDispatchStrategies[s.name]; ok {
+		return strategy
+	}
+	if config.DispatchStrategy != "" {
+		return config.DispatchStrategy
+	}
+	return LeastRecentlyUsed
+}
+
+// selectWorker picks the waiting worker that the request is dispatched to.
+// The waiting list is ordered by when the workers became available, so ties
+// are broken in favor of the least recently used worker.
+func (s *Service) selectWorker(request *Request) *brokerWorker {
+	if len(s.waiting) == 0 {
+		return nil
+	}
+
+	switch s.dispatchStrategy() {
+	case LeastOutstanding:
+		return leastLoaded(s.waiting, func(w *brokerWorker) float64 {
+			return float64(len(w.requests))
+		})
+	case WeightedCapacity:
+		return leastLoaded(s.waiting, func(w *brokerWorker) float64 {
+			return float64(len(w.requests)) / float64(w.capacity)
+		})
+	case Sticky:
+		return stickyWorker(s.waiting, request.StickyKey())
+	default:
+		return s.waiting[0]
+	}
+}
+
+// leastLoaded returns the first worker with the lowest load.
+func leastLoaded(workers []*brokerWorker, load func(*brokerWorker) float64) *brokerWorker {
+	selected := workers[0]
+	lowest := load(selected)
+	for _, worker := range workers[1:] {
+		if l := load(worker); l < lowest {
+			selected, lowest = worker, l
+		}
+	}
+	return selected
+}
+
+// stickyWorker uses rendezvous hashing to pick a worker for the key, the same
+// worker is picked for a key as long as it's available and when it isn't the
+// requests for the key are spread over the others.
+func stickyWorker(workers []*brokerWorker, key string) *brokerWorker {
+	var selected *brokerWorker
+	var highest uint64
+	for _, worker := range workers {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte(worker.idString))
+		if score := h.Sum64(); selected == nil || score > highest {
+			selected, highest = worker, score
+		}
+	}
+	return selected
+}
+
+// parseCapacity reads the capacity a worker advertised in the headers of its
+// READY command, workers that don't advertise one take a single request.
+func parseCapacity(headers []string) int {
+	value, ok := headerValue(headers, capacityHeader)
+	if !ok {
+		return 1
+	}
+	capacity, err := strconv.Atoi(value)
+	if err != nil || capacity < 1 {
+		return 1
+	}
+	return capacity
+}
@@ -0,0 +1,115 @@
+package mdp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectWorker(t *testing.T) {
+	config := DefaultConfig()
+	broker, err := NewBrokerWithConfig("tcp://*:0", config)
+	require.NoError(t, err)
+	defer broker.Close() //nolint:errcheck
+
+	service := broker.ServiceRequire("echo")
+	request := &Request{Client: "client-001", Data: []string{"client-001", "", "hello"}}
+	assert.Nil(t, service.selectWorker(request))
+
+	first := broker.workerRequire("worker-001")
+	first.capacity = 4
+	first.requests = []*Request{{ID: "request-001"}, {ID: "request-002"}}
+	second := broker.workerRequire("worker-002")
+	second.capacity = 4
+	second.requests = []*Request{{ID: "request-003"}, {ID: "request-004"}, {ID: "request-005"}}
+	third := broker.workerRequire("worker-003")
+	third.requests = []*Request{}
+	service.waiting = []*brokerWorker{first, second, third}
+
+	t.Run("LeastRecentlyUsed", func(t *testing.T) {
+		assert.Equal(t, first, service.selectWorker(request))
+	})
+
+	t.Run("LeastOutstanding", func(t *testing.T) {
+		config.DispatchStrategy = LeastOutstanding
+		assert.Equal(t, third, service.selectWorker(request))
+	})
+
+	t.Run("WeightedCapacity", func(t *testing.T) {
+		config.DispatchStrategy = WeightedCapacity
+		third.requests = []*Request{{ID: "request-006"}}
+		assert.Equal(t, first, service.selectWorker(request))
+	})
+
+	t.Run("ServiceOverride", func(t *testing.T) {
+		config.ServiceDispatchStrategies = map[string]DispatchStrategy{"echo": LeastRecentlyUsed}
+		assert.Equal(t, first, service.selectWorker(request))
+		config.ServiceDispatchStrategies = nil
+	})
+
+	t.Run("Sticky", func(t *testing.T) {
+		config.DispatchStrategy = Sticky
+		selected := service.selectWorker(request)
+		require.NotNil(t, selected)
+		assert.Equal(t, selected, service.selectWorker(request))
+
+		// the key is used over the client when a request has one
+		keyed := &Request{Client: "client-002", Data: []string{"client-002", "", EncodeStickyKey("client-001"), "hello"}}
+		assert.Equal(t, selected, service.selectWorker(keyed))
+
+		// requests move to another worker when theirs isn't available
+		service.waiting = delWorker(service.waiting, selected)
+		other := service.selectWorker(request)
+		require.NotNil(t, other)
+		assert.NotEqual(t, selected, other)
+	})
+}
+
+func TestParseCapacity(t *testing.T) {
+	assert.Equal(t, 1, parseCapacity(nil))
+	assert.Equal(t, 8, parseCapacity([]string{capacityHeader + "8"}))
+	assert.Equal(t, 1, parseCapacity([]string{capacityHeader + "0"}))
+	assert.Equal(t, 1, parseCapacity([]string{capacityHeader + "many"}))
+}
+
+func TestWorkerCapacity(t *testing.T) {
+	broker, err := NewBroker("tcp://*:0")
+	require.NoError(t, err)
+	defer broker.Close() //nolint:errcheck
+
+	service := broker.ServiceRequire("echo")
+	worker := broker.workerRequire("worker-001")
+	worker.service = service
+	worker.capacity = 2
+
+	worker.requests = []*Request{{ID: "request-001"}}
+	assert.True(t, worker.available())
+	worker.Waiting()
+	worker.Waiting()
+	assert.Len(t, service.waiting, 1)
+	assert.Len(t, broker.Waiting, 1)
+
+	worker.requests = append(worker.requests, &Request{ID: "request-002"})
+	assert.False(t, worker.available())
+	assert.Equal(t, "request-001", worker.current().ID)
+
+	worker.completeRequest()
+	require.Len(t, worker.requests, 1)
+	assert.Equal(t, "request-002", worker.current().ID)
+	worker.completeRequest()
+	assert.Nil(t, worker.current())
+}
+
+func TestDispatchStrategyConfig(t *testing.T) {
+	config := DefaultConfig()
+	assert.Equal(t, LeastRecentlyUsed, config.DispatchStrategy)
+	assert.NoError(t, config.Validate())
+
+	config.DispatchStrategy = "random"
+	assert.Error(t, config.Validate())
+
+	config.DispatchStrategy = Sticky
+	config.ServiceDispatchStrategies = map[string]DispatchStrategy{"echo": "fastest"}
+	assert.Error(t, config.Validate())
+}
@@ -26,6 +26,8 @@ var (
 	ErrBrokerOverloaded     = errors.New("broker overloaded")
 	ErrAuthenticationFailed = errors.New("authentication failed")
 	ErrAuthorizationFailed  = errors.New("authorization failed")
+	ErrRequestFailed        = errors.New("request failed")
+	ErrServiceOverloaded    = errors.New("service overloaded")
 )
 
 // Error represents a structured MDP protocol error with context
@@ -89,8 +91,17 @@ const (
 	ErrCodeBrokerOverloaded   = "BROKER_OVERLOADED"
 	ErrCodeAuthFailed         = "AUTH_FAILED"
 	ErrCodeAuthzFailed        = "AUTHZ_FAILED"
+	ErrCodeRequestFailed      = "REQUEST_FAILED"
+	ErrCodeServiceOverloaded  = "SERVICE_OVERLOADED"
 )
 
+// replyErrors maps the codes that the broker sends in error replies to the
+// standard error that caused them, so callers can use errors.Is on the result
+var replyErrors = map[string]error{
+	ErrCodeRequestFailed:     ErrRequestFailed,
+	ErrCodeServiceOverloaded: ErrServiceOverloaded,
+}
+
 // NewMDPError creates a new structured MDP error
 func NewMDPError(code, message string, cause error) *Error {
 	return &Error{
@@ -145,6 +156,31 @@ func NewInvalidServiceError(service string, cause error) *Error {
 		WithContext("service", service)
 }
 
+// NewRequestFailedError creates a new error for a request the broker abandoned
+func NewRequestFailedError(requestID string, retries int) *Error {
+	return NewMDPError(ErrCodeRequestFailed,
+		fmt.Sprintf("request '%s' abandoned after %d attempts", requestID, retries), ErrRequestFailed).
+		WithContext("request_id", requestID).
+		WithContext("retries", retries)
+}
+
+// NewServiceOverloadedError creates a new error for a request that was rejected
+// because the service queue is at its limit
+func NewServiceOverloadedError(service, reason string) *Error {
+	return NewMDPError(ErrCodeServiceOverloaded,
+		fmt.Sprintf("service '%s' overloaded: %s", service, reason), ErrServiceOverloaded).
+		WithContext("service", service)
+}
+
+// errorFromReply creates an error from the frames of an error reply that was
+// sent to a client by the broker, the frames are the error code and message
+func errorFromReply(frames []string) *Error {
+	if len(frames) < 2 {
+		return NewInvalidMessageError("malformed error reply", nil)
+	}
+	return NewMDPError(frames[0], frames[1], replyErrors[frames[0]])
+}
+
 // IsRetryableError determines if an error condition is retryable
 func IsRetryableError(err error) bool {
 	if err == nil {
@@ -154,7 +190,8 @@ func IsRetryableError(err error) bool {
 	var mdpErr *Error
 	if errors.As(err, &mdpErr) {
 		switch mdpErr.Code {
-		case ErrCodeTimeout, ErrCodeBrokerUnavailable, ErrCodeConnectionFailed, ErrCodeSocketError, ErrCodeWorkerDisconnected:
+		case ErrCodeTimeout, ErrCodeBrokerUnavailable, ErrCodeConnectionFailed, ErrCodeSocketError, ErrCodeWorkerDisconnected,
+			ErrCodeServiceOverloaded:
 			return true
 		default:
 			return false
@@ -166,7 +203,8 @@ func IsRetryableError(err error) bool {
 		errors.Is(err, ErrBrokerUnavailable) ||
 		errors.Is(err, ErrConnectionFailed) ||
 		errors.Is(err, ErrSocketError) ||
-		errors.Is(err, ErrWorkerDisconnected)
+		errors.Is(err, ErrWorkerDisconnected) ||
+		errors.Is(err, ErrServiceOverloaded)
 }
 
 // IsPermanentError determines if an error condition is permanent (non-retryable)
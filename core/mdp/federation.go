@@ -0,0 +1,248 @@
+package mdp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geoffjay/plantd/core/util"
+
+	log "github.com/sirupsen/logrus"
+	czmq "github.com/zeromq/goczmq/v4"
+)
+
+const (
+	// forwardIdentityPrefix marks the socket identity of a broker that is
+	// forwarding requests for one of its clients, forwarded requests are never
+	// forwarded again which prevents loops between brokers.
+	forwardIdentityPrefix = "cluster:"
+
+	// forwarderIdleTimeout is how long a forwarding socket is kept open after
+	// it was last used.
+	forwarderIdleTimeout = 60 * time.Second
+)
+
+// forwarder relays the requests of a single client to a peer broker. The peer
+// sees the forwarder as an ordinary MDP client, so every reply received on the
+// socket belongs to the client it was created for.
+type forwarder struct {
+	socket   *czmq.Sock
+	node     string    // ID of the peer broker
+	client   string    // identity of the local client
+	pending  int       // requests without a final reply
+	lastUsed time.Time // when a message was last sent or received
+}
+
+// SetClusterManager attaches a cluster manager to the broker. Requests for
+// services that have no local workers are then forwarded to a peer broker that
+// advertises the service, and the services of this broker are advertised in
+// turn.
+func (b *Broker) SetClusterManager(cluster *ClusterManager) {
+	b.cluster = cluster
+}
+
+// forwardIdentity builds the identity used by the forwarding socket for a client.
+func forwardIdentity(nodeID, client string) string {
+	return fmt.Sprintf("%s%s:%s", forwardIdentityPrefix, nodeID, hex.EncodeToString([]byte(client)))
+}
+
+// isForwardedClient is true when the sender is a forwarding peer broker.
+func isForwardedClient(sender string) bool {
+	return strings.HasPrefix(sender, forwardIdentityPrefix)
+}
+
+// hasWorkers checks if any worker, idle or busy, is attached to the service.
+func (s *Service) hasWorkers() bool {
+	if len(s.waiting) > 0 {
+		return true
+	}
+	for _, worker := range s.broker.workers {
+		if worker.service == s {
+			return true
+		}
+	}
+	return false
+}
+
+// localServices lists the services that have at least one worker attached.
+func (b *Broker) localServices() []string {
+	seen := make(map[string]bool)
+	services := make([]string, 0)
+	for _, worker := range b.workers {
+		if worker.service == nil || seen[worker.service.name] {
+			continue
+		}
+		seen[worker.service.name] = true
+		services = append(services, worker.service.name)
+	}
+	return services
+}
+
+// forwardRequest sends a client request to a peer broker when the service has
+// no local workers. Returns `true` if the request was forwarded.
+func (b *Broker) forwardRequest(sender string, service *Service, body []string) bool {
+	if b.cluster == nil || isForwardedClient(sender) || service.hasWorkers() {
+		return false
+	}
+
+	node := b.cluster.GetBrokerForService(service.name)
+	if node == nil || node.ID == b.cluster.LocalID() || !util.Contains(node.Services, service.name) {
+		return false
+	}
+
+	fwd, err := b.forwarderRequire(node, sender)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":    err,
+			"node_id":  node.ID,
+			"endpoint": node.Endpoint,
+		}).Error("failed to connect to peer broker")
+		return false
+	}
+
+	frames := append([]string{"", MdpcClient, MdpcRequest, service.name}, body...)
+	if err = fwd.socket.SendMessage(stringArrayToByte2D(frames)); err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"node_id": node.ID,
+		}).Error("failed to forward request to peer broker")
+		return false
+	}
+
+	fwd.pending++
+	fwd.lastUsed = time.Now()
+
+	log.WithFields(log.Fields{
+		"service": service.name,
+		"node_id": node.ID,
+	}).Debug("forwarded request to peer broker")
+
+	return true
+}
+
+// forwarderRequire is a lazy constructor that locates the forwarder for a
+// client and peer, or connects a new one.
+func (b *Broker) forwarderRequire(node *BrokerNode, client string) (*forwarder, error) {
+	key := node.ID + "/" + client
+	if fwd, ok := b.forwarders[key]; ok {
+		return fwd, nil
+	}
+
+	options := []czmq.SockOption{czmq.SockSetIdentity(forwardIdentity(b.cluster.LocalID(), client))}
+	if b.config.Curve.Enabled() {
+		keys := *b.config.Curve
+		keys.ServerKey = b.peerKey(node.ID)
+		options = append(options, keys.ClientOptions()...)
+	}
+
+	socket, err := czmq.NewDealer(node.Endpoint, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.poller != nil {
+		if err = b.poller.Add(socket); err != nil {
+			socket.Destroy()
+			return nil, err
+		}
+	}
+
+	fwd := &forwarder{
+		socket:   socket,
+		node:     node.ID,
+		client:   client,
+		lastUsed: time.Now(),
+	}
+	b.forwarders[key] = fwd
+
+	log.WithFields(log.Fields{
+		"node_id":  node.ID,
+		"endpoint": node.Endpoint,
+	}).Debug("connected forwarder to peer broker")
+
+	return fwd, nil
+}
+
+// peerKey returns the CURVE public key of a peer broker. Peers that weren't
+// given a key of their own share this broker's key pair, a peer with a
+// different key drops the connection during the handshake and the requests
+// forwarded to it go unanswered.
+func (b *Broker) peerKey(node string) string {
+	if key, ok := b.config.ClusterPeerKeys[node]; ok {
+		return key
+	}
+	return b.config.Curve.PublicKey
+}
+
+// ForwarderMsg relays a reply received from a peer broker to the client that
+// made the request.
+func (b *Broker) ForwarderMsg(socket *czmq.Sock) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var fwd *forwarder
+	for _, item := range b.forwarders {
+		if item.socket == socket {
+			fwd = item
+			break
+		}
+	}
+
+	recv, err := socket.RecvMessage()
+	if err != nil || fwd == nil {
+		log.WithFields(log.Fields{"error": err}).Warn("failed to receive reply from peer broker")
+		return
+	}
+
+	msg := byte2DToStringArray(recv)
+	if err = ValidateClientMessage(msg); err != nil {
+		log.WithError(err).Warn("received invalid reply from peer broker")
+		return
+	}
+
+	if msg[1] != MdpcPartial && fwd.pending > 0 {
+		fwd.pending--
+	}
+	fwd.lastUsed = time.Now()
+
+	snd := stringArrayToByte2D(append([]string{fwd.client}, msg...))
+	if err = b.Socket.SendMessage(snd); err != nil {
+		b.ErrorChannel <- err
+		log.WithFields(log.Fields{"error": err}).Error("failed to send forwarded reply to client")
+	}
+}
+
+// purgeForwarders closes forwarding sockets that have not been used recently.
+func (b *Broker) purgeForwarders() {
+	now := time.Now()
+	for key, fwd := range b.forwarders {
+		if now.Sub(fwd.lastUsed) < forwarderIdleTimeout {
+			continue
+		}
+
+		if fwd.pending > 0 {
+			log.WithFields(log.Fields{
+				"node_id": fwd.node,
+				"pending": fwd.pending,
+			}).Warn("closing forwarder with unanswered requests")
+		}
+
+		b.closeForwarder(key, fwd)
+	}
+}
+
+// closeForwarder removes a forwarder and destroys its socket.
+func (b *Broker) closeForwarder(key string, fwd *forwarder) {
+	if b.poller != nil {
+		b.poller.Remove(fwd.socket)
+	}
+	fwd.socket.Destroy()
+	delete(b.forwarders, key)
+}
+
+// updateCluster advertises the local services and load to the peer brokers.
+func (b *Broker) updateCluster() {
+	b.cluster.UpdateLocalLoad(len(b.workers), b.localServices())
+	b.purgeForwarders()
+}
@@ -0,0 +1,189 @@
+package mdp
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header frames are optional frames that a client places ahead of the request
+// body, or a worker after the service name of its READY command. The leading
+// null byte keeps them from being mistaken for body frames. Workers never see
+// request headers, and the broker returns the tag on every reply so that a
+// client can match replies to requests. The broker sends a nonce header on the
+// HEARTBEAT that challenges a worker to prove its key.
+const (
+	deadlineHeader = "\x00deadline:"
+	tagHeader      = "\x00tag:"
+	stickyHeader   = "\x00sticky:"
+	capacityHeader = "\x00capacity:"
+	keyHeader      = "\x00key:"
+	proofHeader    = "\x00proof:"
+	nonceHeader    = "\x00nonce:"
+)
+
+var headerPrefixes = []string{
+	deadlineHeader, tagHeader, stickyHeader, capacityHeader, keyHeader, proofHeader, nonceHeader,
+}
+
+// EncodeDeadline creates the header frame that carries a request deadline.
+func EncodeDeadline(deadline time.Time) string {
+	return deadlineHeader + strconv.FormatInt(deadline.UnixMilli(), 10)
+}
+
+// DecodeDeadline reads the deadline from a frame, `false` is returned if the
+// frame is not a deadline header.
+func DecodeDeadline(frame string) (time.Time, bool) {
+	if !strings.HasPrefix(frame, deadlineHeader) {
+		return time.Time{}, false
+	}
+
+	ms, err := strconv.ParseInt(frame[len(deadlineHeader):], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.UnixMilli(ms), true
+}
+
+// EncodeTag creates the header frame that carries a request tag.
+func EncodeTag(tag string) string {
+	return tagHeader + tag
+}
+
+// DecodeTag reads the tag from a frame, `false` is returned if the frame is
+// not a tag header.
+func DecodeTag(frame string) (string, bool) {
+	return decodeHeader(frame, tagHeader)
+}
+
+// EncodeStickyKey creates the header frame that carries the key used by the
+// sticky dispatch strategy, requests with the same key go to the same worker.
+func EncodeStickyKey(key string) string {
+	return stickyHeader + key
+}
+
+// decodeHeader reads the value of a header frame with the given prefix.
+func decodeHeader(frame, prefix string) (string, bool) {
+	if !strings.HasPrefix(frame, prefix) {
+		return "", false
+	}
+	return frame[len(prefix):], true
+}
+
+// isHeader checks if a frame is one of the known header frames.
+func isHeader(frame string) bool {
+	for _, prefix := range headerPrefixes {
+		if strings.HasPrefix(frame, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitHeaders separates the header frames at the start of a message body
+// from the rest of the body.
+func splitHeaders(frames []string) (headers, body []string) {
+	n := 0
+	for n < len(frames) && isHeader(frames[n]) {
+		n++
+	}
+	return frames[:n], frames[n:]
+}
+
+// headerValue finds the value of a header in a list of header frames.
+func headerValue(headers []string, prefix string) (string, bool) {
+	for _, frame := range headers {
+		if value, ok := decodeHeader(frame, prefix); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// headerTag finds the tag in a list of header frames.
+func headerTag(headers []string) (string, bool) {
+	return headerValue(headers, tagHeader)
+}
+
+// headerDeadline finds the deadline in a list of header frames.
+func headerDeadline(headers []string) (time.Time, bool) {
+	for _, frame := range headers {
+		if deadline, ok := DecodeDeadline(frame); ok {
+			return deadline, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// headers returns the header frames of the request. The request data holds
+// the client envelope followed by the body, so the headers start at the third
+// frame.
+func (r *Request) headers() []string {
+	if len(r.Data) < 3 {
+		return nil
+	}
+	headers, _ := splitHeaders(r.Data[2:])
+	return headers
+}
+
+// Deadline returns the deadline that the client set for the request, if any.
+func (r *Request) Deadline() (time.Time, bool) {
+	return headerDeadline(r.headers())
+}
+
+// Tag returns the tag that the client set for the request, if any.
+func (r *Request) Tag() (string, bool) {
+	return headerTag(r.headers())
+}
+
+// StickyKey returns the key used to pick a worker with the sticky dispatch
+// strategy. Without a sticky header the identity of the client is used.
+func (r *Request) StickyKey() string {
+	if key, ok := headerValue(r.headers(), stickyHeader); ok {
+		return key
+	}
+	return r.Client
+}
+
+// pastDeadline is true when the client has given up on the request.
+func (r *Request) pastDeadline(now time.Time) bool {
+	deadline, ok := r.Deadline()
+	return ok && now.After(deadline)
+}
+
+// tagHeaders returns the header frames of a request that are echoed back to
+// the client with every reply, these let the client match the reply to its
+// request.
+func tagHeaders(headers []string) []string {
+	if tag, ok := headerTag(headers); ok {
+		return []string{EncodeTag(tag)}
+	}
+	return nil
+}
+
+// replyHeaders returns the header frames to include when replying to the
+// request.
+func (r *Request) replyHeaders() []string {
+	if r == nil {
+		return nil
+	}
+	return tagHeaders(r.headers())
+}
+
+// Deadline returns the deadline of the request that was last received, if the
+// client set one.
+func (w *Worker) Deadline() (time.Time, bool) {
+	return w.deadline, !w.deadline.IsZero()
+}
+
+// RequestContext returns a context for handling the request that was last
+// received. The context is canceled when the client deadline passes so that
+// handlers can abandon work that nobody is waiting for.
+func (w *Worker) RequestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := w.Deadline(); ok {
+		return context.WithDeadline(parent, deadline)
+	}
+	return context.WithCancel(parent)
+}
@@ -0,0 +1,126 @@
+package mdp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadlineFrame(t *testing.T) {
+	deadline := time.UnixMilli(time.Now().Add(time.Second).UnixMilli())
+
+	decoded, ok := DecodeDeadline(EncodeDeadline(deadline))
+	require.True(t, ok)
+	assert.True(t, deadline.Equal(decoded))
+
+	_, ok = DecodeDeadline(`{"key": "value"}`)
+	assert.False(t, ok)
+
+	_, ok = DecodeDeadline(deadlineHeader + "soon")
+	assert.False(t, ok)
+}
+
+func TestRequestDeadline(t *testing.T) {
+	now := time.Now()
+
+	request := &Request{Data: []string{"client-001", "", "echo", "hello"}}
+	_, ok := request.Deadline()
+	assert.False(t, ok)
+	assert.False(t, request.pastDeadline(now))
+
+	request.Data = []string{"client-001", "", EncodeDeadline(now.Add(-time.Second)), "hello"}
+	_, ok = request.Deadline()
+	assert.True(t, ok)
+	assert.True(t, request.pastDeadline(now))
+}
+
+func TestServiceDropExpired(t *testing.T) {
+	broker, err := NewBroker("tcp://*:0")
+	require.NoError(t, err)
+	defer broker.Close() //nolint:errcheck
+
+	service := broker.ServiceRequire("echo")
+
+	expired, err := broker.requestManager.CreateRequest("client-001", "echo",
+		[]string{"client-001", "", EncodeDeadline(time.Now().Add(-time.Second)), "stale"})
+	require.NoError(t, err)
+	current, err := broker.requestManager.CreateRequest("client-002", "echo",
+		[]string{"client-002", "", EncodeDeadline(time.Now().Add(time.Minute)), "fresh"})
+	require.NoError(t, err)
+	unbounded, err := broker.requestManager.CreateRequest("client-003", "echo",
+		[]string{"client-003", "", "whenever"})
+	require.NoError(t, err)
+
+	// Without waiting workers the requests that are still wanted stay queued
+	service.Dispatch(expired)
+	service.Dispatch(current)
+	service.Dispatch(unbounded)
+
+	require.Len(t, service.requests, 2)
+	assert.Equal(t, current.ID, service.requests[0].ID)
+	assert.Equal(t, unbounded.ID, service.requests[1].ID)
+	assert.Equal(t, int64(1), service.failed)
+
+	pending, err := broker.requestManager.GetPendingRequests()
+	require.NoError(t, err)
+	assert.Len(t, pending, 2)
+}
+
+func TestDeadlineRequestContext(t *testing.T) {
+	w := &Worker{}
+
+	ctx, cancel := w.RequestContext(context.Background())
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+	cancel()
+
+	w.deadline = time.Now().Add(-time.Second)
+	ctx, cancel = w.RequestContext(context.Background())
+	defer cancel()
+	assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+}
+
+func TestTagFrame(t *testing.T) {
+	tag, ok := DecodeTag(EncodeTag("42"))
+	require.True(t, ok)
+	assert.Equal(t, "42", tag)
+
+	_, ok = DecodeTag("42")
+	assert.False(t, ok)
+}
+
+func TestSplitHeaders(t *testing.T) {
+	deadline := EncodeDeadline(time.Now())
+	headers, body := splitHeaders([]string{EncodeTag("7"), deadline, "hello", EncodeTag("8")})
+	assert.Equal(t, []string{EncodeTag("7"), deadline}, headers)
+	assert.Equal(t, []string{"hello", EncodeTag("8")}, body)
+
+	headers, body = splitHeaders([]string{"hello"})
+	assert.Empty(t, headers)
+	assert.Equal(t, []string{"hello"}, body)
+
+	request := &Request{Data: []string{"client-001", "", deadline, EncodeTag("7"), "hello"}}
+	tag, ok := request.Tag()
+	require.True(t, ok)
+	assert.Equal(t, "7", tag)
+	assert.Equal(t, []string{EncodeTag("7")}, request.replyHeaders())
+
+	request = &Request{Data: []string{"client-001", "", deadline, "hello"}}
+	assert.Empty(t, request.replyHeaders())
+}
+
+func TestPollTimeout(t *testing.T) {
+	assert.Equal(t, pollInterval, pollTimeout(context.Background(), time.Minute))
+	assert.Equal(t, 20*time.Millisecond, pollTimeout(context.Background(), 20*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.LessOrEqual(t, pollTimeout(ctx, time.Minute), 50*time.Millisecond)
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	assert.Equal(t, time.Millisecond, pollTimeout(ctx, time.Minute))
+}
@@ -1,6 +1,7 @@
 package mdp
 
 import (
+	"encoding/json"
 	"fmt"
 	"runtime"
 	"strings"
@@ -35,6 +36,10 @@ func (m *MMIHandler) HandleRequest(service string, request []string) ([]string,
 		return m.handleHeartbeatQuery(request)
 	case MMIBroker:
 		return m.handleBrokerQuery(request)
+	case MMIServiceList:
+		return m.handleServicesQuery(request)
+	case MMIWorker:
+		return m.handleWorkerQuery(request)
 	default:
 		log.WithField("service", service).Warn("unknown MMI service requested")
 		return []string{MMICodeNotImplemented}, nil
@@ -104,13 +109,55 @@ func (m *MMIHandler) handleWorkersQuery(request []string) ([]string, error) {
 			return []string{MMICodeNotFound, "0"}, nil
 		}
 
-		workerCount := len(service.waiting) + len(service.requests)
+		workerCount := 0
+		for _, worker := range m.broker.workers {
+			if worker.service == service {
+				workerCount++
+			}
+		}
 		return []string{MMICodeOK, fmt.Sprintf("%d", workerCount)}, nil
 	}
 
 	return []string{MMICodeNotFound, "0"}, nil
 }
 
+// handleServicesQuery implements mmi.services - returns the state of every
+// service as a JSON encoded list
+func (m *MMIHandler) handleServicesQuery(_ []string) ([]string, error) {
+	services := make([]ServiceInfo, 0)
+	if m.broker != nil {
+		services = m.broker.serviceInfo()
+	}
+
+	data, err := json.Marshal(services)
+	if err != nil {
+		return []string{MMICodeError, err.Error()}, nil
+	}
+
+	return []string{MMICodeOK, string(data)}, nil
+}
+
+// handleWorkerQuery implements mmi.worker - returns the details of connected
+// workers as a JSON encoded list, optionally limited to a single service
+func (m *MMIHandler) handleWorkerQuery(request []string) ([]string, error) {
+	workers := make([]WorkerInfo, 0)
+	if m.broker != nil {
+		for _, worker := range m.broker.workerInfo() {
+			if len(request) > 0 && request[0] != "" && worker.ServiceName != request[0] {
+				continue
+			}
+			workers = append(workers, worker)
+		}
+	}
+
+	data, err := json.Marshal(workers)
+	if err != nil {
+		return []string{MMICodeError, err.Error()}, nil
+	}
+
+	return []string{MMICodeOK, string(data)}, nil
+}
+
 // handleHeartbeatQuery implements mmi.heartbeat - echo service
 func (m *MMIHandler) handleHeartbeatQuery(request []string) ([]string, error) {
 	// Echo back the request with a timestamp
@@ -131,22 +178,18 @@ func (m *MMIHandler) handleBrokerQuery(_ []string) ([]string, error) {
 	// Add broker information
 	info := []string{
 		fmt.Sprintf("version=%s/%s", MdpcClient, MdpwWorker),
-		fmt.Sprintf("uptime=%d", time.Now().Unix()), // Simple uptime simulation
 		fmt.Sprintf("go_version=%s", runtime.Version()),
 		fmt.Sprintf("go_arch=%s", runtime.GOARCH),
 		fmt.Sprintf("go_os=%s", runtime.GOOS),
 	}
 
-	// Add service count if broker is available
+	// Add uptime and counts if broker is available
 	if m.broker != nil && m.broker.services != nil {
-		info = append(info, fmt.Sprintf("services=%d", len(m.broker.services)))
-
-		// Add total worker count
-		totalWorkers := 0
-		for _, service := range m.broker.services {
-			totalWorkers += len(service.waiting) + len(service.requests)
-		}
-		info = append(info, fmt.Sprintf("workers=%d", totalWorkers))
+		info = append(info,
+			fmt.Sprintf("uptime=%d", int64(m.broker.Uptime().Seconds())),
+			fmt.Sprintf("services=%d", len(m.broker.services)),
+			fmt.Sprintf("workers=%d", len(m.broker.workers)),
+		)
 	}
 
 	response = append(response, info...)
@@ -181,7 +224,7 @@ func ValidateMMIRequest(service string, request []string) error {
 		if request[0] == "" {
 			return NewInvalidMessageError("service name cannot be empty", nil)
 		}
-	case MMIHeartbeat, MMIBroker:
+	case MMIHeartbeat, MMIBroker, MMIServiceList, MMIWorker:
 		// These services accept any request format
 	}
 
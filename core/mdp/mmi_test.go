@@ -0,0 +1,112 @@
+package mdp
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMMITestBroker creates a broker with an echo service that has one waiting
+// worker, one busy worker and a queued request.
+func newMMITestBroker(t *testing.T) *Broker {
+	broker, err := NewBroker("tcp://*:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = broker.Close() })
+
+	service := broker.ServiceRequire("echo")
+	service.served = 5
+	service.failed = 1
+	service.requests = append(service.requests, &Request{ID: "queued-001", Timestamp: time.Now()})
+
+	waiting := broker.workerRequire("worker-001")
+	waiting.service = service
+	service.waiting = append(service.waiting, waiting)
+
+	busy := broker.workerRequire("worker-002")
+	busy.service = service
+	busy.requests = []*Request{{ID: "request-001"}}
+	busy.totalRequests = 5
+
+	return broker
+}
+
+func TestMMIServicesQuery(t *testing.T) {
+	handler := NewMMIHandler(newMMITestBroker(t))
+
+	reply, err := handler.HandleRequest(MMIServiceList, nil)
+	require.NoError(t, err)
+	require.Len(t, reply, 2)
+	assert.Equal(t, MMICodeOK, reply[0])
+
+	var services []ServiceInfo
+	require.NoError(t, json.Unmarshal([]byte(reply[1]), &services))
+	require.Len(t, services, 1)
+	assert.Equal(t, ServiceInfo{
+		Name:    "echo",
+		Waiting: 1,
+		Busy:    1,
+		Queued:  1,
+		Served:  5,
+		Failed:  1,
+	}, services[0])
+}
+
+func TestMMIWorkerQuery(t *testing.T) {
+	handler := NewMMIHandler(newMMITestBroker(t))
+
+	t.Run("AllWorkers", func(t *testing.T) {
+		reply, err := handler.HandleRequest(MMIWorker, nil)
+		require.NoError(t, err)
+		require.Len(t, reply, 2)
+
+		var workers []WorkerInfo
+		require.NoError(t, json.Unmarshal([]byte(reply[1]), &workers))
+		require.Len(t, workers, 2)
+		assert.Equal(t, WorkerStatusWaiting, workers[0].Status)
+		assert.Equal(t, WorkerStatusBusy, workers[1].Status)
+		assert.Equal(t, "request-001", workers[1].Request)
+		assert.Equal(t, int64(5), workers[1].TotalRequests)
+	})
+
+	t.Run("FilterByService", func(t *testing.T) {
+		reply, err := handler.HandleRequest(MMIWorker, []string{"unknown"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{MMICodeOK, "[]"}, reply)
+	})
+}
+
+func TestMMIWorkersQuery(t *testing.T) {
+	handler := NewMMIHandler(newMMITestBroker(t))
+
+	reply, err := handler.HandleRequest(MMIWorkers, []string{"echo"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{MMICodeOK, "2"}, reply)
+
+	reply, err = handler.HandleRequest(MMIWorkers, []string{"unknown"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{MMICodeNotFound, "0"}, reply)
+}
+
+func TestMMIBrokerQuery(t *testing.T) {
+	broker := newMMITestBroker(t)
+	broker.startedAt = time.Now().Add(-time.Hour)
+	handler := NewMMIHandler(broker)
+
+	reply, err := handler.HandleRequest(MMIBroker, nil)
+	require.NoError(t, err)
+	assert.Equal(t, MMICodeOK, reply[0])
+
+	info := make(map[string]string)
+	for _, item := range reply[1:] {
+		parts := strings.SplitN(item, "=", 2)
+		require.Len(t, parts, 2)
+		info[parts[0]] = parts[1]
+	}
+	assert.Equal(t, "3600", info["uptime"])
+	assert.Equal(t, "1", info["services"])
+	assert.Equal(t, "2", info["workers"])
+}
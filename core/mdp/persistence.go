@@ -52,7 +52,25 @@ func (m *MemoryPersistenceStore) StoreRequest(id string, request *Request) error
 		return fmt.Errorf("request cannot be nil")
 	}
 
-	// Set default values if not provided
+	if err := prepareRequest(id, request); err != nil {
+		return err
+	}
+
+	m.requests[id] = request
+
+	log.WithFields(log.Fields{
+		"request_id": id,
+		"client":     request.Client,
+		"service":    request.Service,
+		"status":     request.Status,
+	}).Debug("stored request in memory")
+
+	return nil
+}
+
+// prepareRequest sets default values for any fields that were not provided
+// and checks that the request has not already expired.
+func prepareRequest(id string, request *Request) error {
 	if request.ID == "" {
 		request.ID = id
 	}
@@ -74,15 +92,6 @@ func (m *MemoryPersistenceStore) StoreRequest(id string, request *Request) error
 		return fmt.Errorf("request %s has expired", id)
 	}
 
-	m.requests[id] = request
-
-	log.WithFields(log.Fields{
-		"request_id": id,
-		"client":     request.Client,
-		"service":    request.Service,
-		"status":     request.Status,
-	}).Debug("stored request in memory")
-
 	return nil
 }
 
@@ -204,21 +213,34 @@ func (m *MemoryPersistenceStore) GetStats() map[string]interface{} {
 
 // RequestManager handles request lifecycle and retry logic
 type RequestManager struct {
-	store PersistenceStore
-	mu    sync.RWMutex
+	store      PersistenceStore
+	mu         sync.RWMutex
+	maxRetries int
 }
 
 // NewRequestManager creates a new request manager
 func NewRequestManager(store PersistenceStore) *RequestManager {
 	return &RequestManager{
-		store: store,
+		store:      store,
+		maxRetries: 3,
 	}
 }
 
+// SetMaxRetries sets the number of attempts made for new requests
+func (rm *RequestManager) SetMaxRetries(maxRetries int) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.maxRetries = maxRetries
+}
+
 // CreateRequest creates and stores a new request
 func (rm *RequestManager) CreateRequest(client, service string, data []string) (*Request, error) {
 	id := generateRequestID()
 
+	rm.mu.RLock()
+	maxRetries := rm.maxRetries
+	rm.mu.RUnlock()
+
 	request := &Request{
 		ID:         id,
 		Client:     client,
@@ -226,7 +248,7 @@ func (rm *RequestManager) CreateRequest(client, service string, data []string) (
 		Data:       data,
 		Timestamp:  time.Now(),
 		Retries:    0,
-		MaxRetries: 3,
+		MaxRetries: maxRetries,
 		TTL:        5 * time.Minute,
 		Status:     StatusPending,
 	}
@@ -293,6 +315,23 @@ func (rm *RequestManager) MarkRequestCompleted(id string) error {
 	return nil
 }
 
+// ExpireRequest removes a request that passed its deadline before it could be
+// handled
+func (rm *RequestManager) ExpireRequest(id string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if err := rm.store.DeleteRequest(id); err != nil {
+		return fmt.Errorf("failed to delete request: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"request_id": id,
+	}).Info("request deadline expired")
+
+	return nil
+}
+
 // RetryRequest increments retry count and updates request status
 func (rm *RequestManager) RetryRequest(id string) (*Request, error) {
 	rm.mu.Lock()
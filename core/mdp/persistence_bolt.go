@@ -0,0 +1,275 @@
+package mdp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// boltStoreFile is the name of the database file created in the persistence path
+	boltStoreFile = "requests.db"
+	// boltOpenTimeout limits how long opening the store waits for the file lock
+	boltOpenTimeout = 1 * time.Second
+)
+
+var boltRequestsBucket = []byte("requests")
+
+// BoltPersistenceStore implements file backed persistence using bbolt so that
+// pending requests survive a broker restart
+type BoltPersistenceStore struct {
+	db   *bolt.DB
+	path string
+}
+
+// BoltOptions tune how a bolt request store trades durability for throughput.
+type BoltOptions struct {
+	// NoSync skips the fsync at the end of every write. A request is written
+	// to disk once when it's received, again when it's dispatched, and it's
+	// deleted when the reply is sent, all on the broker's single goroutine,
+	// so syncing each of them limits how many requests a second the broker
+	// can handle. Without it a broker that crashes still keeps its requests,
+	// but those written shortly before the host itself fails can be lost.
+	NoSync bool
+}
+
+// NewBoltPersistenceStore opens, or creates, a request store in the directory
+// `path` that syncs every write to disk
+func NewBoltPersistenceStore(path string) (PersistenceStore, error) {
+	return NewBoltPersistenceStoreWithOptions(path, BoltOptions{})
+}
+
+// NewBoltPersistenceStoreWithOptions opens, or creates, a request store in the
+// directory `path` using the options given
+func NewBoltPersistenceStoreWithOptions(path string, options BoltOptions) (PersistenceStore, error) {
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create persistence path %s: %w", path, err)
+	}
+
+	file := filepath.Join(path, boltStoreFile)
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: boltOpenTimeout, NoSync: options.NoSync})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open persistence store %s: %w", file, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRequestsBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize persistence store: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"path":    file,
+		"no_sync": options.NoSync,
+	}).Info("opened request persistence store")
+
+	return &BoltPersistenceStore{db: db, path: file}, nil
+}
+
+// StoreRequest writes a request to disk
+func (b *BoltPersistenceStore) StoreRequest(id string, request *Request) error {
+	if request == nil {
+		return fmt.Errorf("request cannot be nil")
+	}
+
+	if err := prepareRequest(id, request); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode request %s: %w", id, err)
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRequestsBucket).Put([]byte(id), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store request %s: %w", id, err)
+	}
+
+	log.WithFields(log.Fields{
+		"request_id": id,
+		"client":     request.Client,
+		"service":    request.Service,
+		"status":     request.Status,
+	}).Debug("stored request on disk")
+
+	return nil
+}
+
+// RetrieveRequest reads a request from disk
+func (b *BoltPersistenceStore) RetrieveRequest(id string) (*Request, error) {
+	var request *Request
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltRequestsBucket).Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("request %s not found", id)
+		}
+
+		request = &Request{}
+		return json.Unmarshal(data, request)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if request has expired
+	if time.Since(request.Timestamp) > request.TTL {
+		return nil, fmt.Errorf("request %s has expired", id)
+	}
+
+	return request, nil
+}
+
+// DeleteRequest removes a request from disk
+func (b *BoltPersistenceStore) DeleteRequest(id string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRequestsBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return fmt.Errorf("request %s not found", id)
+		}
+		return bucket.Delete([]byte(id))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"request_id": id,
+	}).Debug("deleted request from disk")
+
+	return nil
+}
+
+// ListPendingRequests returns all pending request IDs
+func (b *BoltPersistenceStore) ListPendingRequests() ([]string, error) {
+	var pendingIDs []string
+	now := time.Now()
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRequestsBucket).ForEach(func(k, v []byte) error {
+			var request Request
+			if err := json.Unmarshal(v, &request); err != nil {
+				log.WithFields(log.Fields{
+					"request_id": string(k),
+					"error":      err,
+				}).Warn("skipping unreadable request")
+				return nil
+			}
+
+			// Skip expired requests
+			if now.Sub(request.Timestamp) > request.TTL {
+				return nil
+			}
+
+			if request.Status == StatusPending || request.Status == StatusProcessing {
+				pendingIDs = append(pendingIDs, string(k))
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending requests: %w", err)
+	}
+
+	return pendingIDs, nil
+}
+
+// Close closes the underlying database file, syncing anything that was
+// written without it first
+func (b *BoltPersistenceStore) Close() error {
+	if b.db.NoSync {
+		if err := b.db.Sync(); err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("failed to sync persistence store")
+		}
+	}
+	return b.db.Close()
+}
+
+// CleanupExpiredRequests removes expired requests from disk
+func (b *BoltPersistenceStore) CleanupExpiredRequests() int {
+	now := time.Now()
+	removed := 0
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRequestsBucket)
+
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var request Request
+			if err := json.Unmarshal(v, &request); err != nil {
+				return nil
+			}
+			if now.Sub(request.Timestamp) > request.TTL {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			removed++
+
+			log.WithFields(log.Fields{
+				"request_id": string(k),
+			}).Debug("cleaned up expired request")
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("failed to clean up expired requests")
+		return 0
+	}
+
+	if removed > 0 {
+		log.WithFields(log.Fields{
+			"removed_count": removed,
+		}).Info("cleaned up expired requests")
+	}
+
+	return removed
+}
+
+// GetStats returns statistics about the persistence store
+func (b *BoltPersistenceStore) GetStats() map[string]interface{} {
+	stats := make(map[string]interface{})
+	statusCounts := make(map[string]int)
+	total := 0
+
+	_ = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRequestsBucket).ForEach(func(_, v []byte) error {
+			var request Request
+			if err := json.Unmarshal(v, &request); err == nil {
+				statusCounts[request.Status]++
+			}
+			total++
+			return nil
+		})
+	})
+
+	stats["total_requests"] = total
+	stats["status_breakdown"] = statusCounts
+	stats["store_type"] = "bolt"
+	stats["path"] = b.path
+
+	return stats
+}
@@ -0,0 +1,178 @@
+package mdp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltPersistenceStore(t *testing.T) { //nolint:funlen
+	path := t.TempDir()
+	store, err := NewBoltPersistenceStore(path)
+	require.NoError(t, err)
+	defer store.Close() //nolint:errcheck
+
+	t.Run("StoreAndRetrieveRequest", func(t *testing.T) {
+		request := &Request{
+			ID:         "test-001",
+			Client:     "client-001",
+			Service:    "echo",
+			Data:       []string{"client-001", "", "hello", "world"},
+			Timestamp:  time.Now(),
+			MaxRetries: 3,
+			TTL:        5 * time.Minute,
+			Status:     "pending",
+		}
+
+		err := store.StoreRequest("test-001", request)
+		assert.NoError(t, err)
+
+		retrieved, err := store.RetrieveRequest("test-001")
+		assert.NoError(t, err)
+		assert.Equal(t, request.ID, retrieved.ID)
+		assert.Equal(t, request.Client, retrieved.Client)
+		assert.Equal(t, request.Service, retrieved.Service)
+		assert.Equal(t, request.Data, retrieved.Data)
+		assert.Equal(t, request.TTL, retrieved.TTL)
+		assert.Equal(t, request.Status, retrieved.Status)
+	})
+
+	t.Run("RetrieveNonexistentRequest", func(t *testing.T) {
+		_, err := store.RetrieveRequest("nonexistent")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "not found")
+	})
+
+	t.Run("DeleteRequest", func(t *testing.T) {
+		err := store.StoreRequest("test-002", &Request{Service: "echo", Status: "pending"})
+		require.NoError(t, err)
+
+		err = store.DeleteRequest("test-002")
+		assert.NoError(t, err)
+
+		_, err = store.RetrieveRequest("test-002")
+		assert.Error(t, err)
+
+		err = store.DeleteRequest("test-002")
+		assert.Error(t, err)
+	})
+
+	t.Run("ListPendingRequests", func(t *testing.T) {
+		requests := []*Request{
+			{ID: "pending-001", Status: "pending"},
+			{ID: "processing-001", Status: "processing"},
+			{ID: "completed-001", Status: "completed"},
+			{ID: "failed-001", Status: "failed"},
+		}
+
+		for _, req := range requests {
+			err := store.StoreRequest(req.ID, req)
+			require.NoError(t, err)
+		}
+
+		pendingIDs, err := store.ListPendingRequests()
+		assert.NoError(t, err)
+		assert.Contains(t, pendingIDs, "pending-001")
+		assert.Contains(t, pendingIDs, "processing-001")
+		assert.NotContains(t, pendingIDs, "completed-001")
+		assert.NotContains(t, pendingIDs, "failed-001")
+	})
+
+	t.Run("CleanupExpiredRequests", func(t *testing.T) {
+		// Store a short lived request and wait for it to expire
+		err := store.StoreRequest("expiring-001", &Request{TTL: 10 * time.Millisecond})
+		require.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+
+		_, err = store.RetrieveRequest("expiring-001")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "expired")
+
+		boltStore := store.(*BoltPersistenceStore)
+		assert.Equal(t, 1, boltStore.CleanupExpiredRequests())
+
+		_, err = store.RetrieveRequest("expiring-001")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "not found")
+	})
+
+	t.Run("GetStats", func(t *testing.T) {
+		stats := store.(*BoltPersistenceStore).GetStats()
+		assert.Equal(t, "bolt", stats["store_type"])
+		assert.Greater(t, stats["total_requests"], 0)
+	})
+}
+
+func TestBoltPersistenceStoreReopen(t *testing.T) {
+	path := t.TempDir()
+
+	store, err := NewBoltPersistenceStore(path)
+	require.NoError(t, err)
+
+	manager := NewRequestManager(store)
+	request, err := manager.CreateRequest("client-001", "echo", []string{"client-001", "", "hello"})
+	require.NoError(t, err)
+	require.NoError(t, manager.Close())
+
+	// Pending requests should still be available after reopening the store
+	store, err = NewBoltPersistenceStore(path)
+	require.NoError(t, err)
+
+	manager = NewRequestManager(store)
+	defer manager.Close() //nolint:errcheck
+
+	pending, err := manager.GetPendingRequests()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, request.ID, pending[0].ID)
+	assert.Equal(t, request.Data, pending[0].Data)
+}
+
+func TestBoltPersistenceStoreNoSync(t *testing.T) {
+	path := t.TempDir()
+
+	store, err := NewBoltPersistenceStoreWithOptions(path, BoltOptions{NoSync: true})
+	require.NoError(t, err)
+
+	manager := NewRequestManager(store)
+	request, err := manager.CreateRequest("client-001", "echo", []string{"client-001", "", "hello"})
+	require.NoError(t, err)
+	require.NoError(t, manager.Close())
+
+	// Closing the store syncs whatever was written without it
+	store, err = NewBoltPersistenceStore(path)
+	require.NoError(t, err)
+	defer store.Close() //nolint:errcheck
+
+	retrieved, err := store.RetrieveRequest(request.ID)
+	require.NoError(t, err)
+	assert.Equal(t, request.Data, retrieved.Data)
+}
+
+func TestBrokerRestoresPendingRequests(t *testing.T) {
+	config := DefaultConfig()
+	config.PersistRequests = true
+	config.PersistPath = t.TempDir()
+
+	store, err := NewBoltPersistenceStore(config.PersistPath)
+	require.NoError(t, err)
+
+	manager := NewRequestManager(store)
+	first, err := manager.CreateRequest("client-001", "echo", []string{"client-001", "", "first"})
+	require.NoError(t, err)
+	second, err := manager.CreateRequest("client-002", "echo", []string{"client-002", "", "second"})
+	require.NoError(t, err)
+	require.NoError(t, manager.Close())
+
+	broker, err := NewBrokerWithConfig("tcp://*:0", config)
+	require.NoError(t, err)
+	defer broker.Close() //nolint:errcheck
+
+	service, ok := broker.services["echo"]
+	require.True(t, ok)
+	require.Len(t, service.requests, 2)
+	assert.Equal(t, first.ID, service.requests[0].ID)
+	assert.Equal(t, second.ID, service.requests[1].ID)
+}
@@ -25,6 +25,12 @@ func TestMDPv2ProtocolCompliance(t *testing.T) {
 			validator: ValidateClientMessage,
 			expectErr: false,
 		},
+		{
+			name:      "valid client error response",
+			message:   []string{MdpcClient, MdpcError, "echo", ErrCodeRequestFailed, "request abandoned"},
+			validator: ValidateClientMessage,
+			expectErr: false,
+		},
 		{
 			name:      "client message too short",
 			message:   []string{MdpcClient, MdpcFinal},
@@ -183,6 +183,50 @@ func TestErrorFactoryFunctions(t *testing.T) {
 			t.Errorf("expected endpoint context to be set")
 		}
 	})
+
+	t.Run("request failed error", func(t *testing.T) {
+		err := NewRequestFailedError("req-123", 3)
+		if err.Code != ErrCodeRequestFailed {
+			t.Errorf("expected code %s, got %s", ErrCodeRequestFailed, err.Code)
+		}
+		if !errors.Is(err, ErrRequestFailed) {
+			t.Error("request failed error should match standard error")
+		}
+		if IsRetryableError(err) {
+			t.Error("request failed error should not be retryable")
+		}
+	})
+
+	t.Run("error from reply", func(t *testing.T) {
+		err := errorFromReply([]string{ErrCodeRequestFailed, "request abandoned"})
+		if err.Code != ErrCodeRequestFailed {
+			t.Errorf("expected code %s, got %s", ErrCodeRequestFailed, err.Code)
+		}
+		if err.Message != "request abandoned" {
+			t.Errorf("expected message to be set, got %s", err.Message)
+		}
+
+		err = errorFromReply([]string{})
+		if err.Code != ErrCodeInvalidMessage {
+			t.Errorf("expected code %s, got %s", ErrCodeInvalidMessage, err.Code)
+		}
+	})
+
+	t.Run("service overloaded error", func(t *testing.T) {
+		err := NewServiceOverloadedError("echo", "queue depth limit of 10 reached")
+		if err.Code != ErrCodeServiceOverloaded {
+			t.Errorf("expected code %s, got %s", ErrCodeServiceOverloaded, err.Code)
+		}
+		if !IsRetryableError(err) {
+			t.Error("service overloaded error should be retryable")
+		}
+
+		// The error received by a client should still match the standard error
+		reply := errorFromReply([]string{err.Code, err.Message})
+		if !errors.Is(reply, ErrServiceOverloaded) {
+			t.Error("expected error reply to match ErrServiceOverloaded")
+		}
+	})
 }
 
 // TestErrorComparison tests error comparison using errors.Is
@@ -0,0 +1,129 @@
+package mdp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/geoffjay/plantd/core/curve"
+	"github.com/geoffjay/plantd/core/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The CURVE key of a peer isn't available to the broker once the connection
+// is established, so workers present their public key in the READY command
+// and prove that they hold the secret key by signing a nonce. The broker
+// answers a READY without a proof with a HEARTBEAT that carries a nonce for
+// that connection, and the worker sends READY again with its proof. A nonce
+// is only accepted once, from the connection it was issued to, and only for
+// a short time, so a proof that was observed can't be replayed.
+
+// nonceLength is the number of random bytes in a challenge nonce.
+const nonceLength = 16
+
+// errWorkerChallenged is returned when a worker was sent a nonce to sign
+// rather than being registered.
+var errWorkerChallenged = errors.New("worker was challenged to prove its key")
+
+// challenge is a nonce that was issued to a worker connection.
+type challenge struct {
+	nonce   string
+	expires time.Time
+}
+
+// readyProofData is the data that a worker signs to register for a service.
+func readyProofData(service, nonce string) string {
+	return MdpwWorker + MdpwReady + service + nonce
+}
+
+// readyCredentials returns the header frames that a worker appends to its
+// READY command, nothing is returned when CURVE isn't used. The proof is only
+// included once the broker has issued a nonce.
+func readyCredentials(keys *curve.Config, service, nonce string) ([]string, error) {
+	if !keys.Enabled() {
+		return nil, nil
+	}
+	credentials := []string{keyHeader + keys.PublicKey}
+	if nonce == "" {
+		return credentials, nil
+	}
+	proof, err := keys.Proof(readyProofData(service, nonce))
+	if err != nil {
+		return nil, err
+	}
+	return append(credentials, proofHeader+proof), nil
+}
+
+// authorizeWorker checks the credentials that a worker presented in the
+// headers of its READY command against the allow-list of the service. A
+// worker with an allowed key that hasn't signed a nonce yet is sent one, and
+// errWorkerChallenged is returned.
+func (b *Broker) authorizeWorker(sender, service string, headers []string) error {
+	allowed := b.config.AllowedWorkers[service]
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	key, hasKey := headerValue(headers, keyHeader)
+	if !hasKey {
+		return errors.New("worker did not present a key")
+	}
+	if !util.Contains(allowed, key) {
+		return fmt.Errorf("worker key %s is not allowed", key)
+	}
+
+	// nonces are used once whether or not the proof holds up
+	issued, challenged := b.challenges[sender]
+	delete(b.challenges, sender)
+
+	proof, hasProof := headerValue(headers, proofHeader)
+	if !hasProof {
+		return b.challengeWorker(sender)
+	}
+	if !challenged || issued.expires.Before(time.Now()) {
+		return fmt.Errorf("worker presented a proof for key %s without a current nonce", key)
+	}
+	if !b.config.Curve.Verify(key, readyProofData(service, issued.nonce), proof) {
+		return fmt.Errorf("worker failed to prove key %s", key)
+	}
+
+	return nil
+}
+
+// challengeWorker sends a worker a nonce to sign.
+func (b *Broker) challengeWorker(sender string) error {
+	if b.Socket == nil {
+		return errors.New("broker is not bound")
+	}
+
+	data := make([]byte, nonceLength)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(data)
+
+	snd := stringArrayToByte2D([]string{sender, MdpwWorker, MdpwHeartbeat, nonceHeader + nonce})
+	if err := b.Socket.SendMessage(snd); err != nil {
+		return err
+	}
+	b.challenges[sender] = challenge{nonce: nonce, expires: time.Now().Add(HeartbeatExpiry)}
+
+	log.WithFields(log.Fields{
+		"worker": fmt.Sprintf("%q", sender),
+	}).Debug("sent worker a nonce to sign")
+
+	return errWorkerChallenged
+}
+
+// purgeChallenges forgets the nonces that weren't answered in time.
+func (b *Broker) purgeChallenges() {
+	now := time.Now()
+	for sender, issued := range b.challenges {
+		if issued.expires.Before(now) {
+			delete(b.challenges, sender)
+		}
+	}
+}
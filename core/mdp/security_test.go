@@ -0,0 +1,95 @@
+package mdp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/geoffjay/plantd/core/curve"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizeWorker(t *testing.T) { //nolint:funlen
+	brokerPublic, brokerSecret, err := curve.GenerateKeys()
+	require.NoError(t, err)
+	workerPublic, workerSecret, err := curve.GenerateKeys()
+	require.NoError(t, err)
+	otherPublic, otherSecret, err := curve.GenerateKeys()
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.Curve = &curve.Config{PublicKey: brokerPublic, SecretKey: brokerSecret}
+	config.AllowedWorkers = map[string][]string{"org.plantd.State": {workerPublic}}
+	require.NoError(t, config.Validate())
+
+	broker, err := NewBrokerWithConfig("tcp://*:0", config)
+	require.NoError(t, err)
+	defer broker.Close() //nolint:errcheck
+
+	worker := &curve.Config{PublicKey: workerPublic, SecretKey: workerSecret, ServerKey: brokerPublic}
+	other := &curve.Config{PublicKey: otherPublic, SecretKey: otherSecret, ServerKey: brokerPublic}
+	issue := func(sender string) string {
+		nonce := sender + "-nonce"
+		broker.challenges[sender] = challenge{nonce: nonce, expires: time.Now().Add(time.Minute)}
+		return nonce
+	}
+
+	credentials, err := readyCredentials(worker, "org.plantd.State", issue("worker-001"))
+	require.NoError(t, err)
+	assert.NoError(t, broker.authorizeWorker("worker-001", "org.plantd.State", credentials))
+
+	// a nonce is only good once, and only for the connection it was issued to
+	assert.Error(t, broker.authorizeWorker("worker-001", "org.plantd.State", credentials))
+	credentials, err = readyCredentials(worker, "org.plantd.State", issue("worker-001"))
+	require.NoError(t, err)
+	assert.Error(t, broker.authorizeWorker("worker-002", "org.plantd.State", credentials))
+
+	// services without an allow-list accept any worker
+	assert.NoError(t, broker.authorizeWorker("worker-003", "org.plantd.Echo", nil))
+
+	assert.Error(t, broker.authorizeWorker("worker-003", "org.plantd.State", nil))
+
+	credentials, err = readyCredentials(other, "org.plantd.State", issue("worker-004"))
+	require.NoError(t, err)
+	assert.Error(t, broker.authorizeWorker("worker-004", "org.plantd.State", credentials))
+
+	// presenting an allowed key without holding its secret key fails
+	credentials[0] = keyHeader + workerPublic
+	issue("worker-004")
+	assert.Error(t, broker.authorizeWorker("worker-004", "org.plantd.State", credentials))
+
+	credentials, err = readyCredentials(worker, "org.plantd.Echo", issue("worker-005"))
+	require.NoError(t, err)
+	assert.Error(t, broker.authorizeWorker("worker-005", "org.plantd.State", credentials))
+
+	// a nonce that wasn't answered in time is no good
+	nonce := issue("worker-006")
+	broker.challenges["worker-006"] = challenge{nonce: nonce, expires: time.Now().Add(-time.Second)}
+	credentials, err = readyCredentials(worker, "org.plantd.State", nonce)
+	require.NoError(t, err)
+	assert.Error(t, broker.authorizeWorker("worker-006", "org.plantd.State", credentials))
+
+	config.Curve = nil
+	assert.Error(t, config.Validate())
+}
+
+func TestReadyCredentials(t *testing.T) {
+	public, secret, err := curve.GenerateKeys()
+	require.NoError(t, err)
+	keys := &curve.Config{PublicKey: public, SecretKey: secret, ServerKey: public}
+
+	credentials, err := readyCredentials(keys, "org.plantd.State", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{keyHeader + public}, credentials)
+
+	credentials, err = readyCredentials(keys, "org.plantd.State", "nonce")
+	require.NoError(t, err)
+	require.Len(t, credentials, 2)
+	_, ok := headerValue(credentials, proofHeader)
+	assert.True(t, ok)
+
+	credentials, err = readyCredentials(nil, "org.plantd.State", "nonce")
+	require.NoError(t, err)
+	assert.Empty(t, credentials)
+}
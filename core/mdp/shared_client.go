@@ -0,0 +1,237 @@
+package mdp
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/geoffjay/plantd/core/curve"
+
+	log "github.com/sirupsen/logrus"
+	czmq "github.com/zeromq/goczmq/v4"
+)
+
+// sharedPollInterval is how long the shared client waits on its socket before
+// checking for new requests to send.
+const sharedPollInterval = 10 * time.Millisecond
+
+// SharedClient is an MDP client that can be used by many goroutines at once.
+// ZeroMQ sockets must not be used concurrently, so a single goroutine owns the
+// DEALER socket and multiplexes the requests over it. Every request is tagged
+// and replies are delivered to the caller waiting on that tag.
+type SharedClient struct {
+	broker   string
+	requests chan *sharedRequest
+	done     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+	tag      uint64 // Tag of the last request, accessed atomically
+
+	mu      sync.Mutex
+	pending map[string]chan sharedReply // Requests waiting for a reply
+}
+
+type sharedRequest struct {
+	frames []string
+	tag    string
+}
+
+type sharedReply struct {
+	data []string
+	err  error
+}
+
+// NewSharedClient creates a client that is safe for concurrent use and
+// connects it to the broker.
+func NewSharedClient(broker string) (*SharedClient, error) {
+	return NewSharedClientWithCurve(broker, nil)
+}
+
+// NewSharedClientWithCurve creates a client that is safe for concurrent use
+// and connects it to the broker using CURVE encryption.
+func NewSharedClientWithCurve(broker string, keys *curve.Config) (*SharedClient, error) {
+	socket, err := czmq.NewDealer(broker, keys.ClientOptions()...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"broker": broker,
+			"error":  err,
+		}).Error("failed to create DEALER socket")
+		return nil, err
+	}
+
+	poller, err := czmq.NewPoller(socket)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"broker": broker,
+			"error":  err,
+		}).Error("failed to create poller")
+		socket.Destroy()
+		return nil, err
+	}
+
+	c := &SharedClient{
+		broker:   broker,
+		requests: make(chan *sharedRequest),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		pending:  make(map[string]chan sharedReply),
+	}
+
+	go c.run(socket, poller)
+
+	log.WithFields(log.Fields{
+		"broker": broker,
+	}).Info("successfully connected to broker")
+
+	return c, nil
+}
+
+// Close stops the client, requests that are still waiting for a reply fail.
+func (c *SharedClient) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		<-c.stopped
+	})
+	return nil
+}
+
+// Request sends a request to a service and waits for the reply until the
+// context is done. The context deadline, if any, is sent with the request so
+// that the broker and worker can abandon it once the deadline passes.
+func (c *SharedClient) Request(ctx context.Context, service string, request ...string) ([]string, error) {
+	tag := strconv.FormatUint(atomic.AddUint64(&c.tag, 1), 10)
+
+	frames := []string{"", MdpcClient, MdpcRequest, service, EncodeTag(tag)}
+	if deadline, ok := ctx.Deadline(); ok {
+		frames = append(frames, EncodeDeadline(deadline))
+	}
+	frames = append(frames, request...)
+
+	if err := ValidateClientRequestMessage(frames[1:]); err != nil {
+		return nil, fmt.Errorf("invalid request format: %w", err)
+	}
+
+	reply := make(chan sharedReply, 1)
+	c.mu.Lock()
+	c.pending[tag] = reply
+	c.mu.Unlock()
+	defer c.forget(tag)
+
+	select {
+	case c.requests <- &sharedRequest{frames: frames, tag: tag}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClientDisconnected
+	}
+
+	select {
+	case r := <-reply:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.stopped:
+		return nil, ErrClientDisconnected
+	}
+}
+
+// forget removes a request that no longer expects a reply.
+func (c *SharedClient) forget(tag string) {
+	c.mu.Lock()
+	delete(c.pending, tag)
+	c.mu.Unlock()
+}
+
+// deliver passes a reply to the request that is waiting for it, replies to
+// requests that were abandoned are dropped.
+func (c *SharedClient) deliver(tag string, reply sharedReply) {
+	c.mu.Lock()
+	ch, ok := c.pending[tag]
+	delete(c.pending, tag)
+	c.mu.Unlock()
+
+	if !ok {
+		log.WithFields(log.Fields{"tag": tag}).Debug("discarded reply to an abandoned request")
+		return
+	}
+	ch <- reply
+}
+
+// run owns the socket, it sends queued requests and delivers replies until the
+// client is closed.
+func (c *SharedClient) run(socket *czmq.Sock, poller *czmq.Poller) {
+	defer close(c.stopped)
+	defer socket.Destroy()
+	defer poller.Destroy()
+
+	for {
+		// send everything that is queued before waiting on the socket
+		for sending := true; sending; {
+			select {
+			case req := <-c.requests:
+				if err := socket.SendMessage(stringArrayToByte2D(req.frames)); err != nil {
+					log.WithFields(log.Fields{
+						"service": req.frames[3],
+						"error":   err,
+					}).Error("failed to send request")
+					c.deliver(req.tag, sharedReply{err: err})
+				}
+			case <-c.done:
+				return
+			default:
+				sending = false
+			}
+		}
+
+		ready, err := poller.Wait(int(sharedPollInterval / time.Millisecond))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("client failure while socket poller was waiting")
+			continue
+		}
+		if ready == nil {
+			continue
+		}
+
+		recv, err := ready.RecvMessage()
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("failed to receive reply")
+			continue
+		}
+		c.handleReply(byte2DToStringArray(recv))
+	}
+}
+
+// handleReply delivers a reply received from the broker.
+func (c *SharedClient) handleReply(msg []string) {
+	if err := ValidateClientMessage(msg); err != nil {
+		log.WithError(err).Error("received invalid client message")
+		return
+	}
+
+	command := msg[1]
+	service := msg[2]
+	headers, data := splitHeaders(msg[3:])
+
+	tag, ok := headerTag(headers)
+	if !ok {
+		log.WithFields(log.Fields{"service": service}).Warn("received reply without a tag")
+		return
+	}
+
+	switch command {
+	case MdpcPartial:
+		// only the final reply is delivered
+	case MdpcError:
+		c.deliver(tag, sharedReply{err: errorFromReply(data).WithContext("service", service)})
+	default:
+		c.deliver(tag, sharedReply{data: data})
+	}
+}
@@ -0,0 +1,37 @@
+package mdp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedClientHandleReply(t *testing.T) {
+	c := &SharedClient{pending: make(map[string]chan sharedReply)}
+
+	first := make(chan sharedReply, 1)
+	second := make(chan sharedReply, 1)
+	c.pending["1"] = first
+	c.pending["2"] = second
+
+	// partial replies are skipped and replies without a pending request dropped
+	c.handleReply([]string{MdpcClient, MdpcPartial, "echo", EncodeTag("1"), "partial"})
+	c.handleReply([]string{MdpcClient, MdpcFinal, "echo", EncodeTag("3"), "stale"})
+	c.handleReply([]string{MdpcClient, MdpcFinal, "echo", "untagged"})
+	assert.Empty(t, first)
+	assert.Len(t, c.pending, 2)
+
+	c.handleReply([]string{MdpcClient, MdpcError, "echo", EncodeTag("2"),
+		ErrCodeServiceOverloaded, "queue full"})
+	c.handleReply([]string{MdpcClient, MdpcFinal, "echo", EncodeTag("1"), "hello"})
+
+	reply := <-first
+	require.NoError(t, reply.err)
+	assert.Equal(t, []string{"hello"}, reply.data)
+
+	reply = <-second
+	assert.True(t, errors.Is(reply.err, ErrServiceOverloaded))
+	assert.Empty(t, c.pending)
+}
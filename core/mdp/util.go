@@ -1,15 +1,58 @@
 package mdp
 
 import (
+	"context"
 	"fmt"
+	"time"
 )
 
+// pollInterval is the longest that a context aware receive waits on the poller
+// before checking whether the context is done.
+const pollInterval = 100 * time.Millisecond
+
+// pollTimeout returns how long to wait on the poller, which is the shortest of
+// the limit, the poll interval and the time left until the context deadline.
+func pollTimeout(ctx context.Context, limit time.Duration) time.Duration {
+	timeout := pollInterval
+	if limit < timeout {
+		timeout = limit
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	if timeout < time.Millisecond {
+		timeout = time.Millisecond
+	}
+	return timeout
+}
+
+// sleepContext pauses for the duration or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func popWorker(workers []*brokerWorker) (worker *brokerWorker, workers2 []*brokerWorker) {
 	worker = workers[0]
 	workers2 = workers[1:]
 	return
 }
 
+func popRequest(requests []*Request) (request *Request, requests2 []*Request) {
+	request = requests[0]
+	requests2 = requests[1:]
+	return
+}
+
 func delWorker(workers []*brokerWorker, worker *brokerWorker) []*brokerWorker {
 	for i := 0; i < len(workers); i++ {
 		if workers[i] == worker {
@@ -20,6 +63,15 @@ func delWorker(workers []*brokerWorker, worker *brokerWorker) []*brokerWorker {
 	return workers
 }
 
+func containsWorker(workers []*brokerWorker, worker *brokerWorker) bool {
+	for _, w := range workers {
+		if w == worker {
+			return true
+		}
+	}
+	return false
+}
+
 func stringArrayToByte2D(in []string) (out [][]byte) {
 	for _, str := range in {
 		out = append(out, []byte(str))
@@ -43,13 +95,14 @@ func ValidateClientMessage(frames []string) error {
 		return fmt.Errorf("frame 0 must be %s, got %s", MdpcClient, frames[0])
 	}
 
-	// Frame 1 should be command (PARTIAL or FINAL)
+	// Frame 1 should be command (PARTIAL, FINAL or ERROR)
 	command := frames[1]
 	switch command {
-	case MdpcPartial, MdpcFinal:
+	case MdpcPartial, MdpcFinal, MdpcError:
 		// Valid response commands
 	default:
-		return fmt.Errorf("frame 1 must be a valid client response command (%s or %s), got %s", MdpcPartial, MdpcFinal, command)
+		return fmt.Errorf("frame 1 must be a valid client response command (%s, %s or %s), got %s",
+			MdpcPartial, MdpcFinal, MdpcError, command)
 	}
 
 	// Frame 2 is service name - allow any non-empty string
@@ -94,10 +147,11 @@ func ValidateBrokerToClientMessage(frames []string) error {
 	// Frame 2 should be response command
 	command := frames[2]
 	switch command {
-	case MdpcPartial, MdpcFinal:
+	case MdpcPartial, MdpcFinal, MdpcError:
 		// Valid response commands
 	default:
-		return fmt.Errorf("frame 2 must be a valid client response command (%s or %s), got %s", MdpcPartial, MdpcFinal, command)
+		return fmt.Errorf("frame 2 must be a valid client response command (%s, %s or %s), got %s",
+			MdpcPartial, MdpcFinal, MdpcError, command)
 	}
 
 	if frames[3] == "" {
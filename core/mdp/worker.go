@@ -4,10 +4,13 @@ package mdp
 // Implements the MDP/Worker spec at http://rfc.zeromq.org/spec:7.
 
 import (
+	"context"
 	"fmt"
 	"runtime"
+	"strconv"
 	"time"
 
+	"github.com/geoffjay/plantd/core/curve"
 	"github.com/geoffjay/plantd/core/util"
 
 	log "github.com/sirupsen/logrus"
@@ -20,6 +23,9 @@ type Worker struct {
 	service string
 	worker  *czmq.Sock // Socket to broker
 	poller  *czmq.Poller
+	curve   *curve.Config // CURVE keys, if the broker requires them
+
+	capacity int // Requests the broker may send before the first is answered
 
 	// Heartbeat management
 	heartbeatAt time.Time     // When to send HEARTBEAT
@@ -27,8 +33,9 @@ type Worker struct {
 	heartbeat   time.Duration // Heartbeat delay, msecs
 	reconnect   time.Duration // Reconnect delay, msecs
 
-	expectReply bool   // False only at start
-	replyTo     string // Return identity, if any
+	expectReply bool      // False only at start
+	replyTo     string    // Return identity, if any
+	deadline    time.Time // Deadline of the current request, if any
 
 	shutdown bool
 }
@@ -84,6 +91,26 @@ func NewWorker(broker, service string) (w *Worker, err error) {
 	return
 }
 
+// NewWorkerWithCurve creates a new instance of the worker class that connects
+// to the broker using CURVE encryption. The worker presents its public key when
+// it registers, which the broker checks against the keys allowed for the
+// service.
+func NewWorkerWithCurve(broker, service string, keys *curve.Config) (w *Worker, err error) {
+	w = &Worker{
+		broker:    broker,
+		service:   service,
+		curve:     keys,
+		heartbeat: 2500 * time.Millisecond,
+		reconnect: 2500 * time.Millisecond,
+		shutdown:  false,
+	}
+
+	err = w.ConnectToBroker()
+	runtime.SetFinalizer(w, (*Worker).Close)
+
+	return
+}
+
 // SendToBroker sends a message to the broker using MDP v0.2 format (no empty frames).
 func (w *Worker) SendToBroker(command string, option string, msg []string) (err error) {
 	n := 3 // Always include empty delimiter frame
@@ -126,7 +153,7 @@ func (w *Worker) SendToBroker(command string, option string, msg []string) (err
 func (w *Worker) ConnectToBroker() (err error) {
 	w.Close()
 
-	if w.worker, err = czmq.NewDealer(w.broker); err != nil {
+	if w.worker, err = czmq.NewDealer(w.broker, w.curve.ClientOptions()...); err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("failed to create dealer")
 	}
 	if err = w.worker.Connect(w.broker); err != nil {
@@ -143,8 +170,7 @@ func (w *Worker) ConnectToBroker() (err error) {
 	}
 
 	// Register service with broker
-	if err = w.SendToBroker(MdpwReady, w.service, []string{}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("failed to send ready message to broker")
+	if err = w.register(""); err != nil {
 		return
 	}
 
@@ -160,6 +186,24 @@ func (w *Worker) ConnectToBroker() (err error) {
 	return
 }
 
+// register sends the READY command for the service, along with a proof over
+// the nonce when the broker has challenged the worker to prove its key.
+func (w *Worker) register(nonce string) error {
+	credentials, err := readyCredentials(w.curve, w.service, nonce)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("failed to create worker credentials")
+		return err
+	}
+	if w.capacity > 1 {
+		credentials = append(credentials, capacityHeader+strconv.Itoa(w.capacity))
+	}
+	if err = w.SendToBroker(MdpwReady, w.service, credentials); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("failed to send ready message to broker")
+		return err
+	}
+	return nil
+}
+
 // Shutdown attempts to bail on execution after the poller timeout.
 func (w *Worker) Shutdown() {
 	w.shutdown = true
@@ -184,6 +228,18 @@ func (w *Worker) SetHeartbeat(heartbeat time.Duration) {
 	w.heartbeat = heartbeat
 }
 
+// SetCapacity sets how many requests the broker may send to the worker before
+// it has replied to the first, the requests are still handled in order. The
+// worker registers again if it's connected so that the broker learns of the
+// change.
+func (w *Worker) SetCapacity(capacity int) error {
+	w.capacity = capacity
+	if w.worker == nil {
+		return nil
+	}
+	return w.ConnectToBroker()
+}
+
 // SetReconnect sets the reconnection delay.
 func (w *Worker) SetReconnect(reconnect time.Duration) {
 	w.reconnect = reconnect
@@ -213,7 +269,15 @@ func (w *Worker) GetResponseStream() *WorkerResponseStream {
 
 // Recv sends a reply, if any, to broker and waits for the next request.
 // Updated for MDP v0.2 protocol with PARTIAL/FINAL support
-func (w *Worker) Recv(reply []string) (msg []string, err error) { //nolint:cyclop
+func (w *Worker) Recv(reply []string) (msg []string, err error) {
+	return w.RecvContext(context.Background(), reply)
+}
+
+// RecvContext sends a reply, if any, to broker and waits for the next request
+// until the context is done. The poller waits in short intervals so that a
+// canceled context returns promptly with the context error while heartbeats
+// continue to be sent as usual.
+func (w *Worker) RecvContext(ctx context.Context, reply []string) (msg []string, err error) { //nolint:cyclop,funlen
 	// format and send the reply if we were provided one
 	if len(reply) == 0 && w.expectReply {
 		log.Trace("received reply, unhandled")
@@ -228,8 +292,15 @@ func (w *Worker) Recv(reply []string) (msg []string, err error) { //nolint:cyclo
 
 	w.expectReply = true
 
+	// liveness drops once for every heartbeat interval without a message
+	silentSince := time.Now()
+
 	for {
-		socket, perr := w.poller.Wait(int(w.heartbeat / 1e6))
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		socket, perr := w.poller.Wait(int(pollTimeout(ctx, w.heartbeat) / time.Millisecond))
 		if perr != nil {
 			log.WithFields(
 				log.Fields{"err": perr},
@@ -244,12 +315,19 @@ func (w *Worker) Recv(reply []string) (msg []string, err error) { //nolint:cyclo
 		}
 
 		if socket == nil { //nolint:nestif
+			if time.Since(silentSince) < w.heartbeat {
+				continue
+			}
+			silentSince = time.Now()
+
 			log.WithFields(log.Fields{
 				"timeout (ms)": int(HeartbeatInterval) / 1e6,
 			}).Tracef("no messages received on worker socket for the timeout duration")
 			w.liveness--
 			if w.liveness == 0 {
-				time.Sleep(w.reconnect)
+				if err = sleepContext(ctx, w.reconnect); err != nil {
+					return nil, err
+				}
 				if err = w.ConnectToBroker(); err != nil {
 					log.WithFields(log.Fields{
 						"err": err,
@@ -262,6 +340,7 @@ func (w *Worker) Recv(reply []string) (msg []string, err error) { //nolint:cyclo
 
 			if len(recvMsg) > 0 {
 				w.liveness = HeartbeatLiveness
+				silentSince = time.Now()
 
 				// Validate message format using robust validation
 				if err := ValidateWorkerMessage(recvMsg); err != nil {
@@ -282,12 +361,19 @@ func (w *Worker) Recv(reply []string) (msg []string, err error) { //nolint:cyclo
 					// we should pop and save as many addresses as there are
 					// up to a null part, but for now, just save one...
 					w.replyTo, msg = util.Unwrap(msg)
+					// the client may have set headers ahead of the body
+					var headers []string
+					headers, msg = splitHeaders(msg)
+					w.deadline, _ = headerDeadline(headers)
 					// here is where we actually have a message to process; we
 					// return it to the caller application:
 					return
 				case MdpwHeartbeat:
-					// do nothing for heartbeats
 					log.Trace("worker received a heartbeat command")
+					// a nonce is the broker asking the worker to prove its key
+					if nonce, ok := headerValue(msg, nonceHeader); ok {
+						_ = w.register(nonce)
+					}
 				case MdpwDisconnect:
 					if err = w.ConnectToBroker(); err != nil {
 						log.WithFields(log.Fields{
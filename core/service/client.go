@@ -17,6 +17,12 @@ type Connection interface {
 	Recv() (reply []string, err error)
 }
 
+// StreamConnection is a connection that can receive the partial replies of a
+// request ahead of the final one.
+type StreamConnection interface {
+	SendAndRecvStream(service string, request ...string) (*mdp.ResponseStream, error)
+}
+
 // Client represents a service client.
 type Client struct {
 	conn Connection
@@ -59,6 +65,11 @@ func (c *Client) sendMessage(id, message string, in interface{}, out interface{}
 		return err
 	}
 
+	return decodeReply(reply, out)
+}
+
+// decodeReply deserializes the body of a reply.
+func decodeReply(reply []string, out interface{}) error {
 	// Validate response
 	if len(reply) == 0 {
 		return errors.New("didn't receive expected response")
@@ -72,8 +83,7 @@ func (c *Client) sendMessage(id, message string, in interface{}, out interface{}
 	log.Debugf("reply: %+v\n", reply)
 
 	// Deserialize reply into a response
-	err = json.Unmarshal([]byte(reply[idx]), out)
-	return err
+	return json.Unmarshal([]byte(reply[idx]), out)
 }
 
 // RawRequest represents a raw service request.
@@ -94,3 +104,45 @@ func (c *Client) SendRawRequest(
 	}
 	return response, nil
 }
+
+// SendRawRequestStream sends a raw request to the service and passes each of
+// the partial responses to a handler, the final response is returned. The
+// stream ends early with the error of the handler if it returns one.
+func (c *Client) SendRawRequestStream(
+	id, requestType string,
+	request *RawRequest,
+	partial func(RawResponse) error,
+) (RawResponse, error) {
+	conn, ok := c.conn.(StreamConnection)
+	if !ok {
+		return nil, errors.New("connection doesn't support streaming")
+	}
+
+	bytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.SendAndRecvStream(id, requestType, string(bytes))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		reply, final, err := stream.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		response := make(RawResponse)
+		if err = decodeReply(reply, &response); err != nil {
+			return nil, err
+		}
+		if final {
+			return response, nil
+		}
+		if err = partial(response); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -161,8 +161,11 @@ func (s *Service) runMessageLoop(ctx context.Context, wg *sync.WaitGroup) {
 			continue
 		}
 
-		// Process message and prepare reply for next iteration
-		reply = s.processMessage(ctx, message)
+		// Process message and prepare reply for next iteration, the request
+		// context expires with the client deadline if one was set
+		reqCtx, cancel := s.worker.RequestContext(ctx)
+		reply = s.processMessage(reqCtx, message)
+		cancel()
 	}
 
 	s.logger.WithFields(logrus.Fields{
@@ -184,6 +187,11 @@ func (s *Service) processMessage(ctx context.Context, message []string) []string
 		return []string{}
 	}
 
+	if err := ctx.Err(); err != nil {
+		s.logger.WithError(err).Warn("Dropping MDP message past its deadline")
+		return []string{`{"error": "Request deadline exceeded"}`}
+	}
+
 	// Extract service name from message
 	// MDP message format: [service_name, operation, data...]
 	serviceName := "identity.health" // Default to health check
@@ -2,9 +2,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"regexp"
+
+	"github.com/geoffjay/plantd/core/bus"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -21,40 +22,30 @@ type metricSinkCallback struct {
 	db *sql.DB
 }
 
-// Metric represents a single measurement data point with time series metadata.
-type Metric struct {
-	Time    string  `json:"time"`
-	Device  string  `json:"device"`
-	Channel string  `json:"channel"`
-	Value   float32 `json:"value"`
-}
-
-func (cb *stateSinkCallback) Handle(data []byte) error {
+// Handle logs a message received on the state bus, bodies aren't logged
+// because state commands and values can be sensitive.
+func (cb *stateSinkCallback) Handle(message *bus.Message) error {
 	log.WithFields(log.Fields{
-		"bus":  "state",
-		"data": string(data),
+		"bus":         "state",
+		"topic":       message.Topic,
+		"data_length": len(message.Body),
 	}).Debug("data received on message bus")
 	return nil
 }
 
-func (cb *eventSinkCallback) Handle(data []byte) error {
+func (cb *eventSinkCallback) Handle(message *bus.Message) error {
 	log.WithFields(log.Fields{
-		"bus":  "event",
-		"data": string(data),
+		"bus":   "event",
+		"topic": message.Topic,
+		"data":  string(message.Body),
 	}).Debug("data received on message bus")
 	return nil
 }
 
-func (cb *metricSinkCallback) Handle(data []byte) error {
-	var metric Metric
-
-	re := regexp.MustCompile(".*{")
-	message := re.ReplaceAllString(string(data), "{")
-	if err := json.Unmarshal([]byte(message), &metric); err != nil {
-		return err
-	}
-
+// Handle stores a metric received by the metric subscriber.
+func (cb *metricSinkCallback) Handle(ctx context.Context, topic string, metric bus.Metric) error {
 	log.WithFields(log.Fields{
+		"topic":   topic,
 		"time":    metric.Time,
 		"device":  metric.Device,
 		"channel": metric.Channel,
@@ -64,7 +55,7 @@ func (cb *metricSinkCallback) Handle(data []byte) error {
 	sql := "INSERT INTO metrics (time, device, channel, value) " +
 		"VALUES ($1, $2, $3, $4)"
 
-	tx, err := cb.db.Begin()
+	tx, err := cb.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -86,7 +77,7 @@ func (cb *metricSinkCallback) Handle(data []byte) error {
 		}
 	}()
 
-	if _, err := stmt.Exec(metric.Time, metric.Device, metric.Channel,
+	if _, err := stmt.ExecContext(ctx, metric.Time, metric.Device, metric.Channel,
 		metric.Value); err != nil {
 		return err
 	}
@@ -51,9 +51,18 @@ func (m *Manager) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}()
 	m.runMigrations()
 
+	metrics, err := bus.NewSubscriber(bus.MetricTopic, bus.JSONCodec,
+		(&metricSinkCallback{db: m.db}).Handle)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "manager.run",
+			"error":   err,
+		}).Fatal("failed to create metric subscriber")
+	}
+
 	m.stateSink = bus.NewSink(">tcp://localhost:11001", "org.plantd")
 	m.eventSink = bus.NewSink(">tcp://localhost:12001", "org.plantd")
-	m.metricSink = bus.NewSink(">tcp://localhost:13001", "org.plantd")
+	m.metricSink = bus.NewSink(">tcp://localhost:13001", metrics.Filter())
 	defer m.stateSink.Stop()
 	defer m.eventSink.Stop()
 	defer m.metricSink.Stop()
@@ -62,8 +71,7 @@ func (m *Manager) Run(ctx context.Context, wg *sync.WaitGroup) {
 		Callback: &stateSinkCallback{db: m.db}})
 	m.eventSink.SetHandler(&bus.SinkHandler{
 		Callback: &eventSinkCallback{db: m.db}})
-	m.metricSink.SetHandler(&bus.SinkHandler{
-		Callback: &metricSinkCallback{db: m.db}})
+	metrics.Attach(ctx, m.metricSink)
 
 	wg.Add(3)
 	go m.eventSink.Run(ctx, wg)
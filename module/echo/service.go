@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/geoffjay/plantd/core/http"
 	"github.com/geoffjay/plantd/core/mdp"
@@ -94,6 +95,14 @@ func (s *Service) runWorker(ctx context.Context, wg *sync.WaitGroup) {
 				continue
 			}
 
+			// the client has given up on the request if its deadline passed
+			if deadline, ok := s.worker.Deadline(); ok && time.Now().After(deadline) {
+				log.WithFields(log.Fields{"deadline": deadline}).Warn(
+					"dropping request past its deadline")
+				reply = []string{`{"error": "request deadline exceeded"}`}
+				continue
+			}
+
 			msgType := request[0]
 
 			// reset reply
@@ -1,37 +1,24 @@
 package main
 
 import (
-	"encoding/json"
-	"regexp"
+	"context"
+
+	"github.com/geoffjay/plantd/core/bus"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type metricSinkCallback struct{}
 
-type Metric struct {
-	Timestamp string   `json:"timestamp"`
-	Value     string   `json:"value"`
-	Units     string   `json:"units"`
-	Tags      []string `json:"tags"`
-}
-
-type MetricGroup struct {
-	Metrics []Metric `json:"metrics"`
-}
-
-func (cb *metricSinkCallback) Handle(data []byte) error {
-	var metric Metric
-
-	re := regexp.MustCompile(".*{")
-	message := re.ReplaceAllString(string(data), "{")
-	if err := json.Unmarshal([]byte(message), &metric); err != nil {
-		return err
-	}
-
+// Handle receives the metrics of the metric subscriber.
+func (cb *metricSinkCallback) Handle(_ context.Context, topic string, metric bus.Metric) error {
 	log.WithFields(log.Fields{
-		"timestamp": metric.Timestamp,
-		"value":     metric.Value,
+		"topic":   topic,
+		"time":    metric.Time,
+		"device":  metric.Device,
+		"channel": metric.Channel,
+		"value":   metric.Value,
+		"units":   metric.Units,
 	}).Debug("handler received metric")
 
 	return nil
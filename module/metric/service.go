@@ -35,6 +35,7 @@ type Producer struct {
 	clientEndpoint string
 	client         *service.Client
 	source         *bus.Source
+	publisher      *bus.Publisher[bus.Metric]
 }
 
 type WeatherResponse struct {
@@ -72,9 +73,13 @@ func NewProducer(clientEndpoint string) Service {
 }
 
 func (c *Consumer) Run(ctx context.Context, wg *sync.WaitGroup) {
-	var err error
+	metrics, err := bus.NewSubscriber(bus.MetricTopic, bus.JSONCodec,
+		(&metricSinkCallback{}).Handle)
+	if err != nil {
+		log.Panic(err)
+	}
 
-	c.sink = bus.NewSink(">tcp://localhost:13001", "org.plantd")
+	c.sink = bus.NewSink(">tcp://localhost:13001", metrics.Filter())
 	c.client, err = service.NewClient(c.clientEndpoint)
 	if err != nil {
 		log.Error(err)
@@ -84,7 +89,7 @@ func (c *Consumer) Run(ctx context.Context, wg *sync.WaitGroup) {
 	defer c.client.Close()
 
 	serviceDiscoveryInform(c.client, "consumer")
-	c.sink.SetHandler(&bus.SinkHandler{Callback: &metricSinkCallback{}})
+	metrics.Attach(ctx, c.sink)
 
 	go c.sink.Run(ctx, wg)
 
@@ -97,6 +102,14 @@ func (p *Producer) Run(ctx context.Context, wg *sync.WaitGroup) {
 	var err error
 
 	p.source = bus.NewSource(">tcp://localhost:13000", "org.plantd.Metric")
+	// a stalled bus shouldn't hold up reading the weather, stale values are
+	// the ones to lose
+	if err = p.source.SetQueue(bus.DefaultQueueSize, bus.QueueDropOldest); err != nil {
+		log.Error(err)
+	}
+	if p.publisher, err = bus.NewPublisher[bus.Metric](p.source, bus.MetricTopic, bus.JSONCodec); err != nil {
+		log.Panic(err)
+	}
 	p.client, err = service.NewClient(p.clientEndpoint)
 	if err != nil {
 		log.Error(err)
@@ -178,19 +191,33 @@ func (p *Producer) Run(ctx context.Context, wg *sync.WaitGroup) {
 				weatherResponse.Units["wind_direction_10m"],
 			)
 
-			metric := Metric{
-				Timestamp: time.Now().String(),
-				Value:     "1",
-				Units:     "count",
-				Tags:      []string{"weather"},
+			for _, field := range weatherFields {
+				value, ok := weatherResponse.Values[field].(float64)
+				if !ok {
+					continue
+				}
+				metric := bus.Metric{
+					Time:    time.Now(),
+					Device:  "weather",
+					Channel: field,
+					Value:   value,
+					Units:   weatherResponse.Units[field],
+					Tags:    []string{"weather"},
+				}
+				if err = p.publisher.Publish(ctx, metric.Params(), metric); err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("failed to queue metric")
+				}
 			}
-			message, err := json.Marshal(metric)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			log.Trace(string(message))
-			p.source.QueueMessage([]byte(message))
+
+			stats := p.source.Stats()
+			log.WithFields(log.Fields{
+				"module":    "metric",
+				"context":   "producer",
+				"queued":    stats.Queued,
+				"published": stats.Published,
+				"dropped":   stats.Dropped,
+				"failed":    stats.Failed,
+			}).Debug("source statistics")
 		}
 	}()
 
@@ -0,0 +1,147 @@
+// Package api holds the messages that the state service exchanges with other
+// services on the state bus.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/geoffjay/plantd/core/curve"
+)
+
+const (
+	// StateChangeTopic is the prefix of the topics that state changes are
+	// published on, the scope follows it. Scopes contain dots so this can't
+	// be a template.
+	StateChangeTopic = "org.plantd.state.change"
+	// StateReplyTopic is the prefix of the topics that the results of state
+	// commands are published on.
+	StateReplyTopic = "org.plantd.state.reply"
+	// StateCommandTopic is the prefix of the topics that state commands are
+	// published on, the scope follows it.
+	StateCommandTopic = "org.plantd.state.command"
+)
+
+// The operations that change the state store.
+const (
+	StateSet         = "set"
+	StateDelete      = "delete"
+	StateCreateScope = "create-scope"
+	StateDeleteScope = "delete-scope"
+	// StateRestoreScope replaces a scope with the one in a backup.
+	StateRestoreScope = "restore-scope"
+)
+
+// StateChange is a change of the state store, it's published on the state bus
+// with the topic of its scope.
+type StateChange struct {
+	Revision  uint64    `json:"revision"`
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Scope     string    `json:"scope"`
+	Key       string    `json:"key,omitempty"`
+	OldValue  string    `json:"old_value,omitempty"`
+	NewValue  string    `json:"new_value,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+}
+
+// StateChangeTopicFor returns the topic the changes of a scope are published
+// on, the topic of an empty scope is the filter of every change.
+func StateChangeTopicFor(scope string) string {
+	if scope == "" {
+		return StateChangeTopic + "."
+	}
+	return StateChangeTopic + "." + scope
+}
+
+// Topic returns the topic the change is published on.
+func (c *StateChange) Topic() string {
+	return StateChangeTopicFor(c.Scope)
+}
+
+// StateCommand asks the state service to set or delete a key, it's published
+// on the state bus with the command topic of its scope. The result is
+// published on the reply topic, which has to start with StateReplyTopic.
+// Commands don't carry credentials, they're signed with the CURVE key of the
+// sender instead.
+type StateCommand struct {
+	ID        string    `json:"id,omitempty"`
+	Time      time.Time `json:"time"`
+	Scope     string    `json:"scope"`
+	Operation string    `json:"operation"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	ReplyTo   string    `json:"reply_to,omitempty"`
+	PublicKey string    `json:"public_key,omitempty"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+// StateCommandResult is the outcome of a StateCommand.
+type StateCommandResult struct {
+	ID        string `json:"id,omitempty"`
+	Scope     string `json:"scope"`
+	Operation string `json:"operation"`
+	Key       string `json:"key"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+	Revision  uint64 `json:"revision,omitempty"`
+	Actor     string `json:"actor,omitempty"`
+}
+
+// StateReplyTopicFor returns the topic the results of the commands of a scope
+// are published on when the commands don't name one.
+func StateReplyTopicFor(scope string) string {
+	return StateReplyTopic + "." + scope
+}
+
+// ReplyTopic returns the topic the result of the command is published on.
+func (c *StateCommand) ReplyTopic() string {
+	if c.ReplyTo != "" {
+		return c.ReplyTo
+	}
+	return StateReplyTopicFor(c.Scope)
+}
+
+// StateCommandTopicFor returns the topic the commands of a scope are published
+// on.
+func StateCommandTopicFor(scope string) string {
+	return StateCommandTopic + "." + scope
+}
+
+// Topic returns the topic the command is published on.
+func (c *StateCommand) Topic() string {
+	return StateCommandTopicFor(c.Scope)
+}
+
+// SigningData returns the data that the signature of the command covers, which
+// is everything but the signature itself.
+func (c *StateCommand) SigningData() (string, error) {
+	unsigned := *c
+	unsigned.Signature = ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Sign signs the command with the CURVE keys of the sender, their server key
+// has to be the public key of the state service. The time of the command is
+// set when it's missing, the state service rejects commands that are too old.
+func (c *StateCommand) Sign(keys *curve.Config) error {
+	if !keys.Enabled() {
+		return errors.New("curve keys are needed to sign a state command")
+	}
+	c.PublicKey = keys.PublicKey
+	if c.Time.IsZero() {
+		c.Time = time.Now().UTC()
+	}
+
+	data, err := c.SigningData()
+	if err != nil {
+		return err
+	}
+	c.Signature, err = keys.Proof(data)
+	return err
+}
@@ -2,20 +2,37 @@
 package auth
 
 import (
+	"context"
+
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	listScopesMsgType  = "list-scopes"
-	healthMsgType      = "health"
-	createScopeMsgType = "create-scope"
-	deleteScopeMsgType = "delete-scope"
-	setMsgType         = "set"
-	getMsgType         = "get"
-	deleteMsgType      = "delete"
-	listKeysMsgType    = "list-keys"
+	listScopesMsgType    = "list-scopes"
+	healthMsgType        = "health"
+	createScopeMsgType   = "create-scope"
+	deleteScopeMsgType   = "delete-scope"
+	setMsgType           = "set"
+	getMsgType           = "get"
+	deleteMsgType        = "delete"
+	listKeysMsgType      = "list-keys"
+	createBackupMsgType  = "create_backup"
+	restoreBackupMsgType = "restore_backup"
+	listBackupsMsgType   = "list_backups"
+	checkReadMsgType     = "state-check-read"
 )
 
+// ActorCallback is implemented by callbacks that record who made a request.
+type ActorCallback interface {
+	ExecuteAs(msgBody, actor string) ([]byte, error)
+}
+
+// StreamCallback is implemented by callbacks that send partial replies ahead
+// of the final one.
+type StreamCallback interface {
+	ExecuteStream(ctx context.Context, msgBody string, send func([]byte) error) ([]byte, error)
+}
+
 // AuthenticatedCallback wraps existing callbacks with authentication.
 type AuthenticatedCallback struct {
 	underlying     interface{ Execute(string) ([]byte, error) } // Use interface directly to avoid circular import
@@ -41,6 +58,51 @@ func NewAuthenticatedCallback(
 
 // Execute performs authentication before calling the underlying callback.
 func (ac *AuthenticatedCallback) Execute(msgBody string) ([]byte, error) {
+	userCtx, scope, response, err := ac.authenticate(msgBody)
+	if err != nil {
+		return response, err
+	}
+
+	// Call the underlying callback with the original message
+	// Note: We pass the original msgBody to maintain compatibility
+	if actorCallback, ok := ac.underlying.(ActorCallback); ok {
+		response, err = actorCallback.ExecuteAs(msgBody, userCtx.UserEmail)
+	} else {
+		response, err = ac.underlying.Execute(msgBody)
+	}
+
+	ac.logResult(userCtx, scope, err)
+
+	return response, err
+}
+
+// ExecuteStream performs authentication before calling the underlying
+// callback, callbacks that don't stream only send the final reply.
+func (ac *AuthenticatedCallback) ExecuteStream(
+	ctx context.Context,
+	msgBody string,
+	send func([]byte) error,
+) ([]byte, error) {
+	streamCallback, ok := ac.underlying.(StreamCallback)
+	if !ok {
+		return ac.Execute(msgBody)
+	}
+
+	userCtx, scope, response, err := ac.authenticate(msgBody)
+	if err != nil {
+		return response, err
+	}
+
+	response, err = streamCallback.ExecuteStream(ctx, msgBody, send)
+
+	ac.logResult(userCtx, scope, err)
+
+	return response, err
+}
+
+// authenticate validates the token of a request for the scope it names, the
+// error response to reply with is returned when it fails.
+func (ac *AuthenticatedCallback) authenticate(msgBody string) (*UserContext, string, []byte, error) {
 	// Parse authenticated request
 	authRequest, err := NewAuthenticatedRequest(msgBody)
 	if err != nil {
@@ -48,7 +110,7 @@ func (ac *AuthenticatedCallback) Execute(msgBody string) ([]byte, error) {
 			"callback": ac.name,
 			"error":    err,
 		}).Error("Failed to parse authenticated request")
-		return CreateErrorResponse(err), err
+		return nil, "", CreateErrorResponse(err), err
 	}
 
 	// Get service scope for permission checking
@@ -58,7 +120,7 @@ func (ac *AuthenticatedCallback) Execute(msgBody string) ([]byte, error) {
 		log.WithFields(log.Fields{
 			"callback": ac.name,
 		}).Error("Service scope missing from request")
-		return CreateErrorResponse(ErrServiceMissing), ErrServiceMissing
+		return nil, "", CreateErrorResponse(ErrServiceMissing), ErrServiceMissing
 	}
 
 	// Use empty scope for global operations
@@ -75,7 +137,7 @@ func (ac *AuthenticatedCallback) Execute(msgBody string) ([]byte, error) {
 			"msgType":  ac.msgType,
 			"error":    err,
 		}).Warn("Authentication failed")
-		return CreateErrorResponse(ErrTokenInvalid), err
+		return nil, scope, CreateErrorResponse(ErrTokenInvalid), err
 	}
 
 	// Log authenticated operation for audit trail
@@ -87,10 +149,11 @@ func (ac *AuthenticatedCallback) Execute(msgBody string) ([]byte, error) {
 		"scope":      scope,
 	}).Info("Authenticated state operation")
 
-	// Call the underlying callback with the original message
-	// Note: We pass the original msgBody to maintain compatibility
-	response, err := ac.underlying.Execute(msgBody)
+	return userCtx, scope, nil, nil
+}
 
+// logResult logs the outcome of an authenticated operation.
+func (ac *AuthenticatedCallback) logResult(userCtx *UserContext, scope string, err error) {
 	if err != nil {
 		log.WithFields(log.Fields{
 			"user_email": userCtx.UserEmail,
@@ -107,14 +170,13 @@ func (ac *AuthenticatedCallback) Execute(msgBody string) ([]byte, error) {
 			"scope":      scope,
 		}).Debug("Operation completed successfully")
 	}
-
-	return response, err
 }
 
 // requiresServiceScope checks if the operation requires a service scope.
 func (ac *AuthenticatedCallback) requiresServiceScope() bool {
 	switch ac.msgType {
-	case listScopesMsgType, healthMsgType:
+	case listScopesMsgType, healthMsgType, createBackupMsgType,
+		restoreBackupMsgType, listBackupsMsgType, checkReadMsgType:
 		// Global operations that don't require a specific service scope
 		return false
 	default:
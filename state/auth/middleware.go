@@ -34,6 +34,8 @@ type AuthMiddleware struct { //nolint:revive
 	cacheTTL        time.Duration
 	cacheMutex      sync.RWMutex
 	logger          *log.Logger
+	// validateToken asks the identity service who a token belongs to
+	validateToken func(token string) (*UserContext, error)
 }
 
 // Config holds configuration for the authentication middleware.
@@ -74,7 +76,7 @@ func NewAuthMiddleware(config *Config) *AuthMiddleware {
 		})
 	}
 
-	return &AuthMiddleware{
+	am := &AuthMiddleware{
 		identityClient:  config.IdentityClient,
 		permissionCache: make(map[string]*CachedPermissions),
 		accessChecker:   accessChecker,
@@ -82,6 +84,9 @@ func NewAuthMiddleware(config *Config) *AuthMiddleware {
 		cacheTTL:        config.CacheTTL,
 		logger:          config.Logger,
 	}
+	am.validateToken = am.identityUser
+
+	return am
 }
 
 // ValidateRequest validates an authentication token and checks permissions.
@@ -90,8 +95,9 @@ func (am *AuthMiddleware) ValidateRequest(msgType, token, scope string) (*UserCo
 		return nil, fmt.Errorf("authentication token required")
 	}
 
-	// Check cache first
-	cacheKey := fmt.Sprintf("%s:%s", token, scope)
+	// Check cache first, a token allowed one operation on a scope isn't
+	// necessarily allowed the others
+	cacheKey := fmt.Sprintf("%s:%s:%s", token, msgType, scope)
 	am.cacheMutex.RLock()
 	if cached, found := am.permissionCache[cacheKey]; found {
 		if time.Now().Before(cached.ExpiresAt) {
@@ -109,6 +115,73 @@ func (am *AuthMiddleware) ValidateRequest(msgType, token, scope string) (*UserCo
 	am.cacheMutex.RUnlock()
 
 	// Validate token with identity service
+	userCtx, err := am.validateToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check specific permissions for the operation using RBAC
+	if err := am.ValidateUser(msgType, userCtx, scope); err != nil {
+		return nil, err
+	}
+
+	// Cache the result
+	am.cacheMutex.Lock()
+	am.permissionCache[cacheKey] = &CachedPermissions{
+		UserContext: userCtx,
+		ExpiresAt:   time.Now().Add(am.cacheTTL),
+	}
+	am.cacheMutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"user_email": userCtx.UserEmail,
+		"user_id":    userCtx.UserID,
+		"scope":      scope,
+		"operation":  msgType,
+		"permission": am.getRequiredPermission(msgType),
+		"cache_miss": true,
+	}).Debug("Authentication and authorization successful")
+
+	return userCtx, nil
+}
+
+// ValidateUser checks that a user is allowed an operation on a scope, with the
+// same permissions that ValidateRequest checks for the user of a token.
+func (am *AuthMiddleware) ValidateUser(msgType string, userCtx *UserContext, scope string) error {
+	requiredPermission := am.getRequiredPermission(msgType)
+	if err := am.accessChecker.CheckScopeAccess(userCtx, requiredPermission, scope); err != nil {
+		return fmt.Errorf("access denied for %s on scope %s: %w", msgType, scope, err)
+	}
+	return nil
+}
+
+// KeyUser returns the user that a key acts as, for callers that are identified
+// by a key rather than a token. It has the permissions of its roles and the
+// ones it's given.
+func (am *AuthMiddleware) KeyUser(email string, roles, permissions []string) (*UserContext, error) {
+	names := append([]string{}, permissions...)
+	for _, role := range roles {
+		rolePermissions, err := am.roleManager.GetRolePermissions(context.Background(), role)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, rolePermissions...)
+	}
+
+	userPermissions := make([]Permission, len(names))
+	for i, name := range names {
+		userPermissions[i] = Permission{Name: name}
+	}
+
+	return &UserContext{
+		UserEmail:   email,
+		Permissions: userPermissions,
+	}, nil
+}
+
+// identityUser validates a token with the identity service and returns the
+// user it belongs to.
+func (am *AuthMiddleware) identityUser(token string) (*UserContext, error) {
 	validateResp, err := am.identityClient.ValidateToken(context.Background(), token)
 	if err != nil {
 		return nil, fmt.Errorf("token validation failed: %w", err)
@@ -133,38 +206,13 @@ func (am *AuthMiddleware) ValidateRequest(msgType, token, scope string) (*UserCo
 		}
 	}
 
-	userCtx := &UserContext{
+	return &UserContext{
 		UserID:      *validateResp.UserID,
 		UserEmail:   validateResp.Email,
 		Username:    "", // Username not returned in ValidateTokenResponse
 		Permissions: permissions,
 		ValidUntil:  time.Unix(expiresAt, 0),
-	}
-
-	// Check specific permissions for the operation using RBAC
-	requiredPermission := am.getRequiredPermission(msgType)
-	if err := am.accessChecker.CheckScopeAccess(userCtx, requiredPermission, scope); err != nil {
-		return nil, fmt.Errorf("access denied for %s on scope %s: %w", msgType, scope, err)
-	}
-
-	// Cache the result
-	am.cacheMutex.Lock()
-	am.permissionCache[cacheKey] = &CachedPermissions{
-		UserContext: userCtx,
-		ExpiresAt:   time.Now().Add(am.cacheTTL),
-	}
-	am.cacheMutex.Unlock()
-
-	log.WithFields(log.Fields{
-		"user_email": userCtx.UserEmail,
-		"user_id":    userCtx.UserID,
-		"scope":      scope,
-		"operation":  msgType,
-		"permission": requiredPermission,
-		"cache_miss": true,
-	}).Debug("Authentication and authorization successful")
-
-	return userCtx, nil
+	}, nil
 }
 
 // getRequiredPermission maps operation types to required permissions.
@@ -184,6 +232,20 @@ func (am *AuthMiddleware) getRequiredPermission(msgType string) string {
 		return StateScopeList
 	case "list-keys":
 		return StateDataRead // Reading keys requires read permission
+	case "state-watch", "state-check-read":
+		return StateDataRead // Watching changes requires read permission
+	case "state-history", "state-get-revision":
+		return StateDataRead // Reading past values requires read permission
+	case "state-lease-grant", "state-lease-renew", "state-lease-revoke":
+		return StateDataWrite // Leases only keep the keys their owner sets
+	case "state-batch", "state-cas":
+		return StateDataWrite // Each operation is checked for its own scope too
+	case "state-get-schema", "validate_data":
+		return StateDataRead // Checking values against schemas requires read permission
+	case "state-set-schema":
+		return StateAdminFull // Schemas restrict what every writer can set
+	case "create_backup", "restore_backup", "list_backups":
+		return StateAdminFull // Backups span every scope
 	case "health":
 		return StateHealthRead
 	default:
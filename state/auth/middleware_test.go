@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRequestCache(t *testing.T) {
+	middleware := NewAuthMiddleware(&Config{AccessChecker: createTestAccessChecker()})
+
+	validated := 0
+	middleware.validateToken = func(_ string) (*UserContext, error) {
+		validated++
+		return createTestUserContext([]string{StateDataRead}), nil
+	}
+
+	_, err := middleware.ValidateRequest("get", "reader-token", "org.plantd.Test")
+	require.NoError(t, err)
+	_, err = middleware.ValidateRequest("get", "reader-token", "org.plantd.Test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, validated)
+
+	// a token that was allowed to read can't then write from the cache
+	_, err = middleware.ValidateRequest("set", "reader-token", "org.plantd.Test")
+	assert.Error(t, err)
+	assert.Equal(t, 2, validated)
+	_, err = middleware.ValidateRequest("set", "reader-token", "org.plantd.Test")
+	assert.Error(t, err)
+
+	// other scopes are checked on their own
+	_, err = middleware.ValidateRequest("get", "reader-token", "org.plantd.Other")
+	require.NoError(t, err)
+	assert.Equal(t, 4, validated)
+}
+
+func TestValidateRequestCheckRead(t *testing.T) {
+	middleware := NewAuthMiddleware(&Config{AccessChecker: createTestAccessChecker()})
+	users := map[string]*UserContext{
+		"global": createTestUserContext([]string{StateDataRead}),
+		"scoped": createTestUserContext([]string{
+			NewPermissionUtils().CreateScopedPermission(StateDataRead, "org.plantd.Test"),
+		}),
+	}
+	middleware.validateToken = func(token string) (*UserContext, error) {
+		return users[token], nil
+	}
+
+	_, err := middleware.ValidateRequest("state-check-read", "scoped", "org.plantd.Test")
+	require.NoError(t, err)
+	_, err = middleware.ValidateRequest("state-check-read", "scoped", "org.plantd.Other")
+	assert.Error(t, err)
+
+	// every scope can only be read with the global permission
+	_, err = middleware.ValidateRequest("state-check-read", "scoped", "")
+	assert.Error(t, err)
+	_, err = middleware.ValidateRequest("state-check-read", "global", "")
+	require.NoError(t, err)
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geoffjay/plantd/core/service"
+	"github.com/geoffjay/plantd/state/api"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultBackupRetention is how many backups are kept when the config doesn't
+// say.
+const DefaultBackupRetention = 10
+
+// ErrBackupNotFound is returned for a backup ID that isn't kept.
+var ErrBackupNotFound = errors.New("backup doesn't exist")
+
+// BackupInfo describes a backup of some of the scopes of the store.
+type BackupInfo struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Scopes      []string  `json:"scopes"`
+	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	Size        int64     `json:"size"`
+	Revision    uint64    `json:"revision"`
+}
+
+// Backups keeps snapshots of the store in a directory, each is a bbolt file
+// with the scopes it was taken of and a JSON file that describes it.
+type Backups struct {
+	dir       string
+	retention int
+	store     *Store
+	mu        sync.Mutex
+}
+
+type createBackupCallback struct {
+	name    string
+	backups *Backups
+}
+
+type restoreBackupCallback struct {
+	name    string
+	backups *Backups
+	manager *Manager
+}
+
+type listBackupsCallback struct {
+	name    string
+	backups *Backups
+}
+
+// NewBackups constructs the backups of a store kept in `dir`, only the latest
+// `retention` are kept.
+func NewBackups(store *Store, dir string, retention int) *Backups {
+	if retention <= 0 {
+		retention = DefaultBackupRetention
+	}
+	return &Backups{
+		dir:       dir,
+		retention: retention,
+		store:     store,
+	}
+}
+
+// Create takes a backup of scopes on behalf of an actor, every scope is
+// backed up when none are given.
+func (b *Backups) Create(actor, name, description string, scopes []string) (*BackupInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	all := b.store.ListAllScope()
+	if len(scopes) == 0 {
+		scopes = all
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(all, scope) {
+			return nil, fmt.Errorf("scope `%s` doesn't exist", scope)
+		}
+	}
+
+	if err := os.MkdirAll(b.dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	info := &BackupInfo{
+		ID:          now.Format("20060102T150405.000000000Z"),
+		Name:        name,
+		Description: description,
+		Scopes:      scopes,
+		CreatedAt:   now,
+		CreatedBy:   actor,
+	}
+	if info.Name == "" {
+		info.Name = info.ID
+	}
+
+	// the snapshot is written beside the backup until it only has the scopes
+	path := b.path(info.ID, ".db")
+	partial := path + ".partial"
+	defer func() { _ = os.Remove(partial) }()
+
+	var err error
+	if info.Revision, err = b.store.Snapshot(partial); err != nil {
+		return nil, fmt.Errorf("failed to take snapshot: %w", err)
+	}
+	if err = keepScopes(partial, scopes); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(partial, path); err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = stat.Size()
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(b.path(info.ID, ".json"), data, 0o644); err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	b.prune()
+
+	return info, nil
+}
+
+// Restore replaces scopes with the ones in a backup on behalf of an actor,
+// every scope of the backup is restored when none are given. Each scope is
+// restored in a transaction of its own, the ones that were restored before a
+// failure are returned with it.
+func (b *Backups) Restore(actor, id string, scopes []string) ([]*api.StateChange, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	info, err := b.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(scopes) == 0 {
+		scopes = info.Scopes
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(info.Scopes, scope) {
+			return nil, fmt.Errorf("scope `%s` isn't in backup %s", scope, id)
+		}
+	}
+
+	db, err := bolt.Open(b.path(id, ".db"), 0o600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup %s: %w", id, err)
+	}
+	defer db.Close()
+
+	var changes []*api.StateChange
+	err = db.View(func(snapshot *bolt.Tx) error {
+		for _, scope := range scopes {
+			change, err := b.store.RestoreScopeBy(actor, scope, snapshot)
+			if err != nil {
+				return fmt.Errorf("failed to restore scope `%s`: %w", scope, err)
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// List returns the backups that are kept, newest first.
+func (b *Backups) List() ([]*BackupInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.list()
+}
+
+func (b *Backups) list() ([]*BackupInfo, error) {
+	entries, err := os.ReadDir(b.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var backups []*BackupInfo
+	for _, entry := range entries {
+		id, found := strings.CutSuffix(entry.Name(), ".json")
+		if !found || entry.IsDir() {
+			continue
+		}
+		info, err := b.get(id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"backup": id,
+				"error":  err,
+			}).Warn("skipping unreadable backup")
+			continue
+		}
+		backups = append(backups, info)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+func (b *Backups) get(id string) (*BackupInfo, error) {
+	// IDs name files in the directory, anything else isn't one
+	if id == "" || id != filepath.Base(id) {
+		return nil, fmt.Errorf("%w: %s", ErrBackupNotFound, id)
+	}
+
+	data, err := os.ReadFile(b.path(id, ".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrBackupNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var info BackupInfo
+	if err = json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid backup %s: %w", id, err)
+	}
+	return &info, nil
+}
+
+// prune removes the oldest backups past the retention.
+func (b *Backups) prune() {
+	backups, err := b.list()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Warn("failed to list backups")
+		return
+	}
+	for _, info := range backups[min(len(backups), b.retention):] {
+		for _, ext := range []string{".json", ".db"} {
+			if err := os.Remove(b.path(info.ID, ext)); err != nil {
+				log.WithFields(log.Fields{
+					"backup": info.ID,
+					"error":  err,
+				}).Warn("failed to remove backup")
+			}
+		}
+		log.WithFields(log.Fields{"backup": info.ID}).Debug("removed backup past retention")
+	}
+}
+
+func (b *Backups) path(id, ext string) string {
+	return filepath.Join(b.dir, id+ext)
+}
+
+// keepScopes removes everything but the scopes, and what's kept about them,
+// from a snapshot.
+func keepScopes(path string, scopes []string) error {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		var drop []string
+		_ = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if string(name) != metaBucket && !slices.Contains(scopes, string(name)) {
+				drop = append(drop, string(name))
+			}
+			return nil
+		})
+		for _, scope := range drop {
+			if err := tx.DeleteBucket([]byte(scope)); err != nil {
+				return err
+			}
+			if err := dropScopeMeta(tx, scope); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Snapshot writes a consistent copy of the store to a file and returns the
+// revision it was taken at, writes carry on while it's taken.
+func (s *Store) Snapshot(path string) (revision uint64, err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte(metaBucket)); meta != nil {
+			revision = meta.Sequence()
+		}
+		_, err := tx.WriteTo(file)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revision, file.Sync()
+}
+
+// RestoreScopeBy replaces a scope, the history of its keys and its schemas,
+// with the one in a snapshot on behalf of an actor and returns the change.
+func (s *Store) RestoreScopeBy(actor, scope string, snapshot *bolt.Tx) (*api.StateChange, error) {
+	if scope == metaBucket {
+		return nil, ErrReservedScope
+	}
+	source := snapshot.Bucket([]byte(scope))
+	if source == nil {
+		return nil, fmt.Errorf("scope `%s` doesn't exist in snapshot", scope)
+	}
+
+	change := &api.StateChange{
+		Operation: api.StateRestoreScope,
+		Scope:     scope,
+		Actor:     actor,
+	}
+	err := s.update(change, func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(scope)) != nil {
+			if err := tx.DeleteBucket([]byte(scope)); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket([]byte(scope))
+		if err != nil {
+			return err
+		}
+		if err = copyBucket(bucket, source); err != nil {
+			return err
+		}
+
+		if err = dropScopeMeta(tx, scope); err != nil {
+			return err
+		}
+		for _, name := range scopeMetaBuckets {
+			kept := scopeMeta(snapshot, name, scope)
+			if kept == nil {
+				continue
+			}
+			if bucket, err = createScopeMeta(tx, name, scope); err != nil {
+				return err
+			}
+			if err = copyBucket(bucket, kept); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return change, err
+}
+
+func copyBucket(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		// scopes don't have buckets of their own
+		if v == nil {
+			return nil
+		}
+		return dst.Put(k, v)
+	})
+}
+
+func readScopes(request service.RawRequest) ([]string, error) {
+	value, found := request["scopes"]
+	if !found {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("scopes must be a list")
+	}
+	scopes := make([]string, 0, len(list))
+	for _, item := range list {
+		scope, ok := item.(string)
+		if !ok || scope == "" {
+			return nil, errors.New("scopes must be a list of names")
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// Execute callback function to handle `create_backup` requests.
+func (cb *createBackupCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles a `create_backup` request made by an actor.
+func (cb *createBackupCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "create_backup",
+	}).Debug("Processing create_backup request")
+
+	var request service.RawRequest
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		return createErrorResponse("Invalid request format: " + err.Error()), err
+	}
+	name, _ := request["name"].(string)
+	description, _ := request["description"].(string)
+	scopes, err := readScopes(request)
+	if err != nil {
+		return createErrorResponse(err.Error()), err
+	}
+
+	info, err := cb.backups.Create(actor, name, description, scopes)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scopes":   scopes,
+			"error":    err,
+		}).Error("Failed to create backup")
+		return createErrorResponse("Failed to create backup: " + err.Error()), err
+	}
+
+	log.WithFields(log.Fields{
+		"callback": cb.name,
+		"backup":   info.ID,
+		"scopes":   info.Scopes,
+		"size":     info.Size,
+		"actor":    actor,
+	}).Info("Successfully created backup")
+
+	return createSuccessResponse(info), nil
+}
+
+// Execute callback function to handle `restore_backup` requests.
+func (cb *restoreBackupCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles a `restore_backup` request made by an actor.
+func (cb *restoreBackupCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "restore_backup",
+	}).Debug("Processing restore_backup request")
+
+	var request service.RawRequest
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		return createErrorResponse("Invalid request format: " + err.Error()), err
+	}
+	id, ok := request["id"].(string)
+	if !ok || id == "" {
+		err := errors.New("backup id missing")
+		return createErrorResponse("Backup ID required for restore_backup request"), err
+	}
+	scopes, err := readScopes(request)
+	if err != nil {
+		return createErrorResponse(err.Error()), err
+	}
+
+	changes, err := cb.backups.Restore(actor, id, scopes)
+
+	// scopes that didn't exist before need a sink
+	restored := make([]string, 0, len(changes))
+	for _, change := range changes {
+		restored = append(restored, change.Scope)
+		if cb.manager != nil {
+			cb.manager.AddSink(change.Scope, &sinkCallback{store: cb.backups.store})
+		}
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"backup":   id,
+			"restored": restored,
+			"error":    err,
+		}).Error("Failed to restore backup")
+		return createErrorResponse("Failed to restore backup: " + err.Error()), err
+	}
+
+	log.WithFields(log.Fields{
+		"callback": cb.name,
+		"backup":   id,
+		"restored": restored,
+		"actor":    actor,
+	}).Info("Successfully restored backup")
+
+	return createSuccessResponse(map[string]interface{}{
+		"id":     id,
+		"scopes": restored,
+		"status": "restored",
+	}), nil
+}
+
+// Execute callback function to handle `list_backups` requests.
+func (cb *listBackupsCallback) Execute(_ string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "list_backups",
+	}).Debug("Processing list_backups request")
+
+	backups, err := cb.backups.List()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"error":    err,
+		}).Error("Failed to list backups")
+		return createErrorResponse("Failed to list backups: " + err.Error()), err
+	}
+
+	return createSuccessResponse(map[string]interface{}{
+		"backups": backups,
+		"count":   len(backups),
+	}), nil
+}
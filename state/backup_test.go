@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/geoffjay/plantd/state/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupsCreateRestore(t *testing.T) {
+	store := newTestStore(t)
+	backups := NewBackups(store, t.TempDir(), 0)
+	require.NoError(t, store.Set("org.plantd.A", "foo", "a1"))
+	require.NoError(t, store.Set("org.plantd.B", "foo", "b1"))
+
+	info, err := backups.Create("user@example.com", "nightly", "before the update",
+		[]string{"org.plantd.A"})
+	require.NoError(t, err)
+	assert.Equal(t, "nightly", info.Name)
+	assert.Equal(t, "user@example.com", info.CreatedBy)
+	assert.Equal(t, []string{"org.plantd.A"}, info.Scopes)
+	assert.Equal(t, store.Revision(), info.Revision)
+	assert.Positive(t, info.Size)
+
+	require.NoError(t, store.Set("org.plantd.A", "foo", "a2"))
+	require.NoError(t, store.Set("org.plantd.A", "bar", "a2"))
+	require.NoError(t, store.Set("org.plantd.B", "foo", "b2"))
+
+	recorder := &changeRecorder{}
+	store.SetNotifier(recorder)
+	changes, err := backups.Restore("admin@example.com", info.ID, nil)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, api.StateRestoreScope, changes[0].Operation)
+	assert.Equal(t, "admin@example.com", changes[0].Actor)
+	assert.Equal(t, changes, recorder.changes)
+
+	// only the scope in the backup is put back, with its history
+	data, err := store.ListAllKeysWithValues("org.plantd.A")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": "a1"}, data)
+	value, err := store.Get("org.plantd.B", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "b2", value)
+	revisions, err := store.History("org.plantd.A", "foo")
+	require.NoError(t, err)
+	require.Len(t, revisions, 1)
+	assert.Equal(t, "a1", revisions[0].Value)
+
+	// scopes that were deleted since are created again
+	require.NoError(t, store.DeleteScope("org.plantd.A"))
+	_, err = backups.Restore("admin@example.com", info.ID, []string{"org.plantd.A"})
+	require.NoError(t, err)
+	assert.True(t, store.HasScope("org.plantd.A"))
+
+	_, err = backups.Restore("admin@example.com", info.ID, []string{"org.plantd.B"})
+	assert.Error(t, err)
+	_, err = backups.Restore("admin@example.com", "../state", nil)
+	assert.ErrorIs(t, err, ErrBackupNotFound)
+}
+
+func TestBackupsRetention(t *testing.T) {
+	store := newTestStore(t)
+	backups := NewBackups(store, t.TempDir(), 2)
+	require.NoError(t, store.Set("org.plantd.A", "foo", "bar"))
+
+	var ids []string
+	for range 3 {
+		info, err := backups.Create("", "", "", nil)
+		require.NoError(t, err)
+		ids = append(ids, info.ID)
+	}
+
+	list, err := backups.List()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, ids[2], list[0].ID)
+	assert.Equal(t, ids[1], list[1].ID)
+
+	_, err = os.Stat(backups.path(ids[0], ".db"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = backups.Create("", "", "", []string{"org.plantd.Missing"})
+	assert.Error(t, err)
+}
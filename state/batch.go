@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/geoffjay/plantd/core/service"
+	"github.com/geoffjay/plantd/state/api"
+	"github.com/geoffjay/plantd/state/auth"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrConditionFailed is returned when a key isn't what an operation expected.
+var ErrConditionFailed = errors.New("condition failed")
+
+// ErrNoRevision is returned for an operation that expects a revision of a key
+// that was set before its history was kept, the key has no revision to match.
+var ErrNoRevision = errors.New("key has no revision")
+
+// KeyOperation is a set or delete of a key. It's only made when the key is at
+// Revision and has the value Expected, for those that are set. A key that's
+// set with a TTL or a Lease expires.
+type KeyOperation struct {
+	Operation string        `json:"operation"`
+	Scope     string        `json:"scope"`
+	Key       string        `json:"key"`
+	Value     string        `json:"value,omitempty"`
+	Revision  *uint64       `json:"revision,omitempty"`
+	Expected  *string       `json:"expected,omitempty"`
+	TTL       time.Duration `json:"ttl,omitempty"`
+	Lease     uint64        `json:"lease,omitempty"`
+}
+
+// ConditionError is returned when a key isn't what an operation expected,
+// with what it is.
+type ConditionError struct {
+	Scope    string
+	Key      string
+	Revision uint64
+	Value    string
+	Exists   bool
+}
+
+func (e *ConditionError) Error() string {
+	if !e.Exists {
+		return fmt.Sprintf("%s: `%s` doesn't exist", ErrConditionFailed, e.Key)
+	}
+	return fmt.Sprintf("%s: `%s` is at revision %d", ErrConditionFailed, e.Key, e.Revision)
+}
+
+func (e *ConditionError) Unwrap() error {
+	return ErrConditionFailed
+}
+
+// CommandAuthorizer checks that the token of a request allows an operation on
+// a scope, it's satisfied by auth.AuthMiddleware.
+type CommandAuthorizer interface {
+	ValidateRequest(msgType, token, scope string) (*auth.UserContext, error)
+}
+
+type batchCallback struct {
+	name       string
+	store      *Store
+	authorizer CommandAuthorizer // nil when authentication is disabled
+}
+
+type casCallback struct {
+	name       string
+	store      *Store
+	authorizer CommandAuthorizer // nil when authentication is disabled
+}
+
+// BatchBy makes operations on behalf of an actor in a single transaction,
+// either every one of them is made or none are. Each operation sees the ones
+// before it, and the changes are returned in the same order.
+func (s *Store) BatchBy(actor string, operations []KeyOperation) ([]*api.StateChange, error) {
+	if len(operations) == 0 {
+		return nil, errors.New("batch has no operations")
+	}
+
+	changes := make([]*api.StateChange, 0, len(operations))
+	err := s.updateAll(func(tx *bolt.Tx, stamp func(*api.StateChange) error) error {
+		for i := range operations {
+			change, err := s.apply(tx, stamp, actor, &operations[i])
+			if err != nil {
+				return fmt.Errorf("operation %d on `%s`: %w", i, operations[i].Key, err)
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// CompareAndSwapBy makes an operation on behalf of an actor only when its key
+// is at the revision or has the value that it expects.
+func (s *Store) CompareAndSwapBy(actor string, operation KeyOperation) (*api.StateChange, error) {
+	if operation.Revision == nil && operation.Expected == nil {
+		return nil, errors.New("revision or expected value required to compare")
+	}
+
+	var change *api.StateChange
+	err := s.updateAll(func(tx *bolt.Tx, stamp func(*api.StateChange) error) (err error) {
+		change, err = s.apply(tx, stamp, actor, &operation)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// apply makes an operation in a write transaction when its key is what it
+// expects.
+func (s *Store) apply(
+	tx *bolt.Tx,
+	stamp func(*api.StateChange) error,
+	actor string,
+	operation *KeyOperation,
+) (*api.StateChange, error) {
+	if operation.Key == "" {
+		return nil, errors.New("key required")
+	}
+	if err := checkCondition(tx, operation); err != nil {
+		return nil, err
+	}
+
+	change := &api.StateChange{
+		Operation: operation.Operation,
+		Scope:     operation.Scope,
+		Key:       operation.Key,
+		Actor:     actor,
+	}
+	write := s.remove
+	switch operation.Operation {
+	case api.StateSet:
+		change.NewValue = operation.Value
+		write = s.put
+	case api.StateDelete:
+	default:
+		return nil, fmt.Errorf("unsupported operation %s", operation.Operation)
+	}
+
+	if err := stamp(change); err != nil {
+		return nil, err
+	}
+	if err := write(tx, change); err != nil {
+		return nil, err
+	}
+	if operation.TTL > 0 || operation.Lease != 0 {
+		return change, setExpiry(tx, actor, change.Time, operation)
+	}
+	return change, nil
+}
+
+// checkCondition makes sure a key is what an operation expects, a revision of
+// 0 is expected of a key that doesn't exist.
+func checkCondition(tx *bolt.Tx, operation *KeyOperation) error {
+	if operation.Revision == nil && operation.Expected == nil {
+		return nil
+	}
+
+	revision, value, err := keyRevision(tx, operation.Scope, operation.Key)
+	if err != nil {
+		return err
+	}
+	exists := value != nil
+	// every change has a revision after 0, only keys without history have none
+	if operation.Revision != nil && exists && revision == 0 {
+		return fmt.Errorf("%w: `%s` was set before its history was kept, expect its value instead",
+			ErrNoRevision, operation.Key)
+	}
+	matched := true
+	if expected := operation.Revision; expected != nil {
+		matched = *expected == revision
+	}
+	if expected := operation.Expected; expected != nil {
+		matched = matched && exists && *expected == string(value)
+	}
+	if matched {
+		return nil
+	}
+
+	return &ConditionError{
+		Scope:    operation.Scope,
+		Key:      operation.Key,
+		Revision: revision,
+		Value:    string(value),
+		Exists:   exists,
+	}
+}
+
+// keyRevision returns the revision a key was last changed at and its value, a
+// key that doesn't exist has no value. Keys that were set before their
+// history was kept are at revision 0.
+func keyRevision(tx *bolt.Tx, scope, key string) (uint64, []byte, error) {
+	bucket := tx.Bucket([]byte(scope))
+	if bucket == nil || scope == metaBucket {
+		return 0, nil, nil
+	}
+	value := bucket.Get([]byte(key))
+	if value == nil {
+		return 0, nil, nil
+	}
+
+	histories := scopeMeta(tx, historyBucket, scope)
+	if histories == nil {
+		return 0, value, nil
+	}
+	revisions, err := decodeHistory(histories.Get([]byte(key)))
+	if err != nil || len(revisions) == 0 {
+		return 0, value, err
+	}
+	return revisions[len(revisions)-1].Revision, value, nil
+}
+
+// parseOperation reads an operation from a request, it's a set on the scope
+// of the request unless it says otherwise.
+func parseOperation(request service.RawRequest, scope string) (KeyOperation, error) {
+	operation := KeyOperation{Operation: api.StateSet, Scope: scope}
+	if name, ok := request["operation"].(string); ok && name != "" {
+		operation.Operation = name
+	}
+	if name, ok := request["scope"].(string); ok && name != "" {
+		operation.Scope = name
+	}
+	if operation.Key, _ = request["key"].(string); operation.Key == "" {
+		return operation, errors.New("key required for every operation")
+	}
+
+	switch operation.Operation {
+	case api.StateSet:
+		value, found := requestValue(request, "value")
+		if !found {
+			return operation, fmt.Errorf("value required to set `%s`", operation.Key)
+		}
+		operation.Value = value
+		ttl, lease, err := readExpiry(request)
+		if err != nil {
+			return operation, err
+		}
+		operation.TTL, operation.Lease = ttl, lease
+	case api.StateDelete:
+	default:
+		return operation, fmt.Errorf("unsupported operation %s", operation.Operation)
+	}
+
+	if _, found := request["revision"]; found {
+		revision, err := readCount(request, "revision")
+		if err != nil {
+			return operation, err
+		}
+		operation.Revision = &revision
+	}
+	if expected, found := requestValue(request, "expected"); found {
+		operation.Expected = &expected
+	}
+
+	return operation, nil
+}
+
+// authorize checks that the token of a request allows every operation on its
+// scope, the request itself was only checked for the scope that it names.
+func authorize(authorizer CommandAuthorizer, request service.RawRequest, operations []KeyOperation) error {
+	if authorizer == nil {
+		return nil
+	}
+	token, _ := request["token"].(string)
+	checked := make(map[string]bool)
+	for _, operation := range operations {
+		if checked[operation.Operation+":"+operation.Scope] {
+			continue
+		}
+		if _, err := authorizer.ValidateRequest(operation.Operation, token, operation.Scope); err != nil {
+			return fmt.Errorf("not allowed to %s in `%s`: %w", operation.Operation, operation.Scope, err)
+		}
+		checked[operation.Operation+":"+operation.Scope] = true
+	}
+	return nil
+}
+
+// createConditionResponse creates the response for an operation on a key that
+// isn't what it expected, with what it is.
+func createConditionResponse(err *ConditionError) []byte {
+	response := Response{
+		Success: false,
+		Error:   err.Error(),
+		Data: map[string]interface{}{
+			"scope":    err.Scope,
+			"key":      err.Key,
+			"swapped":  false,
+			"exists":   err.Exists,
+			"revision": err.Revision,
+			"value":    err.Value,
+		},
+	}
+	bytes, _ := json.Marshal(response)
+	return bytes
+}
+
+// failedResponse creates the response for operations that weren't made, the
+// reply keeps why when the request itself didn't fail.
+func failedResponse(err error) ([]byte, error) {
+	var (
+		invalid   *ValidationError
+		condition *ConditionError
+	)
+	switch {
+	case errors.As(err, &invalid):
+		return createValidationResponse(invalid), nil
+	case errors.As(err, &condition):
+		return createConditionResponse(condition), nil
+	default:
+		return createErrorResponse(err.Error()), err
+	}
+}
+
+// Execute callback function to handle `state-batch` requests.
+func (cb *batchCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles `state-batch` requests made by an authenticated actor.
+func (cb *batchCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "state-batch",
+	}).Debug("Processing state-batch request")
+
+	var request service.RawRequest
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		return createErrorResponse("Invalid request format: " + err.Error()), err
+	}
+	scope, ok := request["service"].(string)
+	if !ok || scope == "" {
+		err := errors.New("service parameter missing")
+		return createErrorResponse("Service scope required for state-batch request"), err
+	}
+
+	items, _ := request["operations"].([]interface{})
+	operations := make([]KeyOperation, 0, len(items))
+	for _, item := range items {
+		fields, _ := item.(map[string]interface{})
+		operation, err := parseOperation(service.RawRequest(fields), scope)
+		if err != nil {
+			return createErrorResponse("Invalid state-batch request: " + err.Error()), err
+		}
+		operations = append(operations, operation)
+	}
+	if err := authorize(cb.authorizer, request, operations); err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"error":    err,
+		}).Warn("Rejected batch with operations that aren't allowed")
+		return createErrorResponse(err.Error()), err
+	}
+
+	changes, err := cb.store.BatchBy(actor, operations)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback":   cb.name,
+			"scope":      scope,
+			"operations": len(operations),
+			"error":      err,
+		}).Warn("Failed to apply batch")
+		return failedResponse(err)
+	}
+
+	log.WithFields(log.Fields{
+		"callback":   cb.name,
+		"scope":      scope,
+		"operations": len(changes),
+		"revision":   changes[len(changes)-1].Revision,
+	}).Info("Successfully applied batch")
+
+	return createSuccessResponse(map[string]interface{}{
+		"count":    len(changes),
+		"revision": changes[len(changes)-1].Revision,
+		"changes":  changes,
+	}), nil
+}
+
+// Execute callback function to handle `state-cas` requests.
+func (cb *casCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles `state-cas` requests made by an authenticated actor.
+func (cb *casCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "state-cas",
+	}).Debug("Processing state-cas request")
+
+	request, scope, _, err := parseKeyRequest(msgBody, "state-cas")
+	if err != nil {
+		return createErrorResponse(err.Error()), err
+	}
+	// the key is always in the scope of the request
+	delete(request, "scope")
+	operation, err := parseOperation(request, scope)
+	if err != nil {
+		return createErrorResponse("Invalid state-cas request: " + err.Error()), err
+	}
+	if err = authorize(cb.authorizer, request, []KeyOperation{operation}); err != nil {
+		return createErrorResponse(err.Error()), err
+	}
+
+	change, err := cb.store.CompareAndSwapBy(actor, operation)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"key":      operation.Key,
+			"error":    err,
+		}).Warn("Failed to compare and swap key")
+		return failedResponse(err)
+	}
+
+	log.WithFields(log.Fields{
+		"callback": cb.name,
+		"scope":    scope,
+		"key":      operation.Key,
+		"revision": change.Revision,
+	}).Info("Successfully swapped key")
+
+	return createSuccessResponse(map[string]interface{}{
+		"scope":    scope,
+		"key":      operation.Key,
+		"swapped":  true,
+		"revision": change.Revision,
+	}), nil
+}
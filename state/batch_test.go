@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/geoffjay/plantd/state/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStore_BatchBy(t *testing.T) {
+	store := newTestStore(t)
+	require.NoError(t, store.Set("org.plantd.A", "foo", "a1"))
+	recorder := &changeRecorder{}
+	store.SetNotifier(recorder)
+	revision := store.Revision()
+
+	changes, err := store.BatchBy("user@example.com", []KeyOperation{
+		{Operation: api.StateSet, Scope: "org.plantd.A", Key: "bar", Value: "a2"},
+		{Operation: api.StateDelete, Scope: "org.plantd.A", Key: "foo"},
+		{Operation: api.StateSet, Scope: "org.plantd.B", Key: "foo", Value: "b1"},
+	})
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+	for i, change := range changes {
+		assert.Equal(t, revision+uint64(i)+1, change.Revision)
+		assert.Equal(t, "user@example.com", change.Actor)
+	}
+	assert.Equal(t, "a1", changes[1].OldValue)
+	assert.Equal(t, changes, recorder.changes)
+
+	data, err := store.ListAllKeysWithValues("org.plantd.A")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"bar": "a2"}, data)
+	value, err := store.Get("org.plantd.B", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "b1", value)
+
+	// nothing is made when any operation fails
+	recorder.changes = nil
+	_, err = store.BatchBy("", []KeyOperation{
+		{Operation: api.StateSet, Scope: "org.plantd.A", Key: "bar", Value: "a3"},
+		{Operation: api.StateSet, Scope: metaBucket, Key: "foo", Value: "derp"},
+	})
+	assert.ErrorIs(t, err, ErrReservedScope)
+	_, err = store.BatchBy("", []KeyOperation{
+		{Operation: api.StateSet, Scope: "org.plantd.A", Key: "bar", Value: "a3"},
+		{Operation: api.StateSet, Scope: "org.plantd.B", Key: "foo", Value: "b2", Expected: ptr("b0")},
+	})
+	assert.ErrorIs(t, err, ErrConditionFailed)
+	_, err = store.BatchBy("", []KeyOperation{
+		{Operation: api.StateCreateScope, Scope: "org.plantd.C", Key: "foo"},
+	})
+	assert.Error(t, err)
+	_, err = store.BatchBy("", nil)
+	assert.Error(t, err)
+
+	value, err = store.Get("org.plantd.A", "bar")
+	require.NoError(t, err)
+	assert.Equal(t, "a2", value)
+	assert.Equal(t, revision+3, store.Revision())
+	assert.Empty(t, recorder.changes)
+}
+
+func TestStore_CompareAndSwapBy(t *testing.T) {
+	store := newTestStore(t)
+	require.NoError(t, store.Set("org.plantd.A", "foo", "a1"))
+	revisions, err := store.History("org.plantd.A", "foo")
+	require.NoError(t, err)
+	current := revisions[0].Revision
+
+	_, err = store.CompareAndSwapBy("", KeyOperation{
+		Operation: api.StateSet, Scope: "org.plantd.A", Key: "foo", Value: "a2",
+	})
+	assert.Error(t, err)
+
+	// a stale revision or value is what's there now
+	_, err = store.CompareAndSwapBy("", KeyOperation{
+		Operation: api.StateSet, Scope: "org.plantd.A", Key: "foo", Value: "a2",
+		Revision: ptr(current - 1),
+	})
+	var failed *ConditionError
+	require.True(t, errors.As(err, &failed))
+	assert.Equal(t, current, failed.Revision)
+	assert.Equal(t, "a1", failed.Value)
+	_, err = store.CompareAndSwapBy("", KeyOperation{
+		Operation: api.StateSet, Scope: "org.plantd.A", Key: "foo", Value: "a2",
+		Revision: ptr(current), Expected: ptr("a0"),
+	})
+	assert.ErrorIs(t, err, ErrConditionFailed)
+
+	change, err := store.CompareAndSwapBy("user@example.com", KeyOperation{
+		Operation: api.StateSet, Scope: "org.plantd.A", Key: "foo", Value: "a2",
+		Revision: ptr(current), Expected: ptr("a1"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, store.Revision(), change.Revision)
+
+	// revision 0 is a key that doesn't exist
+	_, err = store.CompareAndSwapBy("", KeyOperation{
+		Operation: api.StateSet, Scope: "org.plantd.A", Key: "foo", Value: "a3", Revision: ptr(uint64(0)),
+	})
+	assert.ErrorIs(t, err, ErrConditionFailed)
+	_, err = store.CompareAndSwapBy("", KeyOperation{
+		Operation: api.StateSet, Scope: "org.plantd.A", Key: "lock", Value: "me", Revision: ptr(uint64(0)),
+	})
+	require.NoError(t, err)
+
+	_, err = store.CompareAndSwapBy("", KeyOperation{
+		Operation: api.StateDelete, Scope: "org.plantd.A", Key: "foo", Expected: ptr("a2"),
+	})
+	require.NoError(t, err)
+	keys, err := store.ListAllKeys("org.plantd.A")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lock"}, keys)
+
+	// a key set before history was kept has no revision, only its value
+	require.NoError(t, store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("org.plantd.A")).Put([]byte("old"), []byte("a0"))
+	}))
+	for _, expected := range []uint64{0, current} {
+		_, err = store.CompareAndSwapBy("", KeyOperation{
+			Operation: api.StateSet, Scope: "org.plantd.A", Key: "old", Value: "a1", Revision: ptr(expected),
+		})
+		assert.ErrorIs(t, err, ErrNoRevision)
+	}
+	_, err = store.CompareAndSwapBy("", KeyOperation{
+		Operation: api.StateSet, Scope: "org.plantd.A", Key: "old", Value: "a1", Expected: ptr("a0"),
+	})
+	require.NoError(t, err)
+}
+
+func TestBatchCallback(t *testing.T) {
+	store := newTestStore(t)
+	require.NoError(t, store.Set("org.plantd.A", "foo", "a1"))
+	callback := &batchCallback{name: "state-batch", store: store}
+
+	response, err := callback.Execute(`{"service": "org.plantd.A", "operations": [
+		{"key": "setpoint", "value": 21.5},
+		{"operation": "delete", "key": "foo"},
+		{"scope": "org.plantd.B", "key": "mode", "value": "auto"}
+	]}`)
+	require.NoError(t, err)
+	var result Response
+	require.NoError(t, json.Unmarshal(response, &result))
+	assert.True(t, result.Success)
+
+	value, err := store.Get("org.plantd.A", "setpoint")
+	require.NoError(t, err)
+	assert.Equal(t, "21.5", value)
+
+	// a failed condition is a response with what the key is
+	response, err = (&casCallback{name: "state-cas", store: store}).Execute(
+		`{"service": "org.plantd.A", "key": "setpoint", "value": 22, "expected": 20}`)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(response, &result))
+	assert.False(t, result.Success)
+	assert.Equal(t, "21.5", result.Data.(map[string]interface{})["value"])
+
+	_, err = callback.Execute(`{"service": "org.plantd.A", "operations": [{"operation": "get", "key": "foo"}]}`)
+	assert.Error(t, err)
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
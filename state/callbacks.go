@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/geoffjay/plantd/core/bus"
 	"github.com/geoffjay/plantd/core/service"
 
 	log "github.com/sirupsen/logrus"
@@ -70,8 +71,13 @@ type sinkCallback struct {
 }
 
 type healthCallback struct {
-	name  string
-	store *Store
+	name    string
+	store   *Store
+	manager *Manager
+}
+
+type checkReadCallback struct {
+	name string
 }
 
 type listScopesCallback struct {
@@ -86,6 +92,11 @@ type listKeysCallback struct {
 
 // Execute callback function to handle `create-scope` requests.
 func (cb *createScopeCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles `create-scope` requests made by an authenticated actor.
+func (cb *createScopeCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
 	var (
 		scope   string
 		found   bool
@@ -130,7 +141,7 @@ func (cb *createScopeCallback) Execute(msgBody string) ([]byte, error) {
 		return createErrorResponse(fmt.Sprintf("Scope '%s' already exists", scope)), nil
 	}
 
-	err := cb.store.CreateScope(scope)
+	_, err := cb.store.CreateScopeBy(actor, scope)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"callback": cb.name,
@@ -156,6 +167,11 @@ func (cb *createScopeCallback) Execute(msgBody string) ([]byte, error) {
 
 // Execute callback function to handle `delete-scope` requests.
 func (cb *deleteScopeCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles `delete-scope` requests made by an authenticated actor.
+func (cb *deleteScopeCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
 	var (
 		scope   string
 		found   bool
@@ -191,7 +207,7 @@ func (cb *deleteScopeCallback) Execute(msgBody string) ([]byte, error) {
 		return createErrorResponse(fmt.Sprintf("Scope '%s' does not exist", scope)), nil
 	}
 
-	err := cb.store.DeleteScope(scope)
+	_, err := cb.store.DeleteScopeBy(actor, scope)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"callback": cb.name,
@@ -217,6 +233,11 @@ func (cb *deleteScopeCallback) Execute(msgBody string) ([]byte, error) {
 
 // Execute callback function to handle `delete` requests.
 func (cb *deleteCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles `delete` requests made by an authenticated actor.
+func (cb *deleteCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
 	var (
 		scope   string
 		key     string
@@ -262,7 +283,7 @@ func (cb *deleteCallback) Execute(msgBody string) ([]byte, error) {
 		return createErrorResponse("Key cannot be empty"), errors.New("empty key")
 	}
 
-	err := cb.store.Delete(scope, key)
+	_, err := cb.store.DeleteBy(actor, scope, key)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"callback": cb.name,
@@ -359,6 +380,11 @@ func (cb *getCallback) Execute(msgBody string) ([]byte, error) {
 
 // Execute callback function to handle `set` requests.
 func (cb *setCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles `set` requests made by an authenticated actor.
+func (cb *setCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
 	var (
 		scope   string
 		key     string
@@ -414,9 +440,23 @@ func (cb *setCallback) Execute(msgBody string) ([]byte, error) {
 	if key == "" {
 		return createErrorResponse("Key cannot be empty"), errors.New("empty key")
 	}
-
-	err := cb.store.Set(scope, key, value)
+	ttl, lease, err := readExpiry(request)
 	if err != nil {
+		return createErrorResponse("Invalid set request: " + err.Error()), err
+	}
+
+	_, err = cb.store.SetExpiringBy(actor, scope, key, value, ttl, lease)
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"key":      key,
+			"errors":   len(invalid.Errors),
+		}).Warn("Rejected value that doesn't match its schema")
+		// the reply has to keep the errors, so the request didn't fail
+		return createValidationResponse(invalid), nil
+	} else if err != nil {
 		log.WithFields(log.Fields{
 			"callback": cb.name,
 			"scope":    scope,
@@ -441,15 +481,36 @@ func (cb *setCallback) Execute(msgBody string) ([]byte, error) {
 	}), nil
 }
 
-// Handle callback handles subscriber events on the state bus.
-func (cb *sinkCallback) Handle(data []byte) error {
+// Handle callback handles subscriber events on the state bus, the data of a
+// scope isn't kept so it's only logged. Commands are received on their own
+// topic by a commandCallback.
+func (cb *sinkCallback) Handle(message *bus.Message) error {
 	log.WithFields(log.Fields{
-		"data_length":  len(data),
-		"data_preview": string(data)[:min(len(data), 100)], // First 100 chars
+		"topic":       message.Topic,
+		"data_length": len(message.Body),
 	}).Debug("Data received on state bus")
 	return nil
 }
 
+// Execute callback function to handle `state-check-read` requests. The token
+// is checked for read access to the scope of the request, or to every scope
+// without one, by the authentication that wraps the callback, so a request
+// that gets here is allowed.
+func (cb *checkReadCallback) Execute(msgBody string) ([]byte, error) {
+	var request service.RawRequest
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		return createErrorResponse("Invalid request format: " + err.Error()), err
+	}
+	scope, _ := request["service"].(string)
+
+	log.WithFields(log.Fields{
+		"callback": cb.name,
+		"scope":    scope,
+	}).Debug("Allowed to read state")
+
+	return createSuccessResponse(map[string]interface{}{"service": scope}), nil
+}
+
 // Execute callback function to handle `health` requests.
 func (cb *healthCallback) Execute(msgBody string) ([]byte, error) {
 	var request service.RawRequest
@@ -476,6 +537,9 @@ func (cb *healthCallback) Execute(msgBody string) ([]byte, error) {
 		"service":         "org.plantd.State",
 		"store_available": cb.store != nil,
 	}
+	if cb.manager != nil {
+		healthData["sinks"] = cb.manager.SinkStatus()
+	}
 
 	if scope != "" {
 		healthData["scope"] = scope
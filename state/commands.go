@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geoffjay/plantd/core/bus"
+	"github.com/geoffjay/plantd/core/curve"
+	"github.com/geoffjay/plantd/state/api"
+	"github.com/geoffjay/plantd/state/auth"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errInvalidReplyTopic is returned for commands with a reply topic that the
+// state service doesn't publish on.
+var errInvalidReplyTopic = fmt.Errorf("reply topic must start with %s", api.StateReplyTopic)
+
+// commandWindow is how far the time of a command can be from the time that
+// it's received, it bounds how long a command has to be remembered to reject
+// it when it's sent again.
+const commandWindow = 30 * time.Second
+
+// CommandVerifier checks the signature of a command received on the state bus
+// and returns the actor that it was signed by.
+type CommandVerifier interface {
+	Verify(command *api.StateCommand) (string, error)
+}
+
+// UserAuthorizer checks that a user is allowed an operation on a scope, it's
+// satisfied by auth.AuthMiddleware.
+type UserAuthorizer interface {
+	ValidateUser(msgType string, userCtx *auth.UserContext, scope string) error
+}
+
+// ResultPublisher publishes the results of the commands received on the state
+// bus.
+type ResultPublisher interface {
+	Reply(topic string, result *api.StateCommandResult)
+}
+
+// commandHandler applies the commands received on the state bus to the store.
+type commandHandler struct {
+	store     *Store
+	verifier  CommandVerifier // nil when authentication is disabled
+	publisher ResultPublisher
+}
+
+func newCommandHandler(store *Store, verifier CommandVerifier, publisher ResultPublisher) *commandHandler {
+	return &commandHandler{
+		store:     store,
+		verifier:  verifier,
+		publisher: publisher,
+	}
+}
+
+// commandCallback applies the commands of every scope that it receives from
+// the state bus.
+type commandCallback struct {
+	commands *commandHandler
+}
+
+// commandVerifier checks commands against the users of the keys that signed
+// them, with the same permissions as their requests. The signatures of the
+// commands in the window are remembered so that a command that was observed
+// on the bus can't be sent again.
+type commandVerifier struct {
+	keys       *curve.Config
+	authorizer UserAuthorizer
+	users      map[string]*auth.UserContext
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newCommandVerifier(keys *curve.Config, authorizer UserAuthorizer, users map[string]*auth.UserContext) *commandVerifier {
+	return &commandVerifier{
+		keys:       keys,
+		authorizer: authorizer,
+		users:      users,
+		seen:       make(map[string]time.Time),
+	}
+}
+
+// commandUsers resolves the keys that can sign commands to the users that they
+// act as, keys with roles that don't exist are left out.
+func commandUsers(middleware *auth.AuthMiddleware, keys []commandKey) map[string]*auth.UserContext {
+	users := make(map[string]*auth.UserContext)
+	for _, key := range keys {
+		user, err := middleware.KeyUser(key.User, key.Roles, key.Permissions)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"key":   key.Key,
+				"user":  key.User,
+				"error": err,
+			}).Warn("Failed to resolve the user of a command key")
+			continue
+		}
+		users[key.Key] = user
+	}
+	return users
+}
+
+// Verify checks that a command was signed recently by a key whose user is
+// allowed the operation on the scope, and that it hasn't been received before.
+func (v *commandVerifier) Verify(command *api.StateCommand) (string, error) {
+	user, ok := v.users[command.PublicKey]
+	if !ok {
+		return "", errors.New("command is not signed by an allowed key")
+	}
+
+	data, err := command.SigningData()
+	if err != nil {
+		return "", err
+	}
+	if !v.keys.Verify(command.PublicKey, data, command.Signature) {
+		return "", errors.New("invalid command signature")
+	}
+
+	now := time.Now()
+	if command.Time.Before(now.Add(-commandWindow)) || command.Time.After(now.Add(commandWindow)) {
+		return "", errors.New("command time is outside of the accepted window")
+	}
+
+	// the same permissions as the requests of the operation
+	if err = v.authorizer.ValidateUser(command.Operation, user, command.Scope); err != nil {
+		return "", err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for signature, expires := range v.seen {
+		if expires.Before(now) {
+			delete(v.seen, signature)
+		}
+	}
+	if _, ok := v.seen[command.Signature]; ok {
+		return "", errors.New("command was already received")
+	}
+	v.seen[command.Signature] = command.Time.Add(commandWindow)
+
+	return user.UserEmail, nil
+}
+
+// Handle callback handles the commands received on the state bus, every
+// command is applied or answered with an error.
+func (cb *commandCallback) Handle(message *bus.Message) error {
+	var command api.StateCommand
+	if err := json.Unmarshal(message.Body, &command); err != nil || command.Operation == "" {
+		log.WithFields(log.Fields{
+			"topic":       message.Topic,
+			"data_length": len(message.Body),
+		}).Debug("ignoring invalid state command")
+		return nil
+	}
+
+	// the scope in the topic is the one the sender meant
+	if message.Topic != command.Topic() {
+		log.WithFields(log.Fields{
+			"topic": message.Topic,
+			"scope": command.Scope,
+		}).Debug("ignoring state command on the topic of another scope")
+		return nil
+	}
+
+	cb.commands.Apply(&command)
+	return nil
+}
+
+// Apply checks and applies a command, the result is published on its reply
+// topic and returned.
+func (h *commandHandler) Apply(command *api.StateCommand) *api.StateCommandResult {
+	result := &api.StateCommandResult{
+		ID:        command.ID,
+		Scope:     command.Scope,
+		Operation: command.Operation,
+		Key:       command.Key,
+	}
+
+	err := h.apply(command, result)
+	topic := command.ReplyTopic()
+	if err != nil {
+		result.Error = err.Error()
+		if errors.Is(err, errInvalidReplyTopic) {
+			topic = api.StateReplyTopicFor(command.Scope)
+		}
+		log.WithFields(log.Fields{
+			"id":        command.ID,
+			"scope":     command.Scope,
+			"operation": command.Operation,
+			"key":       command.Key,
+			"error":     err,
+		}).Warn("Failed to apply state command")
+	} else {
+		result.Success = true
+		log.WithFields(log.Fields{
+			"id":        command.ID,
+			"scope":     command.Scope,
+			"operation": command.Operation,
+			"key":       command.Key,
+			"actor":     result.Actor,
+			"revision":  result.Revision,
+		}).Info("Applied state command")
+	}
+
+	if h.publisher != nil {
+		h.publisher.Reply(topic, result)
+	}
+	return result
+}
+
+func (h *commandHandler) apply(command *api.StateCommand, result *api.StateCommandResult) error {
+	// replies elsewhere could be taken for commands
+	if command.ReplyTo != "" && !strings.HasPrefix(command.ReplyTo, api.StateReplyTopic+".") {
+		return errInvalidReplyTopic
+	}
+	if command.Operation != api.StateSet && command.Operation != api.StateDelete {
+		return fmt.Errorf("unsupported state command operation %s", command.Operation)
+	}
+	if command.Key == "" {
+		return errors.New("key required for state command")
+	}
+
+	if h.verifier != nil {
+		actor, err := h.verifier.Verify(command)
+		if err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+		result.Actor = actor
+	}
+
+	// commands don't create scopes like sets do
+	if !h.store.HasScope(command.Scope) {
+		return fmt.Errorf("scope %s doesn't exist", command.Scope)
+	}
+
+	var (
+		change *api.StateChange
+		err    error
+	)
+	if command.Operation == api.StateSet {
+		change, err = h.store.SetBy(result.Actor, command.Scope, command.Key, command.Value)
+	} else {
+		change, err = h.store.DeleteBy(result.Actor, command.Scope, command.Key)
+	}
+	if err != nil {
+		return err
+	}
+
+	result.Revision = change.Revision
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/geoffjay/plantd/core/bus"
+	"github.com/geoffjay/plantd/core/curve"
+	"github.com/geoffjay/plantd/state/api"
+	"github.com/geoffjay/plantd/state/auth"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type resultRecorder struct {
+	topics  []string
+	results []*api.StateCommandResult
+}
+
+func (r *resultRecorder) Reply(topic string, result *api.StateCommandResult) {
+	r.topics = append(r.topics, topic)
+	r.results = append(r.results, result)
+}
+
+// commandKeys are the keys of the senders in the command tests.
+type commandKeys struct {
+	writer   *curve.Config // can set in any scope
+	admin    *curve.Config // can set and delete in any scope
+	other    *curve.Config // can only set in org.plantd.Other
+	stranger *curve.Config // isn't allowed
+}
+
+func newKeys(t *testing.T, server string) *curve.Config {
+	public, secret, err := curve.GenerateKeys()
+	require.NoError(t, err)
+	return &curve.Config{PublicKey: public, SecretKey: secret, ServerKey: server}
+}
+
+func newCommandTest(t *testing.T) (*Store, *resultRecorder, *commandCallback, *commandKeys) {
+	store := newTestStore(t, "org.plantd.Test")
+
+	service := newKeys(t, "")
+	keys := &commandKeys{
+		writer:   newKeys(t, service.PublicKey),
+		admin:    newKeys(t, service.PublicKey),
+		other:    newKeys(t, service.PublicKey),
+		stranger: newKeys(t, service.PublicKey),
+	}
+	middleware := auth.NewAuthMiddleware(&auth.Config{})
+	users := commandUsers(middleware, []commandKey{
+		{Key: keys.writer.PublicKey, User: "writer@example.com", Permissions: []string{auth.StateDataWrite}},
+		{Key: keys.admin.PublicKey, User: "admin@example.com", Roles: []string{"state-admin"}},
+		{Key: keys.other.PublicKey, User: "other@example.com", Permissions: []string{"state:scope:org.plantd.Other:write"}},
+		// a role that doesn't exist leaves the key out
+		{Key: keys.stranger.PublicKey, User: "stranger@example.com", Roles: []string{"derp"}},
+	})
+	require.Len(t, users, 3)
+	verifier := newCommandVerifier(service, middleware, users)
+
+	recorder := &resultRecorder{}
+	callback := &commandCallback{
+		commands: newCommandHandler(store, verifier, recorder),
+	}
+	return store, recorder, callback, keys
+}
+
+func signedCommand(t *testing.T, keys *curve.Config, command *api.StateCommand) *api.StateCommand {
+	require.NoError(t, command.Sign(keys))
+	return command
+}
+
+func commandMessage(t *testing.T, topic string, command *api.StateCommand) *bus.Message {
+	body, err := json.Marshal(command)
+	require.NoError(t, err)
+	return bus.NewMessage(topic, body)
+}
+
+func TestCommandCallbackApply(t *testing.T) {
+	store, recorder, callback, keys := newCommandTest(t)
+
+	command := signedCommand(t, keys.writer, &api.StateCommand{
+		ID:        "1",
+		Scope:     "org.plantd.Test",
+		Operation: api.StateSet,
+		Key:       "foo",
+		Value:     "bar",
+	})
+	require.NoError(t, callback.Handle(commandMessage(t, command.Topic(), command)))
+
+	value, err := store.Get("org.plantd.Test", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", value)
+
+	require.Len(t, recorder.results, 1)
+	assert.Equal(t, api.StateReplyTopicFor("org.plantd.Test"), recorder.topics[0])
+	result := recorder.results[0]
+	assert.True(t, result.Success)
+	assert.Equal(t, "1", result.ID)
+	assert.Equal(t, "writer@example.com", result.Actor)
+	assert.Equal(t, store.Revision(), result.Revision)
+
+	// the same command can't be sent again
+	require.NoError(t, callback.Handle(commandMessage(t, command.Topic(), command)))
+	require.Len(t, recorder.results, 2)
+	assert.False(t, recorder.results[1].Success)
+}
+
+func TestCommandCallbackReject(t *testing.T) {
+	store, recorder, callback, keys := newCommandTest(t)
+	require.NoError(t, store.Set("org.plantd.Test", "foo", "bar"))
+
+	newCommand := func(operation, key, value string) *api.StateCommand {
+		return &api.StateCommand{
+			Scope:     "org.plantd.Test",
+			Operation: operation,
+			Key:       key,
+			Value:     value,
+			ReplyTo:   api.StateReplyTopic + ".device",
+		}
+	}
+	tampered := signedCommand(t, keys.writer, newCommand(api.StateSet, "foo", "baz"))
+	tampered.Value = "derp"
+	old := newCommand(api.StateSet, "foo", "baz")
+	old.Time = time.Now().Add(-time.Minute)
+
+	for _, command := range []*api.StateCommand{
+		newCommand(api.StateSet, "foo", "baz"),
+		signedCommand(t, keys.stranger, newCommand(api.StateSet, "foo", "baz")),
+		// only allowed to change another scope
+		signedCommand(t, keys.other, newCommand(api.StateSet, "foo", "baz")),
+		// only allowed to set
+		signedCommand(t, keys.writer, newCommand(api.StateDelete, "foo", "")),
+		tampered,
+		signedCommand(t, keys.writer, old),
+		signedCommand(t, keys.writer, newCommand(api.StateCreateScope, "foo", "")),
+		signedCommand(t, keys.writer, newCommand(api.StateSet, "", "baz")),
+	} {
+		require.NoError(t, callback.Handle(commandMessage(t, command.Topic(), command)))
+	}
+
+	value, err := store.Get("org.plantd.Test", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", value)
+
+	require.Len(t, recorder.results, 8)
+	for i, result := range recorder.results {
+		assert.False(t, result.Success)
+		assert.NotEmpty(t, result.Error)
+		assert.Equal(t, api.StateReplyTopic+".device", recorder.topics[i])
+	}
+
+	// a reply topic the service doesn't own gets the default one
+	command := newCommand(api.StateSet, "foo", "baz")
+	command.ReplyTo = "org.plantd.Test"
+	signedCommand(t, keys.writer, command)
+	require.NoError(t, callback.Handle(commandMessage(t, command.Topic(), command)))
+	require.Len(t, recorder.results, 9)
+	assert.False(t, recorder.results[8].Success)
+	assert.Equal(t, api.StateReplyTopicFor("org.plantd.Test"), recorder.topics[8])
+}
+
+func TestCommandCallbackIgnore(t *testing.T) {
+	_, recorder, callback, keys := newCommandTest(t)
+
+	command := signedCommand(t, keys.writer, &api.StateCommand{
+		Scope: "org.plantd.Test", Operation: api.StateSet, Key: "foo",
+	})
+
+	for _, message := range []*bus.Message{
+		bus.NewMessage(api.StateCommandTopicFor("org.plantd.Test"), []byte("derp")),
+		bus.NewMessage(api.StateCommandTopicFor("org.plantd.Test"), []byte(`{"key": "foo", "value": "bar"}`)),
+		// a command sent on the topic of another scope
+		commandMessage(t, api.StateCommandTopicFor("org.plantd.Test.Other"), command),
+		// commands are only taken from the command topic
+		commandMessage(t, "org.plantd.Test", command),
+		commandMessage(t, api.StateReplyTopicFor("org.plantd.Test"), command),
+	} {
+		require.NoError(t, callback.Handle(message))
+	}
+
+	assert.Empty(t, recorder.results)
+}
+
+func TestCommandCallbackScopes(t *testing.T) {
+	store, recorder, callback, keys := newCommandTest(t)
+	require.NoError(t, store.Set("org.plantd.Test", "foo", "bar"))
+	// sets create the scopes that don't exist
+	require.NoError(t, store.Set("org.plantd.Other", "foo", "bar"))
+
+	for _, command := range []*api.StateCommand{
+		signedCommand(t, keys.admin, &api.StateCommand{
+			Scope: "org.plantd.Test", Operation: api.StateDelete, Key: "foo",
+		}),
+		signedCommand(t, keys.other, &api.StateCommand{
+			Scope: "org.plantd.Other", Operation: api.StateSet, Key: "foo", Value: "baz",
+		}),
+		signedCommand(t, keys.admin, &api.StateCommand{
+			Scope: "org.plantd.Missing", Operation: api.StateSet, Key: "foo", Value: "baz",
+		}),
+	} {
+		require.NoError(t, callback.Handle(commandMessage(t, command.Topic(), command)))
+	}
+
+	require.Len(t, recorder.results, 3)
+	assert.True(t, recorder.results[0].Success)
+	assert.Equal(t, "admin@example.com", recorder.results[0].Actor)
+	assert.True(t, recorder.results[1].Success)
+	assert.Equal(t, "other@example.com", recorder.results[1].Actor)
+
+	value, err := store.Get("org.plantd.Test", "foo")
+	require.NoError(t, err)
+	assert.Empty(t, value)
+	value, err = store.Get("org.plantd.Other", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "baz", value)
+
+	// commands don't create scopes
+	assert.False(t, recorder.results[2].Success)
+	assert.Contains(t, recorder.results[2].Error, "doesn't exist")
+	assert.Equal(t, api.StateReplyTopicFor("org.plantd.Missing"), recorder.topics[2])
+	assert.False(t, store.HasScope("org.plantd.Missing"))
+}
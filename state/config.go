@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	cfg "github.com/geoffjay/plantd/core/config"
+	"github.com/geoffjay/plantd/core/curve"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -13,23 +14,46 @@ type databaseConfig struct {
 	URI     string `mapstructure:"uri"`
 }
 
+type backupConfig struct {
+	Path      string `mapstructure:"path"`
+	Retention int    `mapstructure:"retention"`
+}
+
 type identityConfig struct {
 	Endpoint string `mapstructure:"endpoint"`
 	Timeout  string `mapstructure:"timeout"`
 	Retries  int    `mapstructure:"retries"`
 }
 
+// commandKey is a CURVE public key that's allowed to sign the commands
+// sent on the state bus. The key acts as the user, with the permissions of
+// its roles and the ones listed, and its commands are checked like that
+// user's requests.
+type commandKey struct {
+	Key         string   `mapstructure:"key"`
+	User        string   `mapstructure:"user"`
+	Roles       []string `mapstructure:"roles"`
+	Permissions []string `mapstructure:"permissions"`
+}
+
 // Config represents the configuration for the state service.
 type Config struct {
 	cfg.Config
 
-	Env            string            `mapstructure:"env"`
-	BrokerEndpoint string            `mapstructure:"broker-endpoint"`
-	StateEndpoint  string            `mapstructure:"state-endpoint"`
-	Database       databaseConfig    `mapstructure:"database"`
-	Identity       identityConfig    `mapstructure:"identity"`
-	Log            cfg.LogConfig     `mapstructure:"log"`
-	Service        cfg.ServiceConfig `mapstructure:"service"`
+	Env             string            `mapstructure:"env"`
+	BrokerEndpoint  string            `mapstructure:"broker-endpoint"`
+	StateEndpoint   string            `mapstructure:"state-endpoint"`
+	PublishEndpoint string            `mapstructure:"publish-endpoint"`
+	Workers         int               `mapstructure:"workers"`
+	History         int               `mapstructure:"history"`
+	SweepInterval   string            `mapstructure:"sweep-interval"`
+	Database        databaseConfig    `mapstructure:"database"`
+	Backup          backupConfig      `mapstructure:"backup"`
+	Identity        identityConfig    `mapstructure:"identity"`
+	Curve           curve.Config      `mapstructure:"curve"`
+	CommandKeys     []commandKey      `mapstructure:"command-keys"`
+	Log             cfg.LogConfig     `mapstructure:"log"`
+	Service         cfg.ServiceConfig `mapstructure:"service"`
 }
 
 var lock = &sync.Mutex{}
@@ -39,8 +63,14 @@ var defaults = map[string]interface{}{
 	"env":               "development",
 	"broker-endpoint":   "tcp://localhost:9797",
 	"state-endpoint":    ">tcp://localhost:11001",
+	"publish-endpoint":  ">tcp://localhost:11000",
+	"workers":           4,
+	"history":           DefaultKeyHistory,
+	"sweep-interval":    DefaultSweepInterval.String(),
 	"database.adapter":  "bbolt",
 	"database.uri":      "plantd-state.db",
+	"backup.path":       "plantd-state-backups",
+	"backup.retention":  DefaultBackupRetention,
 	"identity.endpoint": "tcp://127.0.0.1:9797",
 	"identity.timeout":  "30s",
 	"identity.retries":  3,
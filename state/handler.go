@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -16,6 +17,12 @@ type HandlerCallback interface {
 	Execute(msgBody string) ([]byte, error)
 }
 
+// StreamCallback is implemented by callbacks that send partial replies ahead of
+// the final one, `send` is nil when the reply can't be streamed.
+type StreamCallback interface {
+	ExecuteStream(ctx context.Context, msgBody string, send func([]byte) error) ([]byte, error)
+}
+
 // NewHandler creates an instance of a callback.
 func NewHandler() *Handler {
 	return &Handler{
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/geoffjay/plantd/core/service"
+	"github.com/geoffjay/plantd/state/api"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultKeyHistory is how many revisions of each key are kept when the
+// config doesn't say.
+const DefaultKeyHistory = 10
+
+// historyBucket is the bucket in the meta bucket with a bucket of key
+// histories for every scope.
+const historyBucket = "history"
+
+// ErrKeyNotFound is returned when a key doesn't exist, or didn't at the
+// revision that was asked for.
+var ErrKeyNotFound = errors.New("key doesn't exist")
+
+// KeyRevision is a value that a key had, and when and by whom it was set.
+type KeyRevision struct {
+	Revision uint64    `json:"revision"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor,omitempty"`
+	Value    string    `json:"value"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+type historyCallback struct {
+	name  string
+	store *Store
+}
+
+type getRevisionCallback struct {
+	name  string
+	store *Store
+}
+
+// record adds a change of a key to its history, the oldest revisions are
+// dropped once there are more than the limit.
+func (s *Store) record(tx *bolt.Tx, change *api.StateChange) error {
+	bucket, err := createScopeMeta(tx, historyBucket, change.Scope)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := decodeHistory(bucket.Get([]byte(change.Key)))
+	if err != nil {
+		return err
+	}
+	revisions = append(revisions, KeyRevision{
+		Revision: change.Revision,
+		Time:     change.Time,
+		Actor:    change.Actor,
+		Value:    change.NewValue,
+		Deleted:  change.Operation == api.StateDelete,
+	})
+	if len(revisions) > s.history {
+		revisions = revisions[len(revisions)-s.history:]
+	}
+
+	data, err := json.Marshal(revisions)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(change.Key), data)
+}
+
+func decodeHistory(data []byte) (revisions []KeyRevision, err error) {
+	if data == nil {
+		return nil, nil
+	}
+	if err = json.Unmarshal(data, &revisions); err != nil {
+		return nil, fmt.Errorf("invalid key history: %w", err)
+	}
+	return revisions, nil
+}
+
+// readHistory returns the revisions of a key, oldest first. A key that was
+// set before its history was kept has a single revision 0 with its value.
+func readHistory(tx *bolt.Tx, scope, key string) ([]KeyRevision, error) {
+	bucket := tx.Bucket([]byte(scope))
+	if bucket == nil || scope == metaBucket {
+		return nil, fmt.Errorf("scope `%s` doesn't exist", scope)
+	}
+
+	var revisions []KeyRevision
+	if histories := scopeMeta(tx, historyBucket, scope); histories != nil {
+		var err error
+		if revisions, err = decodeHistory(histories.Get([]byte(key))); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(revisions) == 0 {
+		value := bucket.Get([]byte(key))
+		if value == nil {
+			return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+		}
+		revisions = append(revisions, KeyRevision{Value: string(value)})
+	}
+
+	return revisions, nil
+}
+
+// History returns the revisions kept of `key` in the bucket named `scope`,
+// newest first.
+func (s *Store) History(scope, key string) (revisions []KeyRevision, err error) {
+	log.WithFields(log.Fields{
+		"scope": scope,
+		"key":   key,
+	}).Trace("KV history")
+	err = s.db.View(func(tx *bolt.Tx) error {
+		kept, err := readHistory(tx, scope, key)
+		if err != nil {
+			return err
+		}
+		for i := len(kept) - 1; i >= 0; i-- {
+			revisions = append(revisions, kept[i])
+		}
+		return nil
+	})
+	return
+}
+
+// GetRevision returns what `key` in the bucket named `scope` was at a
+// revision of the store, the latest revision is returned for 0.
+func (s *Store) GetRevision(scope, key string, revision uint64) (*KeyRevision, error) {
+	log.WithFields(log.Fields{
+		"scope":    scope,
+		"key":      key,
+		"revision": revision,
+	}).Trace("KV get revision")
+
+	var found *KeyRevision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revisions, err := readHistory(tx, scope, key)
+		if err != nil {
+			return err
+		}
+		if revision == 0 {
+			found = &revisions[len(revisions)-1]
+			return nil
+		}
+		for i := len(revisions) - 1; i >= 0; i-- {
+			if revisions[i].Revision <= revision {
+				found = &revisions[i]
+				return nil
+			}
+		}
+		// the revisions before the oldest one kept were dropped
+		if len(revisions) >= s.history {
+			return fmt.Errorf("%w: %d, the oldest of %s is %d",
+				ErrRevisionCompacted, revision, key, revisions[0].Revision)
+		}
+		return fmt.Errorf("%w: %s at revision %d", ErrKeyNotFound, key, revision)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// parseKeyRequest reads the scope and key of a request.
+func parseKeyRequest(msgBody, operation string) (service.RawRequest, string, string, error) {
+	var request service.RawRequest
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		return nil, "", "", fmt.Errorf("invalid request format: %w", err)
+	}
+
+	scope, ok := request["service"].(string)
+	if !ok || scope == "" {
+		return nil, "", "", fmt.Errorf("service scope required for %s request", operation)
+	}
+	key, ok := request["key"].(string)
+	if !ok || key == "" {
+		return nil, "", "", fmt.Errorf("key required for %s request", operation)
+	}
+
+	return request, scope, key, nil
+}
+
+// readCount reads an optional number that can't be negative from a request.
+func readCount(request service.RawRequest, name string) (uint64, error) {
+	value, found := request[name]
+	if !found {
+		return 0, nil
+	}
+	number, ok := value.(float64)
+	if !ok || number < 0 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+	return uint64(number), nil
+}
+
+// Execute callback function to handle `state-history` requests.
+func (cb *historyCallback) Execute(msgBody string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "state-history",
+	}).Debug("Processing state-history request")
+
+	request, scope, key, err := parseKeyRequest(msgBody, "state-history")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"error":    err,
+		}).Error("Invalid state-history request")
+		return createErrorResponse(err.Error()), err
+	}
+	limit, err := readCount(request, "limit")
+	if err != nil {
+		return createErrorResponse(err.Error()), err
+	}
+
+	revisions, err := cb.store.History(scope, key)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"key":      key,
+			"error":    err,
+		}).Error("Failed to read key history")
+		return createErrorResponse("Failed to read history: " + err.Error()), err
+	}
+	if limit > 0 && uint64(len(revisions)) > limit {
+		revisions = revisions[:limit]
+	}
+
+	log.WithFields(log.Fields{
+		"callback": cb.name,
+		"scope":    scope,
+		"key":      key,
+		"count":    len(revisions),
+	}).Debug("Successfully read key history")
+
+	return createSuccessResponse(map[string]interface{}{
+		"scope":     scope,
+		"key":       key,
+		"revisions": revisions,
+		"count":     len(revisions),
+	}), nil
+}
+
+// Execute callback function to handle `state-get-revision` requests.
+func (cb *getRevisionCallback) Execute(msgBody string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "state-get-revision",
+	}).Debug("Processing state-get-revision request")
+
+	request, scope, key, err := parseKeyRequest(msgBody, "state-get-revision")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"error":    err,
+		}).Error("Invalid state-get-revision request")
+		return createErrorResponse(err.Error()), err
+	}
+	revision, err := readCount(request, "revision")
+	if err != nil {
+		return createErrorResponse(err.Error()), err
+	}
+
+	found, err := cb.store.GetRevision(scope, key, revision)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"key":      key,
+			"revision": revision,
+			"error":    err,
+		}).Error("Failed to get key revision")
+		return createErrorResponse("Failed to get revision: " + err.Error()), err
+	}
+
+	log.WithFields(log.Fields{
+		"callback": cb.name,
+		"scope":    scope,
+		"key":      key,
+		"revision": found.Revision,
+	}).Debug("Successfully retrieved key revision")
+
+	return createSuccessResponse(map[string]interface{}{
+		"scope":    scope,
+		"key":      key,
+		"value":    found.Value,
+		"revision": found.Revision,
+		"time":     found.Time,
+		"actor":    found.Actor,
+		"deleted":  found.Deleted,
+	}), nil
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/geoffjay/plantd/core/service"
+	"github.com/geoffjay/plantd/state/api"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultSweepInterval is how often expired keys are removed when the config
+// doesn't say.
+const DefaultSweepInterval = time.Second
+
+// expiryBucket is the bucket in the meta bucket with a bucket for every scope
+// of when its keys expire, and leaseBucket has its leases.
+const (
+	expiryBucket = "expiry"
+	leaseBucket  = "leases"
+)
+
+var (
+	// ErrLeaseNotFound is returned for a lease that doesn't exist, or has
+	// expired.
+	ErrLeaseNotFound = errors.New("lease doesn't exist")
+	// ErrLeaseOwner is returned when a lease is used by someone other than
+	// its owner.
+	ErrLeaseOwner = errors.New("lease is owned by another client")
+)
+
+// Lease keeps the keys that are set with it until it expires, its owner has to
+// renew it before then to keep them.
+type Lease struct {
+	ID      uint64        `json:"id"`
+	Scope   string        `json:"scope"`
+	Owner   string        `json:"owner,omitempty"`
+	TTL     time.Duration `json:"ttl"`
+	Expires time.Time     `json:"expires"`
+}
+
+// keyExpiry is when a key is removed, at a time or along with a lease.
+type keyExpiry struct {
+	Expires time.Time `json:"expires,omitzero"`
+	Lease   uint64    `json:"lease,omitempty"`
+}
+
+type grantLeaseCallback struct {
+	name  string
+	store *Store
+}
+
+type renewLeaseCallback struct {
+	name  string
+	store *Store
+}
+
+type revokeLeaseCallback struct {
+	name  string
+	store *Store
+}
+
+// SetExpiringBy sets a value on behalf of an actor that's removed once the TTL
+// is up, or along with a lease of the actor, whichever are given.
+func (s *Store) SetExpiringBy(actor, scope, key, value string, ttl time.Duration, lease uint64) (*api.StateChange, error) {
+	operation := KeyOperation{
+		Operation: api.StateSet,
+		Scope:     scope,
+		Key:       key,
+		Value:     value,
+		TTL:       ttl,
+		Lease:     lease,
+	}
+
+	var change *api.StateChange
+	err := s.updateAll(func(tx *bolt.Tx, stamp func(*api.StateChange) error) (err error) {
+		change, err = s.apply(tx, stamp, actor, &operation)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// GrantLease creates a lease in a scope that's owned by an actor.
+func (s *Store) GrantLease(actor, scope string, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, errors.New("lease TTL must be positive")
+	}
+
+	lease := &Lease{Scope: scope, Owner: actor, TTL: ttl}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(scope)) == nil || scope == metaBucket {
+			return fmt.Errorf("scope `%s` doesn't exist", scope)
+		}
+		bucket, err := createScopeMeta(tx, leaseBucket, scope)
+		if err != nil {
+			return err
+		}
+		if lease.ID, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		lease.Expires = time.Now().Add(ttl)
+		return putLease(bucket, lease)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// RenewLease keeps a lease of an actor for another TTL from now.
+func (s *Store) RenewLease(actor, scope string, id uint64) (lease *Lease, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if lease, err = ownLease(tx, actor, scope, id, time.Now()); err != nil {
+			return err
+		}
+		lease.Expires = time.Now().Add(lease.TTL)
+		return putLease(scopeMeta(tx, leaseBucket, scope), lease)
+	})
+	return
+}
+
+// RevokeLease ends a lease of an actor, the keys that were set with it are
+// removed right away and the changes are returned.
+func (s *Store) RevokeLease(actor, scope string, id uint64) ([]*api.StateChange, error) {
+	var changes []*api.StateChange
+	err := s.updateAll(func(tx *bolt.Tx, stamp func(*api.StateChange) error) error {
+		if _, err := ownLease(tx, actor, scope, id, time.Now()); err != nil {
+			return err
+		}
+		if err := scopeMeta(tx, leaseBucket, scope).Delete(leaseKey(id)); err != nil {
+			return err
+		}
+
+		var keys []string
+		if expiries := scopeMeta(tx, expiryBucket, scope); expiries != nil {
+			_ = expiries.ForEach(func(k, v []byte) error {
+				var expiry keyExpiry
+				if json.Unmarshal(v, &expiry) == nil && expiry.Lease == id {
+					keys = append(keys, string(k))
+				}
+				return nil
+			})
+		}
+		for _, key := range keys {
+			change, err := s.expire(tx, stamp, actor, scope, key)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Expire removes the keys that have expired by a time, along with the leases,
+// and returns the changes. The keys are deleted like any other.
+func (s *Store) Expire(now time.Time) ([]*api.StateChange, error) {
+	// most sweeps don't find anything, and shouldn't write
+	found := false
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		keys, leases := expired(tx, now)
+		found = len(keys) > 0 || len(leases) > 0
+		return nil
+	})
+	if !found {
+		return nil, nil
+	}
+
+	var changes []*api.StateChange
+	err := s.updateAll(func(tx *bolt.Tx, stamp func(*api.StateChange) error) error {
+		keys, leases := expired(tx, now)
+		for scope, ids := range leases {
+			bucket := scopeMeta(tx, leaseBucket, scope)
+			for _, id := range ids {
+				if err := bucket.Delete(leaseKey(id)); err != nil {
+					return err
+				}
+			}
+		}
+		for scope, names := range keys {
+			for _, key := range names {
+				change, err := s.expire(tx, stamp, "", scope, key)
+				if err != nil {
+					return err
+				}
+				changes = append(changes, change)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// expire deletes a key that's expired on behalf of an actor.
+func (s *Store) expire(tx *bolt.Tx, stamp func(*api.StateChange) error, actor, scope, key string) (*api.StateChange, error) {
+	change := &api.StateChange{
+		Operation: api.StateDelete,
+		Scope:     scope,
+		Key:       key,
+		Actor:     actor,
+	}
+	if err := stamp(change); err != nil {
+		return nil, err
+	}
+	return change, s.remove(tx, change)
+}
+
+// expired returns the keys of each scope that have expired by a time, and the
+// leases.
+func expired(tx *bolt.Tx, now time.Time) (keys map[string][]string, leases map[string][]uint64) {
+	keys = make(map[string][]string)
+	leases = make(map[string][]uint64)
+
+	meta := tx.Bucket([]byte(metaBucket))
+	if meta == nil {
+		return
+	}
+	if buckets := meta.Bucket([]byte(leaseBucket)); buckets != nil {
+		_ = buckets.ForEach(func(scope, _ []byte) error {
+			_ = buckets.Bucket(scope).ForEach(func(_, v []byte) error {
+				var lease Lease
+				if json.Unmarshal(v, &lease) == nil && !now.Before(lease.Expires) {
+					leases[string(scope)] = append(leases[string(scope)], lease.ID)
+				}
+				return nil
+			})
+			return nil
+		})
+	}
+	if buckets := meta.Bucket([]byte(expiryBucket)); buckets != nil {
+		_ = buckets.ForEach(func(scope, _ []byte) error {
+			if tx.Bucket(scope) == nil {
+				return nil
+			}
+			_ = buckets.Bucket(scope).ForEach(func(k, v []byte) error {
+				var expiry keyExpiry
+				if err := json.Unmarshal(v, &expiry); err != nil {
+					return nil
+				}
+				if (!expiry.Expires.IsZero() && !now.Before(expiry.Expires)) ||
+					(expiry.Lease != 0 && !leaseAlive(tx, string(scope), expiry.Lease, now)) {
+					keys[string(scope)] = append(keys[string(scope)], string(k))
+				}
+				return nil
+			})
+			return nil
+		})
+	}
+	return
+}
+
+// setExpiry makes the key of an operation expire after its TTL or along with
+// its lease, which has to be one of the actor's.
+func setExpiry(tx *bolt.Tx, actor string, now time.Time, operation *KeyOperation) error {
+	expiry := keyExpiry{Lease: operation.Lease}
+	if operation.TTL > 0 {
+		expiry.Expires = now.Add(operation.TTL)
+	}
+	if operation.Lease != 0 {
+		if _, err := ownLease(tx, actor, operation.Scope, operation.Lease, now); err != nil {
+			return err
+		}
+	}
+
+	bucket, err := createScopeMeta(tx, expiryBucket, operation.Scope)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(expiry)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(operation.Key), data)
+}
+
+// clearExpiry makes a key permanent.
+func clearExpiry(tx *bolt.Tx, scope, key string) error {
+	if bucket := scopeMeta(tx, expiryBucket, scope); bucket != nil {
+		return bucket.Delete([]byte(key))
+	}
+	return nil
+}
+
+// ownLease returns a lease that hasn't expired, as long as the actor owns it.
+func ownLease(tx *bolt.Tx, actor, scope string, id uint64, now time.Time) (*Lease, error) {
+	lease, err := readLease(tx, scope, id)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(lease.Expires) {
+		return nil, fmt.Errorf("%w: %d", ErrLeaseNotFound, id)
+	}
+	if lease.Owner != actor {
+		return nil, ErrLeaseOwner
+	}
+	return lease, nil
+}
+
+func leaseAlive(tx *bolt.Tx, scope string, id uint64, now time.Time) bool {
+	lease, err := readLease(tx, scope, id)
+	return err == nil && now.Before(lease.Expires)
+}
+
+func readLease(tx *bolt.Tx, scope string, id uint64) (*Lease, error) {
+	var data []byte
+	if bucket := scopeMeta(tx, leaseBucket, scope); bucket != nil {
+		data = bucket.Get(leaseKey(id))
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%w: %d", ErrLeaseNotFound, id)
+	}
+	var lease Lease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return nil, fmt.Errorf("invalid lease: %w", err)
+	}
+	return &lease, nil
+}
+
+func putLease(bucket *bolt.Bucket, lease *Lease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(leaseKey(lease.ID), data)
+}
+
+func leaseKey(id uint64) []byte {
+	return []byte(strconv.FormatUint(id, 10))
+}
+
+// readExpiry reads the optional TTL and lease of a request.
+func readExpiry(request service.RawRequest) (ttl time.Duration, lease uint64, err error) {
+	if value, found := request["ttl"]; found {
+		text, ok := value.(string)
+		if !ok {
+			return 0, 0, errors.New("ttl must be a duration")
+		}
+		if ttl, err = time.ParseDuration(text); err != nil || ttl <= 0 {
+			return 0, 0, fmt.Errorf("invalid ttl %s", text)
+		}
+	}
+	lease, err = readCount(request, "lease")
+	return ttl, lease, err
+}
+
+// parseLeaseRequest reads the scope and lease of a request.
+func parseLeaseRequest(msgBody, operation string) (string, uint64, error) {
+	var request service.RawRequest
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		return "", 0, fmt.Errorf("invalid request format: %w", err)
+	}
+	scope, ok := request["service"].(string)
+	if !ok || scope == "" {
+		return "", 0, fmt.Errorf("service scope required for %s request", operation)
+	}
+	id, err := readCount(request, "lease")
+	if err != nil || id == 0 {
+		return "", 0, fmt.Errorf("lease required for %s request", operation)
+	}
+	return scope, id, nil
+}
+
+func leaseData(lease *Lease) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      lease.ID,
+		"scope":   lease.Scope,
+		"owner":   lease.Owner,
+		"ttl":     lease.TTL.String(),
+		"expires": lease.Expires,
+	}
+}
+
+// Execute callback function to handle `state-lease-grant` requests.
+func (cb *grantLeaseCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles `state-lease-grant` requests made by an authenticated
+// actor, who owns the lease.
+func (cb *grantLeaseCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "state-lease-grant",
+	}).Debug("Processing state-lease-grant request")
+
+	var request service.RawRequest
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		return createErrorResponse("Invalid request format: " + err.Error()), err
+	}
+	scope, ok := request["service"].(string)
+	if !ok || scope == "" {
+		err := errors.New("service parameter missing")
+		return createErrorResponse("Service scope required for state-lease-grant request"), err
+	}
+	ttl, _, err := readExpiry(request)
+	if err != nil || ttl == 0 {
+		err = errors.New("ttl required for state-lease-grant request")
+		return createErrorResponse(err.Error()), err
+	}
+
+	lease, err := cb.store.GrantLease(actor, scope, ttl)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"error":    err,
+		}).Error("Failed to grant lease")
+		return createErrorResponse("Failed to grant lease: " + err.Error()), err
+	}
+
+	log.WithFields(log.Fields{
+		"callback": cb.name,
+		"scope":    scope,
+		"lease":    lease.ID,
+		"owner":    actor,
+		"ttl":      ttl,
+	}).Info("Successfully granted lease")
+
+	return createSuccessResponse(leaseData(lease)), nil
+}
+
+// Execute callback function to handle `state-lease-renew` requests.
+func (cb *renewLeaseCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles `state-lease-renew` requests made by an authenticated
+// actor.
+func (cb *renewLeaseCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "state-lease-renew",
+	}).Trace("Processing state-lease-renew request")
+
+	scope, id, err := parseLeaseRequest(msgBody, "state-lease-renew")
+	if err != nil {
+		return createErrorResponse(err.Error()), err
+	}
+
+	lease, err := cb.store.RenewLease(actor, scope, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"lease":    id,
+			"error":    err,
+		}).Warn("Failed to renew lease")
+		return createErrorResponse("Failed to renew lease: " + err.Error()), err
+	}
+
+	return createSuccessResponse(leaseData(lease)), nil
+}
+
+// Execute callback function to handle `state-lease-revoke` requests.
+func (cb *revokeLeaseCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteAs(msgBody, "")
+}
+
+// ExecuteAs handles `state-lease-revoke` requests made by an authenticated
+// actor.
+func (cb *revokeLeaseCallback) ExecuteAs(msgBody, actor string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "state-lease-revoke",
+	}).Debug("Processing state-lease-revoke request")
+
+	scope, id, err := parseLeaseRequest(msgBody, "state-lease-revoke")
+	if err != nil {
+		return createErrorResponse(err.Error()), err
+	}
+
+	changes, err := cb.store.RevokeLease(actor, scope, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"lease":    id,
+			"error":    err,
+		}).Error("Failed to revoke lease")
+		return createErrorResponse("Failed to revoke lease: " + err.Error()), err
+	}
+
+	keys := make([]string, 0, len(changes))
+	for _, change := range changes {
+		keys = append(keys, change.Key)
+	}
+	log.WithFields(log.Fields{
+		"callback": cb.name,
+		"scope":    scope,
+		"lease":    id,
+		"keys":     len(keys),
+	}).Info("Successfully revoked lease")
+
+	return createSuccessResponse(map[string]interface{}{
+		"scope":  scope,
+		"lease":  id,
+		"status": "revoked",
+		"keys":   keys,
+	}), nil
+}
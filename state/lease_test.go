@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/geoffjay/plantd/state/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_ExpireTTL(t *testing.T) {
+	store := newTestStore(t, "org.plantd.Test")
+	recorder := &changeRecorder{}
+	store.SetNotifier(recorder)
+
+	_, err := store.SetExpiringBy("", "org.plantd.Test", "online", "true", time.Minute, 0)
+	require.NoError(t, err)
+	_, err = store.SetExpiringBy("", "org.plantd.Test", "mode", "auto", time.Minute, 0)
+	require.NoError(t, err)
+	// setting it again without a TTL keeps it
+	require.NoError(t, store.Set("org.plantd.Test", "mode", "manual"))
+
+	changes, err := store.Expire(time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	recorder.changes = nil
+	changes, err = store.Expire(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, api.StateDelete, changes[0].Operation)
+	assert.Equal(t, "online", changes[0].Key)
+	assert.Equal(t, "true", changes[0].OldValue)
+	assert.Equal(t, changes, recorder.changes)
+
+	keys, err := store.ListAllKeys("org.plantd.Test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mode"}, keys)
+
+	// nothing is left to expire
+	changes, err = store.Expire(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestStore_Lease(t *testing.T) {
+	store := newTestStore(t, "org.plantd.Test")
+
+	_, err := store.GrantLease("module@example.com", "org.plantd.Missing", time.Minute)
+	assert.Error(t, err)
+	_, err = store.GrantLease("module@example.com", "org.plantd.Test", 0)
+	assert.Error(t, err)
+
+	lease, err := store.GrantLease("module@example.com", "org.plantd.Test", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "module@example.com", lease.Owner)
+
+	// only the owner can use it
+	_, err = store.SetExpiringBy("other@example.com", "org.plantd.Test", "lock", "other", 0, lease.ID)
+	assert.ErrorIs(t, err, ErrLeaseOwner)
+	_, err = store.RenewLease("other@example.com", "org.plantd.Test", lease.ID)
+	assert.ErrorIs(t, err, ErrLeaseOwner)
+	_, err = store.SetExpiringBy("module@example.com", "org.plantd.Test", "lock", "module", 0, lease.ID+1)
+	assert.ErrorIs(t, err, ErrLeaseNotFound)
+
+	_, err = store.CompareAndSwapBy("module@example.com", KeyOperation{
+		Operation: api.StateSet, Scope: "org.plantd.Test", Key: "lock", Value: "module",
+		Revision: ptr(uint64(0)), Lease: lease.ID,
+	})
+	require.NoError(t, err)
+	_, err = store.SetExpiringBy("module@example.com", "org.plantd.Test", "online", "true", 0, lease.ID)
+	require.NoError(t, err)
+
+	// a renewed lease keeps its keys
+	renewed, err := store.RenewLease("module@example.com", "org.plantd.Test", lease.ID)
+	require.NoError(t, err)
+	assert.True(t, renewed.Expires.After(lease.Expires))
+	changes, err := store.Expire(lease.Expires)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	changes, err = store.Expire(renewed.Expires)
+	require.NoError(t, err)
+	assert.Len(t, changes, 2)
+	keys, err := store.ListAllKeys("org.plantd.Test")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	_, err = store.RenewLease("module@example.com", "org.plantd.Test", lease.ID)
+	assert.ErrorIs(t, err, ErrLeaseNotFound)
+}
+
+func TestStore_RevokeLease(t *testing.T) {
+	store := newTestStore(t, "org.plantd.Test")
+	recorder := &changeRecorder{}
+	store.SetNotifier(recorder)
+
+	lease, err := store.GrantLease("module@example.com", "org.plantd.Test", time.Minute)
+	require.NoError(t, err)
+	_, err = store.SetExpiringBy("module@example.com", "org.plantd.Test", "lock", "module", 0, lease.ID)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("org.plantd.Test", "mode", "auto"))
+
+	_, err = store.RevokeLease("other@example.com", "org.plantd.Test", lease.ID)
+	assert.ErrorIs(t, err, ErrLeaseOwner)
+
+	recorder.changes = nil
+	changes, err := store.RevokeLease("module@example.com", "org.plantd.Test", lease.ID)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "lock", changes[0].Key)
+	assert.Equal(t, "module@example.com", changes[0].Actor)
+	assert.Equal(t, changes, recorder.changes)
+
+	keys, err := store.ListAllKeys("org.plantd.Test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mode"}, keys)
+	_, err = store.SetExpiringBy("module@example.com", "org.plantd.Test", "lock", "module", 0, lease.ID)
+	assert.ErrorIs(t, err, ErrLeaseNotFound)
+}
@@ -2,113 +2,187 @@ package main
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/geoffjay/plantd/core/bus"
+	"github.com/geoffjay/plantd/core/curve"
 
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	// SinkAdded is the signal ID for when a sink has been added.
-	SinkAdded = iota
-
-	// SinkRemoved is the signal ID for when a sink has been removed.
-	SinkRemoved
-
-	// SinkShutdown is the signal ID that's raised on shutdown.
-	SinkShutdown
-)
-
-// SinkChanBuffer controls the number of sinks that can be created before a
-// deadlock occurs. This should actually be fixed to not have a deadlock,
-// but that's a problem for another day.
-const SinkChanBuffer = 20
-
-// Manager is used to control how some devices are managed.
+// Manager is used to control how some devices are managed. It holds a sink
+// for every scope, sinks can be added and removed at any time and are started
+// as soon as the manager is running.
 type Manager struct {
 	sinkEndpoint string
-	sinkList     map[string]*bus.Sink
-	sinkChan     chan event
+	sinkCurve    *curve.Config
+
+	mu    sync.Mutex
+	ctx   context.Context
+	sinks map[string]*managedSink
+}
+
+// managedSink is a sink with what's needed to stop it on its own.
+type managedSink struct {
+	sink    *bus.Sink
+	added   time.Time
+	started time.Time
+	cancel  context.CancelFunc
+	done    chan struct{}
 }
 
-type event struct {
-	id    int
-	scope string
+// SinkStatus describes the sink of a scope.
+type SinkStatus struct {
+	Scope   string    `json:"scope"`
+	Running bool      `json:"running"`
+	Added   time.Time `json:"added"`
+	Started time.Time `json:"started,omitempty"`
+	Gaps    uint64    `json:"gaps"`
 }
 
 // NewManager creates an instance of the manager.
 func NewManager(endpoint string) *Manager {
 	return &Manager{
 		sinkEndpoint: endpoint,
-		sinkList:     make(map[string]*bus.Sink),
-		sinkChan:     make(chan event, SinkChanBuffer),
+		sinks:        make(map[string]*managedSink),
 	}
 }
 
+// SetCurve sets the CURVE keys that sinks use to connect to the bus.
+func (m *Manager) SetCurve(keys *curve.Config) {
+	m.sinkCurve = keys
+}
+
 // AddSink creates a new message consumer sink and adds it to the list by name.
 func (m *Manager) AddSink(scope string, callback bus.SinkCallback) {
-	if _, ok := m.sinkList[scope]; ok {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sinks[scope]; ok {
 		log.WithFields(
 			log.Fields{"scope": scope},
 		).Debug("scope with that name already exists")
 		return
 	}
+
 	sink := bus.NewSink(m.sinkEndpoint, scope)
+	sink.SetCurve(m.sinkCurve)
 	sink.SetHandler(&bus.SinkHandler{Callback: callback})
-	m.sinkList[scope] = sink
-	m.sinkChan <- event{id: SinkAdded, scope: scope}
+
+	entry := &managedSink{sink: sink, added: time.Now()}
+	m.sinks[scope] = entry
+
+	// sinks added before the manager runs are started by Run
+	if m.ctx != nil {
+		m.startSink(scope, entry)
+	}
 }
 
-// RemoveSink removes a consumer sink from the list by name if it exists.
+// RemoveSink removes a consumer sink from the list by name if it exists, it
+// returns once the sink has closed its socket.
 func (m *Manager) RemoveSink(scope string) {
-	if _, ok := m.sinkList[scope]; ok {
-		defer m.sinkList[scope].Stop()
-		delete(m.sinkList, scope)
-	} else {
+	m.mu.Lock()
+	entry, ok := m.sinks[scope]
+	delete(m.sinks, scope)
+	m.mu.Unlock()
+
+	if !ok {
 		log.WithFields(
 			log.Fields{"scope": scope},
 		).Debug("scope with that name doesn't exist")
+		return
 	}
-	m.sinkChan <- event{id: SinkRemoved, scope: scope}
+
+	m.stopSink(scope, entry)
 }
 
-// Run launches all routines that need to be run and monitors for changes.
+// SinkStatus lists the sinks ordered by scope.
+func (m *Manager) SinkStatus() []SinkStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]SinkStatus, 0, len(m.sinks))
+	for scope, entry := range m.sinks {
+		statuses = append(statuses, SinkStatus{
+			Scope:   scope,
+			Running: entry.sink.Running(),
+			Added:   entry.added,
+			Started: entry.started,
+			Gaps:    entry.sink.Gaps(),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Scope < statuses[j].Scope
+	})
+
+	return statuses
+}
+
+// Run starts the sinks that have been added and any that are added later, it
+// stops all of them when the context is done.
 func (m *Manager) Run(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	log.WithFields(log.Fields{"context": "manager.run"}).Debug("starting")
 
-	go func() {
-	sinkMonitor:
-		for event := range m.sinkChan {
-			switch event.id {
-			case SinkAdded:
-				log.WithFields(log.Fields{"scope": event.scope}).Debug(
-					"sink add received")
-				wg.Add(1)
-				go m.sinkList[event.scope].Run(ctx, wg)
-			case SinkRemoved:
-				log.WithFields(log.Fields{"scope": event.scope}).Debug(
-					"sink remove received")
-			case SinkShutdown:
-				log.Debug("sink shutdown received")
-				break sinkMonitor
-			}
-		}
-	}()
+	m.mu.Lock()
+	m.ctx = ctx
+	for scope, entry := range m.sinks {
+		m.startSink(scope, entry)
+	}
+	m.mu.Unlock()
 
 	<-ctx.Done()
-	m.sinkChan <- event{id: SinkShutdown, scope: ""}
+
+	m.Shutdown()
 
 	log.WithFields(log.Fields{"context": "manager.run"}).Debug("exiting")
 }
 
 // Shutdown stops any running routines.
 func (m *Manager) Shutdown() {
-	for scope := range m.sinkList {
-		m.RemoveSink(scope)
+	m.mu.Lock()
+	sinks := m.sinks
+	m.sinks = make(map[string]*managedSink)
+	m.ctx = nil
+	m.mu.Unlock()
+
+	for scope, entry := range sinks {
+		m.stopSink(scope, entry)
 	}
 
 	log.WithFields(log.Fields{"context": "manager.shutdown"}).Debug(
 		"terminating")
 }
+
+// startSink runs a sink with its own context so it can be stopped without
+// the others, the lock must be held.
+func (m *Manager) startSink(scope string, entry *managedSink) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	entry.cancel = cancel
+	entry.done = make(chan struct{})
+	entry.started = time.Now()
+
+	log.WithFields(log.Fields{"scope": scope}).Debug("starting sink")
+
+	go func() {
+		defer close(entry.done)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		entry.sink.Run(ctx, &wg)
+	}()
+}
+
+// stopSink stops a sink and waits for it to close its socket.
+func (m *Manager) stopSink(scope string, entry *managedSink) {
+	log.WithFields(log.Fields{"scope": scope}).Debug("stopping sink")
+
+	entry.sink.Stop()
+	if entry.cancel == nil {
+		// it was never started
+		return
+	}
+	entry.cancel()
+	<-entry.done
+}
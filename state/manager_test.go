@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/geoffjay/plantd/core/bus"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopSinkCallback struct{}
+
+func (nopSinkCallback) Handle(_ *bus.Message) error {
+	return nil
+}
+
+func TestManagerAddRemoveSink(t *testing.T) {
+	manager := NewManager(">tcp://127.0.0.1:11901")
+
+	manager.AddSink("org.plantd.b", nopSinkCallback{})
+	manager.AddSink("org.plantd.a", nopSinkCallback{})
+	manager.AddSink("org.plantd.a", nopSinkCallback{})
+
+	status := manager.SinkStatus()
+	require.Len(t, status, 2)
+	assert.Equal(t, "org.plantd.a", status[0].Scope)
+	assert.Equal(t, "org.plantd.b", status[1].Scope)
+	assert.False(t, status[0].Running)
+	assert.True(t, status[0].Started.IsZero())
+
+	manager.RemoveSink("org.plantd.a")
+	manager.RemoveSink("org.plantd.missing")
+
+	status = manager.SinkStatus()
+	require.Len(t, status, 1)
+	assert.Equal(t, "org.plantd.b", status[0].Scope)
+}
+
+func TestManagerRunDynamicSinks(t *testing.T) {
+	manager := NewManager(">tcp://127.0.0.1:11902")
+	manager.AddSink("org.plantd.initial", nopSinkCallback{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go manager.Run(ctx, &wg)
+
+	// more sinks than the channel the manager used to have room for, added
+	// and removed concurrently
+	var workers sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			scope := fmt.Sprintf("org.plantd.scope%02d", i)
+			manager.AddSink(scope, nopSinkCallback{})
+			if i%2 == 0 {
+				manager.RemoveSink(scope)
+			}
+		}(i)
+	}
+	workers.Wait()
+
+	require.Len(t, manager.SinkStatus(), 21)
+	require.Eventually(t, func() bool {
+		for _, status := range manager.SinkStatus() {
+			if !status.Running {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	wg.Wait()
+
+	assert.Empty(t, manager.SinkStatus())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/geoffjay/plantd/core/bus"
+	"github.com/geoffjay/plantd/core/curve"
+	"github.com/geoffjay/plantd/state/api"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// changeNotifiers tells each of several notifiers about every change.
+type changeNotifiers []ChangeNotifier
+
+// Notify implements ChangeNotifier.
+func (n changeNotifiers) Notify(change *api.StateChange) {
+	for _, notifier := range n {
+		notifier.Notify(change)
+	}
+}
+
+// changePublisher publishes the changes made to the store on the state bus.
+type changePublisher struct {
+	source *bus.Source
+}
+
+func newChangePublisher(endpoint string, keys *curve.Config) *changePublisher {
+	source := bus.NewSource(endpoint, api.StateChangeTopic)
+	source.SetID("org.plantd.State")
+	source.SetCurve(keys)
+	// a stalled bus shouldn't hold up requests, sinks that miss a change see
+	// the gap in the sequence of the topic
+	if err := source.SetQueue(bus.DefaultQueueSize, bus.QueueDropOldest); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("failed to set change queue")
+	}
+
+	return &changePublisher{source: source}
+}
+
+// Notify queues a change to be published with the topic of its scope.
+func (p *changePublisher) Notify(change *api.StateChange) {
+	body, err := json.Marshal(change)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"scope":    change.Scope,
+			"revision": change.Revision,
+			"error":    err,
+		}).Error("failed to encode state change")
+		return
+	}
+
+	if err = p.source.Queue(&bus.Message{
+		Topic:  change.Topic(),
+		Header: bus.Header{ContentType: bus.ContentTypeJSON},
+		Body:   body,
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"scope":    change.Scope,
+			"revision": change.Revision,
+			"error":    err,
+		}).Warn("failed to queue state change")
+	}
+}
+
+// Reply queues the result of a command received on the state bus to be
+// published, it implements ResultPublisher.
+func (p *changePublisher) Reply(topic string, result *api.StateCommandResult) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"topic": topic,
+			"error": err,
+		}).Error("failed to encode state command result")
+		return
+	}
+
+	if err = p.source.Queue(&bus.Message{
+		Topic:  topic,
+		Header: bus.Header{ContentType: bus.ContentTypeJSON},
+		Body:   body,
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"topic": topic,
+			"error": err,
+		}).Warn("failed to queue state command result")
+	}
+}
+
+// Run publishes changes until the context is done.
+func (p *changePublisher) Run(ctx context.Context, wg *sync.WaitGroup) {
+	p.source.Run(ctx, wg)
+
+	log.WithFields(log.Fields{
+		"context": "publisher.run",
+		"stats":   p.source.Stats(),
+	}).Debug("exiting")
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/geoffjay/plantd/core/service"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// schemaBucket is the bucket in the meta bucket with a bucket of schemas for
+// every scope, they're kept by key pattern.
+const schemaBucket = "schemas"
+
+// ErrInvalidSchema is returned for a schema that can't be used.
+var ErrInvalidSchema = errors.New("invalid schema")
+
+// SchemaError is a way in which a value doesn't match a schema.
+type SchemaError struct {
+	Pattern string `json:"pattern"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a value doesn't match the schemas of its
+// key.
+type ValidationError struct {
+	Scope  string
+	Key    string
+	Errors []SchemaError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Path+": "+err.Message)
+	}
+	return fmt.Sprintf("value of `%s` doesn't match its schema: %s", e.Key,
+		strings.Join(messages, "; "))
+}
+
+type setSchemaCallback struct {
+	name  string
+	store *Store
+}
+
+type getSchemaCallback struct {
+	name  string
+	store *Store
+}
+
+type validateCallback struct {
+	name  string
+	store *Store
+}
+
+// SetSchema attaches a JSON Schema to the keys of a scope that match a
+// pattern, the pattern `*` matches every key. The schema is removed when it's
+// empty.
+func (s *Store) SetSchema(scope, pattern string, schema []byte) error {
+	if pattern == "" {
+		pattern = "*"
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid key pattern %s: %w", pattern, err)
+	}
+	if len(schema) > 0 {
+		if err := checkSchema(schema); err != nil {
+			return err
+		}
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(scope)) == nil || scope == metaBucket {
+			return fmt.Errorf("scope `%s` doesn't exist", scope)
+		}
+		if len(schema) == 0 {
+			if bucket := scopeMeta(tx, schemaBucket, scope); bucket != nil {
+				return bucket.Delete([]byte(pattern))
+			}
+			return nil
+		}
+		bucket, err := createScopeMeta(tx, schemaBucket, scope)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(pattern), schema)
+	})
+}
+
+// Schemas returns the schemas of a scope by key pattern.
+func (s *Store) Schemas(scope string) (schemas map[string]json.RawMessage, err error) {
+	schemas = make(map[string]json.RawMessage)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(scope)) == nil || scope == metaBucket {
+			return fmt.Errorf("scope `%s` doesn't exist", scope)
+		}
+		bucket := scopeMeta(tx, schemaBucket, scope)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			schemas[string(k)] = append(json.RawMessage(nil), v...)
+			return nil
+		})
+	})
+	return
+}
+
+// Validate checks a value against the schemas of its key, a value that
+// matches them has no errors.
+func (s *Store) Validate(scope, key, value string) (errs []SchemaError, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		errs, err = validateKey(tx, scope, key, value)
+		return err
+	})
+	return
+}
+
+// validateKey checks a value against every schema of the scope with a
+// pattern that matches the key.
+func validateKey(tx *bolt.Tx, scope, key, value string) ([]SchemaError, error) {
+	bucket := scopeMeta(tx, schemaBucket, scope)
+	if bucket == nil {
+		return nil, nil
+	}
+
+	// values are JSON, anything else is taken as a string
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		decoded = value
+	}
+
+	var errs []SchemaError
+	err := bucket.ForEach(func(k, v []byte) error {
+		if matched, _ := path.Match(string(k), key); !matched {
+			return nil
+		}
+		var schema interface{}
+		if err := json.Unmarshal(v, &schema); err != nil {
+			return fmt.Errorf("%w for %s: %w", ErrInvalidSchema, k, err)
+		}
+		for _, problem := range validateValue(schema, decoded, "$") {
+			problem.Pattern = string(k)
+			errs = append(errs, problem)
+		}
+		return nil
+	})
+	return errs, err
+}
+
+// schemaKeywords are the keywords that schemas can have, the ones that are
+// checked by validateValue and the annotations that don't change what's
+// valid. A schema with any other keyword is rejected rather than enforcing
+// less than it says.
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true, "multipleOf": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"items": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+	"properties": true, "required": true, "additionalProperties": true,
+	"allOf": true, "anyOf": true, "oneOf": true, "not": true,
+	"$schema": true, "$comment": true, "title": true, "description": true, "default": true, "examples": true,
+}
+
+// checkSchema makes sure a schema is a JSON object or boolean with only the
+// supported keywords and patterns that compile.
+func checkSchema(data []byte) error {
+	var schema interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+	}
+	return walkSchema(schema)
+}
+
+func walkSchema(schema interface{}) error {
+	switch schema := schema.(type) {
+	case bool:
+		return nil
+	case map[string]interface{}:
+		keywords := make([]string, 0, len(schema))
+		for keyword := range schema {
+			keywords = append(keywords, keyword)
+		}
+		sort.Strings(keywords)
+		for _, keyword := range keywords {
+			if !schemaKeywords[keyword] {
+				return fmt.Errorf("%w: keyword %s isn't supported", ErrInvalidSchema, keyword)
+			}
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+			}
+		}
+		for _, keyword := range []string{"items", "additionalProperties", "not"} {
+			if sub, ok := schema[keyword]; ok {
+				if err := walkSchema(sub); err != nil {
+					return err
+				}
+			}
+		}
+		for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+			subs, _ := schema[keyword].([]interface{})
+			for _, sub := range subs {
+				if err := walkSchema(sub); err != nil {
+					return err
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for _, sub := range properties {
+			if err := walkSchema(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: a schema must be an object or a boolean", ErrInvalidSchema)
+	}
+}
+
+// validateValue checks a decoded JSON value against a schema. These keywords
+// are supported: type, enum, const, minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum, multipleOf, minLength, maxLength, pattern, items,
+// minItems, maxItems, uniqueItems, properties, required,
+// additionalProperties, allOf, anyOf, oneOf and not.
+func validateValue(schema, value interface{}, at string) []SchemaError {
+	rules, ok := schema.(map[string]interface{})
+	if !ok {
+		if allowed, _ := schema.(bool); !allowed {
+			return []SchemaError{{Path: at, Message: "no value is allowed"}}
+		}
+		return nil
+	}
+
+	v := &validation{rules: rules, at: at}
+	if types := schemaTypes(rules["type"]); len(types) > 0 {
+		kind := jsonType(value)
+		matched := false
+		for _, t := range types {
+			// every integer is a number too
+			if t == kind || (t == "number" && kind == "integer") {
+				matched = true
+			}
+		}
+		if !matched {
+			v.fail("expected %s, got %s", strings.Join(types, " or "), kind)
+			// the other keywords don't make sense for the wrong type
+			return v.errs
+		}
+	}
+	if options, ok := rules["enum"].([]interface{}); ok && !containsValue(options, value) {
+		v.fail("must be one of %s", encode(options))
+	}
+	if expected, ok := rules["const"]; ok && !reflect.DeepEqual(expected, value) {
+		v.fail("must be %s", encode(expected))
+	}
+
+	switch value := value.(type) {
+	case float64:
+		v.numberRules(value)
+	case string:
+		v.stringRules(value)
+	case []interface{}:
+		v.arrayRules(value)
+	case map[string]interface{}:
+		v.objectRules(value)
+	}
+	v.combinedRules(value)
+
+	return v.errs
+}
+
+// validation collects the ways a value doesn't match the rules of a schema.
+type validation struct {
+	rules map[string]interface{}
+	at    string
+	errs  []SchemaError
+}
+
+func (v *validation) fail(format string, args ...interface{}) {
+	v.errs = append(v.errs, SchemaError{Path: v.at, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validation) limit(keyword string) (float64, bool) {
+	limit, ok := v.rules[keyword].(float64)
+	return limit, ok
+}
+
+func (v *validation) numberRules(value float64) {
+	if limit, ok := v.limit("minimum"); ok && value < limit {
+		v.fail("must be at least %v", limit)
+	}
+	if limit, ok := v.limit("maximum"); ok && value > limit {
+		v.fail("must be at most %v", limit)
+	}
+	if limit, ok := v.limit("exclusiveMinimum"); ok && value <= limit {
+		v.fail("must be more than %v", limit)
+	}
+	if limit, ok := v.limit("exclusiveMaximum"); ok && value >= limit {
+		v.fail("must be less than %v", limit)
+	}
+	if divisor, ok := v.limit("multipleOf"); ok && divisor > 0 {
+		if quotient := value / divisor; math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			v.fail("must be a multiple of %v", divisor)
+		}
+	}
+}
+
+func (v *validation) stringRules(value string) {
+	length := float64(utf8.RuneCountInString(value))
+	if limit, ok := v.limit("minLength"); ok && length < limit {
+		v.fail("must be at least %v characters", limit)
+	}
+	if limit, ok := v.limit("maxLength"); ok && length > limit {
+		v.fail("must be at most %v characters", limit)
+	}
+	if pattern, ok := v.rules["pattern"].(string); ok {
+		if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(value) {
+			v.fail("must match %s", pattern)
+		}
+	}
+}
+
+func (v *validation) arrayRules(value []interface{}) {
+	if limit, ok := v.limit("minItems"); ok && float64(len(value)) < limit {
+		v.fail("must have at least %v items", limit)
+	}
+	if limit, ok := v.limit("maxItems"); ok && float64(len(value)) > limit {
+		v.fail("must have at most %v items", limit)
+	}
+	if unique, _ := v.rules["uniqueItems"].(bool); unique {
+		for i := range value {
+			if containsValue(value[:i], value[i]) {
+				v.fail("items must be unique")
+				break
+			}
+		}
+	}
+	if items, ok := v.rules["items"]; ok {
+		for i, item := range value {
+			v.errs = append(v.errs, validateValue(items, item, fmt.Sprintf("%s[%d]", v.at, i))...)
+		}
+	}
+}
+
+func (v *validation) objectRules(value map[string]interface{}) {
+	required, _ := v.rules["required"].([]interface{})
+	for _, name := range required {
+		if name, ok := name.(string); ok {
+			if _, found := value[name]; !found {
+				v.fail("%s is required", name)
+			}
+		}
+	}
+
+	properties, _ := v.rules["properties"].(map[string]interface{})
+	additional, restricted := v.rules["additionalProperties"]
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub, ok := properties[name]
+		if !ok && !restricted {
+			continue
+		} else if !ok {
+			sub = additional
+		}
+		if allowed, isBool := sub.(bool); isBool && !allowed {
+			v.fail("%s is not allowed", name)
+			continue
+		}
+		v.errs = append(v.errs, validateValue(sub, value[name], v.at+"."+name)...)
+	}
+}
+
+func (v *validation) combinedRules(value interface{}) {
+	if subs, ok := v.rules["allOf"].([]interface{}); ok {
+		for _, sub := range subs {
+			v.errs = append(v.errs, validateValue(sub, value, v.at)...)
+		}
+	}
+	if subs, ok := v.rules["anyOf"].([]interface{}); ok && countMatches(subs, value, v.at) == 0 {
+		v.fail("must match at least one of the schemas in anyOf")
+	}
+	if subs, ok := v.rules["oneOf"].([]interface{}); ok && countMatches(subs, value, v.at) != 1 {
+		v.fail("must match exactly one of the schemas in oneOf")
+	}
+	if sub, ok := v.rules["not"]; ok && len(validateValue(sub, value, v.at)) == 0 {
+		v.fail("must not match the schema in not")
+	}
+}
+
+func countMatches(schemas []interface{}, value interface{}, at string) (count int) {
+	for _, schema := range schemas {
+		if len(validateValue(schema, value, at)) == 0 {
+			count++
+		}
+	}
+	return
+}
+
+func schemaTypes(value interface{}) (types []string) {
+	switch value := value.(type) {
+	case string:
+		types = append(types, value)
+	case []interface{}:
+		for _, t := range value {
+			if t, ok := t.(string); ok {
+				types = append(types, t)
+			}
+		}
+	}
+	return
+}
+
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func encode(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// createValidationResponse creates the response for a value that doesn't
+// match its schemas, with each of the ways it doesn't.
+func createValidationResponse(err *ValidationError) []byte {
+	response := Response{
+		Success: false,
+		Error:   err.Error(),
+		Data: map[string]interface{}{
+			"scope":  err.Scope,
+			"key":    err.Key,
+			"valid":  false,
+			"errors": err.Errors,
+		},
+	}
+	bytes, _ := json.Marshal(response)
+	return bytes
+}
+
+// requestValue reads a value of a request, values that aren't strings are
+// taken as JSON.
+func requestValue(request service.RawRequest, name string) (string, bool) {
+	value, found := request[name]
+	if !found {
+		return "", false
+	}
+	if value, ok := value.(string); ok {
+		return value, true
+	}
+	return encode(value), true
+}
+
+// Execute callback function to handle `state-set-schema` requests.
+func (cb *setSchemaCallback) Execute(msgBody string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "state-set-schema",
+	}).Debug("Processing state-set-schema request")
+
+	var request service.RawRequest
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		return createErrorResponse("Invalid request format: " + err.Error()), err
+	}
+	scope, ok := request["service"].(string)
+	if !ok || scope == "" {
+		err := errors.New("service parameter missing")
+		return createErrorResponse("Service scope required for state-set-schema request"), err
+	}
+	pattern, _ := request["pattern"].(string)
+
+	// a missing or null schema removes the one that's there
+	var schema []byte
+	if value, found := request["schema"]; found && value != nil {
+		schema = []byte(encode(value))
+	}
+
+	if err := cb.store.SetSchema(scope, pattern, schema); err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"pattern":  pattern,
+			"error":    err,
+		}).Error("Failed to set schema")
+		return createErrorResponse("Failed to set schema: " + err.Error()), err
+	}
+
+	status := "set"
+	if schema == nil {
+		status = "removed"
+	}
+	log.WithFields(log.Fields{
+		"callback": cb.name,
+		"scope":    scope,
+		"pattern":  pattern,
+		"status":   status,
+	}).Info("Successfully updated schema")
+
+	return createSuccessResponse(map[string]string{
+		"scope":   scope,
+		"pattern": pattern,
+		"status":  status,
+	}), nil
+}
+
+// Execute callback function to handle `state-get-schema` requests, the
+// schemas of a pattern or of the patterns that match a key are returned, or
+// every one of the scope.
+func (cb *getSchemaCallback) Execute(msgBody string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "state-get-schema",
+	}).Debug("Processing state-get-schema request")
+
+	var request service.RawRequest
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		return createErrorResponse("Invalid request format: " + err.Error()), err
+	}
+	scope, ok := request["service"].(string)
+	if !ok || scope == "" {
+		err := errors.New("service parameter missing")
+		return createErrorResponse("Service scope required for state-get-schema request"), err
+	}
+	pattern, _ := request["pattern"].(string)
+	key, _ := request["key"].(string)
+
+	schemas, err := cb.store.Schemas(scope)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"error":    err,
+		}).Error("Failed to get schemas")
+		return createErrorResponse("Failed to get schemas: " + err.Error()), err
+	}
+	for name := range schemas {
+		matched, _ := path.Match(name, key)
+		if (pattern != "" && name != pattern) || (key != "" && !matched) {
+			delete(schemas, name)
+		}
+	}
+
+	return createSuccessResponse(map[string]interface{}{
+		"scope":   scope,
+		"schemas": schemas,
+		"count":   len(schemas),
+	}), nil
+}
+
+// Execute callback function to handle `validate_data` requests, the value is
+// checked without being set.
+func (cb *validateCallback) Execute(msgBody string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "validate_data",
+	}).Debug("Processing validate_data request")
+
+	request, scope, key, err := parseKeyRequest(msgBody, "validate_data")
+	if err != nil {
+		return createErrorResponse(err.Error()), err
+	}
+	value, found := requestValue(request, "value")
+	if !found {
+		err = errors.New("value parameter missing")
+		return createErrorResponse("Value required for validate_data request"), err
+	}
+
+	errs, err := cb.store.Validate(scope, key, value)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"scope":    scope,
+			"key":      key,
+			"error":    err,
+		}).Error("Failed to validate value")
+		return createErrorResponse("Failed to validate value: " + err.Error()), err
+	}
+
+	return createSuccessResponse(map[string]interface{}{
+		"scope":  scope,
+		"key":    key,
+		"valid":  len(errs) == 0,
+		"errors": append([]SchemaError{}, errs...),
+	}), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		paths  []string
+	}{
+		{"type", `{"type": "number"}`, `12.5`, nil},
+		{"integer is a number", `{"type": "number"}`, `12`, nil},
+		{"wrong type", `{"type": "integer"}`, `12.5`, []string{"$"}},
+		{"several types", `{"type": ["string", "null"]}`, `null`, nil},
+		{"range", `{"minimum": 0, "exclusiveMaximum": 100}`, `100`, []string{"$"}},
+		{"multiple", `{"multipleOf": 0.5}`, `1.5`, nil},
+		{"enum", `{"enum": ["auto", "manual"]}`, `"off"`, []string{"$"}},
+		{"const", `{"const": {"a": 1}}`, `{"a": 1}`, nil},
+		{"length", `{"minLength": 2, "maxLength": 3}`, `"ab"`, nil},
+		{"pattern", `{"pattern": "^[a-z]+$"}`, `"Abc"`, []string{"$"}},
+		{"items", `{"items": {"type": "string"}, "maxItems": 2}`, `["a", 1, "c"]`,
+			[]string{"$", "$[1]"}},
+		{"unique", `{"uniqueItems": true}`, `[1, 2, 1]`, []string{"$"}},
+		{"required", `{"required": ["setpoint"]}`, `{"mode": "auto"}`, []string{"$"}},
+		{"properties", `{
+			"properties": {"setpoint": {"type": "number", "maximum": 50}},
+			"additionalProperties": false
+		}`, `{"setpoint": 60, "mode": "auto"}`, []string{"$", "$.setpoint"}},
+		{"anyOf", `{"anyOf": [{"type": "string"}, {"minimum": 0}]}`, `-1`, []string{"$"}},
+		{"oneOf", `{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, `1`, []string{"$"}},
+		{"not", `{"not": {"type": "null"}}`, `null`, []string{"$"}},
+		{"false", `false`, `1`, []string{"$"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema, value interface{}
+			require.NoError(t, json.Unmarshal([]byte(tt.schema), &schema))
+			require.NoError(t, json.Unmarshal([]byte(tt.value), &value))
+
+			var paths []string
+			for _, problem := range validateValue(schema, value, "$") {
+				assert.NotEmpty(t, problem.Message)
+				paths = append(paths, problem.Path)
+			}
+			assert.ElementsMatch(t, tt.paths, paths)
+		})
+	}
+}
+
+func TestStore_Schemas(t *testing.T) {
+	store := newTestStore(t, "org.plantd.Test")
+
+	assert.Error(t, store.SetSchema("org.plantd.Missing", "*", []byte(`{}`)))
+	assert.ErrorIs(t, store.SetSchema("org.plantd.Test", "*", []byte(`[]`)), ErrInvalidSchema)
+	assert.ErrorIs(t, store.SetSchema("org.plantd.Test", "*", []byte(`{"pattern": "("}`)),
+		ErrInvalidSchema)
+	assert.Error(t, store.SetSchema("org.plantd.Test", "[", []byte(`{}`)))
+	// keywords that aren't supported would enforce nothing
+	for _, schema := range []string{
+		`{"$ref": "#/$defs/setpoint"}`,
+		`{"type": "string", "format": "email"}`,
+		`{"properties": {"foo": {"minProperties": 1}}}`,
+		`{"anyOf": [{"if": {"type": "string"}, "then": {"maxLength": 8}}]}`,
+	} {
+		assert.ErrorIs(t, store.SetSchema("org.plantd.Test", "*", []byte(schema)), ErrInvalidSchema, schema)
+	}
+	require.NoError(t, store.SetSchema("org.plantd.Test", "*",
+		[]byte(`{"title": "Any", "description": "Anything", "properties": {"format": {"type": "string"}}}`)))
+	require.NoError(t, store.SetSchema("org.plantd.Test", "*", nil))
+
+	require.NoError(t, store.SetSchema("org.plantd.Test", "setpoint.*",
+		[]byte(`{"type": "number", "minimum": 0, "maximum": 100}`)))
+	require.NoError(t, store.SetSchema("org.plantd.Test", "", []byte(`{"maxLength": 8}`)))
+
+	schemas, err := store.Schemas("org.plantd.Test")
+	require.NoError(t, err)
+	assert.Len(t, schemas, 2)
+	assert.Contains(t, schemas, "*")
+
+	// values that don't match are rejected with every way they don't
+	_, err = store.SetBy("user@example.com", "org.plantd.Test", "setpoint.temp", "150")
+	var invalid *ValidationError
+	require.True(t, errors.As(err, &invalid))
+	require.Len(t, invalid.Errors, 1)
+	assert.Equal(t, "setpoint.*", invalid.Errors[0].Pattern)
+	value, err := store.Get("org.plantd.Test", "setpoint.temp")
+	require.NoError(t, err)
+	assert.Empty(t, value)
+
+	_, err = store.SetBy("user@example.com", "org.plantd.Test", "setpoint.temp", "hot")
+	require.True(t, errors.As(err, &invalid))
+	assert.Len(t, invalid.Errors, 1)
+
+	require.NoError(t, store.Set("org.plantd.Test", "setpoint.temp", "21.5"))
+	require.NoError(t, store.Set("org.plantd.Test", "mode", "auto"))
+
+	errs, err := store.Validate("org.plantd.Test", "mode", "automatic")
+	require.NoError(t, err)
+	assert.Len(t, errs, 1)
+
+	// schemas go with their scope
+	require.NoError(t, store.SetSchema("org.plantd.Test", "*", nil))
+	schemas, err = store.Schemas("org.plantd.Test")
+	require.NoError(t, err)
+	assert.Len(t, schemas, 1)
+	require.NoError(t, store.DeleteScope("org.plantd.Test"))
+	require.NoError(t, store.CreateScope("org.plantd.Test"))
+	schemas, err = store.Schemas("org.plantd.Test")
+	require.NoError(t, err)
+	assert.Empty(t, schemas)
+}
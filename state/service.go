@@ -2,15 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/geoffjay/plantd/core/bus"
 	"github.com/geoffjay/plantd/core/mdp"
 	"github.com/geoffjay/plantd/core/util"
 	"github.com/geoffjay/plantd/identity/pkg/client"
+	"github.com/geoffjay/plantd/state/api"
 	"github.com/geoffjay/plantd/state/auth"
 
 	"github.com/nelkinda/health-go"
@@ -21,16 +24,27 @@ import (
 type Service struct {
 	handler        *Handler
 	manager        *Manager
+	publisher      *changePublisher
 	store          *Store
-	worker         *mdp.Worker
+	hub            *watchHub
+	commands       *commandHandler
+	commandSink    *bus.Sink
+	backups        *Backups
+	workers        []*mdp.Worker
 	identityClient *client.Client
 	authMiddleware *auth.AuthMiddleware
 }
 
 // NewService creates an instance of the service.
 func NewService() *Service {
+	config := GetConfig()
+
+	manager := NewManager(">tcp://localhost:11001")
+	manager.SetCurve(&config.Curve)
+
 	return &Service{
-		manager: NewManager(">tcp://localhost:11001"),
+		manager:   manager,
+		publisher: newChangePublisher(config.PublishEndpoint, &config.Curve),
 	}
 }
 
@@ -40,6 +54,10 @@ func (s *Service) setupStore() {
 	if err := s.store.Load(path); err != nil {
 		log.WithFields(log.Fields{"err": err}).Panic("failed to setup KV store")
 	}
+	s.store.SetHistoryLimit(GetConfig().History)
+	s.backups = NewBackups(s.store, GetConfig().Backup.Path, GetConfig().Backup.Retention)
+	s.hub = newWatchHub(DefaultWatchHistory, s.store.Revision())
+	s.store.SetNotifier(changeNotifiers{s.publisher, s.hub})
 }
 
 func (s *Service) setupIdentityClient() {
@@ -94,6 +112,23 @@ func (s *Service) setupHandler() {
 	var err error
 	s.handler = NewHandler()
 
+	// batches are checked like requests and commands on the state bus have to
+	// be signed when there's auth
+	var (
+		authorizer CommandAuthorizer
+		verifier   CommandVerifier
+	)
+	if s.authMiddleware != nil {
+		authorizer = s.authMiddleware
+		config := GetConfig()
+		if !config.Curve.Enabled() || len(config.CommandKeys) == 0 {
+			log.Warn("No curve keys or command keys are set, commands on the state bus will be rejected")
+		}
+		verifier = newCommandVerifier(&config.Curve, s.authMiddleware,
+			commandUsers(s.authMiddleware, config.CommandKeys))
+	}
+	s.commands = newCommandHandler(s.store, verifier, s.publisher)
+
 	// Create original callbacks (without authentication)
 	originalCallbacks := map[string]interface{ Execute(string) ([]byte, error) }{
 		"create-scope": &createScopeCallback{
@@ -112,7 +147,7 @@ func (s *Service) setupHandler() {
 			name: "state-set", store: s.store,
 		},
 		"health": &healthCallback{
-			name: "health", store: s.store,
+			name: "health", store: s.store, manager: s.manager,
 		},
 		"list-scopes": &listScopesCallback{
 			name: "list-scopes", store: s.store,
@@ -120,6 +155,53 @@ func (s *Service) setupHandler() {
 		"list-keys": &listKeysCallback{
 			name: "list-keys", store: s.store,
 		},
+		"state-history": &historyCallback{
+			name: "state-history", store: s.store,
+		},
+		"state-get-revision": &getRevisionCallback{
+			name: "state-get-revision", store: s.store,
+		},
+		"state-batch": &batchCallback{
+			name: "state-batch", store: s.store, authorizer: authorizer,
+		},
+		"state-cas": &casCallback{
+			name: "state-cas", store: s.store, authorizer: authorizer,
+		},
+		"state-lease-grant": &grantLeaseCallback{
+			name: "state-lease-grant", store: s.store,
+		},
+		"state-lease-renew": &renewLeaseCallback{
+			name: "state-lease-renew", store: s.store,
+		},
+		"state-lease-revoke": &revokeLeaseCallback{
+			name: "state-lease-revoke", store: s.store,
+		},
+		"state-set-schema": &setSchemaCallback{
+			name: "state-set-schema", store: s.store,
+		},
+		"state-get-schema": &getSchemaCallback{
+			name: "state-get-schema", store: s.store,
+		},
+		"validate_data": &validateCallback{
+			name: "validate_data", store: s.store,
+		},
+		"create_backup": &createBackupCallback{
+			name: "create_backup", backups: s.backups,
+		},
+		"restore_backup": &restoreBackupCallback{
+			name: "restore_backup", backups: s.backups, manager: s.manager,
+		},
+		"list_backups": &listBackupsCallback{
+			name: "list_backups", backups: s.backups,
+		},
+		"state-check-read": &checkReadCallback{
+			name: "state-check-read",
+		},
+		"state-watch": &watchCallback{
+			name: "state-watch", hub: s.hub,
+			// a worker is always left for other requests
+			slots: make(chan struct{}, max(GetConfig().Workers-1, 1)),
+		},
 	}
 
 	// Wrap callbacks with authentication if auth middleware is available
@@ -161,13 +243,20 @@ func (s *Service) setupHandler() {
 	}
 }
 
+// setupWorker creates the workers that requests are handled by, there's more
+// than one so that a watch doesn't hold up every other request.
 func (s *Service) setupWorker() {
-	var err error
+	config := GetConfig()
 	endpoint := util.Getenv("PLANTD_STATE_BROKER_ENDPOINT",
 		"tcp://127.0.0.1:9797")
-	if s.worker, err = mdp.NewWorker(endpoint, "org.plantd.State"); err != nil {
-		log.WithFields(log.Fields{"err": err}).Panic(
-			"failed to setup message queue worker")
+	for i := 0; i < max(config.Workers, 1); i++ {
+		worker, err := mdp.NewWorkerWithCurve(endpoint, "org.plantd.State",
+			&config.Curve)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Panic(
+				"failed to setup message queue worker")
+		}
+		s.workers = append(s.workers, worker)
 	}
 }
 
@@ -180,6 +269,15 @@ func (s *Service) setupConsumers() {
 			"creating sink for scope")
 		s.manager.AddSink(scope, &sinkCallback{store: s.store})
 	}
+
+	// one sink takes the commands for every scope, including the ones that
+	// sets create without a sink of their own
+	config := GetConfig()
+	s.commandSink = bus.NewSink(config.StateEndpoint, api.StateCommandTopic+".")
+	s.commandSink.SetCurve(&config.Curve)
+	s.commandSink.SetHandler(&bus.SinkHandler{
+		Callback: &commandCallback{commands: s.commands},
+	})
 }
 
 // Run handles the service execution.
@@ -191,7 +289,11 @@ func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup) {
 	s.setupWorker()
 
 	defer s.store.Unload()
-	defer s.worker.Close()
+	defer func() {
+		for _, worker := range s.workers {
+			worker.Close()
+		}
+	}()
 	defer s.manager.Shutdown()
 	defer func() {
 		if s.identityClient != nil {
@@ -205,16 +307,65 @@ func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	log.WithFields(log.Fields{"context": "service.run"}).Debug("starting")
 
-	wg.Add(3)
+	wg.Add(5 + len(s.workers))
 	go s.runHealth(ctx, wg)
+	go s.runSweeper(ctx, wg)
 	go s.manager.Run(ctx, wg)
-	go s.runWorker(ctx, wg)
+	go s.publisher.Run(ctx, wg)
+	go s.commandSink.Run(ctx, wg)
+	for _, worker := range s.workers {
+		go s.runWorker(ctx, wg, worker)
+	}
 
 	<-ctx.Done()
 
 	log.WithFields(log.Fields{"context": "service.run"}).Debug("exiting")
 }
 
+// runSweeper removes the keys that have expired, each one is published like
+// any other delete.
+func (s *Service) runSweeper(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	interval, err := time.ParseDuration(GetConfig().SweepInterval)
+	if err != nil || interval <= 0 {
+		log.WithFields(log.Fields{
+			"interval": GetConfig().SweepInterval,
+			"error":    err,
+		}).Warn("invalid sweep interval, using the default")
+		interval = DefaultSweepInterval
+	}
+
+	log.WithFields(log.Fields{
+		"context":  "service.run-sweeper",
+		"interval": interval,
+	}).Debug("starting")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"context": "service.run-sweeper"}).Debug("exiting")
+			return
+		case now := <-ticker.C:
+			changes, err := s.store.Expire(now)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("failed to remove expired keys")
+				continue
+			}
+			for _, change := range changes {
+				log.WithFields(log.Fields{
+					"scope":    change.Scope,
+					"key":      change.Key,
+					"revision": change.Revision,
+				}).Info("Removed expired key")
+			}
+		}
+	}
+}
+
 func (s *Service) runHealth(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
@@ -263,9 +414,15 @@ func (s *Service) healthStatusHandler(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusServiceUnavailable)
 	}
 
+	sinks, err := json.Marshal(status["sinks"])
+	if err != nil {
+		log.WithError(err).Error("failed to encode sink status")
+		sinks = []byte("[]")
+	}
+
 	// Enhanced JSON response with detailed identity status
 	identityStatus := status["identity"].(map[string]interface{})
-	_, err := fmt.Fprintf(w, `{
+	_, err = fmt.Fprintf(w, `{
 		"status": "%s",
 		"store": %t,
 		"identity": {
@@ -273,6 +430,7 @@ func (s *Service) healthStatusHandler(w http.ResponseWriter, _ *http.Request) {
 			"connected": %t,
 			"message": "%s"
 		},
+		"sinks": %s,
 		"auth_mode": "%s",
 		"timestamp": "%s"
 	}`,
@@ -281,6 +439,7 @@ func (s *Service) healthStatusHandler(w http.ResponseWriter, _ *http.Request) {
 		identityStatus["status"],
 		identityStatus["connected"],
 		identityStatus["message"],
+		sinks,
 		status["auth_mode"],
 		status["timestamp"])
 	if err != nil {
@@ -302,6 +461,7 @@ func (s *Service) getHealthStatus() map[string]interface{} {
 		"status":    overallStatus,
 		"store":     storeHealthy,
 		"identity":  identityStatus,
+		"sinks":     s.manager.SinkStatus(),
 		"auth_mode": s.getAuthMode(),
 		"timestamp": time.Now().Format(time.RFC3339),
 	}
@@ -356,17 +516,17 @@ func (s *Service) getAuthMode() string {
 	return "enabled"
 }
 
-func (s *Service) runWorker(ctx context.Context, wg *sync.WaitGroup) {
+func (s *Service) runWorker(ctx context.Context, wg *sync.WaitGroup, worker *mdp.Worker) {
 	var err error
 	fields := log.Fields{"context": "service.worker"}
 	defer wg.Done()
 
 	go func() {
 		var request, reply []string
-		for !s.worker.Terminated() {
+		for !worker.Terminated() {
 			log.WithFields(fields).Debug("waiting for request")
 
-			if request, err = s.worker.Recv(reply); err != nil {
+			if request, err = worker.Recv(reply); err != nil {
 				log.WithFields(log.Fields{"error": err}).Error(
 					"failed while receiving request")
 				continue
@@ -384,7 +544,10 @@ func (s *Service) runWorker(ctx context.Context, wg *sync.WaitGroup) {
 
 			// Process the message - expecting format: [client_id, operation, data...]
 			// The client_id is included in the message for reply routing
-			reply = s.processMessage(ctx, request)
+			// the request context expires with the client deadline, if set
+			reqCtx, cancel := worker.RequestContext(ctx)
+			reply = s.processMessage(reqCtx, worker, request)
+			cancel()
 
 			log.WithFields(log.Fields{
 				"context": "service.worker",
@@ -394,13 +557,13 @@ func (s *Service) runWorker(ctx context.Context, wg *sync.WaitGroup) {
 	}()
 
 	<-ctx.Done()
-	s.worker.Shutdown()
+	worker.Shutdown()
 
 	log.WithFields(fields).Debug("exiting")
 }
 
 // processMessage processes a single MDP message for the state service
-func (s *Service) processMessage(_ context.Context, message []string) []string {
+func (s *Service) processMessage(ctx context.Context, worker *mdp.Worker, message []string) []string {
 	log.WithFields(log.Fields{
 		"message_length": len(message),
 		"raw_message":    message,
@@ -411,6 +574,11 @@ func (s *Service) processMessage(_ context.Context, message []string) []string {
 		return []string{`{"error": "Invalid message format"}`}
 	}
 
+	if err := ctx.Err(); err != nil {
+		log.WithError(err).Warn("Dropping request past its deadline")
+		return []string{`{"error": "Request deadline exceeded"}`}
+	}
+
 	// Extract operation from message
 	// Message format: [operation, ...args]
 	operation := message[0]
@@ -436,12 +604,20 @@ func (s *Service) processMessage(_ context.Context, message []string) []string {
 
 	// For most operations, we need to combine the args into a single string
 	// This matches the expected behavior of the original implementation
+	argData := ""
 	if len(args) > 0 {
-		argData := args[0] // Most operations expect a single argument
-		data, err = callback.Execute(argData)
+		argData = args[0] // Most operations expect a single argument
+	}
+	// Some operations like "list-scopes" don't need arguments
+
+	if streamCallback, ok := callback.(StreamCallback); ok {
+		// partial replies go straight to the client ahead of the final one
+		stream := worker.GetResponseStream()
+		data, err = streamCallback.ExecuteStream(ctx, argData, func(partial []byte) error {
+			return stream.SendPartial([]string{string(partial)})
+		})
 	} else {
-		// Some operations like "list-scopes" don't need arguments
-		data, err = callback.Execute("")
+		data, err = callback.Execute(argData)
 	}
 
 	if err != nil {
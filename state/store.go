@@ -1,20 +1,45 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/geoffjay/plantd/state/api"
 
 	log "github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 )
 
+// metaBucket holds what the store keeps about itself, it's not a scope.
+const metaBucket = "__plantd"
+
+// scopeMetaBuckets are the buckets in the meta bucket with a bucket for each
+// scope, what's in them goes along with the scope.
+var scopeMetaBuckets = []string{historyBucket, schemaBucket, expiryBucket, leaseBucket}
+
+// ErrReservedScope is returned when a scope has the name the store uses for
+// its own data.
+var ErrReservedScope = errors.New("scope name is reserved")
+
+// ChangeNotifier is told about every change made to the store.
+type ChangeNotifier interface {
+	Notify(change *api.StateChange)
+}
+
 // Store type is used to access the on disk KV store.
 type Store struct {
-	db *bolt.DB
+	db       *bolt.DB
+	notifier ChangeNotifier
+	history  int
+	// changes are notified in the order of their revisions
+	mu sync.Mutex
 }
 
 // NewStore constructs a new instance of a Store.
 func NewStore() *Store {
-	return &Store{}
+	return &Store{history: DefaultKeyHistory}
 }
 
 // Load opens the KV store file at `path`.
@@ -35,8 +60,35 @@ func (s *Store) Unload() {
 	}
 }
 
+// SetNotifier sets what is told about the changes made to the store.
+func (s *Store) SetNotifier(notifier ChangeNotifier) {
+	s.notifier = notifier
+}
+
+// SetHistoryLimit sets how many revisions of each key are kept.
+func (s *Store) SetHistoryLimit(limit int) {
+	if limit <= 0 {
+		limit = DefaultKeyHistory
+	}
+	s.history = limit
+}
+
+// Revision returns the revision of the last change made to the store.
+func (s *Store) Revision() (revision uint64) {
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte(metaBucket)); meta != nil {
+			revision = meta.Sequence()
+		}
+		return nil
+	})
+	return
+}
+
 // HasScope checks if the bucket with the name `scope` exists.
 func (s *Store) HasScope(scope string) bool {
+	if scope == metaBucket {
+		return false
+	}
 	exists := false
 	_ = s.db.View(func(tx *bolt.Tx) error {
 		if bucket := tx.Bucket([]byte(scope)); bucket != nil {
@@ -48,43 +100,60 @@ func (s *Store) HasScope(scope string) bool {
 }
 
 // CreateScope creates a new bucket in the store with the name `scope`.
-func (s *Store) CreateScope(scope string) (err error) {
-	tx, err := s.db.Begin(true)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		_ = tx.Rollback()
-	}()
+func (s *Store) CreateScope(scope string) error {
+	_, err := s.CreateScopeBy("", scope)
+	return err
+}
 
-	if _, err = tx.CreateBucketIfNotExists([]byte(scope)); err != nil {
-		return err
+// CreateScopeBy creates a scope on behalf of an actor and returns the change.
+func (s *Store) CreateScopeBy(actor, scope string) (*api.StateChange, error) {
+	if scope == metaBucket {
+		return nil, ErrReservedScope
 	}
-
-	return tx.Commit()
+	change := &api.StateChange{
+		Operation: api.StateCreateScope,
+		Scope:     scope,
+		Actor:     actor,
+	}
+	err := s.update(change, func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(scope))
+		return err
+	})
+	return change, err
 }
 
 // DeleteScope removes a bucket from the store with the name `scope`.
-func (s *Store) DeleteScope(scope string) (err error) {
-	tx, err := s.db.Begin(true)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		_ = tx.Rollback()
-	}()
+func (s *Store) DeleteScope(scope string) error {
+	_, err := s.DeleteScopeBy("", scope)
+	return err
+}
 
-	if err = tx.DeleteBucket([]byte(scope)); err != nil {
-		return err
+// DeleteScopeBy removes a scope on behalf of an actor and returns the change.
+func (s *Store) DeleteScopeBy(actor, scope string) (*api.StateChange, error) {
+	if scope == metaBucket {
+		return nil, ErrReservedScope
 	}
-
-	return tx.Commit()
+	change := &api.StateChange{
+		Operation: api.StateDeleteScope,
+		Scope:     scope,
+		Actor:     actor,
+	}
+	err := s.update(change, func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(scope)); err != nil {
+			return err
+		}
+		return dropScopeMeta(tx, scope)
+	})
+	return change, err
 }
 
 // ListAllScope returns a list of all scope names (bucket names) in the store.
 func (s *Store) ListAllScope() (list []string) {
 	_ = s.db.View(func(tx *bolt.Tx) error {
 		_ = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if string(name) == metaBucket {
+				return nil
+			}
 			list = append(list, string(name))
 			return nil
 		})
@@ -125,40 +194,189 @@ func (s *Store) Get(scope, key string) (value string, err error) {
 }
 
 // Set `value` at `key` in the bucket named `scope`.
-func (s *Store) Set(scope, key, value string) (err error) {
+func (s *Store) Set(scope, key, value string) error {
+	_, err := s.SetBy("", scope, key, value)
+	return err
+}
+
+// SetBy sets a value on behalf of an actor and returns the change. The scope
+// is created if it doesn't exist, a value that doesn't match the schemas of
+// its key isn't set and a ValidationError is returned.
+func (s *Store) SetBy(actor, scope, key, value string) (*api.StateChange, error) {
 	log.WithFields(log.Fields{
 		"scope": scope,
 		"key":   key,
 		"value": value,
 	}).Trace("KV set")
-	err = s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(scope))
-		if bucket == nil {
-			if err := s.CreateScope(scope); err != nil {
-				return err
-			}
-		}
-		err := bucket.Put([]byte(key), []byte(value))
-		return err
+	if scope == metaBucket {
+		return nil, ErrReservedScope
+	}
+	change := &api.StateChange{
+		Operation: api.StateSet,
+		Scope:     scope,
+		Key:       key,
+		NewValue:  value,
+		Actor:     actor,
+	}
+	err := s.update(change, func(tx *bolt.Tx) error {
+		return s.put(tx, change)
 	})
-	return
+	return change, err
+}
+
+// put sets the value of a change, it's checked against the schemas of the key
+// first.
+func (s *Store) put(tx *bolt.Tx, change *api.StateChange) error {
+	if change.Scope == metaBucket {
+		return ErrReservedScope
+	}
+	bucket, err := tx.CreateBucketIfNotExists([]byte(change.Scope))
+	if err != nil {
+		return err
+	}
+	errs, err := validateKey(tx, change.Scope, change.Key, change.NewValue)
+	if err != nil {
+		return err
+	} else if len(errs) > 0 {
+		return &ValidationError{Scope: change.Scope, Key: change.Key, Errors: errs}
+	}
+	change.OldValue = string(bucket.Get([]byte(change.Key)))
+	if err = bucket.Put([]byte(change.Key), []byte(change.NewValue)); err != nil {
+		return err
+	}
+	// a value that's set again without a TTL doesn't expire
+	if err = clearExpiry(tx, change.Scope, change.Key); err != nil {
+		return err
+	}
+	return s.record(tx, change)
 }
 
 // Delete `key` in the bucket named `scope`.
-func (s *Store) Delete(scope, key string) (err error) {
+func (s *Store) Delete(scope, key string) error {
+	_, err := s.DeleteBy("", scope, key)
+	return err
+}
+
+// DeleteBy deletes a key on behalf of an actor and returns the change.
+func (s *Store) DeleteBy(actor, scope, key string) (*api.StateChange, error) {
 	log.WithFields(log.Fields{
 		"scope": scope,
 		"key":   key,
 	}).Trace("KV delete")
-	err = s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(scope))
-		if bucket == nil {
-			return fmt.Errorf("scope `%s` doesn't exist", scope)
-		}
-		err := bucket.Delete([]byte(key))
+	change := &api.StateChange{
+		Operation: api.StateDelete,
+		Scope:     scope,
+		Key:       key,
+		Actor:     actor,
+	}
+	err := s.update(change, func(tx *bolt.Tx) error {
+		return s.remove(tx, change)
+	})
+	return change, err
+}
+
+// remove deletes the key of a change.
+func (s *Store) remove(tx *bolt.Tx, change *api.StateChange) error {
+	bucket := tx.Bucket([]byte(change.Scope))
+	if bucket == nil || change.Scope == metaBucket {
+		return fmt.Errorf("scope `%s` doesn't exist", change.Scope)
+	}
+	change.OldValue = string(bucket.Get([]byte(change.Key)))
+	if err := bucket.Delete([]byte(change.Key)); err != nil {
 		return err
+	}
+	if err := clearExpiry(tx, change.Scope, change.Key); err != nil {
+		return err
+	}
+	return s.record(tx, change)
+}
+
+// update runs a write transaction that makes a change, the change gets the
+// next revision of the store before it's made and the notifier is told about
+// it once it's committed.
+func (s *Store) update(change *api.StateChange, fn func(tx *bolt.Tx) error) error {
+	return s.updateAll(func(tx *bolt.Tx, stamp func(*api.StateChange) error) error {
+		if err := stamp(change); err != nil {
+			return err
+		}
+		return fn(tx)
 	})
-	return
+}
+
+// updateAll runs a write transaction that makes several changes, each one has
+// to be stamped with the next revision of the store before it's made. Either
+// all of them are made or none are, and the notifier is told about them in
+// order once they're committed.
+func (s *Store) updateAll(fn func(tx *bolt.Tx, stamp func(*api.StateChange) error) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changes []*api.StateChange
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		return fn(tx, func(change *api.StateChange) (err error) {
+			change.Revision, err = meta.NextSequence()
+			change.Time = now
+			changes = append(changes, change)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.notifier != nil {
+		for _, change := range changes {
+			s.notifier.Notify(change)
+		}
+	}
+	return nil
+}
+
+// scopeMeta returns the bucket of a scope in one of the scopeMetaBuckets, or
+// nil when there isn't one.
+func scopeMeta(tx *bolt.Tx, name, scope string) *bolt.Bucket {
+	meta := tx.Bucket([]byte(metaBucket))
+	if meta == nil {
+		return nil
+	}
+	buckets := meta.Bucket([]byte(name))
+	if buckets == nil {
+		return nil
+	}
+	return buckets.Bucket([]byte(scope))
+}
+
+// createScopeMeta returns the bucket of a scope in one of the
+// scopeMetaBuckets, it's created if it doesn't exist.
+func createScopeMeta(tx *bolt.Tx, name, scope string) (*bolt.Bucket, error) {
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := meta.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return buckets.CreateBucketIfNotExists([]byte(scope))
+}
+
+// dropScopeMeta removes the buckets of a scope from the scopeMetaBuckets.
+func dropScopeMeta(tx *bolt.Tx, scope string) error {
+	for _, name := range scopeMetaBuckets {
+		if scopeMeta(tx, name, scope) == nil {
+			continue
+		}
+		buckets := tx.Bucket([]byte(metaBucket)).Bucket([]byte(name))
+		if err := buckets.DeleteBucket([]byte(scope)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ListAllKeys returns a list of all keys in a specific scope.
@@ -2,9 +2,13 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/geoffjay/plantd/state/api"
+
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -14,6 +18,19 @@ type StoreTestSuite struct {
 	store *Store
 }
 
+// newTestStore loads a store in a directory of the test with the scopes given,
+// it's unloaded when the test ends.
+func newTestStore(t *testing.T, scopes ...string) *Store {
+	t.Helper()
+	store := NewStore()
+	require.NoError(t, store.Load(filepath.Join(t.TempDir(), "state.db")))
+	t.Cleanup(store.Unload)
+	for _, scope := range scopes {
+		require.NoError(t, store.CreateScope(scope))
+	}
+	return store
+}
+
 func TestStoreLoad(t *testing.T) {
 	store := NewStore()
 	if err := os.Mkdir("./tmp", 0664); err != nil {
@@ -168,3 +185,107 @@ func (suite *StoreTestSuite) TestStore_ListAllKeysWithValues() {
 	err = suite.store.DeleteScope("testscope")
 	suite.NoError(err, err)
 }
+
+type changeRecorder struct {
+	changes []*api.StateChange
+}
+
+func (r *changeRecorder) Notify(change *api.StateChange) {
+	r.changes = append(r.changes, change)
+}
+
+func (suite *StoreTestSuite) TestStore_Changes() {
+	recorder := &changeRecorder{}
+	suite.store.SetNotifier(recorder)
+	defer suite.store.SetNotifier(nil)
+
+	revision := suite.store.Revision()
+
+	_, err := suite.store.CreateScopeBy("user@example.com", "changes")
+	suite.NoError(err, err)
+	_, err = suite.store.SetBy("user@example.com", "changes", "foo", "bar")
+	suite.NoError(err, err)
+	change, err := suite.store.SetBy("user@example.com", "changes", "foo", "baz")
+	suite.NoError(err, err)
+	suite.Equal("bar", change.OldValue)
+	suite.Equal("baz", change.NewValue)
+	_, err = suite.store.DeleteBy("user@example.com", "changes", "foo")
+	suite.NoError(err, err)
+	_, err = suite.store.DeleteScopeBy("user@example.com", "changes")
+	suite.NoError(err, err)
+
+	suite.Require().Len(recorder.changes, 5)
+	operations := []string{
+		api.StateCreateScope, api.StateSet, api.StateSet, api.StateDelete,
+		api.StateDeleteScope,
+	}
+	for i, change := range recorder.changes {
+		suite.Equal(operations[i], change.Operation)
+		suite.Equal("changes", change.Scope)
+		suite.Equal("user@example.com", change.Actor)
+		suite.Equal(revision+uint64(i)+1, change.Revision)
+	}
+	suite.Equal("baz", recorder.changes[3].OldValue)
+	suite.Equal(revision+5, suite.store.Revision())
+
+	// failed changes aren't announced
+	_, err = suite.store.DeleteScopeBy("user@example.com", "changes")
+	suite.Error(err)
+	suite.Len(recorder.changes, 5)
+}
+
+func (suite *StoreTestSuite) TestStore_ReservedScope() {
+	err := suite.store.CreateScope(metaBucket)
+	suite.ErrorIs(err, ErrReservedScope)
+	err = suite.store.Set(metaBucket, "foo", "bar")
+	suite.ErrorIs(err, ErrReservedScope)
+	suite.False(suite.store.HasScope(metaBucket))
+	suite.NotContains(suite.store.ListAllScope(), metaBucket)
+}
+
+func (suite *StoreTestSuite) TestStore_History() {
+	suite.store.SetHistoryLimit(3)
+	defer suite.store.SetHistoryLimit(DefaultKeyHistory)
+	defer func() { _ = suite.store.DeleteScope("history") }()
+
+	first, err := suite.store.SetBy("user@example.com", "history", "foo", "a")
+	suite.Require().NoError(err)
+	for _, value := range []string{"b", "c"} {
+		_, err = suite.store.SetBy("user@example.com", "history", "foo", value)
+		suite.Require().NoError(err)
+	}
+	deleted, err := suite.store.DeleteBy("admin@example.com", "history", "foo")
+	suite.Require().NoError(err)
+
+	// only the latest three are kept, newest first
+	revisions, err := suite.store.History("history", "foo")
+	suite.Require().NoError(err)
+	suite.Require().Len(revisions, 3)
+	suite.Equal(deleted.Revision, revisions[0].Revision)
+	suite.True(revisions[0].Deleted)
+	suite.Equal("admin@example.com", revisions[0].Actor)
+	suite.Equal("c", revisions[1].Value)
+	suite.Equal("b", revisions[2].Value)
+	suite.Equal("user@example.com", revisions[2].Actor)
+	suite.False(revisions[2].Time.IsZero())
+
+	revision, err := suite.store.GetRevision("history", "foo", deleted.Revision-1)
+	suite.Require().NoError(err)
+	suite.Equal("c", revision.Value)
+
+	revision, err = suite.store.GetRevision("history", "foo", 0)
+	suite.Require().NoError(err)
+	suite.True(revision.Deleted)
+
+	_, err = suite.store.GetRevision("history", "foo", first.Revision)
+	suite.ErrorIs(err, ErrRevisionCompacted)
+
+	_, err = suite.store.History("history", "missing")
+	suite.ErrorIs(err, ErrKeyNotFound)
+
+	// the history goes with the scope
+	suite.Require().NoError(suite.store.DeleteScope("history"))
+	suite.Require().NoError(suite.store.CreateScope("history"))
+	_, err = suite.store.History("history", "foo")
+	suite.ErrorIs(err, ErrKeyNotFound)
+}
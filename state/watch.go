@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geoffjay/plantd/core/service"
+	"github.com/geoffjay/plantd/state/api"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultWatchTimeout is how long a watch stays open when the request
+	// doesn't say.
+	DefaultWatchTimeout = 30 * time.Second
+	// MaxWatchTimeout is the longest a watch can stay open, a client that
+	// wants more watches again from the revision it was given.
+	MaxWatchTimeout = 5 * time.Minute
+	// DefaultWatchHistory is how many of the latest changes are kept for
+	// watches to resume from.
+	DefaultWatchHistory = 1000
+
+	// watchKeepAlive is how often an open watch lets the client know it's
+	// still there, it has to be shorter than the client timeout.
+	watchKeepAlive = time.Second
+)
+
+// The types of the partial replies of a watch.
+const (
+	watchEventChange    = "change"
+	watchEventKeepAlive = "keepalive"
+)
+
+// ErrRevisionCompacted is returned when a watch resumes from a revision that
+// is older than the changes that are kept.
+var ErrRevisionCompacted = errors.New("revision is no longer available")
+
+// ErrTooManyWatches is returned when every worker that can hold a watch is
+// already holding one.
+var ErrTooManyWatches = errors.New("too many open watches")
+
+// watchHub keeps the latest changes of the store so that watches can resume
+// from a revision, and wakes the watches up when there's a new one.
+type watchHub struct {
+	mu       sync.Mutex
+	size     int
+	revision uint64
+	changes  []*api.StateChange
+	changed  chan struct{}
+}
+
+// watchEvent is a partial reply of a watch.
+type watchEvent struct {
+	Type     string           `json:"type"`
+	Revision uint64           `json:"revision"`
+	Change   *api.StateChange `json:"change,omitempty"`
+}
+
+// watchRequest is what a `state-watch` request asks for.
+type watchRequest struct {
+	scope    string
+	prefix   string
+	revision uint64
+	timeout  time.Duration
+}
+
+type watchCallback struct {
+	name  string
+	hub   *watchHub
+	slots chan struct{} // watches that can be open at once
+}
+
+func newWatchHub(size int, revision uint64) *watchHub {
+	if size <= 0 {
+		size = DefaultWatchHistory
+	}
+	return &watchHub{
+		size:     size,
+		revision: revision,
+		changed:  make(chan struct{}),
+	}
+}
+
+// Notify keeps a change and wakes up the watches, it implements
+// ChangeNotifier.
+func (h *watchHub) Notify(change *api.StateChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.changes = append(h.changes, change)
+	if len(h.changes) > h.size {
+		h.changes = h.changes[len(h.changes)-h.size:]
+	}
+	if change.Revision > h.revision {
+		h.revision = change.Revision
+	}
+
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// Revision returns the revision of the latest change.
+func (h *watchHub) Revision() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.revision
+}
+
+// since returns the changes after a revision, and a channel that's closed
+// when there's another one.
+func (h *watchHub) since(revision uint64) ([]*api.StateChange, <-chan struct{}, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	oldest := h.revision + 1
+	if len(h.changes) > 0 {
+		oldest = h.changes[0].Revision
+	}
+	if revision+1 < oldest {
+		return nil, nil, fmt.Errorf("%w: %d, the oldest is %d", ErrRevisionCompacted, revision, oldest)
+	}
+
+	var changes []*api.StateChange
+	for _, change := range h.changes {
+		if change.Revision > revision {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, h.changed, nil
+}
+
+// matches checks whether a change is one the watch asked for, changes of the
+// whole scope match any prefix.
+func (r *watchRequest) matches(change *api.StateChange) bool {
+	if change.Scope != r.scope {
+		return false
+	}
+	if change.Key == "" {
+		return true
+	}
+	return strings.HasPrefix(change.Key, r.prefix)
+}
+
+func parseWatchRequest(msgBody string) (*watchRequest, error) {
+	var request service.RawRequest
+	if err := json.Unmarshal([]byte(msgBody), &request); err != nil {
+		return nil, fmt.Errorf("invalid request format: %w", err)
+	}
+
+	watch := &watchRequest{timeout: DefaultWatchTimeout}
+
+	var ok bool
+	if watch.scope, ok = request["service"].(string); !ok || watch.scope == "" {
+		return nil, errors.New("service scope required for state-watch request")
+	}
+	if prefix, found := request["prefix"]; found {
+		if watch.prefix, ok = prefix.(string); !ok {
+			return nil, errors.New("prefix must be a string")
+		}
+	}
+	if revision, found := request["revision"]; found {
+		value, ok := revision.(float64)
+		if !ok || value < 0 {
+			return nil, errors.New("revision must be a positive number")
+		}
+		watch.revision = uint64(value)
+	}
+	if timeout, found := request["timeout"]; found {
+		value, ok := timeout.(string)
+		if !ok {
+			return nil, errors.New("timeout must be a duration")
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid timeout %s", value)
+		}
+		watch.timeout = min(duration, MaxWatchTimeout)
+	}
+
+	return watch, nil
+}
+
+// Execute handles `state-watch` requests that can't be streamed, it replies as
+// soon as there are changes or when the watch times out.
+func (cb *watchCallback) Execute(msgBody string) ([]byte, error) {
+	return cb.ExecuteStream(context.Background(), msgBody, nil)
+}
+
+// ExecuteStream handles `state-watch` requests. Every change of the scope
+// with a key that starts with the prefix is sent as a partial reply until the
+// watch times out, the final reply has the revision to resume from.
+func (cb *watchCallback) ExecuteStream(ctx context.Context, msgBody string, send func([]byte) error) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"callback":  cb.name,
+		"operation": "state-watch",
+	}).Debug("Processing state-watch request")
+
+	request, err := parseWatchRequest(msgBody)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"error":    err,
+		}).Error("Invalid state-watch request")
+		return createErrorResponse(err.Error()), err
+	}
+
+	if cb.slots != nil {
+		select {
+		case cb.slots <- struct{}{}:
+			defer func() { <-cb.slots }()
+		default:
+			return createErrorResponse("Too many open watches, retry later"), ErrTooManyWatches
+		}
+	}
+
+	// a watch without a revision starts from the latest change
+	revision := request.revision
+	if revision == 0 {
+		revision = cb.hub.Revision()
+	}
+
+	timeout := time.NewTimer(request.timeout)
+	defer timeout.Stop()
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	var collected []*api.StateChange
+	for {
+		changes, changed, err := cb.hub.since(revision)
+		if err != nil {
+			return createErrorResponse(err.Error()), err
+		}
+
+		for _, change := range changes {
+			revision = change.Revision
+			if !request.matches(change) {
+				continue
+			}
+			if send == nil {
+				collected = append(collected, change)
+				continue
+			}
+			if err := cb.send(send, watchEventChange, revision, change); err != nil {
+				return createErrorResponse(err.Error()), err
+			}
+		}
+
+		// without a stream the first changes end the watch
+		if send == nil && len(collected) > 0 {
+			return cb.reply(request, revision, collected, "changed"), nil
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			if send != nil {
+				if err := cb.send(send, watchEventKeepAlive, revision, nil); err != nil {
+					return createErrorResponse(err.Error()), err
+				}
+			}
+		case <-timeout.C:
+			return cb.reply(request, revision, collected, "timeout"), nil
+		case <-ctx.Done():
+			return cb.reply(request, revision, collected, "canceled"), nil
+		}
+	}
+}
+
+func (cb *watchCallback) send(send func([]byte) error, kind string, revision uint64, change *api.StateChange) error {
+	data, err := json.Marshal(&watchEvent{Type: kind, Revision: revision, Change: change})
+	if err != nil {
+		return err
+	}
+	if err = send(data); err != nil {
+		log.WithFields(log.Fields{
+			"callback": cb.name,
+			"error":    err,
+		}).Warn("Failed to send state-watch event")
+	}
+	return err
+}
+
+func (cb *watchCallback) reply(request *watchRequest, revision uint64, changes []*api.StateChange, reason string) []byte {
+	log.WithFields(log.Fields{
+		"callback": cb.name,
+		"scope":    request.scope,
+		"prefix":   request.prefix,
+		"revision": revision,
+		"reason":   reason,
+	}).Debug("state-watch completed")
+
+	data := map[string]interface{}{
+		"scope":    request.scope,
+		"prefix":   request.prefix,
+		"revision": revision,
+		"reason":   reason,
+	}
+	if changes != nil {
+		data["changes"] = changes
+	}
+	return createSuccessResponse(data)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/geoffjay/plantd/state/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchHubSince(t *testing.T) {
+	hub := newWatchHub(2, 10)
+
+	changes, _, err := hub.since(10)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	for revision := uint64(11); revision <= 13; revision++ {
+		hub.Notify(&api.StateChange{Revision: revision, Scope: "test"})
+	}
+	assert.Equal(t, uint64(13), hub.Revision())
+
+	changes, _, err = hub.since(11)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, uint64(12), changes[0].Revision)
+	assert.Equal(t, uint64(13), changes[1].Revision)
+
+	// only the last two are kept
+	_, _, err = hub.since(10)
+	assert.ErrorIs(t, err, ErrRevisionCompacted)
+}
+
+func TestParseWatchRequest(t *testing.T) {
+	request, err := parseWatchRequest(`{"service": "test", "prefix": "foo", "revision": 4, "timeout": "1h"}`)
+	require.NoError(t, err)
+	assert.Equal(t, "test", request.scope)
+	assert.Equal(t, "foo", request.prefix)
+	assert.Equal(t, uint64(4), request.revision)
+	assert.Equal(t, MaxWatchTimeout, request.timeout)
+
+	request, err = parseWatchRequest(`{"service": "test"}`)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultWatchTimeout, request.timeout)
+
+	for _, body := range []string{
+		`{}`,
+		`{"service": "test", "revision": -1}`,
+		`{"service": "test", "timeout": "soon"}`,
+		`not json`,
+	} {
+		_, err = parseWatchRequest(body)
+		assert.Error(t, err, body)
+	}
+}
+
+func TestWatchCallbackStream(t *testing.T) {
+	hub := newWatchHub(DefaultWatchHistory, 10)
+	hub.Notify(&api.StateChange{Revision: 11, Operation: api.StateSet, Scope: "test", Key: "foo.a"})
+	hub.Notify(&api.StateChange{Revision: 12, Operation: api.StateSet, Scope: "test", Key: "bar"})
+	hub.Notify(&api.StateChange{Revision: 13, Operation: api.StateSet, Scope: "other", Key: "foo.b"})
+
+	var events []watchEvent
+	send := func(data []byte) error {
+		var event watchEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return err
+		}
+		events = append(events, event)
+		return nil
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		hub.Notify(&api.StateChange{Revision: 14, Operation: api.StateDelete, Scope: "test", Key: "foo.a"})
+	}()
+
+	// resuming from a revision sends what came after it, then what's new
+	callback := &watchCallback{name: "state-watch", hub: hub}
+	data, err := callback.ExecuteStream(context.Background(),
+		`{"service": "test", "prefix": "foo", "revision": 10, "timeout": "200ms"}`, send)
+	require.NoError(t, err)
+
+	var response Response
+	require.NoError(t, json.Unmarshal(data, &response))
+	assert.True(t, response.Success)
+	result := response.Data.(map[string]interface{})
+	assert.Equal(t, "timeout", result["reason"])
+	assert.Equal(t, float64(14), result["revision"])
+
+	require.Len(t, events, 2)
+	assert.Equal(t, watchEventChange, events[0].Type)
+	assert.Equal(t, uint64(11), events[0].Change.Revision)
+	assert.Equal(t, uint64(14), events[1].Change.Revision)
+	assert.Equal(t, api.StateDelete, events[1].Change.Operation)
+}
+
+func TestWatchCallbackLongPoll(t *testing.T) {
+	hub := newWatchHub(DefaultWatchHistory, 7)
+	callback := &watchCallback{name: "state-watch", hub: hub, slots: make(chan struct{}, 1)}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		hub.Notify(&api.StateChange{Revision: 8, Operation: api.StateSet, Scope: "test", Key: "foo"})
+	}()
+
+	data, err := callback.Execute(`{"service": "test", "timeout": "5s"}`)
+	require.NoError(t, err)
+
+	var response Response
+	require.NoError(t, json.Unmarshal(data, &response))
+	result := response.Data.(map[string]interface{})
+	assert.Equal(t, "changed", result["reason"])
+	assert.Equal(t, float64(8), result["revision"])
+	assert.Len(t, result["changes"], 1)
+
+	// the slot is given back once the watch is done
+	assert.Empty(t, callback.slots)
+}